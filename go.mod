@@ -2,4 +2,14 @@ module github.com/skullernet/pakserve
 
 go 1.19
 
-require gopkg.in/yaml.v3 v3.0.1
+require (
+	github.com/fsnotify/fsnotify v1.7.0
+	golang.org/x/crypto v0.17.0
+	golang.org/x/sys v0.15.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	golang.org/x/net v0.10.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+)
@@ -0,0 +1,187 @@
+package pak
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	errBadName       = errors.New("pak: bad file name")
+	errDuplicateName = errors.New("pak: duplicate file name")
+)
+
+type builderFile struct {
+	size int64
+	open func() (io.ReadCloser, error)
+}
+
+// Builder collects files from various sources and writes them to a PAK file
+// in one go. Names are normalized and limits are checked as files are added,
+// so that errors are reported before anything is written. Files are written
+// sorted by name, which makes output reproducible.
+type Builder struct {
+	files map[string]*builderFile
+	size  int64
+	opt   Options
+}
+
+// NewBuilder returns an empty Builder.
+func NewBuilder() *Builder {
+	return NewBuilderOptions(Options{})
+}
+
+// NewBuilderOptions is like NewBuilder but enforces limits given by opt.
+func NewBuilderOptions(opt Options) *Builder {
+	return &Builder{files: make(map[string]*builderFile), opt: opt}
+}
+
+// NormalizeName converts name to the form used in PAK files: lower case,
+// forward slashes, no leading slash and no "." or ".." elements. It returns
+// empty string if name is empty or escapes the root.
+func NormalizeName(name string) string {
+	name = strings.ReplaceAll(strings.ToLower(name), `\`, `/`)
+	name = path.Clean(strings.TrimLeft(name, "/"))
+	if name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return ""
+	}
+	return name
+}
+
+func (b *Builder) add(name string, size int64, open func() (io.ReadCloser, error)) error {
+	norm := NormalizeName(name)
+	if len(norm) == 0 {
+		return &fs.PathError{Op: "add", Path: name, Err: errBadName}
+	}
+	if len(norm) > MaxFileName {
+		return &fs.PathError{Op: "add", Path: name, Err: errNameTooLong}
+	}
+	if _, ok := b.files[norm]; ok {
+		return &fs.PathError{Op: "add", Path: name, Err: errDuplicateName}
+	}
+	if len(b.files) >= b.opt.maxFiles() {
+		return errTooManyFiles
+	}
+	if size > int64(b.opt.maxFileLen()) || size > int64(b.opt.maxOffset())-b.opt.headerSize()-b.size {
+		return &fs.PathError{Op: "add", Path: name, Err: errFileTooBig}
+	}
+	b.files[norm] = &builderFile{size: size, open: open}
+	b.size += size
+	return nil
+}
+
+// AddBytes adds a file with the given name and contents.
+func (b *Builder) AddBytes(name string, data []byte) error {
+	return b.add(name, int64(len(data)), func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	})
+}
+
+// AddFile adds a file from disk, stored under its slash separated path. The
+// file is read when the PAK file is written.
+func (b *Builder) AddFile(name string) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return &fs.PathError{Op: "add", Path: name, Err: errBadName}
+	}
+	return b.add(filepath.ToSlash(name), fi.Size(), func() (io.ReadCloser, error) {
+		return os.Open(name)
+	})
+}
+
+// AddFS adds all regular files found in fsys, stored under their paths
+// within fsys. Files are read when the PAK file is written.
+func (b *Builder) AddFS(fsys fs.FS) error {
+	return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type()&fs.ModeType != 0 {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return b.add(name, fi.Size(), func() (io.ReadCloser, error) {
+			return fsys.Open(name)
+		})
+	})
+}
+
+// Len returns the number of files added so far.
+func (b *Builder) Len() int {
+	return len(b.files)
+}
+
+// Write writes PAK file containing all added files to w.
+func (b *Builder) Write(w io.WriteSeeker) error {
+	names := make([]string, 0, len(b.files))
+	for name := range b.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pak, err := NewWriterOptions(w, b.opt)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := pak.Create(name); err != nil {
+			return err
+		}
+		f, err := b.files[name].open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(pak, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return pak.Close()
+}
+
+// WriteFile writes PAK file containing all added files to a temporary file
+// in the same directory as name, then renames it to name. Thus name is
+// either left untouched or fully written, even if writing fails midway.
+func (b *Builder) WriteFile(name string) error {
+	return writeFileAtomic(name, func(f *os.File) error { return b.Write(f) })
+}
+
+// calls write with a temporary file in the same directory as name, then
+// renames it to name if write succeeds
+func writeFileAtomic(name string, write func(f *os.File) error) error {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
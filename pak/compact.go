@@ -0,0 +1,36 @@
+package pak
+
+import "os"
+
+// Compact rewrites PAK file specified by name, dropping space not used by any
+// file, such as data of files replaced or removed in update mode. Files keep
+// their directory order. Like Builder.WriteFile, new PAK file is written to a
+// temporary file which is then renamed to name.
+func Compact(name string) error {
+	return CompactOptions(name, Options{})
+}
+
+// CompactOptions is like Compact but enforces limits given by opt.
+func CompactOptions(name string, opt Options) error {
+	r, err := OpenReaderOptions(name, opt)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// keep offset size of existing PAK file
+	opt.Extended = opt.extended()
+	opt.Offsets64 = r.offsets64
+	return writeFileAtomic(name, func(f *os.File) error {
+		w, err := NewWriterOptions(f, opt)
+		if err != nil {
+			return err
+		}
+		for _, v := range r.File {
+			if err := w.Copy(v); err != nil {
+				return err
+			}
+		}
+		return w.Close()
+	})
+}
@@ -0,0 +1,103 @@
+package pak
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// size of reads between context checks
+const contextChunk = 65536
+
+type contextReaderAt struct {
+	ctx context.Context
+	r   io.ReaderAt
+}
+
+// NewContextReaderAt returns ReaderAt that reads from r until ctx is done,
+// then fails with ctx.Err(). Context is checked between reads of up to 64 KiB.
+// If ctx has a deadline, each read also returns once the deadline passes,
+// even if underlying read is stalled, e.g. on a failing disk. Such read is
+// left to complete in background into a private buffer.
+func NewContextReaderAt(ctx context.Context, r io.ReaderAt) io.ReaderAt {
+	return &contextReaderAt{ctx: ctx, r: r}
+}
+
+func (r *contextReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	_, deadline := r.ctx.Deadline()
+	total := 0
+	for len(p) > 0 {
+		if err := r.ctx.Err(); err != nil {
+			return total, err
+		}
+		n := len(p)
+		if n > contextChunk {
+			n = contextChunk
+		}
+		var m int
+		var err error
+		if deadline {
+			m, err = r.readAtDeadline(p[:n], off)
+		} else {
+			m, err = r.r.ReadAt(p[:n], off)
+		}
+		total += m
+		if err != nil {
+			return total, err
+		}
+		p = p[m:]
+		off += int64(m)
+	}
+	return total, nil
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+func (r *contextReaderAt) readAtDeadline(p []byte, off int64) (int, error) {
+	buf := make([]byte, len(p))
+	done := make(chan readResult, 1)
+	go func() {
+		n, err := r.r.ReadAt(buf, off)
+		done <- readResult{n, err}
+	}()
+	select {
+	case res := <-done:
+		copy(p, buf[:res.n])
+		return res.n, res.err
+	case <-r.ctx.Done():
+		return 0, r.ctx.Err()
+	}
+}
+
+// OpenContext is like Open, but reads fail once ctx is done. See
+// NewContextReaderAt for details.
+func (f *File) OpenContext(ctx context.Context) *io.SectionReader {
+	return io.NewSectionReader(NewContextReaderAt(ctx, f.pak.r), int64(f.Filepos), int64(f.Filelen))
+}
+
+// OpenReaderContext is like OpenReaderOptions, but reading of PAK directory
+// fails once ctx is done. The returned ReadCloser is not bound to ctx; use
+// File.OpenContext to read files under context.
+func OpenReaderContext(ctx context.Context, name string, opt Options) (*ReadCloser, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	pak := new(ReadCloser)
+	if err := pak.init(NewContextReaderAt(ctx, f), fi.Size(), &opt); err != nil {
+		f.Close()
+		return nil, err
+	}
+	// files are read without context later
+	pak.r = io.NewSectionReader(f, 0, fi.Size())
+	pak.f = f
+	return pak, nil
+}
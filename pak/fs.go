@@ -0,0 +1,183 @@
+package pak
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fsEntry is a file or directory inferred from file names
+type fsEntry struct {
+	name string // base name
+	file *File  // nil for directories
+	list []fs.DirEntry
+}
+
+func (e *fsEntry) Name() string {
+	return e.name
+}
+
+func (e *fsEntry) Size() int64 {
+	if e.file == nil {
+		return 0
+	}
+	return int64(e.file.Filelen)
+}
+
+func (e *fsEntry) Mode() fs.FileMode {
+	if e.file == nil {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (e *fsEntry) Type() fs.FileMode {
+	return e.Mode().Type()
+}
+
+func (e *fsEntry) ModTime() time.Time {
+	return time.Time{}
+}
+
+func (e *fsEntry) IsDir() bool {
+	return e.file == nil
+}
+
+func (e *fsEntry) Sys() any {
+	return e.file
+}
+
+func (e *fsEntry) Info() (fs.FileInfo, error) {
+	return e, nil
+}
+
+// removes empty path elements, or returns empty string if name is not valid
+// for fs.FS
+func fsName(name string) string {
+	var elems []string
+	for _, e := range strings.Split(name, "/") {
+		if len(e) > 0 {
+			elems = append(elems, e)
+		}
+	}
+	name = strings.Join(elems, "/")
+	if !fs.ValidPath(name) || name == "." {
+		return ""
+	}
+	return name
+}
+
+func (pak *Reader) initFileList() {
+	pak.fsOnce.Do(func() {
+		pak.fsEntries = map[string]*fsEntry{".": {name: "."}}
+		for _, f := range pak.File {
+			name := fsName(f.Name)
+			if len(name) == 0 {
+				continue
+			}
+			if _, ok := pak.fsEntries[name]; ok {
+				continue
+			}
+			pak.fsEntries[name] = &fsEntry{name: path.Base(name), file: f}
+			for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+				e := pak.fsEntries[dir]
+				if e != nil && e.file == nil {
+					break
+				}
+				pak.fsEntries[dir] = &fsEntry{name: path.Base(dir)}
+			}
+		}
+		for name, e := range pak.fsEntries {
+			if name != "." {
+				parent := pak.fsEntries[path.Dir(name)]
+				parent.list = append(parent.list, e)
+			}
+		}
+		for _, e := range pak.fsEntries {
+			sort.Slice(e.list, func(i, j int) bool { return e.list[i].Name() < e.list[j].Name() })
+		}
+	})
+}
+
+// Open opens the named file in the archive, using the semantics of fs.FS.Open.
+// Empty path elements are ignored and directories are implied by file names,
+// like Walk does. If there are duplicate files, the first one in archive
+// order is opened. Files that are shadowed by directories of the same name
+// and files with names not valid for fs.FS can't be opened.
+func (pak *Reader) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	pak.initFileList()
+	e := pak.fsEntries[name]
+	if e == nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if e.file == nil {
+		return &openDir{e: e}, nil
+	}
+	return &openFile{SectionReader: e.file.Open(), e: e}, nil
+}
+
+// ReadDir reads the named directory in the archive and returns its entries
+// sorted by name, using the semantics of fs.ReadDirFS.ReadDir.
+func (pak *Reader) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	pak.initFileList()
+	e := pak.fsEntries[name]
+	if e == nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	if e.file != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return append([]fs.DirEntry(nil), e.list...), nil
+}
+
+type openFile struct {
+	*io.SectionReader
+	e *fsEntry
+}
+
+func (f *openFile) Stat() (fs.FileInfo, error) {
+	return f.e, nil
+}
+
+func (f *openFile) Close() error {
+	return nil
+}
+
+type openDir struct {
+	e      *fsEntry
+	offset int
+}
+
+func (d *openDir) Stat() (fs.FileInfo, error) {
+	return d.e, nil
+}
+
+func (d *openDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.e.name, Err: errors.New("is a directory")}
+}
+
+func (d *openDir) Close() error {
+	return nil
+}
+
+func (d *openDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.e.list[d.offset:]
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(rest) {
+		rest = rest[:n]
+	}
+	d.offset += len(rest)
+	return append([]fs.DirEntry(nil), rest...), nil
+}
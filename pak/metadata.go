@@ -0,0 +1,106 @@
+package pak
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	// Name of reserved PAK file entry holding Metadata.
+	MetadataName = "pakmeta.json"
+
+	// Maximum size of encoded Metadata.
+	MaxMetadataSize = 4096
+
+	// ZIP archive comment holding Metadata starts with this prefix.
+	metadataPrefix = "pakmeta:"
+)
+
+var errBadMetadata = errors.New("pak: bad metadata")
+
+// Metadata describes who created archive, when and what it contains. It is
+// stored in reserved MetadataName entry of PAK files and in archive comment
+// of ZIP files.
+type Metadata struct {
+	Creator string    `json:"creator,omitempty"`
+	Created time.Time `json:"created"`
+	SHA256  string    `json:"sha256,omitempty"` // hash of archive content
+	Version string    `json:"version,omitempty"`
+}
+
+// Marshal returns JSON encoding of m.
+func (m *Metadata) Marshal() ([]byte, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > MaxMetadataSize {
+		return nil, errBadMetadata
+	}
+	return b, nil
+}
+
+// UnmarshalMetadata parses JSON encoded Metadata.
+func UnmarshalMetadata(b []byte) (*Metadata, error) {
+	if len(b) > MaxMetadataSize {
+		return nil, errBadMetadata
+	}
+	m := new(Metadata)
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, errBadMetadata
+	}
+	return m, nil
+}
+
+// Comment returns m encoded as ZIP archive comment.
+func (m *Metadata) Comment() (string, error) {
+	b, err := m.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return metadataPrefix + string(b), nil
+}
+
+// MetadataFromComment parses Metadata from ZIP archive comment. It returns
+// nil Metadata if comment doesn't hold any.
+func MetadataFromComment(comment string) (*Metadata, error) {
+	if !strings.HasPrefix(comment, metadataPrefix) {
+		return nil, nil
+	}
+	return UnmarshalMetadata([]byte(strings.TrimPrefix(comment, metadataPrefix)))
+}
+
+// Metadata returns Metadata stored in the PAK file, or nil if there is none.
+func (pak *Reader) Metadata() (*Metadata, error) {
+	for i := len(pak.File) - 1; i >= 0; i-- {
+		f := pak.File[i]
+		if f.Name != MetadataName {
+			continue
+		}
+		if f.Filelen > MaxMetadataSize {
+			return nil, errBadMetadata
+		}
+		b, err := io.ReadAll(f.Open())
+		if err != nil {
+			return nil, err
+		}
+		return UnmarshalMetadata(b)
+	}
+	return nil, nil
+}
+
+// WriteMetadata adds reserved entry holding m to the PAK file.
+func (pak *Writer) WriteMetadata(m *Metadata) error {
+	b, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := pak.Create(MetadataName); err != nil {
+		return err
+	}
+	_, err = pak.Write(b)
+	return err
+}
@@ -0,0 +1,46 @@
+package pak
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+func atoi(s string) (v int, err error) {
+	f := strings.FieldsFunc(s, func(c rune) bool {
+		return !unicode.IsDigit(c)
+	})
+	if len(f) > 0 {
+		return strconv.Atoi(f[0])
+	}
+	return 0, strconv.ErrSyntax
+}
+
+// SortSearchOrder sorts packfile names found in a game directory in the order
+// they are searched, i.e. the first packfile has the highest priority. Like
+// Quake 2 engines do, packfiles not named pakN are searched first in reverse
+// alphabetical order, followed by pakN files in descending numerical order.
+func SortSearchOrder(names []string) {
+	sort.Slice(names, func(i, j int) bool {
+		a := strings.ToLower(names[j])
+		b := strings.ToLower(names[i])
+		p1 := strings.HasPrefix(a, "pak")
+		p2 := strings.HasPrefix(b, "pak")
+		switch {
+		case p1 && p2:
+			v1, err1 := atoi(a)
+			v2, err2 := atoi(b)
+			if err1 == nil && err2 == nil {
+				return v1 < v2
+			}
+			return a < b
+		case p1:
+			return true
+		case p2:
+			return false
+		default:
+			return a < b
+		}
+	})
+}
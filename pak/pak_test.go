@@ -2,12 +2,25 @@ package pak
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 func TestReadWrite(t *testing.T) {
-	w, err := OpenWriter("test.pak")
+	name := filepath.Join(t.TempDir(), "test.pak")
+	w, err := OpenWriter(name)
 	if err != nil {
 		t.Fatalf("open writer: %v", err)
 	}
@@ -30,7 +43,7 @@ func TestReadWrite(t *testing.T) {
 		t.Fatalf("close writer: %v", err)
 	}
 
-	r, err := OpenReader("test.pak")
+	r, err := OpenReader(name)
 	if err != nil {
 		t.Fatalf("open reader: %v", err)
 	}
@@ -52,3 +65,664 @@ func TestReadWrite(t *testing.T) {
 		t.Fatalf("close reader: %v", err)
 	}
 }
+
+func writeTestPak(t testing.TB, name string) []byte {
+	w, err := OpenWriter(name)
+	if err != nil {
+		t.Fatalf("open writer: %v", err)
+	}
+	for _, v := range []string{"foo", "bar"} {
+		if err := w.Create(v); err != nil {
+			t.Fatalf("create file: %v", err)
+		}
+		if _, err := w.Write([]byte(v + v)); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close writer: %v", err)
+	}
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatalf("read file: %v", err)
+	}
+	return b
+}
+
+func TestReaderOptions(t *testing.T) {
+	b := writeTestPak(t, filepath.Join(t.TempDir(), "test.pak"))
+
+	if _, err := NewReaderOptions(bytes.NewReader(b), int64(len(b)), Options{MaxFiles: 1}); err != errTooManyFiles {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := NewReaderOptions(bytes.NewReader(b), int64(len(b)), Options{MaxFileLen: 5}); err != errBadFileLen {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := NewReader(bytes.NewReader(b), int64(len(b)-1)); err != errBadDirOfs {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := NewReaderOptions(bytes.NewReader(b), int64(len(b)), Options{MaxFiles: 2, MaxFileLen: 6}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	m := &Metadata{
+		Creator: "tester",
+		Created: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		SHA256:  strings.Repeat("ab", 32),
+		Version: "1.2",
+	}
+
+	name := filepath.Join(t.TempDir(), "test.pak")
+	w, err := OpenWriter(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Create("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteMetadata(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := OpenReader(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if len(r.File) != 2 || r.File[1].Name != MetadataName {
+		t.Fatalf("unexpected files %v", r.File)
+	}
+	got, err := r.Metadata()
+	if err != nil || *got != *m {
+		t.Fatalf("unexpected metadata %v, error %v", got, err)
+	}
+
+	comment, err := m.Comment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = MetadataFromComment(comment)
+	if err != nil || *got != *m {
+		t.Fatalf("unexpected metadata %v, error %v", got, err)
+	}
+	if got, err := MetadataFromComment("just a comment"); got != nil || err != nil {
+		t.Fatalf("unexpected metadata %v, error %v", got, err)
+	}
+	if _, err := MetadataFromComment(metadataPrefix + "{"); err == nil {
+		t.Fatal("bad metadata accepted")
+	}
+	if _, err := (&Metadata{Creator: strings.Repeat("x", MaxMetadataSize)}).Marshal(); err == nil {
+		t.Fatal("oversized metadata accepted")
+	}
+}
+
+func FuzzReader(f *testing.F) {
+	f.Add(writeTestPak(f, filepath.Join(f.TempDir(), "test.pak")))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		r, err := NewReader(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			return
+		}
+		for _, file := range r.File {
+			ioutil.ReadAll(file.Open())
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	b := make([]byte, 12+4*64+10)
+	copy(b, "PACK")
+	binary.LittleEndian.PutUint32(b[4:], 22)
+	binary.LittleEndian.PutUint32(b[8:], 4*64)
+	for i, e := range []struct {
+		name     string
+		pos, len uint32
+	}{
+		{"good", 12, 6},
+		{"overlap", 14, 6},
+		{"", 12, 0},
+		{"past", 12, 1000},
+	} {
+		d := b[22+i*64:]
+		copy(d, e.name)
+		binary.LittleEndian.PutUint32(d[56:], e.pos)
+		binary.LittleEndian.PutUint32(d[60:], e.len)
+	}
+
+	r, err := NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("open reader: %v", err)
+	}
+	var got []string
+	for _, f := range r.Validate() {
+		got = append(got, f.String())
+	}
+	want := []string{
+		"file at offset 12 has empty name",
+		`"past" extends past end of file`,
+		`"overlap" overlaps "good"`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected findings: %q", got)
+	}
+}
+
+func TestWalkGlob(t *testing.T) {
+	b := make([]byte, 12)
+	copy(b, "PACK")
+	names := []string{"maps/q2dm1.bsp", "pics/colormap.pcx", "maps/q2dm1.ent", "default.cfg", "maps/sub/x.bsp", "pics//a.pcx"}
+	for _, name := range names {
+		var d [64]byte
+		copy(d[:], name)
+		b = append(b, d[:]...)
+	}
+	binary.LittleEndian.PutUint32(b[4:], 12)
+	binary.LittleEndian.PutUint32(b[8:], uint32(64*len(names)))
+
+	r, err := NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("open reader: %v", err)
+	}
+
+	var got []string
+	err = r.Walk(func(name string, f *File) error {
+		if f == nil {
+			got = append(got, name+"/")
+		} else {
+			got = append(got, name)
+		}
+		if name == "maps/sub" {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	want := "default.cfg maps/ maps/q2dm1.bsp maps/q2dm1.ent maps/sub/ pics/ pics/a.pcx pics/colormap.pcx"
+	if strings.Join(got, " ") != want {
+		t.Fatalf("unexpected walk order: %q", got)
+	}
+
+	files, err := r.Glob("maps/*.bsp")
+	if err != nil || len(files) != 1 || files[0].Name != "maps/q2dm1.bsp" {
+		t.Fatalf("unexpected glob result: %v %v", files, err)
+	}
+	if _, err := r.Glob("maps/["); err != path.ErrBadPattern {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	dir := t.TempDir()
+	fsys := fstest.MapFS{
+		"Maps/Q2DM1.bsp": {Data: []byte("map")},
+		"pics/a.pcx":     {Data: []byte("pic")},
+	}
+
+	b := NewBuilder()
+	if err := b.AddFS(fsys); err != nil {
+		t.Fatalf("add fs: %v", err)
+	}
+	if err := b.AddBytes(`\default.cfg`, []byte("cfg")); err != nil {
+		t.Fatalf("add bytes: %v", err)
+	}
+	for _, name := range []string{"maps/q2dm1.bsp", "../evil", "", strings.Repeat("x", MaxFileName+1)} {
+		if err := b.AddBytes(name, nil); err == nil {
+			t.Fatalf("%q: expected error", name)
+		}
+	}
+
+	name := filepath.Join(dir, "out.pak")
+	if err := b.WriteFile(name); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	r, err := OpenReader(name)
+	if err != nil {
+		t.Fatalf("open reader: %v", err)
+	}
+	defer r.Close()
+
+	var got []string
+	for _, f := range r.File {
+		data, _ := ioutil.ReadAll(f.Open())
+		got = append(got, f.Name+"="+string(data))
+	}
+	want := "default.cfg=cfg maps/q2dm1.bsp=map pics/a.pcx=pic"
+	if strings.Join(got, " ") != want {
+		t.Fatalf("unexpected contents: %q", got)
+	}
+
+	// no temporary files left behind
+	if d, _ := ioutil.ReadDir(dir); len(d) != 1 {
+		t.Fatalf("unexpected files in output directory: %d", len(d))
+	}
+}
+
+// reads as zeros except for chunks of data at given offsets
+type sparseReader map[int64][]byte
+
+func (r sparseReader) ReadAt(p []byte, off int64) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	for pos, data := range r {
+		for i := range data {
+			if j := pos + int64(i) - off; j >= 0 && j < int64(len(p)) {
+				p[j] = data[i]
+			}
+		}
+	}
+	return len(p), nil
+}
+
+func TestExtended(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.pak")
+	w, err := OpenWriterOptions(name, Options{Extended: true})
+	if err != nil {
+		t.Fatalf("open writer: %v", err)
+	}
+	for i := 0; i <= MaxFiles; i++ {
+		if err := w.Create(fmt.Sprintf("file%d", i)); err != nil {
+			t.Fatalf("create file: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close writer: %v", err)
+	}
+	if _, err := OpenReader(name); err != errTooManyFiles {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r, err := OpenReaderOptions(name, Options{Extended: true})
+	if err != nil || len(r.File) != MaxFiles+1 {
+		t.Fatalf("unexpected result: %v", err)
+	}
+	r.Close()
+
+	// file and directory beyond 2 GiB
+	const dirofs = 3 << 30
+	header := make([]byte, 12)
+	copy(header, "PACK")
+	binary.LittleEndian.PutUint32(header[4:], dirofs)
+	binary.LittleEndian.PutUint32(header[8:], 64)
+	dir := make([]byte, 64)
+	copy(dir, "big")
+	binary.LittleEndian.PutUint32(dir[56:], 1<<31)
+	binary.LittleEndian.PutUint32(dir[60:], 1<<30)
+	big := sparseReader{0: header, dirofs: dir}
+
+	if _, err := NewReader(big, dirofs+64); err != errBadDirOfs {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	br, err := NewReaderOptions(big, dirofs+64, Options{Extended: true})
+	if err != nil {
+		t.Fatalf("open extended reader: %v", err)
+	}
+	if f := br.File[0]; f.Name != "big" || f.Filepos != 1<<31 || f.Filelen != 1<<30 {
+		t.Fatalf("unexpected file %+v", f)
+	}
+	if findings := br.Validate(); len(findings) > 0 {
+		t.Fatalf("unexpected findings: %v", findings)
+	}
+}
+
+// file that skips over writes of zeroBlock instead of writing them, leaving
+// holes in sparse file
+type sparseFile struct {
+	*os.File
+}
+
+var zeroBlock = make([]byte, 1<<20)
+
+func (f sparseFile) Write(p []byte) (int, error) {
+	if len(p) == len(zeroBlock) && &p[0] == &zeroBlock[0] {
+		_, err := f.Seek(int64(len(p)), io.SeekCurrent)
+		return len(p), err
+	}
+	return f.File.Write(p)
+}
+
+func TestOffsets64(t *testing.T) {
+	const holeSize = MaxExtendedOffset + 1
+	name := filepath.Join(t.TempDir(), "test.pak")
+	write := func(opt Options) error {
+		f, err := os.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		w, err := NewWriterOptions(sparseFile{f}, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Create("hole"); err != nil {
+			t.Fatal(err)
+		}
+		for n := int64(0); n < holeSize; n += int64(len(zeroBlock)) {
+			if _, err := w.Write(zeroBlock); err != nil {
+				return err
+			}
+		}
+		if err := w.Create("tail"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("tail data")); err != nil {
+			return err
+		}
+		return w.Close()
+	}
+
+	if err := write(Options{Extended: true}); err != errFileTooBig {
+		t.Fatalf("extended writer went past 4 GiB: %v", err)
+	}
+	if err := write(Options{Offsets64: true}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if _, err := OpenReader(name); err != errBadIdent {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r, err := OpenReaderOptions(name, Options{Extended: true})
+	if err != nil {
+		t.Fatalf("open reader: %v", err)
+	}
+	defer r.Close()
+	if len(r.File) != 2 || r.File[0].Filelen < holeSize || r.File[1].Filepos <= MaxExtendedOffset {
+		t.Fatalf("unexpected files %+v %+v", r.File[0], r.File[1])
+	}
+	b, err := io.ReadAll(r.File[1].Open())
+	if err != nil || string(b) != "tail data" {
+		t.Fatalf("unexpected data %q: %v", b, err)
+	}
+	if findings := r.Validate(); len(findings) > 0 {
+		t.Fatalf("unexpected findings: %v", findings)
+	}
+
+	// updater keeps 64-bit offsets
+	w, err := OpenUpdaterOptions(name, Options{Extended: true})
+	if err != nil {
+		t.Fatalf("open updater: %v", err)
+	}
+	if err := w.Create("added"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close updater: %v", err)
+	}
+	r2, err := OpenReaderOptions(name, Options{Extended: true})
+	if err != nil || len(r2.File) != 3 || !r2.offsets64 {
+		t.Fatalf("unexpected result after update: %v", err)
+	}
+	r2.Close()
+}
+
+// blocks reads until unblocked
+type stalledReader chan struct{}
+
+func (r stalledReader) ReadAt(p []byte, off int64) (int, error) {
+	<-r
+	return len(p), nil
+}
+
+func TestContext(t *testing.T) {
+	b := NewBuilder()
+	data := bytes.Repeat([]byte("x"), contextChunk*3)
+	if err := b.AddBytes("big", data); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "test.pak")
+	if err := b.WriteFile(name); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := OpenReaderContext(context.Background(), name, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	got, err := io.ReadAll(r.File[0].OpenContext(context.Background()))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := io.ReadAll(r.File[0].OpenContext(ctx)); err != context.Canceled {
+		t.Fatalf("read with canceled context: %v", err)
+	}
+	if _, err := OpenReaderContext(ctx, name, Options{}); err != context.Canceled {
+		t.Fatalf("open with canceled context: %v", err)
+	}
+
+	stall := make(stalledReader)
+	defer close(stall)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := NewContextReaderAt(ctx, stall).ReadAt(make([]byte, 10), 0); err != context.DeadlineExceeded {
+		t.Fatalf("stalled read: %v", err)
+	}
+}
+
+func TestFS(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.pak")
+	w, err := OpenWriter(name)
+	if err != nil {
+		t.Fatalf("open writer: %v", err)
+	}
+	files := []string{"maps/q2dm1.bsp", "pics//colormap.pcx", "maps/q2dm1.bsp", "../evil", "sound", "sound/a.wav", "default.cfg"}
+	for i, v := range files {
+		if err := w.Create(v); err != nil {
+			t.Fatalf("create file: %v", err)
+		}
+		if _, err := fmt.Fprintf(w, "%d", i); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close writer: %v", err)
+	}
+
+	r, err := OpenReader(name)
+	if err != nil {
+		t.Fatalf("open reader: %v", err)
+	}
+	defer r.Close()
+
+	if err := fstest.TestFS(r, "maps/q2dm1.bsp", "pics/colormap.pcx", "sound/a.wav", "default.cfg"); err != nil {
+		t.Fatal(err)
+	}
+
+	// first duplicate wins
+	if data, err := fs.ReadFile(r, "maps/q2dm1.bsp"); err != nil || string(data) != "0" {
+		t.Fatalf("unexpected contents: %q %v", data, err)
+	}
+	for _, v := range []string{"evil", "../evil", "pics//colormap.pcx", "MAPS/q2dm1.bsp"} {
+		if _, err := r.Open(v); err == nil {
+			t.Fatalf("%q: expected error", v)
+		}
+	}
+	if fi, err := fs.Stat(r, "sound"); err != nil || !fi.IsDir() {
+		t.Fatalf("sound: expected directory: %v", err)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPak(t, filepath.Join(dir, "in.pak"))
+	r, err := OpenReader(filepath.Join(dir, "in.pak"))
+	if err != nil {
+		t.Fatalf("open reader: %v", err)
+	}
+	defer r.Close()
+
+	name := filepath.Join(dir, "out.pak")
+	w, err := OpenWriter(name)
+	if err != nil {
+		t.Fatalf("open writer: %v", err)
+	}
+	for _, f := range r.File {
+		if err := w.Copy(f); err != nil {
+			t.Fatalf("copy file: %v", err)
+		}
+	}
+	fw, err := w.CreateHeader(&FileHeader{Name: "baz"})
+	if err != nil {
+		t.Fatalf("create header: %v", err)
+	}
+	if _, err := io.WriteString(fw, "bazbaz"); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close writer: %v", err)
+	}
+
+	out, err := OpenReader(name)
+	if err != nil {
+		t.Fatalf("open reader: %v", err)
+	}
+	defer out.Close()
+	var got []string
+	for _, f := range out.File {
+		data, _ := ioutil.ReadAll(f.Open())
+		got = append(got, f.Name+"="+string(data))
+	}
+	if want := "foo=foofoo bar=barbar baz=bazbaz"; strings.Join(got, " ") != want {
+		t.Fatalf("unexpected contents: %q", got)
+	}
+
+	// limits are checked before copying
+	w, err = OpenWriterOptions(filepath.Join(dir, "small.pak"), Options{MaxFileLen: 4})
+	if err != nil {
+		t.Fatalf("open writer: %v", err)
+	}
+	defer w.Close()
+	if err := w.Copy(r.File[0]); err != errFileTooBig {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestUpdater(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.pak")
+	writeTestPak(t, name)
+
+	w, err := OpenUpdater(name)
+	if err != nil {
+		t.Fatalf("open updater: %v", err)
+	}
+	for _, v := range []string{"foo", "baz"} {
+		if err := w.Create(v); err != nil {
+			t.Fatalf("create file: %v", err)
+		}
+		if _, err := w.Write([]byte(v + "123")); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close writer: %v", err)
+	}
+
+	r, err := OpenReader(name)
+	if err != nil {
+		t.Fatalf("open reader: %v", err)
+	}
+	defer r.Close()
+	var got []string
+	for _, f := range r.File {
+		data, _ := ioutil.ReadAll(f.Open())
+		got = append(got, f.Name+"="+string(data))
+	}
+	if want := "foo=foo123 bar=barbar baz=baz123"; strings.Join(got, " ") != want {
+		t.Fatalf("unexpected contents: %q", got)
+	}
+
+	// old directory is overwritten and file is truncated after new one
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if want := int64(headerSize + 12 + 12 + 3*entrySize); fi.Size() != want {
+		t.Fatalf("unexpected size: %d, want %d", fi.Size(), want)
+	}
+}
+
+func TestRemoveCompact(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.pak")
+	writeTestPak(t, name)
+
+	w, err := OpenUpdater(name)
+	if err != nil {
+		t.Fatalf("open updater: %v", err)
+	}
+	if err := w.Remove("foo"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if err := w.Remove("foo"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := w.Create("bar"); err != nil {
+		t.Fatalf("create file: %v", err)
+	}
+	if _, err := w.Write([]byte("new")); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close writer: %v", err)
+	}
+
+	if err := Compact(name); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatalf("read file: %v", err)
+	}
+	r, err := NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("open reader: %v", err)
+	}
+	if len(r.File) != 1 || r.File[0].Name != "bar" || r.File[0].Filepos != headerSize {
+		t.Fatalf("unexpected files: %v", r.File)
+	}
+	if data, _ := ioutil.ReadAll(r.File[0].Open()); string(data) != "new" {
+		t.Fatalf("unexpected contents: %q", data)
+	}
+	if want := headerSize + 3 + entrySize; len(b) != want {
+		t.Fatalf("unexpected size: %d, want %d", len(b), want)
+	}
+}
+
+func TestStreamWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewStreamWriter(&buf)
+	if err != nil {
+		t.Fatalf("new writer: %v", err)
+	}
+	for _, v := range []string{"foo", "bar"} {
+		if err := w.Create(v); err != nil {
+			t.Fatalf("create file: %v", err)
+		}
+		if _, err := w.Write([]byte(v + v)); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("data written before close: %d bytes", buf.Len())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close writer: %v", err)
+	}
+
+	want := writeTestPak(t, filepath.Join(t.TempDir(), "test.pak"))
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("stream output differs from file output")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"io"
 	"os"
+	"sync"
 )
 
 const (
@@ -13,6 +14,11 @@ const (
 	headerSize = 12
 	entrySize  = 64
 
+	// PAK files with 64-bit offsets
+	pak64Ident   = 'P' | 'K'<<8 | '6'<<16 | '4'<<24
+	header64Size = 20
+	entry64Size  = 72
+
 	// Maximum number of files in PAK file.
 	MaxFiles = 4096
 
@@ -21,6 +27,15 @@ const (
 
 	// Maximum size of PAK file and all files it contains.
 	MaxOffset = 1<<31 - 1
+
+	// Maximum number of files in extended PAK file.
+	MaxExtendedFiles = 1 << 20
+
+	// Maximum size of extended PAK file and all files it contains.
+	MaxExtendedOffset = 1<<32 - 1
+
+	// Maximum size of PAK file with 64-bit offsets and all files it contains.
+	Max64Offset = 1<<63 - 1
 )
 
 var (
@@ -44,12 +59,40 @@ type pakEntry struct {
 	Filelen uint32
 }
 
+type pak64Header struct {
+	Ident  uint32
+	Dirofs uint64
+	Dirlen uint64
+}
+
+type pak64Entry struct {
+	Name    [MaxFileName]byte
+	Filepos uint64
+	Filelen uint64
+}
+
+func entryName(name []byte) string {
+	b := bytes.IndexByte(name, 0)
+	if b < 0 {
+		b = len(name)
+	}
+	return string(name[:b])
+}
+
+func (e *pakEntry) name() string {
+	return entryName(e.Name[:])
+}
+
+func (e *pak64Entry) name() string {
+	return entryName(e.Name[:])
+}
+
 // A File is a single file in a PAK archive.
 // The file content can be accessed by calling Open.
 type File struct {
 	Name    string
-	Filepos uint32
-	Filelen uint32
+	Filepos uint64
+	Filelen uint64
 	pak     *Reader
 }
 
@@ -59,10 +102,15 @@ func (f *File) Open() *io.SectionReader {
 	return io.NewSectionReader(f.pak.r, int64(f.Filepos), int64(f.Filelen))
 }
 
-// A Reader serves content from a PAK archive.
+// A Reader serves content from a PAK archive. Reader implements fs.FS and
+// fs.ReadDirFS.
 type Reader struct {
-	File []*File
-	r    *io.SectionReader
+	File      []*File
+	r         *io.SectionReader
+	offsets64 bool // PAK file has 64-bit offsets
+
+	fsOnce    sync.Once
+	fsEntries map[string]*fsEntry
 }
 
 // A ReadCloser is a Reader that must be closed when no longer needed.
@@ -71,8 +119,78 @@ type ReadCloser struct {
 	f *os.File
 }
 
+// Options limit resources Reader is allowed to consume when parsing
+// untrusted PAK files. Zero values mean default limits.
+type Options struct {
+	// Maximum number of files, can't be raised above MaxFiles.
+	MaxFiles int
+
+	// Maximum length of a single file, can't be raised above MaxOffset.
+	MaxFileLen int64
+
+	// Extended allows up to MaxExtendedFiles files and offsets up to
+	// MaxExtendedOffset, which raises the limits above. Such PAK files are
+	// produced by Quake 2 Remaster and similar tools, but can't be read by
+	// classic engines. Extended Reader also reads PAK files with 64-bit
+	// offsets.
+	Extended bool
+
+	// Offsets64 makes Writer produce PAK files with 64-bit offsets, which
+	// can hold files and archives larger than 4 GiB, up to Max64Offset.
+	// Such PAK files have their own ident and can only be read by Reader
+	// with Extended or Offsets64 set. Implies Extended limit on number of
+	// files. Updater keeps offset size of existing PAK file.
+	Offsets64 bool
+}
+
+func (opt *Options) extended() bool {
+	return opt.Extended || opt.Offsets64
+}
+
+func (opt *Options) maxFiles() int {
+	limit := MaxFiles
+	if opt.extended() {
+		limit = MaxExtendedFiles
+	}
+	if opt.MaxFiles > 0 && opt.MaxFiles < limit {
+		return opt.MaxFiles
+	}
+	return limit
+}
+
+func (opt *Options) maxOffset() uint64 {
+	if opt.Offsets64 {
+		return Max64Offset
+	}
+	if opt.Extended {
+		return MaxExtendedOffset
+	}
+	return MaxOffset
+}
+
+func (opt *Options) maxFileLen() uint64 {
+	limit := opt.maxOffset()
+	if opt.MaxFileLen > 0 && uint64(opt.MaxFileLen) < limit {
+		return uint64(opt.MaxFileLen)
+	}
+	return limit
+}
+
+// returns size of PAK header written with opt
+func (opt *Options) headerSize() int64 {
+	if opt.Offsets64 {
+		return header64Size
+	}
+	return headerSize
+}
+
 // OpenReader will open the PAK file specified by name and return a ReadCloser.
 func OpenReader(name string) (*ReadCloser, error) {
+	return OpenReaderOptions(name, Options{})
+}
+
+// OpenReaderOptions is like OpenReader but enforces limits given by opt.
+func OpenReaderOptions(name string, opt Options) (*ReadCloser, error) {
 	f, err := os.Open(name)
 	if err != nil {
 		return nil, err
@@ -83,7 +201,7 @@ func OpenReader(name string) (*ReadCloser, error) {
 		return nil, err
 	}
 	pak := new(ReadCloser)
-	if err := pak.init(f, fi.Size()); err != nil {
+	if err := pak.init(f, fi.Size(), &opt); err != nil {
 		f.Close()
 		return nil, err
 	}
@@ -94,52 +212,86 @@ func OpenReader(name string) (*ReadCloser, error) {
 // NewReader returns a new Reader reading from r, which is assumed to
 // have the given size in bytes.
 func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
+	return NewReaderOptions(r, size, Options{})
+}
+
+// NewReaderOptions is like NewReader but enforces limits given by opt.
+func NewReaderOptions(r io.ReaderAt, size int64, opt Options) (*Reader, error) {
 	pak := new(Reader)
-	if err := pak.init(r, size); err != nil {
+	if err := pak.init(r, size, &opt); err != nil {
 		return nil, err
 	}
 	return pak, nil
 }
 
-func (pak *Reader) init(r io.ReaderAt, size int64) error {
+func (pak *Reader) init(r io.ReaderAt, size int64, opt *Options) error {
 	pak.r = io.NewSectionReader(r, 0, size)
-	var header pakHeader
-	if err := binary.Read(pak.r, binary.LittleEndian, &header); err != nil {
+	var ident uint32
+	if err := binary.Read(pak.r, binary.LittleEndian, &ident); err != nil {
 		return err
 	}
-	if header.Ident != pakIdent {
+	if _, err := pak.r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var dirofs, dirlen, entLen uint64
+	switch {
+	case ident == pakIdent:
+		var header pakHeader
+		if err := binary.Read(pak.r, binary.LittleEndian, &header); err != nil {
+			return err
+		}
+		dirofs, dirlen, entLen = uint64(header.Dirofs), uint64(header.Dirlen), entrySize
+	case ident == pak64Ident && opt.extended():
+		var header pak64Header
+		if err := binary.Read(pak.r, binary.LittleEndian, &header); err != nil {
+			return err
+		}
+		dirofs, dirlen, entLen = header.Dirofs, header.Dirlen, entry64Size
+		pak.offsets64 = true
+	default:
 		return errBadIdent
 	}
-	if header.Dirlen%entrySize != 0 {
+
+	// offsets of 64-bit PAK file are only limited by Max64Offset
+	limits := *opt
+	limits.Extended = opt.extended()
+	limits.Offsets64 = pak.offsets64
+	maxOffset, maxFileLen := limits.maxOffset(), limits.maxFileLen()
+
+	if dirlen%entLen != 0 {
 		return errBadDirLen
 	}
-	numFiles := int(header.Dirlen / entrySize)
-	if numFiles > MaxFiles {
+	if dirlen/entLen > uint64(opt.maxFiles()) {
 		return errTooManyFiles
 	}
-	if header.Dirofs > MaxOffset-header.Dirlen {
+	numFiles := int(dirlen / entLen)
+	if dirofs > maxOffset-dirlen || int64(dirofs+dirlen) > size {
 		return errBadDirOfs
 	}
-	if _, err := pak.r.Seek(int64(header.Dirofs), io.SeekStart); err != nil {
+	if _, err := pak.r.Seek(int64(dirofs), io.SeekStart); err != nil {
 		return err
 	}
 	pak.File = make([]*File, numFiles)
 	for i := 0; i < numFiles; i++ {
-		var entry pakEntry
-		if err := binary.Read(pak.r, binary.LittleEndian, &entry); err != nil {
-			return err
+		var entry pak64Entry
+		if pak.offsets64 {
+			if err := binary.Read(pak.r, binary.LittleEndian, &entry); err != nil {
+				return err
+			}
+		} else {
+			var e pakEntry
+			if err := binary.Read(pak.r, binary.LittleEndian, &e); err != nil {
+				return err
+			}
+			entry = pak64Entry{e.Name, uint64(e.Filepos), uint64(e.Filelen)}
 		}
-		if entry.Filelen > MaxOffset {
+		if entry.Filelen > maxFileLen {
 			return errBadFileLen
 		}
-		if entry.Filepos > MaxOffset-entry.Filelen {
+		if entry.Filepos > maxOffset-entry.Filelen {
 			return errBadFilePos
 		}
-		b := bytes.IndexByte(entry.Name[:], 0)
-		if b < 0 {
-			b = len(entry.Name)
-		}
-		pak.File[i] = &File{string(entry.Name[:b]), entry.Filepos, entry.Filelen, pak}
+		pak.File[i] = &File{entry.name(), entry.Filepos, entry.Filelen, pak}
 	}
 	return nil
 }
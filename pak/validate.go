@@ -0,0 +1,79 @@
+package pak
+
+import (
+	"fmt"
+	"sort"
+)
+
+// FindingKind is the kind of problem found by Validate.
+type FindingKind int
+
+const (
+	// File data extends past end of PAK file.
+	PastEOF FindingKind = iota
+
+	// File data overlaps data of another file.
+	Overlap
+
+	// File has empty name.
+	EmptyName
+)
+
+// A Finding is a problem with a single file in PAK archive. Such files can
+// still be read, but most likely indicate a broken or malicious packing tool.
+type Finding struct {
+	Kind FindingKind
+	File *File
+
+	// File that File overlaps, for Overlap findings.
+	Other *File
+}
+
+func (f Finding) String() string {
+	switch f.Kind {
+	case PastEOF:
+		return fmt.Sprintf(`"%s" extends past end of file`, f.File.Name)
+	case Overlap:
+		return fmt.Sprintf(`"%s" overlaps "%s"`, f.File.Name, f.Other.Name)
+	case EmptyName:
+		return fmt.Sprintf("file at offset %d has empty name", f.File.Filepos)
+	}
+	return fmt.Sprintf("unknown finding %d", f.Kind)
+}
+
+// Validate checks PAK directory for files extending past end of PAK file,
+// files with overlapping data and files with empty names. Findings are
+// returned in directory order, except that overlaps are reported after other
+// findings in order of file position. Files extending past end of PAK file
+// are not checked for overlaps. Empty files never overlap.
+func (pak *Reader) Validate() []Finding {
+	var findings []Finding
+	valid := make([]*File, 0, len(pak.File))
+	for _, f := range pak.File {
+		if len(f.Name) == 0 {
+			findings = append(findings, Finding{Kind: EmptyName, File: f})
+		}
+		if int64(f.Filepos)+int64(f.Filelen) > pak.r.Size() {
+			findings = append(findings, Finding{Kind: PastEOF, File: f})
+			continue
+		}
+		valid = append(valid, f)
+	}
+
+	sort.SliceStable(valid, func(i, j int) bool {
+		return valid[i].Filepos < valid[j].Filepos
+	})
+	var last *File
+	for _, f := range valid {
+		if f.Filelen == 0 {
+			continue
+		}
+		if last != nil && f.Filepos < last.Filepos+last.Filelen {
+			findings = append(findings, Finding{Kind: Overlap, File: f, Other: last})
+		}
+		if last == nil || f.Filepos+f.Filelen > last.Filepos+last.Filelen {
+			last = f
+		}
+	}
+	return findings
+}
@@ -0,0 +1,113 @@
+package pak
+
+import (
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// WalkFunc is the type of function called by Walk for each file and
+// directory. For directories f is nil. If the function returns fs.SkipDir
+// when invoked on a directory, Walk skips the directory's contents. If it
+// returns fs.SkipDir when invoked on a file, Walk skips the remaining files
+// in the containing directory. Any other error stops the walk.
+type WalkFunc func(name string, f *File) error
+
+// directory inferred from file names
+type walkDir struct {
+	dirs  map[string]*walkDir
+	files map[string][]*File
+}
+
+func (d *walkDir) names() []string {
+	names := make([]string, 0, len(d.dirs)+len(d.files))
+	for name := range d.dirs {
+		names = append(names, name)
+	}
+	for name := range d.files {
+		if _, ok := d.dirs[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (d *walkDir) walk(prefix string, fn WalkFunc) error {
+	for _, elem := range d.names() {
+		name := prefix + elem
+		if sub, ok := d.dirs[elem]; ok {
+			if err := fn(name, nil); err == fs.SkipDir {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if err := sub.walk(name+"/", fn); err != nil {
+				return err
+			}
+		}
+		for _, f := range d.files[elem] {
+			if err := fn(name, f); err == fs.SkipDir {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Walk calls fn for each file in the archive and for each directory implied
+// by file names, in lexical order within each directory. Empty path elements
+// are ignored, so "maps//q2dm1.bsp" is visited as "maps/q2dm1.bsp". The root
+// directory itself is not visited. Duplicate files are visited in archive
+// order.
+func (pak *Reader) Walk(fn WalkFunc) error {
+	root := &walkDir{}
+	for _, f := range pak.File {
+		var elems []string
+		for _, e := range strings.Split(f.Name, "/") {
+			if len(e) > 0 {
+				elems = append(elems, e)
+			}
+		}
+		if len(elems) == 0 {
+			continue
+		}
+		d := root
+		for _, e := range elems[:len(elems)-1] {
+			if d.dirs == nil {
+				d.dirs = make(map[string]*walkDir)
+			}
+			sub, ok := d.dirs[e]
+			if !ok {
+				sub = &walkDir{}
+				d.dirs[e] = sub
+			}
+			d = sub
+		}
+		if d.files == nil {
+			d.files = make(map[string][]*File)
+		}
+		name := elems[len(elems)-1]
+		d.files[name] = append(d.files[name], f)
+	}
+	return root.walk("", fn)
+}
+
+// Glob returns files whose names match pattern, in archive order. The syntax
+// of patterns is the same as in path.Match. The only possible returned error
+// is path.ErrBadPattern.
+func (pak *Reader) Glob(pattern string) ([]*File, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	var files []*File
+	for _, f := range pak.File {
+		if ok, _ := path.Match(pattern, f.Name); ok {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
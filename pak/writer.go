@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"io/fs"
 	"os"
 )
 
@@ -17,19 +18,28 @@ var (
 // Writer implements a PAK file writer.
 type Writer struct {
 	w      io.WriteSeeker
-	files  []pakEntry
-	offset int
+	files  []pak64Entry
+	offset int64
+	opt    Options
 	closed bool
 	isFile bool
+	cur    int            // index of file being written or -1
+	index  map[string]int // existing files in update mode
+	stream io.Writer      // final destination of temporary file w
 }
 
 // OpenWriter returns a new Writer writing a PAK file specified by name.
 func OpenWriter(name string) (*Writer, error) {
+	return OpenWriterOptions(name, Options{})
+}
+
+// OpenWriterOptions is like OpenWriter but enforces limits given by opt.
+func OpenWriterOptions(name string, opt Options) (*Writer, error) {
 	f, err := os.Create(name)
 	if err != nil {
 		return nil, err
 	}
-	pak, err := NewWriter(f)
+	pak, err := NewWriterOptions(f, opt)
 	if err != nil {
 		f.Close()
 		return nil, err
@@ -38,48 +48,171 @@ func OpenWriter(name string) (*Writer, error) {
 	return pak, nil
 }
 
+// OpenUpdater opens existing PAK file specified by name for updating. The
+// returned Writer keeps files already in the archive: Create with a name of
+// existing file replaces it, keeping its position in the directory, and other
+// names are appended. New data is written after existing file data, usually
+// over the old directory, and the new directory is written by Close, so PAK
+// file is left corrupted if updating fails midway. Space used by replaced
+// files is not reclaimed.
+func OpenUpdater(name string) (*Writer, error) {
+	return OpenUpdaterOptions(name, Options{})
+}
+
+// OpenUpdaterOptions is like OpenUpdater but enforces limits given by opt.
+func OpenUpdaterOptions(name string, opt Options) (*Writer, error) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	pak, err := newUpdater(f, opt)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return pak, nil
+}
+
+// maps names of files to their first directory entries
+func (pak *Writer) buildIndex() {
+	pak.index = make(map[string]int, len(pak.files))
+	for i := len(pak.files) - 1; i >= 0; i-- {
+		pak.index[pak.files[i].name()] = i
+	}
+}
+
+func newUpdater(f *os.File, opt Options) (*Writer, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r := new(Reader)
+	if err := r.init(f, fi.Size(), &opt); err != nil {
+		return nil, err
+	}
+
+	// data of existing files follows header, so its size can't change
+	opt.Extended = opt.extended()
+	opt.Offsets64 = r.offsets64
+	pak := &Writer{
+		w:      f,
+		files:  make([]pak64Entry, len(r.File)),
+		offset: opt.headerSize(),
+		opt:    opt,
+		isFile: true,
+		cur:    -1,
+	}
+	for i, v := range r.File {
+		e := &pak.files[i]
+		copy(e.Name[:], v.Name)
+		e.Filepos = v.Filepos
+		e.Filelen = v.Filelen
+		if end := int64(v.Filepos + v.Filelen); end > pak.offset {
+			pak.offset = end
+		}
+	}
+	pak.buildIndex()
+	if _, err := f.Seek(pak.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return pak, nil
+}
+
+// NewStreamWriter returns a new Writer writing a PAK file to w, which doesn't
+// need to be seekable, such as network connection or HTTP response. Since
+// PAK header must be written first, PAK file is written to a temporary file,
+// which is copied to w and removed by Close.
+func NewStreamWriter(w io.Writer) (*Writer, error) {
+	return NewStreamWriterOptions(w, Options{})
+}
+
+// NewStreamWriterOptions is like NewStreamWriter but enforces limits given by
+// opt.
+func NewStreamWriterOptions(w io.Writer, opt Options) (*Writer, error) {
+	f, err := os.CreateTemp("", "pak-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	pak, err := NewWriterOptions(f, opt)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	pak.stream = w
+	return pak, nil
+}
+
 // NewWriter returns a new Writer writing a PAK file to w.
 func NewWriter(w io.WriteSeeker) (*Writer, error) {
+	return NewWriterOptions(w, Options{})
+}
+
+// NewWriterOptions is like NewWriter but enforces limits given by opt.
+func NewWriterOptions(w io.WriteSeeker, opt Options) (*Writer, error) {
 	if _, err := w.Seek(0, io.SeekStart); err != nil {
 		return nil, err
 	}
-	if err := binary.Write(w, binary.LittleEndian, new(pakHeader)); err != nil {
+	if _, err := w.Write(make([]byte, opt.headerSize())); err != nil {
 		return nil, err
 	}
 	pak := &Writer{
 		w:      w,
-		offset: headerSize,
+		offset: opt.headerSize(),
+		opt:    opt,
+		cur:    -1,
 	}
 	return pak, nil
 }
 
 func (pak *Writer) finishEntry() {
-	if len(pak.files) > 0 {
-		e := &pak.files[len(pak.files)-1]
-		e.Filelen = uint32(pak.offset) - e.Filepos
+	if pak.cur >= 0 {
+		e := &pak.files[pak.cur]
+		e.Filelen = uint64(pak.offset) - e.Filepos
 	}
 }
 
 func (pak *Writer) finish() error {
 	pak.finishEntry()
 
-	dirLen := binary.Size(pak.files)
-	if pak.offset > MaxOffset-dirLen {
+	var dir any = pak.files
+	if !pak.opt.Offsets64 {
+		// offsets were checked against 32-bit limits when written
+		files := make([]pakEntry, len(pak.files))
+		for i, e := range pak.files {
+			files[i] = pakEntry{e.Name, uint32(e.Filepos), uint32(e.Filelen)}
+		}
+		dir = files
+	}
+	dirLen := binary.Size(dir)
+	if pak.offset > int64(pak.opt.maxOffset())-int64(dirLen) {
 		return errBadDirOfs
 	}
 
-	if err := binary.Write(pak.w, binary.LittleEndian, pak.files); err != nil {
+	if err := binary.Write(pak.w, binary.LittleEndian, dir); err != nil {
 		return err
 	}
+	if pak.index != nil {
+		if err := pak.w.(*os.File).Truncate(pak.offset + int64(dirLen)); err != nil {
+			return err
+		}
+	}
 	if _, err := pak.w.Seek(0, io.SeekStart); err != nil {
 		return err
 	}
 
-	header := &pakHeader{
+	var header any = &pakHeader{
 		Ident:  pakIdent,
 		Dirofs: uint32(pak.offset),
 		Dirlen: uint32(dirLen),
 	}
+	if pak.opt.Offsets64 {
+		header = &pak64Header{
+			Ident:  pak64Ident,
+			Dirofs: uint64(pak.offset),
+			Dirlen: uint64(dirLen),
+		}
+	}
 	if err := binary.Write(pak.w, binary.LittleEndian, header); err != nil {
 		return err
 	}
@@ -97,7 +230,17 @@ func (pak *Writer) Close() error {
 	pak.closed = true
 
 	var err2 error
-	if pak.isFile {
+	if pak.stream != nil {
+		f := pak.w.(*os.File)
+		if err == nil {
+			_, err = f.Seek(0, io.SeekStart)
+		}
+		if err == nil {
+			_, err = io.Copy(pak.stream, f)
+		}
+		f.Close()
+		os.Remove(f.Name())
+	} else if pak.isFile {
 		err2 = pak.w.(io.Closer).Close()
 	}
 	if err != nil {
@@ -117,16 +260,49 @@ func (pak *Writer) Create(name string) error {
 	if len(name) > MaxFileName {
 		return errNameTooLong
 	}
-	if len(pak.files) >= MaxFiles {
+	if i, ok := pak.index[name]; ok {
+		pak.files[i].Filepos = uint64(pak.offset)
+		pak.cur = i
+		return nil
+	}
+	if len(pak.files) >= pak.opt.maxFiles() {
 		return errTooManyFiles
 	}
 
-	entry := pakEntry{
-		Filepos: uint32(pak.offset),
+	entry := pak64Entry{
+		Filepos: uint64(pak.offset),
 	}
 	copy(entry.Name[:], name)
 
 	pak.files = append(pak.files, entry)
+	pak.cur = len(pak.files) - 1
+	return nil
+}
+
+// Remove removes all files with the given name added so far, including
+// existing files in update mode. Data of removed files is left in place as
+// dead space, which can be reclaimed by Compact.
+func (pak *Writer) Remove(name string) error {
+	if pak.closed {
+		return errAlreadyClosed
+	}
+	pak.finishEntry()
+	pak.cur = -1
+
+	files := pak.files[:0]
+	for _, e := range pak.files {
+		if e.name() != name {
+			files = append(files, e)
+		}
+	}
+	if len(files) == len(pak.files) {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	pak.files = files
+
+	if pak.index != nil {
+		pak.buildIndex()
+	}
 	return nil
 }
 
@@ -136,13 +312,51 @@ func (pak *Writer) Write(p []byte) (int, error) {
 	if pak.closed {
 		return 0, errAlreadyClosed
 	}
-	if len(pak.files) == 0 {
+	if pak.cur < 0 {
 		return 0, errFileNotOpen
 	}
-	if pak.offset > MaxOffset-len(p) {
+	if pak.offset > int64(pak.opt.maxOffset())-int64(len(p)) {
+		return 0, errFileTooBig
+	}
+	if pak.offset-int64(pak.files[pak.cur].Filepos) > int64(pak.opt.maxFileLen())-int64(len(p)) {
 		return 0, errFileTooBig
 	}
 	n, err := pak.w.Write(p)
-	pak.offset += n
+	pak.offset += int64(n)
 	return n, err
 }
+
+// FileHeader describes a file added by CreateHeader.
+type FileHeader struct {
+	Name string
+}
+
+// CreateHeader adds a file described by fh to the PAK file and returns a
+// Writer to which file contents should be written, like zip.Writer does. The
+// returned Writer is valid until the next call to Create, CreateHeader, Copy
+// or Close.
+func (pak *Writer) CreateHeader(fh *FileHeader) (io.Writer, error) {
+	if err := pak.Create(fh.Name); err != nil {
+		return nil, err
+	}
+	return pak, nil
+}
+
+// Copy copies the file f, usually from a Reader, into the PAK file under the
+// same name. Limits are checked before the file is added, and data is copied
+// directly to the underlying writer.
+func (pak *Writer) Copy(f *File) error {
+	size := int64(f.Filelen)
+	if pak.offset > int64(pak.opt.maxOffset())-size || size > int64(pak.opt.maxFileLen()) {
+		return errFileTooBig
+	}
+	if err := pak.Create(f.Name); err != nil {
+		return err
+	}
+	n, err := io.Copy(pak.w, f.Open())
+	pak.offset += n
+	if err == nil && n < size {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
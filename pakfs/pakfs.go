@@ -0,0 +1,413 @@
+// Package pakfs provides file system that merges packfiles and directories
+// the way Quake 2 server builds its search path, so that tools can see the
+// same files game clients would get.
+package pakfs
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/skullernet/pakserve/pak"
+)
+
+// FS is a stack of packfiles and directories searched in order. Names are
+// looked up in packfiles case insensitively, and in directories as given.
+// FS implements fs.FS, fs.ReadDirFS and fs.StatFS. Sys method of FileInfo
+// of packfile entries returns *pak.File or *zip.File.
+type FS struct {
+	layers  []layer
+	closers []io.Closer
+}
+
+// layer is either packfile or directory
+type layer struct {
+	dir   string
+	files map[string]*entry // lower case names of packfile entries
+	dirs  map[string]map[string]bool
+}
+
+type entry struct {
+	name    string // base name
+	size    int64
+	modTime time.Time
+	sys     any // *pak.File or *zip.File
+	open    func() (io.ReadSeeker, error)
+}
+
+// Open opens packfiles and directories given by paths, earlier ones having
+// higher priority. Packfiles found in a directory are searched before its
+// loose files, in the order Quake 2 searches them.
+func Open(paths ...string) (*FS, error) {
+	return OpenOptions(pak.Options{}, paths...)
+}
+
+// OpenOptions is like Open but enforces limits given by opt on .pak files.
+func OpenOptions(opt pak.Options, paths ...string) (*FS, error) {
+	fsys := new(FS)
+	for _, p := range paths {
+		if err := fsys.add(p, opt); err != nil {
+			fsys.Close()
+			return nil, err
+		}
+	}
+	return fsys, nil
+}
+
+// IsPackfile reports whether name has .pak or .pkz extension.
+func IsPackfile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".pak" || ext == ".pkz"
+}
+
+func (fsys *FS) add(name string, opt pak.Options) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fsys.addPackfile(name, fi, opt)
+	}
+
+	d, err := os.ReadDir(name)
+	if err != nil {
+		return err
+	}
+	paks := make([]string, 0, len(d))
+	for _, v := range d {
+		if !v.IsDir() && IsPackfile(v.Name()) {
+			paks = append(paks, v.Name())
+		}
+	}
+	pak.SortSearchOrder(paks)
+	for _, v := range paks {
+		p := filepath.Join(name, v)
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		if err := fsys.addPackfile(p, fi, opt); err != nil {
+			return err
+		}
+	}
+	fsys.layers = append(fsys.layers, layer{dir: name})
+	return nil
+}
+
+func (fsys *FS) addPackfile(name string, fi fs.FileInfo, opt pak.Options) error {
+	l := layer{files: make(map[string]*entry), dirs: make(map[string]map[string]bool)}
+	add := func(n string, e *entry) {
+		n = pak.NormalizeName(n)
+		if !fs.ValidPath(n) {
+			return
+		}
+		e.name = path.Base(n)
+		l.files[n] = e
+		for dir := path.Dir(n); ; n, dir = dir, path.Dir(dir) {
+			if l.dirs[dir] == nil {
+				l.dirs[dir] = make(map[string]bool)
+			}
+			l.dirs[dir][path.Base(n)] = true
+			if dir == "." {
+				break
+			}
+		}
+	}
+
+	if strings.ToLower(filepath.Ext(name)) == ".pkz" {
+		r, err := zip.OpenReader(name)
+		if err != nil {
+			return err
+		}
+		fsys.closers = append(fsys.closers, r)
+		for _, f := range r.File {
+			if f.Mode().IsDir() {
+				continue
+			}
+			f := f
+			add(f.Name, &entry{
+				size:    int64(f.UncompressedSize64),
+				modTime: f.Modified,
+				sys:     f,
+				open:    func() (io.ReadSeeker, error) { return newZipReader(f) },
+			})
+		}
+	} else {
+		r, err := pak.OpenReaderOptions(name, opt)
+		if err != nil {
+			return err
+		}
+		fsys.closers = append(fsys.closers, r)
+		for _, f := range r.File {
+			f := f
+			add(f.Name, &entry{
+				size:    int64(f.Filelen),
+				modTime: fi.ModTime(),
+				sys:     f,
+				open:    func() (io.ReadSeeker, error) { return f.Open(), nil },
+			})
+		}
+	}
+	fsys.layers = append(fsys.layers, l)
+	return nil
+}
+
+// Close closes all packfiles.
+func (fsys *FS) Close() error {
+	var err error
+	for _, c := range fsys.closers {
+		if err2 := c.Close(); err == nil {
+			err = err2
+		}
+	}
+	fsys.closers = nil
+	return err
+}
+
+func (fsys *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	lower := strings.ToLower(name)
+	isDir := false
+	for _, l := range fsys.layers {
+		if l.files == nil {
+			f, err := os.Open(filepath.Join(l.dir, filepath.FromSlash(name)))
+			if err != nil {
+				continue
+			}
+			fi, err := f.Stat()
+			if err == nil && fi.Mode().IsRegular() {
+				return f, nil
+			}
+			f.Close()
+			isDir = isDir || err == nil && fi.IsDir()
+			continue
+		}
+		if e := l.files[lower]; e != nil {
+			r, err := e.open()
+			if err != nil {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+			}
+			return &file{ReadSeeker: r, entry: e}, nil
+		}
+		isDir = isDir || l.dirs[lower] != nil
+	}
+	if !isDir {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	entries, err := fsys.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return &dirFile{info: dirInfo{name: path.Base(name)}, entries: entries}, nil
+}
+
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: errors.Unwrap(err)}
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// ReadDir returns merged entries of named directory in all packfiles and
+// directories, sorted by name. Entries found earlier in search order win.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	lower := strings.ToLower(name)
+	seen := make(map[string]fs.DirEntry)
+	found := false
+	for _, l := range fsys.layers {
+		if l.files == nil {
+			d, err := os.ReadDir(filepath.Join(l.dir, filepath.FromSlash(name)))
+			if err != nil {
+				continue
+			}
+			found = true
+			for _, v := range d {
+				if _, ok := seen[v.Name()]; ok {
+					continue
+				}
+				if v.IsDir() {
+					seen[v.Name()] = fs.FileInfoToDirEntry(dirInfo{name: v.Name()})
+				} else if v.Type().IsRegular() {
+					seen[v.Name()] = v
+				}
+			}
+			continue
+		}
+		children := l.dirs[lower]
+		if children == nil {
+			continue
+		}
+		found = true
+		for child := range children {
+			if _, ok := seen[child]; ok {
+				continue
+			}
+			full := child
+			if lower != "." {
+				full = lower + "/" + child
+			}
+			if e := l.files[full]; e != nil {
+				seen[child] = fs.FileInfoToDirEntry(fileInfo{e})
+			} else {
+				seen[child] = fs.FileInfoToDirEntry(dirInfo{name: child})
+			}
+		}
+	}
+	if !found {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	list := make([]fs.DirEntry, 0, len(seen))
+	for _, v := range seen {
+		list = append(list, v)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, nil
+}
+
+type fileInfo struct {
+	e *entry
+}
+
+func (fi fileInfo) Name() string       { return fi.e.name }
+func (fi fileInfo) Size() int64        { return fi.e.size }
+func (fi fileInfo) Mode() fs.FileMode  { return 0444 }
+func (fi fileInfo) ModTime() time.Time { return fi.e.modTime }
+func (fi fileInfo) IsDir() bool        { return false }
+func (fi fileInfo) Sys() any           { return fi.e.sys }
+
+type dirInfo struct {
+	name string
+}
+
+func (fi dirInfo) Name() string       { return fi.name }
+func (fi dirInfo) Size() int64        { return 0 }
+func (fi dirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (fi dirInfo) ModTime() time.Time { return time.Time{} }
+func (fi dirInfo) IsDir() bool        { return true }
+func (fi dirInfo) Sys() any           { return nil }
+
+// file is open packfile entry
+type file struct {
+	io.ReadSeeker
+	entry *entry
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return fileInfo{f.entry}, nil
+}
+
+func (f *file) Close() error {
+	if c, ok := f.ReadSeeker.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// dirFile is open merged directory
+type dirFile struct {
+	info    dirInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+func (d *dirFile) Close() error {
+	return nil
+}
+
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(rest) {
+		rest = rest[:n]
+	}
+	d.offset += len(rest)
+	return rest, nil
+}
+
+// zipReader makes compressed ZIP entry seekable by reopening it when
+// seeking backwards
+type zipReader struct {
+	f      *zip.File
+	r      io.ReadCloser
+	pos    int64 // position of r
+	offset int64 // position requested by Seek
+}
+
+func newZipReader(f *zip.File) (*zipReader, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	return &zipReader{f: f, r: r}, nil
+}
+
+func (z *zipReader) Read(p []byte) (int, error) {
+	if z.offset >= int64(z.f.UncompressedSize64) {
+		return 0, io.EOF
+	}
+	if z.offset < z.pos {
+		r, err := z.f.Open()
+		if err != nil {
+			return 0, err
+		}
+		z.r.Close()
+		z.r, z.pos = r, 0
+	}
+	if z.offset > z.pos {
+		n, err := io.CopyN(io.Discard, z.r, z.offset-z.pos)
+		z.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := z.r.Read(p)
+	z.pos += int64(n)
+	z.offset = z.pos
+	return n, err
+}
+
+func (z *zipReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += z.offset
+	case io.SeekEnd:
+		offset += int64(z.f.UncompressedSize64)
+	default:
+		return 0, errors.New("pakfs: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("pakfs: negative position")
+	}
+	z.offset = offset
+	return offset, nil
+}
+
+func (z *zipReader) Close() error {
+	return z.r.Close()
+}
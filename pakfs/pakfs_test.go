@@ -0,0 +1,120 @@
+package pakfs
+
+import (
+	"archive/zip"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/skullernet/pakserve/pak"
+)
+
+func writeTestPkz(t testing.TB, name string, files map[string]string) {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	for k, v := range files {
+		fw, err := w.Create(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(v))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestPak(t testing.TB, name string, files map[string]string) {
+	b := pak.NewBuilder()
+	for k, v := range files {
+		if err := b.AddBytes(k, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.WriteFile(name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t testing.TB, fsys fs.FS, name string) string {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		t.Fatalf("read %s: %v", name, err)
+	}
+	return string(data)
+}
+
+func TestFS(t *testing.T) {
+	dir := t.TempDir()
+	mod := filepath.Join(dir, "mod")
+	base := filepath.Join(dir, "baseq2")
+	for _, d := range []string{mod, filepath.Join(base, "maps")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeTestPak(t, filepath.Join(base, "pak0.pak"), map[string]string{
+		"maps/q2dm1.bsp":    "pak0",
+		"maps/q2dm2.bsp":    "pak0",
+		"pics/colormap.pcx": "pak0",
+	})
+	writeTestPak(t, filepath.Join(base, "pak1.pak"), map[string]string{
+		"maps/q2dm1.bsp": "pak1",
+	})
+	writeTestPkz(t, filepath.Join(base, "extra.pkz"), map[string]string{
+		"Maps/Q2DM2.bsp":   "pkz",
+		"sound/misc/a.wav": "pkz",
+	})
+	os.WriteFile(filepath.Join(base, "maps", "q2dm1.bsp"), []byte("loose"), 0644)
+	os.WriteFile(filepath.Join(base, "maps", "q2dm3.bsp"), []byte("loose"), 0644)
+	os.WriteFile(filepath.Join(mod, "default.cfg"), []byte("mod"), 0644)
+
+	fsys, err := Open(mod, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fsys.Close()
+
+	if err := fstest.TestFS(fsys, "default.cfg", "maps/q2dm1.bsp", "maps/q2dm2.bsp",
+		"maps/q2dm3.bsp", "pics/colormap.pcx", "sound/misc/a.wav", "pak0.pak"); err != nil {
+		t.Fatal(err)
+	}
+
+	// other paks are searched first, then pakN in descending order, then loose files
+	for name, want := range map[string]string{
+		"default.cfg":    "mod",
+		"maps/q2dm1.bsp": "pak1",
+		"MAPS/Q2DM2.BSP": "pkz",
+		"maps/q2dm3.bsp": "loose",
+	} {
+		if got := readTestFile(t, fsys, name); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+
+	f, err := fsys.Open("sound/misc/a.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	s := f.(io.Seeker)
+	io.ReadAll(f)
+	if _, err := s.Seek(1, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(f); string(data) != "kz" {
+		t.Fatalf("read after seek: %q", data)
+	}
+
+	if _, err := fsys.Stat("maps/missing.bsp"); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,7 @@
+package main
+
+import "github.com/skullernet/pakserve/server"
+
+func main() {
+	server.Main()
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"compress/flate"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+type command struct {
+	name    string // subcommand name
+	alias   string // legacy single letter flag
+	args    string // argument synopsis
+	short   string // one line description
+	long    string // detailed description, may be empty
+	minArgs int
+	maxArgs int                    // -1 if unlimited
+	flags   func(fs *flag.FlagSet) // defines command specific flags, may be nil
+	run     func()
+}
+
+// global options given before command
+var options = []struct {
+	name string
+	help string
+}{
+	{"--overwrite", "Replace existing output file (default)."},
+	{"--no-clobber", "Fail if output file already exists."},
+	{"--extended", "Read and write extended .pak files of Quake 2 Remaster."},
+	{"--offsets64", "Write .pak files with 64-bit offsets, larger than 4 GiB."},
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{
+			name: "list", alias: "-l", args: "<path>...", minArgs: 1, maxArgs: -1, run: list,
+			short: "list pak contents, or merged contents of paks, pkzs and dirs",
+			long: "Given single .pak or .pkz file, lists its contents. Given several paths or a directory, " +
+				"lists merged contents of paks, pkzs and directories the way server would resolve them: " +
+				"earlier arguments win, and packfiles found in a directory are searched before its loose files. " +
+				"Each path is listed with archive it is served from, followed by archives it shadows. " +
+				"Single archive is listed in archive order, merged contents are sorted by name, unless -sort is given.",
+			flags: func(fs *flag.FlagSet) {
+				fs.BoolVar(&listLong, "long", false, "also list data offset, CRC-32 and compression method")
+				fs.StringVar(&listFormat, "format", listFormat, "output format: text, json or csv")
+				fs.StringVar(&listSort, "sort", "", "sort by name, or by size largest first")
+			},
+		},
+		{
+			name: "verify", alias: "-v", args: "<pak>", minArgs: 1, maxArgs: 1, run: verify,
+			short: "verify pak directory",
+			long: "Reports files extending past end of file, files with overlapping data and files with empty names. " +
+				"Exits with non-zero status if any problems are found.",
+		},
+		{
+			name: "create", alias: "-c", args: "<pak> <dir>", minArgs: 2, maxArgs: 2, run: create,
+			short: "create pak from dir",
+			long:  "File names are converted to lower case and files are stored sorted by name.",
+		},
+		{
+			name: "create-pkz", alias: "-C", args: "<pkz> <dir>", minArgs: 2, maxArgs: 2, run: createZip,
+			short: "create pkz from dir",
+			long: "Files are deflated unless they are already compressed (.jpg, .png, .ogg, .mp3, .zip, .pkz, .gz " +
+				"by default) or don't get smaller when deflated, in which case they are stored.",
+			flags: zipFlags,
+		},
+		{
+			name: "extract", alias: "-x", args: "<pak> <dir>", minArgs: 2, maxArgs: 2, run: extract,
+			short: "extract pak into dir",
+			long:  "File names are converted to lower case.",
+		},
+		{
+			name: "add", alias: "-a", args: "<pak|pkz> <file|dir> [name]", minArgs: 2, maxArgs: 3, run: add,
+			short: "add files to existing pak or pkz",
+			long: "Adds single file under its base name or given name, or all files under dir with names " +
+				"relative to dir, prefixed by name if given. Names are converted to lower case and files with " +
+				"the same names are replaced. Pak is copied and the copy updated by appending new data, " +
+				"then it replaces the original, so interrupted run leaves pak intact. " +
+				"Pkz is rewritten, copying existing files without recompressing them.",
+			flags: zipFlags,
+		},
+		{
+			name: "diff", alias: "-diff", args: "<path> <path>", minArgs: 2, maxArgs: 2, run: diff,
+			short: "compare files of two paks, pkzs or dirs",
+			long: "Lists files only in first path prefixed with -, files only in second path prefixed with + " +
+				"and files with different content prefixed with M. Names are compared case insensitively. " +
+				"Exits with non-zero status if any differences are found.",
+		},
+		{
+			name: "merge", alias: "-m", args: "<pak> <path>...", minArgs: 2, maxArgs: -1, run: merge,
+			short: "merge paks, pkzs and dirs into single pak",
+			long: "Later paths override files of earlier ones with the same name, the way packfiles loaded " +
+				"later do, so that mod stack can be flattened into one pak. Packfiles found in a directory " +
+				"override its loose files, and are themselves not merged as files. " +
+				"File names are converted to lower case and files are stored sorted by name.",
+		},
+		{
+			name: "delete", alias: "-d", args: "<pak> <name>...", minArgs: 2, maxArgs: -1, run: deleteFiles,
+			short: "delete files from pak",
+			long: "Names are matched case insensitively. Pak is rewritten without deleted files and " +
+				"space left by files replaced or removed before. Fails if any of the names is not found.",
+		},
+		{
+			name: "compress", alias: "-z", args: "<pak> <pkz>", minArgs: 2, maxArgs: 2, run: compress,
+			short: "convert pak to pkz",
+			long:  "Files are compressed the same way create-pkz does. Metadata stamped into pak is moved to archive comment.",
+			flags: zipFlags,
+		},
+		{
+			name: "uncompress", alias: "-u", args: "<pkz> <pak>", minArgs: 2, maxArgs: 2, run: uncompress,
+			short: "convert pkz to pak",
+		},
+		{
+			name: "stamp", args: "<pak|pkz> [output]", minArgs: 1, maxArgs: 2, run: stamp,
+			short: "embed metadata into pak or pkz",
+			long: "Records creator, creation time, version and SHA-256 of archive content, " +
+				"replacing metadata stamped before. Metadata is stored in reserved pakmeta.json entry of .pak " +
+				"and in archive comment of .pkz, where server picks it up for archive manifest. " +
+				"Archive is rewritten in place unless output is given.",
+			flags: func(fs *flag.FlagSet) {
+				fs.StringVar(&stampCreator, "creator", "", "name of archive creator")
+				fs.StringVar(&stampVersion, "version", "", "archive version string")
+			},
+		},
+		{
+			name: "info", args: "<pak|pkz>", minArgs: 1, maxArgs: 1, run: info,
+			short: "show metadata of pak or pkz",
+			long: "Prints metadata embedded by stamp command and checks content hash. " +
+				"Exits with non-zero status if content was modified since archive was stamped.",
+		},
+		{
+			name: "help", args: "[command]", maxArgs: 1, run: help,
+			short: "show help for command",
+		},
+		{
+			name: "completion", args: "<bash|zsh|fish>", minArgs: 1, maxArgs: 1, run: completion,
+			short: "print shell completion script",
+			long:  `For bash, add "source <(pakutil completion bash)" to ~/.bashrc.`,
+		},
+		{
+			name: "man", maxArgs: 0, run: manPage,
+			short: "print manual page in roff format",
+			long:  "E.g. pakutil man > /usr/local/share/man/man1/pakutil.1",
+		},
+	}
+}
+
+// defines flags of commands writing pkz
+func zipFlags(fs *flag.FlagSet) {
+	fs.IntVar(&zipLevel, "level", zipLevel, "deflate level from 1 (fastest) to 9 (smallest), 0 stores all files, -1 uses default level")
+	fs.StringVar(&zipStore, "store", zipStore, "comma separated extensions of files stored without compression")
+	fs.BoolVar(&zipAllow64, "zip64", false, "allow archives over 4 GiB or with over 65534 files")
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name || len(c.alias) > 0 && c.alias == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (c *command) synopsis() string {
+	s := "pakutil [options] " + c.name
+	if len(c.args) > 0 {
+		s += " " + c.args
+	}
+	return s
+}
+
+func (c *command) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	if c.flags != nil {
+		c.flags(fs)
+	}
+	return fs
+}
+
+func (c *command) printHelp(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s\n\n", c.synopsis())
+	fmt.Fprintf(w, "%s.\n", strings.ToUpper(c.short[:1])+c.short[1:])
+	if len(c.long) > 0 {
+		fmt.Fprintf(w, "\n%s\n", wrap(c.long, 79))
+	}
+	if len(c.alias) > 0 {
+		fmt.Fprintf(w, "\nAlias: %s\n", c.alias)
+	}
+	fs := c.flagSet()
+	fs.SetOutput(w)
+	n := 0
+	fs.VisitAll(func(*flag.Flag) { n++ })
+	if n > 0 {
+		fmt.Fprintln(w, "\nFlags:")
+		fs.PrintDefaults()
+	}
+}
+
+// breaks text into lines no longer than width, if possible
+func wrap(s string, width int) string {
+	var b strings.Builder
+	n := 0
+	for _, word := range strings.Fields(s) {
+		if n > 0 && n+1+len(word) > width {
+			b.WriteByte('\n')
+			n = 0
+		} else if n > 0 {
+			b.WriteByte(' ')
+			n++
+		}
+		b.WriteString(word)
+		n += len(word)
+	}
+	return b.String()
+}
+
+func usage() {
+	w := os.Stderr
+	fmt.Fprintln(w, "Usage: pakutil [options] <command> [args]")
+	fmt.Fprintln(w, "\nCommands:")
+	for _, c := range commands {
+		name := c.name
+		if len(c.alias) > 0 {
+			name += ", " + c.alias
+		}
+		fmt.Fprintf(w, "  %-16s %s\n", name, c.short)
+	}
+	fmt.Fprintln(w, "\nOptions:")
+	for _, o := range options {
+		fmt.Fprintf(w, "  %-16s %s\n", o.name, o.help)
+	}
+	fmt.Fprintln(w, "\nRun 'pakutil help <command>' for details.")
+	os.Exit(2)
+}
+
+// reports command line mistake and exits
+func usageError(c *command, format string, v ...any) {
+	fmt.Fprintf(os.Stderr, "pakutil: %s\n", fmt.Sprintf(format, v...))
+	if c != nil {
+		fmt.Fprintf(os.Stderr, "Usage: %s\n", c.synopsis())
+		fmt.Fprintf(os.Stderr, "Run 'pakutil help %s' for details.\n", c.name)
+	} else {
+		fmt.Fprintln(os.Stderr, "Run 'pakutil help' for usage.")
+	}
+	os.Exit(2)
+}
+
+// parses command flags and checks number of arguments
+func runCommand(c *command, cmdArgs []string) {
+	fs := c.flagSet()
+	if err := fs.Parse(cmdArgs); err == flag.ErrHelp {
+		c.printHelp(os.Stdout)
+		return
+	} else if err != nil {
+		usageError(c, "%s", err)
+	}
+	args = fs.Args()
+	if len(args) < c.minArgs {
+		usageError(c, "%s: not enough arguments", c.name)
+	}
+	if c.maxArgs >= 0 && len(args) > c.maxArgs {
+		usageError(c, "%s: too many arguments", c.name)
+	}
+	if zipLevel < flate.DefaultCompression || zipLevel > flate.BestCompression {
+		usageError(c, "invalid deflate level %d", zipLevel)
+	}
+	c.run()
+}
+
+func help() {
+	if len(args) == 0 {
+		usage()
+	}
+	c := findCommand(args[0])
+	if c == nil {
+		usageError(nil, "unknown command %q", args[0])
+	}
+	c.printHelp(os.Stdout)
+}
+
+func commandNames() []string {
+	var names []string
+	for _, c := range commands {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+func completion() {
+	names := strings.Join(commandNames(), " ")
+	var opts []string
+	for _, o := range options {
+		opts = append(opts, o.name)
+	}
+	optNames := strings.Join(opts, " ")
+
+	switch args[0] {
+	case "bash":
+		fmt.Printf(`_pakutil() {
+	local cur=${COMP_WORDS[COMP_CWORD]} i
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		case ${COMP_WORDS[i]} in
+		--*) ;;
+		help) COMPREPLY=($(compgen -W "%[1]s" -- "$cur")); return ;;
+		completion) COMPREPLY=($(compgen -W "bash zsh fish" -- "$cur")); return ;;
+		*) COMPREPLY=($(compgen -f -- "$cur")); return ;;
+		esac
+	done
+	COMPREPLY=($(compgen -W "%[1]s %[2]s" -- "$cur"))
+}
+complete -o filenames -F _pakutil pakutil
+`, names, optNames)
+	case "zsh":
+		fmt.Printf(`#compdef pakutil
+_pakutil() {
+	local -a words_before
+	words_before=(${words[2,CURRENT-1]:#--*})
+	if (( ${#words_before} == 0 )); then
+		compadd -- %s %s
+	elif [[ ${words_before[1]} == help ]]; then
+		compadd -- %[1]s
+	elif [[ ${words_before[1]} == completion ]]; then
+		compadd -- bash zsh fish
+	else
+		_files
+	fi
+}
+compdef _pakutil pakutil
+`, names, optNames)
+	case "fish":
+		fmt.Printf("complete -c pakutil -n '__fish_use_subcommand' -f -a '%s'\n", names)
+		for _, o := range options {
+			fmt.Printf("complete -c pakutil -n '__fish_use_subcommand' -l '%s' -d '%s'\n",
+				strings.TrimPrefix(o.name, "--"), strings.ReplaceAll(o.help, "'", `\'`))
+		}
+		fmt.Printf("complete -c pakutil -n '__fish_seen_subcommand_from help' -f -a '%s'\n", names)
+		fmt.Println("complete -c pakutil -n '__fish_seen_subcommand_from completion' -f -a 'bash zsh fish'")
+	default:
+		usageError(findCommand("completion"), "unknown shell %q", args[0])
+	}
+}
+
+// escapes text for roff
+func roff(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\e`)
+	s = strings.ReplaceAll(s, "-", `\-`)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = `\&` + s
+	}
+	return s
+}
+
+func manPage() {
+	fmt.Printf(".TH PAKUTIL 1 %q\n", time.Now().Format("2006-01-02"))
+	fmt.Println(".SH NAME")
+	fmt.Println(`pakutil \- manipulate Quake 2 .pak and .pkz files`)
+	fmt.Println(".SH SYNOPSIS")
+	fmt.Println(`.B pakutil
+[\fIoptions\fR] \fIcommand\fR [\fIargs\fR]`)
+	fmt.Println(".SH DESCRIPTION")
+	fmt.Println("Lists, verifies, creates and extracts .pak files, creates .pkz archives and converts between the two.")
+	fmt.Println("Output is written to temporary file, then renamed, so interrupted run never leaves truncated output behind.")
+	fmt.Println(".SH OPTIONS")
+	for _, o := range options {
+		fmt.Printf(".TP\n.B %s\n%s\n", roff(o.name), roff(o.help))
+	}
+	fmt.Println(".SH COMMANDS")
+	for _, c := range commands {
+		fmt.Printf(".TP\n.B %s", roff(c.name))
+		if len(c.args) > 0 {
+			fmt.Printf(` \fI%s\fR`, roff(c.args))
+		}
+		fmt.Println()
+		text := strings.ToUpper(c.short[:1]) + c.short[1:] + "."
+		if len(c.long) > 0 {
+			text += " " + c.long
+		}
+		if len(c.alias) > 0 {
+			text += " Alias: " + c.alias + "."
+		}
+		fmt.Println(roff(text))
+		c.flagSet().VisitAll(func(f *flag.Flag) {
+			fmt.Printf(".RS\n.TP\n.B \\-%s\n%s\n.RE\n", roff(f.Name), roff(f.Usage))
+		})
+	}
+	fmt.Println(".SH EXIT STATUS")
+	fmt.Println("0 on success, 1 on failure, 2 on command line mistakes.")
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/skullernet/pakserve/pak"
+)
+
+var (
+	listLong   bool
+	listFormat = "text"
+	listSort   string
+)
+
+// file visible through search path, or file of single listed archive
+type listFile struct {
+	Name    string   `json:"name"`
+	Size    uint64   `json:"size"`
+	Offset  int64    `json:"offset,omitempty"`
+	CRC32   string   `json:"crc32,omitempty"`
+	Method  string   `json:"method,omitempty"`
+	Source  string   `json:"source"`
+	Shadows []string `json:"shadows,omitempty"` // sources of files with the same name searched later
+}
+
+// fills in fields of long listing
+type listDetails func(f *listFile) error
+
+func crcOf(r io.Reader) (string, error) {
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%08x", h.Sum32()), nil
+}
+
+func zipMethod(m uint16) string {
+	switch m {
+	case zip.Store:
+		return "store"
+	case zip.Deflate:
+		return "deflate"
+	}
+	return strconv.Itoa(int(m))
+}
+
+// calls fn for each file found in archive or directory at path
+func readSource(path string, fn func(name string, size uint64, details listDetails)) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".pak":
+		r, err := pak.OpenReaderOptions(path, pakOptions)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		for _, f := range r.File {
+			fn(f.Name, uint64(f.Filelen), func(l *listFile) (err error) {
+				l.Offset = int64(f.Filepos)
+				l.Method = "store"
+				l.CRC32, err = crcOf(f.Open())
+				return
+			})
+		}
+	case ".pkz":
+		r, err := zip.OpenReader(path)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		for _, f := range r.File {
+			if f.Mode()&os.ModeDir != 0 {
+				continue
+			}
+			fn(f.Name, f.UncompressedSize64, func(l *listFile) (err error) {
+				l.Offset, err = f.DataOffset()
+				l.Method = zipMethod(f.Method)
+				l.CRC32 = fmt.Sprintf("%08x", f.CRC32)
+				return
+			})
+		}
+	default:
+		return walkFiles(path, func(name, p string) error {
+			fi, err := os.Stat(p)
+			if err != nil {
+				return err
+			}
+			fn(name, uint64(fi.Size()), func(l *listFile) error {
+				f, err := os.Open(p)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				l.CRC32, err = crcOf(f)
+				return err
+			})
+			return nil
+		})
+	}
+	return nil
+}
+
+// adds files found in archive or directory at path to merged listing,
+// unless they are already there
+func listSource(files map[string]*listFile, path string) error {
+	var err error
+	readErr := readSource(path, func(name string, size uint64, details listDetails) {
+		name = pakToFs(name)
+		if len(name) == 0 || err != nil {
+			return
+		}
+		if f, ok := files[name]; ok {
+			if f.Source != path {
+				f.Shadows = append(f.Shadows, path)
+			}
+			return
+		}
+		f := &listFile{Name: name, Size: size, Source: path}
+		if listLong {
+			err = details(f)
+		}
+		files[name] = f
+	})
+	if readErr != nil {
+		return readErr
+	}
+	return err
+}
+
+// lists files visible through search path made of given archives and
+// directories, resolving duplicates like server does: earlier arguments
+// win, and packfiles found in directories are searched before the directory
+// itself in the same order as server searches them
+func listMerged() []*listFile {
+	files := make(map[string]*listFile)
+	for _, arg := range args {
+		fi, err := os.Stat(arg)
+		if err != nil {
+			fatal(err)
+		}
+		if fi.IsDir() {
+			d, err := os.ReadDir(arg)
+			if err != nil {
+				fatal(err)
+			}
+			paks := make([]string, 0, len(d))
+			for _, v := range d {
+				ext := strings.ToLower(filepath.Ext(v.Name()))
+				if !v.IsDir() && (ext == ".pak" || ext == ".pkz") {
+					paks = append(paks, v.Name())
+				}
+			}
+			pak.SortSearchOrder(paks)
+			for _, v := range paks {
+				if err := listSource(files, filepath.Join(arg, v)); err != nil {
+					fatal(err)
+				}
+			}
+		}
+		if err := listSource(files, arg); err != nil {
+			fatal(err)
+		}
+	}
+
+	list := make([]*listFile, 0, len(files))
+	for _, f := range files {
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// lists files of single archive in archive order
+func listArchive(path string) []*listFile {
+	var list []*listFile
+	var err error
+	readErr := readSource(path, func(name string, size uint64, details listDetails) {
+		if err != nil {
+			return
+		}
+		f := &listFile{Name: name, Size: size, Source: path}
+		if listLong {
+			err = details(f)
+		}
+		list = append(list, f)
+	})
+	if readErr != nil {
+		fatal(readErr)
+	}
+	if err != nil {
+		fatal(err)
+	}
+	return list
+}
+
+func printList(list []*listFile, merged bool) {
+	switch listFormat {
+	case "json":
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		if err := e.Encode(list); err != nil {
+			fatal(err)
+		}
+		return
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		header := []string{"name", "size", "source", "shadows"}
+		if listLong {
+			header = []string{"name", "size", "offset", "crc32", "method", "source", "shadows"}
+		}
+		w.Write(header)
+		for _, f := range list {
+			size := strconv.FormatUint(f.Size, 10)
+			shadows := strings.Join(f.Shadows, ";")
+			if listLong {
+				w.Write([]string{f.Name, size, strconv.FormatInt(f.Offset, 10), f.CRC32, f.Method, f.Source, shadows})
+			} else {
+				w.Write([]string{f.Name, size, f.Source, shadows})
+			}
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	size := uint64(0)
+	for _, f := range list {
+		if listLong {
+			fmt.Printf("%10d  %9d  %8s  %-7s  %s", f.Offset, f.Size, f.CRC32, f.Method, f.Name)
+		} else {
+			fmt.Printf("%9d  %s", f.Size, f.Name)
+		}
+		if merged {
+			fmt.Printf("  %s", f.Source)
+			if len(f.Shadows) > 0 {
+				fmt.Printf(" (shadows %s)", strings.Join(f.Shadows, ", "))
+			}
+		}
+		fmt.Println()
+		size += f.Size
+	}
+	// totals go under size column, which follows offset column in long format
+	indent := ""
+	if listLong {
+		indent = fmt.Sprintf("%10s  ", "")
+	}
+	fmt.Println(indent + "---------  ---------")
+	fmt.Printf("%s%9d  %d files\n", indent, size, len(list))
+}
+
+func list() {
+	switch listFormat {
+	case "text", "json", "csv":
+	default:
+		usageError(findCommand("list"), "unknown format %q", listFormat)
+	}
+	switch listSort {
+	case "", "name", "size":
+	default:
+		usageError(findCommand("list"), "unknown sort order %q", listSort)
+	}
+
+	var files []*listFile
+	fi, err := os.Stat(args[0])
+	merged := len(args) > 1 || err == nil && fi.IsDir()
+	if merged {
+		files = listMerged()
+	} else {
+		files = listArchive(input(0))
+		for _, f := range files {
+			f.Source = args[0]
+		}
+	}
+
+	switch listSort {
+	case "name":
+		sort.SliceStable(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	case "size":
+		sort.SliceStable(files, func(i, j int) bool { return files[i].Size > files[j].Size })
+	}
+	printList(files, merged)
+}
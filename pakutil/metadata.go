@@ -0,0 +1,211 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/skullernet/pakserve/pak"
+)
+
+var (
+	stampCreator string
+	stampVersion string
+)
+
+// file of pak or pkz that contributes to content hash
+type contentFile struct {
+	name string
+	size uint64
+	open func() (io.ReadCloser, error)
+}
+
+// returns SHA-256 of names and data of files sorted by name, so that pak and
+// pkz with the same files have the same content hash
+func contentHash(files []contentFile) (string, error) {
+	sort.SliceStable(files, func(i, j int) bool { return files[i].name < files[j].name })
+	h := sha256.New()
+	for _, f := range files {
+		var size [8]byte
+		binary.LittleEndian.PutUint64(size[:], f.size)
+		io.WriteString(h, f.name)
+		h.Write([]byte{0})
+		h.Write(size[:])
+
+		r, err := f.open()
+		if err != nil {
+			return "", err
+		}
+		_, err = io.CopyN(h, r, int64(f.size))
+		r.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func pakContent(r *pak.ReadCloser) []contentFile {
+	var files []contentFile
+	for _, f := range r.File {
+		if f.Name == pak.MetadataName {
+			continue
+		}
+		f := f
+		files = append(files, contentFile{f.Name, uint64(f.Filelen), func() (io.ReadCloser, error) {
+			return io.NopCloser(f.Open()), nil
+		}})
+	}
+	return files
+}
+
+func zipContent(r *zip.ReadCloser) []contentFile {
+	var files []contentFile
+	for _, f := range r.File {
+		if f.Mode()&os.ModeDir == 0 {
+			files = append(files, contentFile{f.Name, f.UncompressedSize64, f.Open})
+		}
+	}
+	return files
+}
+
+func isPkz(name string) bool {
+	return strings.ToLower(filepath.Ext(name)) == ".pkz"
+}
+
+func stampPak(in, out string, meta *pak.Metadata) {
+	r, err := pak.OpenReaderOptions(in, pakOptions)
+	if err != nil {
+		fatal(err)
+	}
+	defer r.Close()
+
+	if meta.SHA256, err = contentHash(pakContent(r)); err != nil {
+		fatal(err)
+	}
+
+	f := createOutput(out)
+	w, err := pak.NewWriterOptions(f, pakOptions)
+	if err != nil {
+		fatal(err)
+	}
+	for _, v := range r.File {
+		if v.Name == pak.MetadataName {
+			continue
+		}
+		if err := w.Copy(v); err != nil {
+			fatal(err)
+		}
+	}
+	if err := w.WriteMetadata(meta); err != nil {
+		fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		fatal(err)
+	}
+	r.Close()
+	commitOutput(f)
+}
+
+func stampZip(in, out string, meta *pak.Metadata) {
+	r, err := zip.OpenReader(in)
+	if err != nil {
+		fatal(err)
+	}
+	defer r.Close()
+
+	if meta.SHA256, err = contentHash(zipContent(r)); err != nil {
+		fatal(err)
+	}
+	comment, err := meta.Comment()
+	if err != nil {
+		fatal(err)
+	}
+
+	f := createOutput(out)
+	w := zip.NewWriter(f)
+	for _, v := range r.File {
+		// copies compressed data as is
+		if err := w.Copy(v); err != nil {
+			fatal(err)
+		}
+	}
+	if err := w.SetComment(comment); err != nil {
+		fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		fatal(err)
+	}
+	r.Close()
+	commitOutput(f)
+}
+
+func stamp() {
+	in, out := input(0), args[0]
+	if len(args) > 1 {
+		out = args[1]
+	}
+	meta := &pak.Metadata{
+		Creator: stampCreator,
+		Created: time.Now().UTC().Truncate(time.Second),
+		Version: stampVersion,
+	}
+	if isPkz(in) {
+		stampZip(in, out, meta)
+	} else {
+		stampPak(in, out, meta)
+	}
+}
+
+func info() {
+	var meta *pak.Metadata
+	var sum string
+	if isPkz(input(0)) {
+		r, err := zip.OpenReader(input(0))
+		if err != nil {
+			fatal(err)
+		}
+		defer r.Close()
+		if meta, err = pak.MetadataFromComment(r.Comment); err != nil {
+			fatal(err)
+		}
+		if sum, err = contentHash(zipContent(r)); err != nil {
+			fatal(err)
+		}
+	} else {
+		r, err := pak.OpenReaderOptions(input(0), pakOptions)
+		if err != nil {
+			fatal(err)
+		}
+		defer r.Close()
+		if meta, err = r.Metadata(); err != nil {
+			fatal(err)
+		}
+		if sum, err = contentHash(pakContent(r)); err != nil {
+			fatal(err)
+		}
+	}
+
+	if meta == nil {
+		fmt.Println("no metadata")
+		fmt.Printf("content: %s\n", sum)
+		return
+	}
+	fmt.Printf("creator: %s\n", meta.Creator)
+	fmt.Printf("created: %s\n", meta.Created.Format(time.RFC3339))
+	fmt.Printf("version: %s\n", meta.Version)
+	fmt.Printf("sha256:  %s\n", meta.SHA256)
+	if !strings.EqualFold(meta.SHA256, sum) {
+		fmt.Printf("content: %s (modified since stamped)\n", sum)
+		exit(1)
+	}
+	fmt.Println("content: matches")
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+var (
+	noClobber bool
+
+	// temporary copy of archive read from standard input
+	stdinPath string
+
+	// temporary files not yet renamed to their final names
+	tempFiles      = make(map[*os.File]string)
+	tempFilesMutex sync.Mutex
+)
+
+// creates temporary file in the directory of output file name. Once fully
+// written, it must be passed to commitOutput to replace the output file.
+// This way interrupted run never leaves truncated output behind. Name "-"
+// means standard output.
+func createOutput(name string) *os.File {
+	if name == "-" {
+		return createStdout()
+	}
+	if noClobber {
+		if _, err := os.Lstat(name); err == nil {
+			fatal(&fs.PathError{Op: "create", Path: name, Err: fs.ErrExist})
+		}
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*.tmp")
+	if err != nil {
+		fatal(err)
+	}
+	tempFilesMutex.Lock()
+	tempFiles[f] = name
+	tempFilesMutex.Unlock()
+	return f
+}
+
+func commitOutput(f *os.File) {
+	tempFilesMutex.Lock()
+	name := tempFiles[f]
+	tempFilesMutex.Unlock()
+
+	if name == "-" {
+		commitStdout(f)
+		return
+	}
+	if err := f.Sync(); err != nil {
+		fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		fatal(err)
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		fatal(err)
+	}
+	if noClobber {
+		// unlike rename, link fails if output was created meanwhile
+		if err := os.Link(f.Name(), name); err != nil {
+			fatal(err)
+		}
+		os.Remove(f.Name())
+	} else if err := os.Rename(f.Name(), name); err != nil {
+		fatal(err)
+	}
+
+	tempFilesMutex.Lock()
+	delete(tempFiles, f)
+	tempFilesMutex.Unlock()
+}
+
+func removeTempFiles() {
+	tempFilesMutex.Lock()
+	defer tempFilesMutex.Unlock()
+	for f := range tempFiles {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	tempFiles = make(map[*os.File]string)
+}
+
+// archives can't be written sequentially, so output to stdout is written to
+// temporary file first, then copied by commitOutput
+func createStdout() *os.File {
+	f, err := os.CreateTemp("", "pakutil-*.tmp")
+	if err != nil {
+		fatal(err)
+	}
+	tempFilesMutex.Lock()
+	tempFiles[f] = "-"
+	tempFilesMutex.Unlock()
+	return f
+}
+
+func commitStdout(f *os.File) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		fatal(err)
+	}
+	if _, err := io.Copy(os.Stdout, f); err != nil {
+		fatal(err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	tempFilesMutex.Lock()
+	delete(tempFiles, f)
+	tempFilesMutex.Unlock()
+}
+
+// returns path of input archive given by argument i. Archives can't be read
+// sequentially, so "-" is spooled from stdin to temporary file, which is
+// given .pak or .pkz extension depending on its contents.
+func input(i int) string {
+	if args[i] != "-" {
+		return args[i]
+	}
+	if len(stdinPath) > 0 {
+		return stdinPath
+	}
+
+	r := bufio.NewReader(os.Stdin)
+	ext := ".pak"
+	if magic, _ := r.Peek(2); string(magic) == "PK" {
+		ext = ".pkz"
+	}
+	f, err := os.CreateTemp("", "pakutil-*"+ext)
+	if err != nil {
+		fatal(err)
+	}
+	tempFilesMutex.Lock()
+	tempFiles[f] = ""
+	tempFilesMutex.Unlock()
+	if _, err := io.Copy(f, r); err != nil {
+		fatal(err)
+	}
+	stdinPath = f.Name()
+	return stdinPath
+}
+
+// like os.Exit, but removes temporary files first
+func exit(code int) {
+	removeTempFiles()
+	os.Exit(code)
+}
+
+// like log.Fatal, but removes temporary files first
+func fatal(v ...any) {
+	removeTempFiles()
+	log.Fatal(v...)
+}
+
+// removes temporary files when interrupted
+func handleSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		removeTempFiles()
+		fmt.Fprintln(os.Stderr, sig)
+		os.Exit(1)
+	}()
+}
@@ -2,61 +2,54 @@ package main
 
 import (
 	"archive/zip"
+	"bytes"
+	"compress/flate"
 	"errors"
 	"fmt"
 	"github.com/skullernet/pakserve/pak"
+	"github.com/skullernet/pakserve/pakfs"
+	"hash/crc32"
 	"io"
 	"io/fs"
 	"log"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 )
 
 var (
-	args []string
-)
+	args       []string
+	pakOptions pak.Options
 
-func usage() {
-	log.Printf("Usage: %s <cmd> [args]", os.Args[0])
-	log.Println("  -l <pak>        | list pak contents")
-	log.Println("  -c <pak> <dir>  | create pak from dir")
-	log.Println("  -x <pak> <dir>  | extract pak into dir")
-	log.Println("  -z <pak> <pkz>  | convert pak to pkz")
-	log.Println("  -u <pkz> <pak>  | convert pkz to pak")
-	os.Exit(1)
-}
+	zipLevel   = flate.DefaultCompression
+	zipStore   = ".jpg,.png,.ogg,.mp3,.zip,.pkz,.gz"
+	zipAllow64 bool
+)
 
-func list() {
-	if len(args) != 1 {
-		usage()
-	}
-	pak, err := pak.OpenReader(args[0])
+func verify() {
+	pak, err := pak.OpenReaderOptions(input(0), pakOptions)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 	defer pak.Close()
 
-	size := uint32(0)
-	for _, f := range pak.File {
-		fmt.Printf("%9d  %s\n", f.Filelen, f.Name)
-		size += f.Filelen
-	}
-	fmt.Println("---------  ---------")
-	fmt.Printf("%9d  %d files\n", size, len(pak.File))
-}
-
-func create() {
-	if len(args) != 2 {
-		usage()
+	findings := pak.Validate()
+	for _, f := range findings {
+		fmt.Println(f)
 	}
-	pak, err := pak.OpenWriter(args[0])
-	if err != nil {
-		log.Fatal(err)
+	if len(findings) > 0 {
+		pak.Close()
+		exit(1)
 	}
+}
 
-	err = filepath.WalkDir(args[1], func(path string, d fs.DirEntry, err error) error {
+// calls fn for each regular file in dir with its pak name
+func walkFiles(dir string, fn func(name, path string) error) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
@@ -64,30 +57,287 @@ func create() {
 			return nil
 		}
 
-		rel, err := filepath.Rel(args[1], path)
+		rel, err := filepath.Rel(dir, path)
 		if err != nil {
 			return err
 		}
-		if err = pak.Create(fsToPak(rel)); err != nil {
-			return err
+		return fn(fsToPak(rel), path)
+	})
+}
+
+func create() {
+	if _, err := os.Stat(args[1]); err != nil {
+		fatal(err)
+	}
+	b := pak.NewBuilderOptions(pakOptions)
+	if err := b.AddFS(os.DirFS(args[1])); err != nil {
+		fatal(err)
+	}
+	out := createOutput(args[0])
+	if err := b.Write(out); err != nil {
+		fatal(err)
+	}
+	commitOutput(out)
+}
+
+// zip.Writer that refuses to produce ZIP64 archive unless allowed, since some
+// clients can't load them
+type zipWriter struct {
+	*zip.Writer
+	count *countWriter
+	files int
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+var errZip64 = errors.New("archive needs ZIP64 extensions, use -zip64 to allow them")
+
+func newZipWriter(w io.Writer) *zipWriter {
+	c := &countWriter{w: w}
+	return &zipWriter{Writer: zip.NewWriter(c), count: c}
+}
+
+func (zw *zipWriter) check() error {
+	zw.files++
+	if zipAllow64 {
+		return nil
+	}
+	if err := zw.Flush(); err != nil {
+		return err
+	}
+	if zw.count.n >= math.MaxUint32 || zw.files >= math.MaxUint16 {
+		return errZip64
+	}
+	return nil
+}
+
+func (zw *zipWriter) Copy(f *zip.File) error {
+	if err := zw.Writer.Copy(f); err != nil {
+		return err
+	}
+	return zw.check()
+}
+
+func deflate(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, zipLevel)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// files that are already compressed are stored, not deflated. So are files
+// that don't get smaller when deflated.
+func isCompressed(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	for _, v := range strings.Split(zipStore, ",") {
+		if len(ext) > 0 && strings.EqualFold(strings.TrimSpace(v), ext) {
+			return true
 		}
+	}
+	return false
+}
 
-		f, err := os.Open(path)
-		if err != nil {
+// adds file to zip, deflating it unless that doesn't help
+func (zw *zipWriter) add(name string, data []byte, modTime time.Time) error {
+	header := &zip.FileHeader{
+		Name:               name,
+		Method:             zip.Store,
+		CRC32:              crc32.ChecksumIEEE(data),
+		UncompressedSize64: uint64(len(data)),
+	}
+	// CreateRaw doesn't fill in MS-DOS time from Modified
+	header.SetModTime(modTime)
+	raw := data
+	if zipLevel != flate.NoCompression && !isCompressed(name) {
+		if b, err := deflate(data); err != nil {
 			return err
+		} else if len(b) < len(data) {
+			header.Method = zip.Deflate
+			raw = b
 		}
-		defer f.Close()
+	}
+	header.CompressedSize64 = uint64(len(raw))
+
+	w, err := zw.CreateRaw(header)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(raw); err != nil {
+		return err
+	}
+	return zw.check()
+}
 
-		_, err = io.Copy(pak, f)
+// adds file at path to zip under given name
+func (zw *zipWriter) addFile(name, path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
 		return err
+	}
+	return zw.add(name, data, fi.ModTime())
+}
+
+func createZip() {
+	out := createOutput(args[0])
+	zw := newZipWriter(out)
+	err := walkFiles(args[1], func(name, path string) error {
+		return zw.addFile(name, path)
 	})
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+	if err = zw.Close(); err != nil {
+		fatal(err)
+	}
+	commitOutput(out)
+}
+
+// file to be added to existing archive
+type addFile struct {
+	name string
+	path string
+}
+
+// returns files given by add command arguments: single file, or all files
+// under directory, optionally stored under name or name prefix
+func addFiles() []addFile {
+	var prefix string
+	if len(args) > 2 {
+		prefix = args[2]
+	}
+
+	fi, err := os.Stat(args[1])
+	if err != nil {
+		fatal(err)
+	}
+	if !fi.IsDir() {
+		if len(prefix) == 0 {
+			prefix = filepath.Base(args[1])
+		}
+		name := pak.NormalizeName(prefix)
+		if len(name) == 0 {
+			fatal(&fs.PathError{Op: "add", Path: prefix, Err: fs.ErrInvalid})
+		}
+		return []addFile{{name, args[1]}}
 	}
 
-	if err = pak.Close(); err != nil {
-		log.Fatal(err)
+	var files []addFile
+	err = walkFiles(args[1], func(name, path string) error {
+		name = pak.NormalizeName(prefix + "/" + name)
+		if len(name) == 0 {
+			return &fs.PathError{Op: "add", Path: path, Err: fs.ErrInvalid}
+		}
+		files = append(files, addFile{name, path})
+		return nil
+	})
+	if err != nil {
+		fatal(err)
+	}
+	return files
+}
+
+func add() {
+	files := addFiles()
+	if isPkz(input(0)) {
+		addZip(files)
+	} else {
+		addPak(files)
+	}
+}
+
+// updates copy of pak, so that input is left intact if update fails midway
+func addPak(files []addFile) {
+	out := createOutput(args[0])
+	in, err := os.Open(input(0))
+	if err != nil {
+		fatal(err)
+	}
+	_, err = io.Copy(out, in)
+	in.Close()
+	if err != nil {
+		fatal(err)
+	}
+
+	w, err := pak.OpenUpdaterOptions(out.Name(), pakOptions)
+	if err != nil {
+		fatal(err)
+	}
+	for _, v := range files {
+		f, err := os.Open(v.path)
+		if err != nil {
+			fatal(err)
+		}
+		if err := w.Create(v.name); err != nil {
+			fatal(err)
+		}
+		_, err = io.Copy(w, f)
+		f.Close()
+		if err != nil {
+			fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		fatal(err)
+	}
+	commitOutput(out)
+}
+
+func addZip(files []addFile) {
+	r, err := zip.OpenReader(input(0))
+	if err != nil {
+		fatal(err)
+	}
+	defer r.Close()
+
+	replaced := make(map[string]bool)
+	for _, v := range files {
+		replaced[v.name] = true
+	}
+
+	out := createOutput(args[0])
+	zw := newZipWriter(out)
+	for _, f := range r.File {
+		if replaced[pakToFs(f.Name)] {
+			continue
+		}
+		if err := zw.Copy(f); err != nil {
+			fatal(err)
+		}
+	}
+	for _, v := range files {
+		if err := zw.addFile(v.name, v.path); err != nil {
+			fatal(err)
+		}
+	}
+	if err := zw.SetComment(r.Comment); err != nil {
+		fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		fatal(err)
 	}
+	r.Close()
+	commitOutput(out)
 }
 
 func fsToPak(n string) string {
@@ -102,12 +352,9 @@ func pakToFs(n string) string {
 }
 
 func extract() {
-	if len(args) != 2 {
-		usage()
-	}
-	pak, err := pak.OpenReader(args[0])
+	pak, err := pak.OpenReaderOptions(input(0), pakOptions)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 	defer pak.Close()
 
@@ -120,71 +367,303 @@ func extract() {
 		path = filepath.Join(args[1], path)
 
 		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil && !errors.Is(err, os.ErrExist) {
-			log.Fatal(err)
+			fatal(err)
 		}
 
 		out, err := os.Create(path)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 
 		_, err = io.CopyN(out, f.Open(), int64(f.Filelen))
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 		if err = out.Close(); err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 	}
 }
 
 func compress() {
-	if len(args) != 2 {
-		usage()
+	r, err := pak.OpenReaderOptions(input(0), pakOptions)
+	if err != nil {
+		fatal(err)
 	}
-	pak, err := pak.OpenReader(args[0])
+	defer r.Close()
+
+	fi, err := os.Stat(input(0))
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
-	defer pak.Close()
 
-	out, err := os.Create(args[1])
+	// metadata entry becomes archive comment, like stamp writes it for pkz
+	meta, err := r.Metadata()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
-	zip := zip.NewWriter(out)
-	for _, f := range pak.File {
-		w, err := zip.Create(f.Name)
+	out := createOutput(args[1])
+	zw := newZipWriter(out)
+	for _, f := range r.File {
+		if f.Name == pak.MetadataName {
+			continue
+		}
+		data := make([]byte, f.Filelen)
+		if _, err := io.ReadFull(f.Open(), data); err != nil {
+			fatal(err)
+		}
+		if err := zw.add(f.Name, data, fi.ModTime()); err != nil {
+			fatal(err)
+		}
+	}
+	if meta != nil {
+		comment, err := meta.Comment()
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
+		}
+		if err := zw.SetComment(comment); err != nil {
+			fatal(err)
 		}
-		_, err = io.CopyN(w, f.Open(), int64(f.Filelen))
+	}
+	if err = zw.Close(); err != nil {
+		fatal(err)
+	}
+	commitOutput(out)
+}
+
+// flattens paks, pkzs and directories into single pak, later inputs
+// overriding earlier ones like packfiles loaded later do in game
+func merge() {
+	inputs := make([]string, 0, len(args)-1)
+	for i := len(args) - 1; i > 0; i-- {
+		inputs = append(inputs, input(i))
+	}
+	fsys, err := pakfs.OpenOptions(pakOptions, inputs...)
+	if err != nil {
+		fatal(err)
+	}
+	defer fsys.Close()
+
+	// collect names before creating output, which may be in one of input dirs
+	names := make(map[string]string)
+	err = fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
 		if err != nil {
-			log.Fatal(err)
+			return err
+		}
+		if d.Type()&fs.ModeType != 0 || pakfs.IsPackfile(name) {
+			return nil
+		}
+		if norm := pak.NormalizeName(name); len(names[norm]) == 0 {
+			names[norm] = name
 		}
+		return nil
+	})
+	if err != nil {
+		fatal(err)
 	}
-	if err = zip.Close(); err != nil {
-		log.Fatal(err)
+
+	sorted := make([]string, 0, len(names))
+	for norm := range names {
+		sorted = append(sorted, norm)
 	}
-	if err = out.Close(); err != nil {
-		log.Fatal(err)
+	sort.Strings(sorted)
+
+	out := createOutput(args[0])
+	w, err := pak.NewWriterOptions(out, pakOptions)
+	if err != nil {
+		fatal(err)
 	}
+	for _, norm := range sorted {
+		f, err := fsys.Open(names[norm])
+		if err != nil {
+			fatal(err)
+		}
+		if err := w.Create(norm); err != nil {
+			fatal(err)
+		}
+		_, err = io.Copy(w, f)
+		f.Close()
+		if err != nil {
+			fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		fatal(err)
+	}
+	fsys.Close()
+	commitOutput(out)
 }
 
-func uncompress() {
-	if len(args) != 2 {
-		usage()
+// returns files of archive or directory at path by normalized name
+func diffSource(path string) (*pakfs.FS, map[string]string) {
+	fsys, err := pakfs.OpenOptions(pakOptions, path)
+	if err != nil {
+		fatal(err)
+	}
+	names := make(map[string]string)
+	err = fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type()&fs.ModeType != 0 {
+			return nil
+		}
+		if norm := pak.NormalizeName(name); len(names[norm]) == 0 {
+			names[norm] = name
+		}
+		return nil
+	})
+	if err != nil {
+		fatal(err)
+	}
+	return fsys, names
+}
+
+// compares sizes and CRCs of ZIP entries first, then contents
+func sameFile(a, b fs.FS, nameA, nameB string) (bool, error) {
+	fa, err := fs.Stat(a, nameA)
+	if err != nil {
+		return false, err
+	}
+	fb, err := fs.Stat(b, nameB)
+	if err != nil {
+		return false, err
+	}
+	if fa.Size() != fb.Size() {
+		return false, nil
 	}
-	zip, err := zip.OpenReader(args[0])
+	za, ok1 := fa.Sys().(*zip.File)
+	zb, ok2 := fb.Sys().(*zip.File)
+	if ok1 && ok2 && za.CRC32 != zb.CRC32 {
+		return false, nil
+	}
+
+	ra, err := a.Open(nameA)
 	if err != nil {
-		log.Fatal(err)
+		return false, err
+	}
+	defer ra.Close()
+	rb, err := b.Open(nameB)
+	if err != nil {
+		return false, err
+	}
+	defer rb.Close()
+
+	bufA := make([]byte, 32*1024)
+	bufB := make([]byte, len(bufA))
+	for {
+		n, errA := io.ReadFull(ra, bufA)
+		_, errB := io.ReadFull(rb, bufB[:n])
+		if errA != nil && errA != io.EOF && errA != io.ErrUnexpectedEOF {
+			return false, errA
+		}
+		if errB != nil && errB != io.EOF {
+			return false, errB
+		}
+		if !bytes.Equal(bufA[:n], bufB[:n]) {
+			return false, nil
+		}
+		if n < len(bufA) {
+			return true, nil
+		}
+	}
+}
+
+func diff() {
+	fsA, namesA := diffSource(input(0))
+	defer fsA.Close()
+	fsB, namesB := diffSource(input(1))
+	defer fsB.Close()
+
+	all := make([]string, 0, len(namesA)+len(namesB))
+	for norm := range namesA {
+		all = append(all, norm)
+	}
+	for norm := range namesB {
+		if len(namesA[norm]) == 0 {
+			all = append(all, norm)
+		}
+	}
+	sort.Strings(all)
+
+	changed := false
+	for _, norm := range all {
+		nameA, nameB := namesA[norm], namesB[norm]
+		switch {
+		case len(nameB) == 0:
+			fmt.Printf("-  %s\n", norm)
+		case len(nameA) == 0:
+			fmt.Printf("+  %s\n", norm)
+		default:
+			same, err := sameFile(fsA, fsB, nameA, nameB)
+			if err != nil {
+				fatal(err)
+			}
+			if same {
+				continue
+			}
+			fmt.Printf("M  %s\n", norm)
+		}
+		changed = true
+	}
+	if changed {
+		exit(1)
+	}
+}
+
+// rewrites pak without named files, which also drops any dead space
+func deleteFiles() {
+	r, err := pak.OpenReaderOptions(input(0), pakOptions)
+	if err != nil {
+		fatal(err)
+	}
+	defer r.Close()
+
+	remove := make(map[string]bool)
+	for _, v := range args[1:] {
+		remove[pakToFs(v)] = false
+	}
+
+	out := createOutput(args[0])
+	w, err := pak.NewWriterOptions(out, pakOptions)
+	if err != nil {
+		fatal(err)
+	}
+	for _, f := range r.File {
+		name := pakToFs(f.Name)
+		if _, ok := remove[name]; ok {
+			remove[name] = true
+			continue
+		}
+		if err := w.Copy(f); err != nil {
+			fatal(err)
+		}
+	}
+	for _, v := range args[1:] {
+		if !remove[pakToFs(v)] {
+			fatal(&fs.PathError{Op: "delete", Path: v, Err: fs.ErrNotExist})
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		fatal(err)
+	}
+	r.Close()
+	commitOutput(out)
+}
+
+func uncompress() {
+	zip, err := zip.OpenReader(input(0))
+	if err != nil {
+		fatal(err)
 	}
 	defer zip.Close()
 
-	pak, err := pak.OpenWriter(args[1])
+	out := createOutput(args[1])
+	pak, err := pak.NewWriterOptions(out, pakOptions)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
 	for _, f := range zip.File {
@@ -192,44 +671,54 @@ func uncompress() {
 			continue
 		}
 		if err = pak.Create(f.Name); err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 		r, err := f.Open()
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 		_, err = io.CopyN(pak, r, int64(f.UncompressedSize64))
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 		r.Close()
 	}
 
 	if err = pak.Close(); err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
+	commitOutput(out)
 }
 
 func main() {
 	log.SetFlags(0)
 
-	if len(os.Args) < 2 {
-		usage()
+	cmd := os.Args[1:]
+	for len(cmd) > 0 && strings.HasPrefix(cmd[0], "--") {
+		switch cmd[0] {
+		case "--overwrite":
+			noClobber = false
+		case "--no-clobber":
+			noClobber = true
+		case "--extended":
+			pakOptions.Extended = true
+		case "--offsets64":
+			pakOptions.Offsets64 = true
+		case "--help":
+			usage()
+		default:
+			usageError(nil, "unknown option %q", cmd[0])
+		}
+		cmd = cmd[1:]
 	}
-
-	args = os.Args[2:]
-	switch os.Args[1] {
-	case "-l":
-		list()
-	case "-c":
-		create()
-	case "-x":
-		extract()
-	case "-z":
-		compress()
-	case "-u":
-		uncompress()
-	default:
+	if len(cmd) < 1 {
 		usage()
 	}
+	c := findCommand(cmd[0])
+	if c == nil {
+		usageError(nil, "unknown command %q", cmd[0])
+	}
+	handleSignals()
+	runCommand(c, cmd[1:])
+	removeTempFiles()
 }
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/skullernet/pakserve/pak"
+)
+
+// test binary runs pakutil itself when this variable is set, so that
+// commands calling os.Exit can be tested in child process
+const mainEnv = "PAKUTIL_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(mainEnv) == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runs pakutil with given arguments and standard input, returns its standard
+// output and exit code. Fails test if pakutil leaves temporary files behind.
+func pakutil(t *testing.T, stdin []byte, args ...string) ([]byte, int) {
+	t.Helper()
+	tmp := t.TempDir()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), mainEnv+"=1", "TMPDIR="+tmp)
+	cmd.Stdin = bytes.NewReader(stdin)
+	out, err := cmd.Output()
+	if list, _ := os.ReadDir(tmp); len(list) > 0 {
+		t.Errorf("%v: temporary files left", args)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return out, exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out, 0
+}
+
+// like pakutil, but fails test unless command succeeds
+func mustRun(t *testing.T, args ...string) []byte {
+	t.Helper()
+	out, code := pakutil(t, nil, args...)
+	if code != 0 {
+		t.Fatalf("%v: exit code %d", args, code)
+	}
+	return out
+}
+
+func writeTestPak(t *testing.T, name string, files map[string]string) {
+	t.Helper()
+	b := pak.NewBuilder()
+	for k, v := range files {
+		if err := b.AddBytes(k, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.WriteFile(name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func zipNames(t *testing.T, name string) ([]string, string) {
+	t.Helper()
+	r, err := zip.OpenReader(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	return names, r.Comment
+}
+
+func TestCompressMetadata(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "test.pak")
+	writeTestPak(t, name, map[string]string{"maps/test.bsp": "test"})
+	mustRun(t, "stamp", "-creator", "tester", name)
+
+	pkz := filepath.Join(dir, "test.pkz")
+	mustRun(t, "-z", name, pkz)
+	names, comment := zipNames(t, pkz)
+	if len(names) != 1 || names[0] != "maps/test.bsp" {
+		t.Fatalf("unexpected pkz entries %q", names)
+	}
+	meta, err := pak.MetadataFromComment(comment)
+	if err != nil || meta == nil || meta.Creator != "tester" {
+		t.Fatalf("metadata not moved to comment: %q", comment)
+	}
+	if out, code := pakutil(t, nil, "info", pkz); code != 0 {
+		t.Fatalf("info exit code %d: %s", code, out)
+	}
+}
+
+// returns names and contents of files in pak
+func readTestPak(t *testing.T, name string) map[string]string {
+	t.Helper()
+	r, err := pak.OpenReader(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	files := make(map[string]string)
+	for _, f := range r.File {
+		b, err := io.ReadAll(f.Open())
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(b)
+	}
+	return files
+}
+
+func TestAddPak(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "test.pak")
+	writeTestPak(t, name, map[string]string{"maps/test.bsp": "test"})
+	before, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// failed update leaves pak and directory as they were
+	long := filepath.Join(dir, "data")
+	if err := os.WriteFile(long, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, code := pakutil(t, nil, "add", name, long, strings.Repeat("x", pak.MaxFileName+1)); code == 0 {
+		t.Fatal("too long name accepted")
+	}
+	if after, err := os.ReadFile(name); err != nil || !bytes.Equal(after, before) {
+		t.Fatal("pak changed by failed update")
+	}
+	if list, _ := os.ReadDir(dir); len(list) != 2 {
+		t.Fatalf("unexpected %d files left", len(list))
+	}
+
+	mustRun(t, "add", name, long, "maps/data.txt")
+	files := readTestPak(t, name)
+	if len(files) != 2 || files["maps/test.bsp"] != "test" || files["maps/data.txt"] != "data" {
+		t.Fatalf("unexpected files %q", files)
+	}
+}
+
+func TestMergeStdin(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.pak"), filepath.Join(dir, "b.pak")
+	writeTestPak(t, a, map[string]string{"maps/a.bsp": "a", "maps/same.bsp": "a"})
+	writeTestPak(t, b, map[string]string{"maps/b.bsp": "b", "maps/same.bsp": "b"})
+	data, err := os.ReadFile(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(dir, "out.pak")
+	if _, code := pakutil(t, data, "merge", out, a, "-"); code != 0 {
+		t.Fatalf("merge exit code %d", code)
+	}
+	files := readTestPak(t, out)
+	if len(files) != 3 || files["maps/same.bsp"] != "b" {
+		t.Fatalf("unexpected files %q", files)
+	}
+}
+
+func TestListTotals(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.pak")
+	writeTestPak(t, name, map[string]string{"maps/a.bsp": "a", "maps/b.bsp": strings.Repeat("b", 1000)})
+
+	for _, long := range []bool{false, true} {
+		args := []string{"list", name}
+		if long {
+			args = []string{"list", "-long", name}
+		}
+		lines := strings.Split(strings.TrimSuffix(string(mustRun(t, args...)), "\n"), "\n")
+		if len(lines) != 4 {
+			t.Fatalf("unexpected listing:\n%s", strings.Join(lines, "\n"))
+		}
+		// right edge of size column
+		end := strings.Index(lines[1], "1000") + 4
+		if !strings.HasSuffix(lines[2][:end], "---------") || !strings.HasSuffix(lines[3][:end], " 1001") {
+			t.Errorf("totals not aligned with sizes:\n%s", strings.Join(lines, "\n"))
+		}
+	}
+}
+
+func TestAtomicOutput(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "test.pak")
+	writeTestPak(t, name, map[string]string{"maps/a.bsp": "a"})
+	before, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// output is written to temporary file, which is removed on failure
+	if _, code := pakutil(t, nil, "delete", name, "maps/missing.bsp"); code == 0 {
+		t.Fatal("missing file deleted")
+	}
+	if after, err := os.ReadFile(name); err != nil || !bytes.Equal(after, before) {
+		t.Fatal("output changed by failed command")
+	}
+	if list, _ := os.ReadDir(dir); len(list) != 1 {
+		t.Fatalf("unexpected %d files left", len(list))
+	}
+}
+
+func TestNoClobber(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "maps"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "maps", "a.bsp"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "test.pak")
+	if err := os.WriteFile(name, []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, code := pakutil(t, nil, "--no-clobber", "create", name, src); code == 0 {
+		t.Fatal("existing output replaced")
+	}
+	if b, _ := os.ReadFile(name); string(b) != "keep" {
+		t.Fatal("existing output changed")
+	}
+	mustRun(t, "--no-clobber", "create", filepath.Join(dir, "new.pak"), src)
+	mustRun(t, "--overwrite", "create", name, src)
+	if files := readTestPak(t, name); files["maps/a.bsp"] != "a" {
+		t.Fatalf("unexpected files %q", files)
+	}
+}
+
+func TestStdio(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "test.pak")
+	writeTestPak(t, name, map[string]string{"maps/a.bsp": "a"})
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "b.txt")
+	if err := os.WriteFile(file, []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// pak from stdin updated to stdout
+	out, code := pakutil(t, data, "add", "-", file, "maps/b.txt")
+	if code != 0 {
+		t.Fatalf("add exit code %d", code)
+	}
+	if err := os.WriteFile(name, out, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if files := readTestPak(t, name); len(files) != 2 || files["maps/b.txt"] != "b" {
+		t.Fatalf("unexpected files %q", files)
+	}
+
+	// pkz detected on stdin
+	pkz := filepath.Join(dir, "test.pkz")
+	mustRun(t, "compress", name, pkz)
+	data, err = os.ReadFile(pkz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, code = pakutil(t, data, "list", "-")
+	if code != 0 || !strings.Contains(string(out), "maps/b.txt") {
+		t.Fatalf("unexpected listing %d:\n%s", code, out)
+	}
+}
+
+func TestAddDelete(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "new.txt")
+	if err := os.WriteFile(file, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.Join(dir, "test.pak")
+	writeTestPak(t, name, map[string]string{"maps/a.bsp": "a", "maps/b.bsp": "b"})
+	mustRun(t, "add", name, file, "maps/A.bsp")
+	mustRun(t, "add", name, file, "maps/c.txt")
+	mustRun(t, "delete", name, "MAPS/B.BSP")
+	files := readTestPak(t, name)
+	if len(files) != 2 || files["maps/a.bsp"] != "new" || files["maps/c.txt"] != "new" {
+		t.Fatalf("unexpected pak files %q", files)
+	}
+
+	pkz := filepath.Join(dir, "test.pkz")
+	mustRun(t, "compress", name, pkz)
+	mustRun(t, "add", pkz, file, "maps/d.txt")
+	names, _ := zipNames(t, pkz)
+	if strings.Join(names, ",") != "maps/a.bsp,maps/c.txt,maps/d.txt" {
+		t.Fatalf("unexpected pkz files %q", names)
+	}
+}
+
+func TestMergePrecedence(t *testing.T) {
+	dir := t.TempDir()
+	mod := filepath.Join(dir, "mod")
+	if err := os.MkdirAll(filepath.Join(mod, "maps"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{"maps/loose.bsp": "loose", "maps/only.bsp": "loose"} {
+		if err := os.WriteFile(filepath.Join(mod, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestPak(t, filepath.Join(mod, "pak0.pak"), map[string]string{"maps/loose.bsp": "pak0", "maps/b.bsp": "pak0"})
+	base := filepath.Join(dir, "base.pak")
+	writeTestPak(t, base, map[string]string{"maps/a.bsp": "base", "maps/b.bsp": "base"})
+
+	out := filepath.Join(dir, "out.pak")
+	mustRun(t, "merge", out, base, mod)
+	want := map[string]string{
+		"maps/a.bsp":     "base",  // only in earlier path
+		"maps/b.bsp":     "pak0",  // later path overrides
+		"maps/loose.bsp": "pak0",  // packfile overrides loose file of its directory
+		"maps/only.bsp":  "loose", // loose file is kept
+	}
+	if files := readTestPak(t, out); !reflect.DeepEqual(files, want) {
+		t.Fatalf("unexpected files %q", files)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.pak"), filepath.Join(dir, "b.pak")
+	writeTestPak(t, a, map[string]string{"maps/same.bsp": "same", "maps/changed.bsp": "a", "maps/removed.bsp": "a"})
+	writeTestPak(t, b, map[string]string{"MAPS/Same.bsp": "same", "maps/changed.bsp": "b", "maps/added.bsp": "b"})
+
+	out, code := pakutil(t, nil, "diff", a, a)
+	if code != 0 || len(out) != 0 {
+		t.Fatalf("identical paks: exit code %d, output %q", code, out)
+	}
+	out, code = pakutil(t, nil, "diff", a, b)
+	want := "+  maps/added.bsp\nM  maps/changed.bsp\n-  maps/removed.bsp\n"
+	if code != 1 || string(out) != want {
+		t.Fatalf("different paks: exit code %d, output %q", code, out)
+	}
+	if _, code := pakutil(t, nil, "diff", a, filepath.Join(dir, "missing.pak")); code != 1 {
+		t.Fatalf("missing path: exit code %d", code)
+	}
+}
+
+func TestListFormats(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.pak")
+	writeTestPak(t, name, map[string]string{"maps/a.bsp": "a", "maps/b.bsp": "bb"})
+
+	text := string(mustRun(t, "list", name))
+	if !strings.Contains(text, "        1  maps/a.bsp\n") || !strings.Contains(text, "        3  2 files\n") {
+		t.Errorf("unexpected text listing:\n%s", text)
+	}
+
+	var files []listFile
+	if err := json.Unmarshal(mustRun(t, "list", "-format", "json", name), &files); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[1].Name != "maps/b.bsp" || files[1].Size != 2 {
+		t.Errorf("unexpected json listing %+v", files)
+	}
+
+	records, err := csv.NewReader(bytes.NewReader(mustRun(t, "list", "-long", "-format", "csv", name))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || strings.Join(records[0], ",") != "name,size,offset,crc32,method,source,shadows" ||
+		records[1][0] != "maps/a.bsp" || records[1][4] != "store" {
+		t.Errorf("unexpected csv listing %q", records)
+	}
+
+	if _, code := pakutil(t, nil, "list", "-format", "xml", name); code != 2 {
+		t.Errorf("unknown format: exit code %d", code)
+	}
+}
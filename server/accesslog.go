@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+type accessLogRecord struct {
+	Time       string  `json:"time"`
+	Client     string  `json:"client"`
+	Host       string  `json:"host"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Proto      string  `json:"proto"`
+	SearchPath string  `json:"search_path,omitempty"`
+	Archive    string  `json:"archive,omitempty"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	Encoding   string  `json:"encoding,omitempty"`
+	Referer    string  `json:"referer,omitempty"`
+	UserAgent  string  `json:"user_agent,omitempty"`
+	Duration   float64 `json:"duration"`
+	CRC        string  `json:"crc,omitempty"`
+}
+
+// remembers packfile the response is served from, for access log
+func logArchive(w http.ResponseWriter, archive string) {
+	if wl, ok := w.(*loggingResponseWriter); ok {
+		wl.archive = archive
+	}
+}
+
+// writes access log record as a single line of JSON. Logger flags are
+// bypassed so that each line is valid JSON, the record has its own time.
+func logJSON(logger *log.Logger, wl *loggingResponseWriter, r *http.Request, start time.Time) {
+	rec := accessLogRecord{
+		Time:       start.UTC().Format(time.RFC3339Nano),
+		Client:     r.RemoteAddr,
+		Host:       r.Host,
+		Method:     r.Method,
+		Path:       r.RequestURI,
+		Proto:      r.Proto,
+		SearchPath: wl.searchPath,
+		Archive:    wl.archive,
+		Status:     wl.status,
+		Bytes:      wl.written,
+		Encoding:   wl.Header().Get("Content-Encoding"),
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+		Duration:   time.Since(start).Seconds(),
+	}
+	if wl.crc != nil {
+		rec.CRC = fmt.Sprintf("%08x", wl.crc.Sum32())
+	}
+	b, err := json.Marshal(&rec)
+	if err != nil {
+		log.Printf("ERROR: %s", err)
+		return
+	}
+	logger.Writer().Write(append(b, '\n'))
+}
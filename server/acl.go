@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"net/netip"
+)
+
+func validateACL(cfg *Config) error {
+	for _, list := range [][]string{cfg.AllowFrom, cfg.DenyFrom} {
+		for _, v := range list {
+			if _, err := parsePrefix(v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func compilePrefixes(list []string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, v := range list {
+		p, _ := parsePrefix(v)
+		prefixes = append(prefixes, p)
+	}
+	return prefixes
+}
+
+func compileACL(c *liveConfig) {
+	c.allowFrom = compilePrefixes(c.AllowFrom)
+	c.denyFrom = compilePrefixes(c.DenyFrom)
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// reports whether address passes allow and deny lists. Deny list takes
+// precedence.
+func aclCheck(allow, deny []netip.Prefix, addr netip.Addr) bool {
+	if containsAddr(deny, addr) {
+		return false
+	}
+	return len(allow) == 0 || containsAddr(allow, addr)
+}
+
+// reports whether client address passes global AllowFrom and DenyFrom lists
+// and those of listener profile
+func aclAllowed(r *http.Request) bool {
+	c := config()
+	p := profileFor(r)
+	if len(c.allowFrom)+len(c.denyFrom) == 0 && (p == nil || len(p.allowFrom)+len(p.denyFrom) == 0) {
+		return true
+	}
+	addr := clientAddr(r)
+	if !aclCheck(c.allowFrom, c.denyFrom, addr) {
+		return false
+	}
+	return p == nil || aclCheck(p.allowFrom, p.denyFrom, addr)
+}
@@ -0,0 +1,412 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// indexEntry describes packfile entry visible through search path
+type indexEntry struct {
+	archive string
+	offset  int64
+	size    uint64
+	crc     uint32
+}
+
+// maps search path name to quake paths visible through it
+type indexSnapshot map[string]map[string]indexEntry
+
+type indexDiff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+}
+
+var (
+	snapshots      = make(map[string]indexSnapshot)
+	snapshotsMutex sync.Mutex
+	matchAll       = []*regexp.Regexp{regexp.MustCompile("")}
+)
+
+// returns names of all compiled search paths along with their search lists,
+// tenant search path names are prefixed with tenant name.
+// Must be called with searchPathsMutex held.
+func allSearchPaths() map[string]*compiledSearchPath {
+	all := make(map[string]*compiledSearchPath)
+	for i := range searchPaths {
+		all[searchPaths[i].cfg.Name] = &searchPaths[i]
+	}
+	for _, t := range tenants {
+		for i := range t.searchPaths {
+			all[t.name+"/"+t.searchPaths[i].cfg.Name] = &t.searchPaths[i]
+		}
+	}
+	return all
+}
+
+func takeSnapshot() indexSnapshot {
+	searchPathsMutex.RLock()
+	defer searchPathsMutex.RUnlock()
+
+	snap := make(indexSnapshot)
+	for name, s := range allSearchPaths() {
+		files := make(map[string]indexEntry)
+		for path, sp := range s.visibleFiles(s.load(), matchAll, false) {
+			e, _ := sp.files.get(path)
+			size := e.filelen
+			if e.method == 0 {
+				size = e.size
+			}
+			files[path] = indexEntry{archive: sp.path, offset: e.offset, size: size, crc: e.filecrc}
+		}
+		snap[name] = files
+	}
+	return snap
+}
+
+// PAK entries have no CRC, so their location is compared instead
+func (e indexEntry) changed(o indexEntry) bool {
+	if e.size != o.size || e.crc != o.crc {
+		return true
+	}
+	return e.crc == 0 && (e.archive != o.archive || e.offset != o.offset)
+}
+
+func diffSnapshots(old, cur indexSnapshot) map[string]*indexDiff {
+	diffs := make(map[string]*indexDiff)
+	get := func(name string) *indexDiff {
+		d, ok := diffs[name]
+		if !ok {
+			d = &indexDiff{Added: []string{}, Removed: []string{}, Changed: []string{}}
+			diffs[name] = d
+		}
+		return d
+	}
+	for name, files := range cur {
+		d := get(name)
+		for path, e := range files {
+			if o, ok := old[name][path]; !ok {
+				d.Added = append(d.Added, path)
+			} else if e.changed(o) {
+				d.Changed = append(d.Changed, path)
+			}
+		}
+	}
+	for name, files := range old {
+		d := get(name)
+		for path := range files {
+			if _, ok := cur[name][path]; !ok {
+				d.Removed = append(d.Removed, path)
+			}
+		}
+	}
+	for _, d := range diffs {
+		sort.Strings(d.Added)
+		sort.Strings(d.Removed)
+		sort.Strings(d.Changed)
+	}
+	return diffs
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
+
+// POST /admin/snapshot?name=<name>
+func handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if len(name) == 0 {
+		http.Error(w, "missing snapshot name", http.StatusBadRequest)
+		return
+	}
+
+	snap := takeSnapshot()
+	snapshotsMutex.Lock()
+	snapshots[name] = snap
+	snapshotsMutex.Unlock()
+
+	files := 0
+	for _, v := range snap {
+		files += len(v)
+	}
+	writeJSON(w, map[string]interface{}{"name": name, "files": files})
+}
+
+// GET /admin/diff?name=<name>
+func handleDiff(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	snapshotsMutex.Lock()
+	old, ok := snapshots[name]
+	snapshotsMutex.Unlock()
+	if !ok {
+		http.Error(w, "no such snapshot", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, diffSnapshots(old, takeSnapshot()))
+}
+
+type banInfo struct {
+	Prefix  string     `json:"prefix"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// GET /admin/bans lists bans
+// POST /admin/bans?addr=<addr>[&duration=<duration>] adds ban
+// DELETE /admin/bans?addr=<addr> removes ban
+func handleBans(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		list := make([]banInfo, 0)
+		for _, b := range bans.list() {
+			info := banInfo{Prefix: b.prefix.String()}
+			if !b.expires.IsZero() {
+				info.Expires = &b.expires
+			}
+			list = append(list, info)
+		}
+		writeJSON(w, list)
+		return
+	}
+
+	b, err := parseBan(r.URL.Query().Get("addr"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case "POST":
+		if v := r.URL.Query().Get("duration"); len(v) > 0 {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(w, "bad duration", http.StatusBadRequest)
+				return
+			}
+			b.expires = time.Now().Add(d).Truncate(time.Second)
+		}
+		bans.add(b)
+		log.Printf("Banned %s", b)
+	case "DELETE":
+		if !bans.remove(b.prefix) {
+			http.Error(w, "no such ban", http.StatusNotFound)
+			return
+		}
+		log.Printf("Unbanned %s", b.prefix)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /admin/reload
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	log.Println("Reloading on admin request")
+	result := struct {
+		Reloaded bool   `json:"reloaded"`
+		Error    string `json:"error,omitempty"`
+		Revision int64  `json:"revision"`
+	}{Reloaded: true}
+	if err := reload(); err != nil {
+		result.Reloaded = false
+		result.Error = err.Error()
+	}
+	result.Revision = contentRevision.Load()
+	writeJSON(w, result)
+}
+
+// GET /admin/issues
+func handleIssues(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	searchPathsMutex.RLock()
+	issues := make(map[string][]string)
+	for _, s := range allSearchPaths() {
+		for _, sp := range s.load() {
+			if len(sp.issues) > 0 {
+				issues[sp.path] = sp.issues
+			}
+		}
+	}
+	searchPathsMutex.RUnlock()
+
+	writeJSON(w, issues)
+}
+
+type archiveStatus struct {
+	Path        string     `json:"path"`
+	Type        string     `json:"type"` // dir, pak or pkz
+	Files       int        `json:"files"`
+	Issues      int        `json:"issues"`
+	Size        int64      `json:"size,omitempty"`
+	Modified    *time.Time `json:"modified,omitempty"`
+	SHA256      string     `json:"sha256,omitempty"` // not set until hashed in background
+	Quarantined bool       `json:"quarantined,omitempty"`
+}
+
+type searchPathStatus struct {
+	Name     string          `json:"name"`
+	Match    string          `json:"match"`
+	Lazy     bool            `json:"lazy,omitempty"`
+	Scanned  *time.Time      `json:"scanned,omitempty"` // not set if lazy search path wasn't scanned yet
+	Files    int             `json:"files"`
+	Archives []archiveStatus `json:"archives"`
+}
+
+type memoryStatus struct {
+	Alloc      uint64 `json:"alloc"`
+	Sys        uint64 `json:"sys"`
+	HeapInuse  uint64 `json:"heap_inuse"`
+	NumGC      uint32 `json:"num_gc"`
+	Goroutines int    `json:"goroutines"`
+}
+
+type adminStatus struct {
+	Phase           string             `json:"phase"`
+	Started         time.Time          `json:"started"`
+	Revision        string             `json:"revision"`
+	ActiveTransfers int64              `json:"active_transfers"`
+	LastScan        *ScanResult        `json:"last_scan,omitempty"`
+	SearchPaths     []searchPathStatus `json:"search_paths"`
+	Cache           cacheStats         `json:"cache"`
+	OpenFiles       int                `json:"open_files"`
+	Memory          memoryStatus       `json:"memory"`
+}
+
+func searchPathStatuses() []searchPathStatus {
+	searchPathsMutex.RLock()
+	defer searchPathsMutex.RUnlock()
+
+	all := allSearchPaths()
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := make([]searchPathStatus, 0, len(all))
+	for _, name := range names {
+		c := all[name]
+		search, scanned := c.peek()
+		st := searchPathStatus{Name: name, Match: c.cfg.Match, Lazy: c.lazy != nil, Archives: []archiveStatus{}}
+		if !scanned.IsZero() {
+			st.Scanned = &scanned
+		}
+		for _, s := range search {
+			a := archiveStatus{Path: s.path, Type: "dir"}
+			if s.files != nil {
+				a.Type = "pak"
+				if s.offsets != nil {
+					a.Type = "pkz"
+				}
+				a.Files = s.files.len()
+				a.Issues = len(s.issues)
+				a.Size = s.state.info.Size()
+				mtime := s.state.info.ModTime()
+				a.Modified = &mtime
+				a.SHA256 = archiveHash(s.path, s.state.info)
+				a.Quarantined = s.state.quarantined.Load()
+				st.Files += a.Files
+			}
+			st.Archives = append(st.Archives, a)
+		}
+		list = append(list, st)
+	}
+	return list
+}
+
+// GET /admin/status
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	status := adminStatus{
+		Started:         startTime,
+		Revision:        revisionString(),
+		ActiveTransfers: activeTransfers.Load(),
+		SearchPaths:     searchPathStatuses(),
+		Cache:           contentCache.stats(),
+		OpenFiles:       openFiles.len(),
+		Memory: memoryStatus{
+			Alloc:      m.Alloc,
+			Sys:        m.Sys,
+			HeapInuse:  m.HeapInuse,
+			NumGC:      m.NumGC,
+			Goroutines: runtime.NumGoroutine(),
+		},
+	}
+	statusMutex.Lock()
+	status.Phase = phase
+	status.LastScan = lastScan
+	statusMutex.Unlock()
+
+	writeJSON(w, status)
+}
+
+// GET /admin/stats
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !statsEnabled() {
+		http.Error(w, "statistics not collected", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, statsSnapshot())
+}
+
+// rejects requests that don't carry AdminToken as bearer token
+func adminAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(config().AdminToken)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if config().LogLevel >= LogLevelDebug {
+			log.Printf(`ADMIN: %s "%s %s"`, r.RemoteAddr, r.Method, r.RequestURI)
+		}
+		h(w, r)
+	}
+}
+
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/snapshot", adminAuth(handleSnapshot))
+	mux.HandleFunc("/admin/diff", adminAuth(handleDiff))
+	mux.HandleFunc("/admin/bans", adminAuth(handleBans))
+	mux.HandleFunc("/admin/reload", adminAuth(handleReload))
+	mux.HandleFunc("/admin/issues", adminAuth(handleIssues))
+	mux.HandleFunc("/admin/stats", adminAuth(handleStats))
+	mux.HandleFunc("/admin/status", adminAuth(handleStatus))
+	mux.HandleFunc("/admin/publish", adminAuth(handlePublish))
+	return mux
+}
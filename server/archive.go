@@ -0,0 +1,281 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skullernet/pakserve/pak"
+)
+
+type archiveKey struct {
+	path  string
+	size  int64
+	mtime int64
+}
+
+type ManifestArchive struct {
+	Name     string        `json:"name"`
+	Size     int64         `json:"size"`
+	Mtime    int64         `json:"mtime"`
+	SHA256   string        `json:"sha256,omitempty"`
+	Metadata *pak.Metadata `json:"metadata,omitempty"`
+}
+
+type Manifest struct {
+	Archives []ManifestArchive `json:"archives"`
+}
+
+var (
+	archiveHashes      = make(map[archiveKey]string)
+	archiveHashPending = make(map[archiveKey]bool)
+	archiveHashMutex   sync.Mutex
+	archiveHashWorker  sync.Mutex
+)
+
+// scanners that can be assigned to packfile extensions
+const (
+	ScannerPak = "pak"
+	ScannerZip = "zip"
+)
+
+// returns default map of lower case packfile extensions to scanners
+func defaultPakExtensions() map[string]string {
+	return map[string]string{".pak": ScannerPak, ".pkz": ScannerZip}
+}
+
+func validatePakExtensions(cfg *Config) error {
+	for ext, scanner := range cfg.PakExtensions {
+		switch scanner {
+		case ScannerPak, ScannerZip:
+		default:
+			return fmt.Errorf(`Bad scanner "%s" for extension "%s"`, scanner, ext)
+		}
+	}
+	return nil
+}
+
+// merges PakExtensions from config into defaults
+func compilePakExtensions(c *liveConfig) {
+	c.pakExtensions = defaultPakExtensions()
+	for ext, scanner := range c.PakExtensions {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		c.pakExtensions[ext] = scanner
+	}
+}
+
+// returns scanner for packfile name, or nil if name is not a packfile
+func archiveScanner(name string) func(string) (*searchPath, error) {
+	switch config().pakExtensions[strings.ToLower(filepath.Ext(name))] {
+	case ScannerPak:
+		return scanpak
+	case ScannerZip:
+		return scanzip
+	}
+	return nil
+}
+
+func isArchiveName(name string) bool {
+	return archiveScanner(name) != nil
+}
+
+// reports whether quake path names packfile at the top of search directory
+// that can be downloaded as a whole due to PakDownloadWhiteList
+func pakDownloadAllowed(path string) bool {
+	return !strings.Contains(path, "/") && isArchiveName(path) && matchRegexpList(config().pakDownloads, path)
+}
+
+func hashFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashArchive(key archiveKey) {
+	// hash one archive at a time to avoid thrashing the disk
+	archiveHashWorker.Lock()
+	sum, err := hashFile(key.path)
+	archiveHashWorker.Unlock()
+
+	archiveHashMutex.Lock()
+	defer archiveHashMutex.Unlock()
+
+	delete(archiveHashPending, key)
+	if err != nil {
+		log.Printf(`ERROR: hash "%s": %s`, key.path, err)
+		return
+	}
+	archiveHashes[key] = sum
+}
+
+// returns cached SHA-256 of the archive, or empty string if it is not yet
+// known, in which case it is computed in background
+func archiveHash(name string, fi os.FileInfo) string {
+	key := archiveKey{name, fi.Size(), fi.ModTime().UnixNano()}
+
+	archiveHashMutex.Lock()
+	defer archiveHashMutex.Unlock()
+
+	if sum, ok := archiveHashes[key]; ok {
+		return sum
+	}
+	if !archiveHashPending[key] {
+		archiveHashPending[key] = true
+		go hashArchive(key)
+	}
+	return ""
+}
+
+// returns SHA-256 of the archive, computing it right away if not yet known
+func archiveHashNow(name string, fi os.FileInfo) (string, error) {
+	key := archiveKey{name, fi.Size(), fi.ModTime().UnixNano()}
+
+	archiveHashMutex.Lock()
+	sum, ok := archiveHashes[key]
+	archiveHashMutex.Unlock()
+	if ok {
+		return sum, nil
+	}
+
+	archiveHashWorker.Lock()
+	sum, err := hashFile(name)
+	archiveHashWorker.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	archiveHashMutex.Lock()
+	archiveHashes[key] = sum
+	archiveHashMutex.Unlock()
+	return sum, nil
+}
+
+// checks that archives pinned by search path have expected content
+func verifyPins(cfg ConfigSearchPath, search []searchPath) bool {
+	ok := true
+	for name, want := range cfg.Pins {
+		name = filepath.Clean(name)
+		var found *searchPath
+		for i := range search {
+			if search[i].state != nil && search[i].path == name {
+				found = &search[i]
+				break
+			}
+		}
+		if found == nil {
+			log.Printf(`ERROR: pinned archive "%s" not found in search path "%s"`, name, cfg.Name)
+			ok = false
+			continue
+		}
+		sum, err := archiveHashNow(found.path, found.state.info)
+		if err != nil {
+			log.Printf(`ERROR: hash "%s": %s`, name, err)
+			ok = false
+			continue
+		}
+		if !strings.EqualFold(sum, want) {
+			log.Printf(`ERROR: pinned archive "%s" has SHA-256 %s, expected %s`, name, sum, want)
+			ok = false
+		}
+	}
+	if !ok {
+		log.Printf(`ERROR: search path "%s" not served due to pinned archive mismatch`, cfg.Name)
+	}
+	return ok
+}
+
+// lists archives that can be downloaded as a whole through this search path
+func handleManifest(w http.ResponseWriter, r *http.Request, match *compiledSearchPath, search []searchPath) {
+	manifest := Manifest{Archives: make([]ManifestArchive, 0)}
+	seen := make(map[string]bool)
+
+	for _, s := range search {
+		if s.files == nil {
+			continue
+		}
+		name := filepath.Base(s.path)
+		lower := strings.ToLower(name)
+		if seen[lower] || !match.allowDir(lower) {
+			continue
+		}
+		fi, err := os.Stat(s.path)
+		if err != nil {
+			continue
+		}
+		seen[lower] = true
+		manifest.Archives = append(manifest.Archives, ManifestArchive{
+			Name:     name,
+			Size:     fi.Size(),
+			Mtime:    fi.ModTime().Unix(),
+			SHA256:   archiveHash(s.path, fi),
+			Metadata: s.meta,
+		})
+	}
+
+	b, err := json.Marshal(&manifest)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+}
+
+// starts background hashing of archives in search path
+func hashArchives(sp []searchPath) {
+	for _, s := range sp {
+		if s.files == nil {
+			continue
+		}
+		if fi, err := os.Stat(s.path); err == nil {
+			archiveHash(s.path, fi)
+		}
+	}
+}
+
+// drops cached hashes of archives that are gone or were replaced since.
+// Must be called with searchPathsMutex held.
+func pruneArchiveHashes() {
+	keep := make(map[archiveKey]bool)
+
+	dirCacheMutex.Lock()
+	for _, sp := range dirCache {
+		for _, s := range sp {
+			if s.state != nil {
+				fi := s.state.info
+				keep[archiveKey{s.path, fi.Size(), fi.ModTime().UnixNano()}] = true
+			}
+		}
+	}
+	dirCacheMutex.Unlock()
+
+	archiveHashMutex.Lock()
+	defer archiveHashMutex.Unlock()
+
+	for key := range archiveHashes {
+		if !keep[key] {
+			delete(archiveHashes, key)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+type ConfigAutoTLS struct {
+	Domains  []string `yaml:"Domains"`
+	CacheDir string   `yaml:"CacheDir"`
+	Email    string   `yaml:"Email"`
+}
+
+// obtains and renews certificates if AutoTLS is enabled
+var autoCert *autocert.Manager
+
+func autoTLSEnabled(cfg *Config) bool {
+	return len(cfg.AutoTLS.Domains) > 0
+}
+
+func validateAutoTLS(cfg *Config) error {
+	if !autoTLSEnabled(cfg) {
+		return nil
+	}
+	if len(cfg.ListenTLS) == 0 {
+		return errors.New("ListenTLS must be set if AutoTLS is enabled")
+	}
+	if len(cfg.CertFile)+len(cfg.KeyFile) > 0 {
+		return errors.New("CertFile and KeyFile can't be set if AutoTLS is enabled")
+	}
+	if len(cfg.AutoTLS.CacheDir) == 0 {
+		return errors.New("AutoTLS CacheDir must be set")
+	}
+	return nil
+}
+
+// makes TLS config get certificates from ACME CA, answering TLS-ALPN-01
+// challenges
+func setupAutoTLS(cfg *tls.Config) {
+	autoCert = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(config().AutoTLS.Domains...),
+		Cache:      autocert.DirCache(config().AutoTLS.CacheDir),
+		Email:      config().AutoTLS.Email,
+	}
+	cfg.GetCertificate = autoCert.GetCertificate
+	cfg.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+}
+
+// answers ACME HTTP-01 challenges on plain text listener
+func autoTLSHandler(h http.Handler) http.Handler {
+	if autoCert == nil {
+		return h
+	}
+	return autoCert.HTTPHandler(h)
+}
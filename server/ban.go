@@ -0,0 +1,314 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ConfigBans struct {
+	File            string        `yaml:"File"`
+	AutoBanAfter    int           `yaml:"AutoBanAfter"`
+	AutoBanWindow   time.Duration `yaml:"AutoBanWindow"`
+	AutoBanDuration time.Duration `yaml:"AutoBanDuration"`
+}
+
+type ban struct {
+	prefix  netip.Prefix
+	expires time.Time // zero if ban is permanent
+}
+
+// counts rate limited requests from single address
+type strike struct {
+	count int
+	start time.Time
+}
+
+// automatic bans of single address, for escalation
+type offense struct {
+	count   int
+	expires time.Time // forgotten after this
+}
+
+type banList struct {
+	mutex    sync.RWMutex
+	bans     []ban
+	strikes  map[netip.Addr]*strike
+	offenses map[netip.Addr]offense
+	pruned   time.Time // when strikes and offenses were last pruned
+}
+
+// longest automatic ban
+const maxAutoBan = 7 * 24 * time.Hour
+
+var bans banList
+
+func (l *banList) reset() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.bans = nil
+	l.strikes = make(map[netip.Addr]*strike)
+	l.offenses = make(map[netip.Addr]offense)
+	l.pruned = time.Time{}
+}
+
+func (b ban) expired(now time.Time) bool {
+	return !b.expires.IsZero() && now.After(b.expires)
+}
+
+func (b ban) String() string {
+	if b.expires.IsZero() {
+		return b.prefix.String()
+	}
+	return b.prefix.String() + " " + b.expires.UTC().Format(time.RFC3339)
+}
+
+// parses IP address or subnet, address is treated as single address subnet
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.ContainsRune(s, '/') {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// parses IP address or subnet, optionally followed by expiry time
+func parseBan(line string) (ban, error) {
+	var b ban
+	fields := strings.Fields(line)
+	if len(fields) == 0 || len(fields) > 2 {
+		return b, errors.New("expected address and optional expiry time")
+	}
+	var err error
+	if b.prefix, err = parsePrefix(fields[0]); err != nil {
+		return b, err
+	}
+	if len(fields) == 2 {
+		if b.expires, err = time.Parse(time.RFC3339, fields[1]); err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// returns client address without port, IPv4-mapped addresses are unmapped
+func clientAddr(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, _ := netip.ParseAddr(host)
+	return addr.Unmap()
+}
+
+func loadBans() error {
+	bans.reset()
+	if len(config().Bans.File) == 0 {
+		return nil
+	}
+	f, err := os.Open(config().Bans.File)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	now := time.Now()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		b, err := parseBan(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", config().Bans.File, n, err)
+		}
+		if !b.expired(now) {
+			bans.bans = append(bans.bans, b)
+		}
+	}
+	return scanner.Err()
+}
+
+// writes ban list to a temporary file first, like saveState does
+func (l *banList) save() {
+	if len(config().Bans.File) == 0 {
+		return
+	}
+
+	var sb strings.Builder
+	now := time.Now()
+	l.mutex.RLock()
+	for _, b := range l.bans {
+		if !b.expired(now) {
+			fmt.Fprintln(&sb, b)
+		}
+	}
+	l.mutex.RUnlock()
+
+	f, err := os.CreateTemp(filepath.Dir(config().Bans.File), ".pakserve-bans-*")
+	if err != nil {
+		log.Printf(`ERROR: save bans "%s": %s`, config().Bans.File, err)
+		return
+	}
+	_, err = f.WriteString(sb.String())
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), config().Bans.File)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		log.Printf(`ERROR: save bans "%s": %s`, config().Bans.File, err)
+	}
+}
+
+// reports whether client address of request is banned
+func (l *banList) blocked(r *http.Request) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	if len(l.bans) == 0 {
+		return false
+	}
+	addr := clientAddr(r)
+	now := time.Now()
+	for _, b := range l.bans {
+		if b.prefix.Contains(addr) && !b.expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// adds or replaces ban of the same prefix, dropping expired bans
+func (l *banList) add(b ban) {
+	l.mutex.Lock()
+	now := time.Now()
+	bans := l.bans[:0]
+	for _, v := range l.bans {
+		if v.prefix != b.prefix && !v.expired(now) {
+			bans = append(bans, v)
+		}
+	}
+	l.bans = append(bans, b)
+	l.mutex.Unlock()
+
+	l.save()
+}
+
+// returns false if prefix was not banned
+func (l *banList) remove(prefix netip.Prefix) bool {
+	l.mutex.Lock()
+	found := false
+	for i, v := range l.bans {
+		if v.prefix == prefix {
+			l.bans = append(l.bans[:i], l.bans[i+1:]...)
+			found = true
+			break
+		}
+	}
+	l.mutex.Unlock()
+
+	if found {
+		l.save()
+	}
+	return found
+}
+
+func (l *banList) list() []ban {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	now := time.Now()
+	list := make([]ban, 0, len(l.bans))
+	for _, b := range l.bans {
+		if !b.expired(now) {
+			list = append(list, b)
+		}
+	}
+	return list
+}
+
+// drops strikes older than AutoBanWindow and forgotten offenses, at most
+// once per window. Must be called with mutex held.
+func (l *banList) prune(now time.Time) {
+	window := config().Bans.AutoBanWindow
+	if now.Sub(l.pruned) <= window {
+		return
+	}
+	l.pruned = now
+	for addr, s := range l.strikes {
+		if now.Sub(s.start) > window {
+			delete(l.strikes, addr)
+		}
+	}
+	for addr, o := range l.offenses {
+		if now.After(o.expires) {
+			delete(l.offenses, addr)
+		}
+	}
+}
+
+// counts rate limited request from addr and temporarily bans it after
+// AutoBanAfter such requests within AutoBanWindow. Each subsequent automatic
+// ban of the same address lasts twice as long, up to a week. Address is
+// forgiven once it goes a week after its last automatic ban without another.
+func (l *banList) strike(addr netip.Addr) {
+	if config().Bans.AutoBanAfter <= 0 || !addr.IsValid() {
+		return
+	}
+
+	l.mutex.Lock()
+	now := time.Now()
+	s, ok := l.strikes[addr]
+	if !ok || now.Sub(s.start) > config().Bans.AutoBanWindow {
+		l.prune(now)
+		s = &strike{start: now}
+		l.strikes[addr] = s
+	}
+	s.count++
+	if s.count < config().Bans.AutoBanAfter {
+		l.mutex.Unlock()
+		return
+	}
+	delete(l.strikes, addr)
+	o := l.offenses[addr]
+	if now.After(o.expires) {
+		o.count = 0
+	}
+	d := config().Bans.AutoBanDuration << o.count
+	if d > maxAutoBan || d <= 0 {
+		d = maxAutoBan
+	} else {
+		o.count++
+	}
+	o.expires = now.Add(d + maxAutoBan)
+	l.offenses[addr] = o
+	l.mutex.Unlock()
+
+	log.Printf("WARNING: banned %s for %s after %d rate limited requests", addr, d, config().Bans.AutoBanAfter)
+	l.add(ban{prefix: netip.PrefixFrom(addr, addr.BitLen()), expires: now.Add(d)})
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// bytes written at once by throttled responses
+const throttleChunk = 16384
+
+type ConfigBandwidthWindow struct {
+	From  string `yaml:"From"`  // HH:MM local time
+	To    string `yaml:"To"`    // HH:MM local time, exclusive
+	Limit int64  `yaml:"Limit"` // bytes per second, 0 is unlimited
+}
+
+type bandwidthWindow struct {
+	from, to int // minutes since midnight
+	limit    int64
+}
+
+// byteThrottle limits aggregate rate of bytes written by all responses
+type byteThrottle struct {
+	mutex sync.Mutex
+	next  time.Time // when bytes reserved so far are sent at current rate
+}
+
+var globalThrottle byteThrottle
+
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf(`Bad time of day "%s"`, s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func validateBandwidthSchedule(cfg *Config) error {
+	for _, v := range cfg.BandwidthSchedule {
+		if _, err := parseTimeOfDay(v.From); err != nil {
+			return err
+		}
+		if _, err := parseTimeOfDay(v.To); err != nil {
+			return err
+		}
+		if v.Limit < 0 {
+			return fmt.Errorf("Bad bandwidth limit %d", v.Limit)
+		}
+	}
+	if cfg.MaxBandwidth < 0 {
+		return fmt.Errorf("Bad bandwidth limit %d", cfg.MaxBandwidth)
+	}
+	for _, sp := range cfg.SearchPaths {
+		if sp.MaxBandwidth < 0 {
+			return fmt.Errorf(`Bad bandwidth limit %d for search path "%s"`, sp.MaxBandwidth, sp.Match)
+		}
+	}
+	return nil
+}
+
+func compileBandwidthSchedule(c *liveConfig) {
+	for _, v := range c.BandwidthSchedule {
+		from, _ := parseTimeOfDay(v.From)
+		to, _ := parseTimeOfDay(v.To)
+		c.bandwidthSchedule = append(c.bandwidthSchedule, bandwidthWindow{from: from, to: to, limit: v.Limit})
+	}
+}
+
+// returns bandwidth limit of the first window that includes t, 0 if none.
+// Windows may wrap around midnight, window with equal ends lasts all day.
+func scheduledBandwidth(t time.Time) int64 {
+	m := t.Hour()*60 + t.Minute()
+	for _, w := range config().bandwidthSchedule {
+		if w.from == w.to ||
+			w.from < w.to && m >= w.from && m < w.to ||
+			w.from > w.to && (m >= w.from || m < w.to) {
+			return w.limit
+		}
+	}
+	return 0
+}
+
+// returns aggregate bandwidth limit at time t, which is the lower of
+// MaxBandwidth and scheduled limit, 0 if unlimited
+func globalBandwidth(t time.Time) int64 {
+	limit := scheduledBandwidth(t)
+	if max := config().MaxBandwidth; max > 0 && (limit == 0 || max < limit) {
+		return max
+	}
+	return limit
+}
+
+// reserves n bytes at given rate and returns how long to wait before
+// sending them
+func (t *byteThrottle) reserve(n int, rate int64) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	wait := t.next.Sub(now)
+	t.next = t.next.Add(time.Duration(float64(n) / float64(rate) * float64(time.Second)))
+	return wait
+}
+
+type throttledWriter struct {
+	http.ResponseWriter
+	client     *tokenBucket        // bandwidth limit of client, may be nil
+	searchPath *compiledSearchPath // search path with MaxBandwidth, may be nil
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	if w.client == nil && w.searchPath == nil && globalBandwidth(time.Now()) == 0 {
+		return w.ResponseWriter.Write(p)
+	}
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > throttleChunk {
+			n = throttleChunk
+		}
+		if limit := globalBandwidth(time.Now()); limit > 0 {
+			time.Sleep(globalThrottle.reserve(n, limit))
+		}
+		if s := w.searchPath; s != nil {
+			time.Sleep(s.throttle.reserve(n, s.cfg.MaxBandwidth))
+		}
+		if w.client != nil {
+			time.Sleep(w.client.reserve(float64(n)))
+		}
+		m, err := w.ResponseWriter.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// applies MaxBandwidth, BandwidthSchedule and client bandwidth limits to
+// responses. Search path limit is applied by handler once it is matched.
+func throttleHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(&throttledWriter{ResponseWriter: w, client: clientLimits.bandwidth(r)}, r)
+	})
+}
+
+// applies MaxBandwidth of matched search path to response
+func throttleSearchPath(w http.ResponseWriter, match *compiledSearchPath) {
+	if match.throttle == nil {
+		return
+	}
+	if wl, ok := w.(*loggingResponseWriter); ok {
+		w = wl.ResponseWriter
+	}
+	if tw, ok := w.(*throttledWriter); ok {
+		tw.searchPath = match
+	}
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var benchLogRequest = regexp.MustCompile(`"(?:GET|HEAD) (\S+) HTTP/`)
+
+// extracts request paths from access log written with LogLevel 2
+func benchPathsFromLog(name string) []string {
+	f, err := os.Open(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	var paths []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if m := benchLogRequest.FindStringSubmatch(scanner.Text()); m != nil {
+			paths = append(paths, m[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+	return paths
+}
+
+// builds request paths for every packfile entry reachable through the
+// literal prefix of each search path regexp
+func benchPathsSynthetic() []string {
+	seen := make(map[string]bool)
+	for i := range searchPaths {
+		s := &searchPaths[i]
+		// anchor prevents LiteralPrefix from finding anything
+		expr := strings.TrimPrefix(s.match.String(), "^")
+		prefix, _ := regexp.MustCompile(expr).LiteralPrefix()
+		for _, sp := range s.load() {
+			for i := 0; i < sp.files.len(); i++ {
+				if p := prefix + sp.files.name(i); s.match.MatchString(p) {
+					seen[p] = true
+				}
+			}
+		}
+	}
+	paths := make([]string, 0, len(seen))
+	for p := range seen {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func percentile(d []time.Duration, p int) time.Duration {
+	return d[(len(d)-1)*p/100]
+}
+
+func bench(args []string) {
+	if len(args) < 1 {
+		usage()
+	}
+	loadConfig(args[0])
+
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	concurrency := flags.Int("c", 8, "number of concurrent clients")
+	requests := flags.Int("n", 10000, "total number of requests")
+	encoding := flags.String("e", "gzip", "Accept-Encoding header to send")
+	referer := flags.String("r", "quake2://", "Referer header to send")
+	flags.Parse(args[1:])
+
+	scanSearchPaths()
+
+	var paths []string
+	if flags.NArg() > 0 {
+		paths = benchPathsFromLog(flags.Arg(0))
+	} else {
+		paths = benchPathsSynthetic()
+	}
+	if len(paths) == 0 || *requests < 1 || *concurrency < 1 {
+		log.Fatal("Nothing to do")
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(handler))
+	defer srv.Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: *concurrency,
+			DisableCompression:  true,
+		},
+	}
+
+	var (
+		next      int64
+		received  int64
+		failures  int64
+		latencies = make([]time.Duration, *requests)
+		statuses  = make(map[int]int)
+		mutex     sync.Mutex
+		wg        sync.WaitGroup
+		m0, m1    runtime.MemStats
+	)
+
+	runtime.GC()
+	runtime.ReadMemStats(&m0)
+	start := time.Now()
+
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				n := atomic.AddInt64(&next, 1) - 1
+				if n >= int64(*requests) {
+					return
+				}
+				req, err := http.NewRequest("GET", srv.URL+paths[n%int64(len(paths))], nil)
+				if err != nil {
+					log.Fatal(err)
+				}
+				if len(*encoding) > 0 {
+					req.Header.Set("Accept-Encoding", *encoding)
+				}
+				if len(*referer) > 0 {
+					req.Header.Set("Referer", *referer)
+				}
+
+				t := time.Now()
+				resp, err := client.Do(req)
+				if err != nil {
+					atomic.AddInt64(&failures, 1)
+					latencies[n] = time.Since(t)
+					continue
+				}
+				b, _ := io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				latencies[n] = time.Since(t)
+
+				atomic.AddInt64(&received, b)
+				mutex.Lock()
+				statuses[resp.StatusCode]++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&m1)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	codes := make([]int, 0, len(statuses))
+	for c := range statuses {
+		codes = append(codes, c)
+	}
+	sort.Ints(codes)
+
+	fmt.Printf("Requests:      %d (%d paths, %d clients)\n", *requests, len(paths), *concurrency)
+	for _, c := range codes {
+		fmt.Printf("Status %d:    %d\n", c, statuses[c])
+	}
+	if failures > 0 {
+		fmt.Printf("Failures:      %d\n", failures)
+	}
+	fmt.Printf("Elapsed:       %v\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("Throughput:    %.1f req/s, %.2f MB/s\n",
+		float64(*requests)/elapsed.Seconds(), float64(received)/elapsed.Seconds()/1e6)
+	fmt.Printf("Latency:       p50 %v, p99 %v, max %v\n",
+		percentile(latencies, 50), percentile(latencies, 99), latencies[len(latencies)-1])
+	// client side allocations are included, since it runs in the same process
+	fmt.Printf("Allocations:   %d allocs/req, %d bytes/req\n",
+		(m1.Mallocs-m0.Mallocs)/uint64(*requests), (m1.TotalAlloc-m0.TotalAlloc)/uint64(*requests))
+}
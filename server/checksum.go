@@ -0,0 +1,113 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maximum number of cached checksums, cache is cleared when exceeded
+const maxChecksums = 65536
+
+// checksums that can be requested with checksum query parameter
+var checksumAlgorithms = map[string]func() hash.Hash{
+	ChecksumCRC32: func() hash.Hash { return crc32.NewIEEE() },
+	"md5":         md5.New,
+	"sha1":        sha1.New,
+}
+
+type checksumKey struct {
+	content   signatureKey
+	algorithm string
+}
+
+var (
+	checksums      = make(map[checksumKey]string)
+	checksumsMutex sync.Mutex
+)
+
+// returns algorithm of checksum requested instead of file content, if
+// ChecksumQuery is enabled
+func checksumRequested(r *http.Request) (string, bool) {
+	if !config().ChecksumQuery || !r.URL.Query().Has("checksum") {
+		return "", false
+	}
+	return strings.ToLower(r.URL.Query().Get("checksum")), true
+}
+
+// returns hex digest of content, calling read to feed it to hash if not
+// cached
+func cachedChecksum(key checksumKey, read func(h hash.Hash) error) (string, error) {
+	checksumsMutex.Lock()
+	sum, ok := checksums[key]
+	checksumsMutex.Unlock()
+	if ok {
+		return sum, nil
+	}
+
+	h := checksumAlgorithms[key.algorithm]()
+	if err := read(h); err != nil {
+		return "", err
+	}
+	sum = hex.EncodeToString(h.Sum(nil))
+
+	checksumsMutex.Lock()
+	if len(checksums) >= maxChecksums {
+		checksums = make(map[checksumKey]string)
+	}
+	checksums[key] = sum
+	checksumsMutex.Unlock()
+	return sum, nil
+}
+
+// returns checksum of decompressed packfile entry. CRC32 of ZIP entries is
+// known from central directory.
+func (s *searchPath) entryChecksum(entry *pakFileEntry, algorithm string) (string, error) {
+	if algorithm == ChecksumCRC32 && s.offsets != nil {
+		return fmt.Sprintf("%08x", entry.filecrc), nil
+	}
+	key := checksumKey{signatureKey{path: s.path, offset: entry.offset, state: s.state}, algorithm}
+	return cachedChecksum(key, func(h hash.Hash) error {
+		f, err := openFiles.open(s.path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		r, err := s.entryReader(f, entry)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = io.Copy(h, r)
+		return err
+	})
+}
+
+// returns checksum of directory file
+func fileChecksum(f *os.File, fi os.FileInfo, algorithm string) (string, error) {
+	key := checksumKey{signatureKey{path: f.Name(), offset: fi.Size(), mtime: fi.ModTime().UnixNano()}, algorithm}
+	return cachedChecksum(key, func(h hash.Hash) error {
+		_, err := io.Copy(h, io.NewSectionReader(f, 0, fi.Size()))
+		return err
+	})
+}
+
+// responds with checksum in X-Content-<algorithm> header and body
+func writeChecksum(w http.ResponseWriter, r *http.Request, algorithm, sum string) {
+	w.Header().Set("X-Content-"+strings.ToUpper(algorithm), sum)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(sum)+1))
+	if r.Method != "HEAD" {
+		io.WriteString(w, sum+"\n")
+	}
+}
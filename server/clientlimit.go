@@ -0,0 +1,178 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+type ConfigClientLimits struct {
+	RequestRate       float64       `yaml:"RequestRate"`
+	RequestBurst      int           `yaml:"RequestBurst"`
+	Bandwidth         int64         `yaml:"Bandwidth"`
+	BandwidthBurst    int64         `yaml:"BandwidthBurst"`
+	MaxLargeTransfers int           `yaml:"MaxLargeTransfers"`
+	LargeTransferSize int64         `yaml:"LargeTransferSize"`
+	QueueTimeout      time.Duration `yaml:"QueueTimeout"`
+	TrustedProxies    []string      `yaml:"TrustedProxies"`
+}
+
+// limits of single client address
+type clientLimit struct {
+	requests  *tokenBucket  // nil if unlimited
+	bytes     *tokenBucket  // nil if unlimited
+	transfers chan struct{} // slots for large transfers, nil if unlimited
+}
+
+type clientLimiter struct {
+	mutex     sync.Mutex
+	clients   map[netip.Addr]*clientLimit
+	trusted   []netip.Prefix
+	lastPrune time.Time
+}
+
+// how often limits of idle clients are forgotten
+const clientPruneInterval = time.Minute
+
+var clientLimits clientLimiter
+
+func validateClientLimits(cfg *Config) error {
+	l := &cfg.ClientLimits
+	if l.RequestRate < 0 || l.RequestBurst < 0 || l.Bandwidth < 0 || l.BandwidthBurst < 0 ||
+		l.MaxLargeTransfers < 0 || l.LargeTransferSize < 0 || l.QueueTimeout < 0 {
+		return fmt.Errorf("Bad ClientLimits")
+	}
+	for _, v := range l.TrustedProxies {
+		if _, err := parsePrefix(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func compileClientLimits() {
+	clientLimits.mutex.Lock()
+	defer clientLimits.mutex.Unlock()
+
+	clientLimits.clients = make(map[netip.Addr]*clientLimit)
+	clientLimits.trusted = nil
+	for _, v := range config().ClientLimits.TrustedProxies {
+		p, _ := parsePrefix(v)
+		clientLimits.trusted = append(clientLimits.trusted, p)
+	}
+}
+
+func (l *clientLimiter) enabled() bool {
+	cfg := &config().ClientLimits
+	return cfg.RequestRate > 0 || cfg.Bandwidth > 0 || cfg.MaxLargeTransfers > 0
+}
+
+// returns limits of client that made request, nil if it isn't limited
+func (l *clientLimiter) get(r *http.Request) *clientLimit {
+	if !l.enabled() {
+		return nil
+	}
+	addr := clientAddr(r)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, p := range l.trusted {
+		if p.Contains(addr) {
+			return nil
+		}
+	}
+	if now := time.Now(); now.Sub(l.lastPrune) > clientPruneInterval {
+		l.prune()
+		l.lastPrune = now
+	}
+	c := l.clients[addr]
+	if c == nil {
+		cfg := &config().ClientLimits
+		c = new(clientLimit)
+		if cfg.RequestRate > 0 {
+			c.requests = newTokenBucket(cfg.RequestRate, cfg.RequestBurst)
+		}
+		if cfg.Bandwidth > 0 {
+			burst := cfg.BandwidthBurst
+			if burst < cfg.Bandwidth {
+				burst = cfg.Bandwidth
+			}
+			c.bytes = newTokenBucket(float64(cfg.Bandwidth), int(burst))
+		}
+		if cfg.MaxLargeTransfers > 0 {
+			c.transfers = make(chan struct{}, cfg.MaxLargeTransfers)
+		}
+		l.clients[addr] = c
+	}
+	return c
+}
+
+// forgets clients whose buckets are full again and that have no large
+// transfers in progress. Must be called with mutex held.
+func (l *clientLimiter) prune() {
+	for addr, c := range l.clients {
+		if (c.requests == nil || c.requests.full()) && (c.bytes == nil || c.bytes.full()) && len(c.transfers) == 0 {
+			delete(l.clients, addr)
+		}
+	}
+}
+
+// returns false if request was rejected due to client request rate
+func (l *clientLimiter) admit(w http.ResponseWriter, r *http.Request) bool {
+	c := l.get(r)
+	if c == nil || c.requests == nil || c.requests.allow() {
+		return true
+	}
+	bans.strike(clientAddr(r))
+	w.Header().Set("Retry-After", "1")
+	closeWithError(w, r, http.StatusTooManyRequests)
+	return false
+}
+
+// returns bandwidth limit of client that made request, nil if unlimited
+func (l *clientLimiter) bandwidth(r *http.Request) *tokenBucket {
+	if c := l.get(r); c != nil {
+		return c.bytes
+	}
+	return nil
+}
+
+func releaseNothing() {}
+
+// limits number of concurrent transfers of files of at least
+// LargeTransferSize bytes per client, waiting up to QueueTimeout for a free
+// slot. Returns false if request was rejected, otherwise release must be
+// called once transfer is done.
+func (l *clientLimiter) acquire(w http.ResponseWriter, r *http.Request, size int64) (release func(), ok bool) {
+	if config().ClientLimits.MaxLargeTransfers <= 0 || size < config().ClientLimits.LargeTransferSize || r.Method == "HEAD" {
+		return releaseNothing, true
+	}
+	c := l.get(r)
+	if c == nil || c.transfers == nil {
+		return releaseNothing, true
+	}
+	release = func() { <-c.transfers }
+
+	select {
+	case c.transfers <- struct{}{}:
+		return release, true
+	default:
+	}
+	if d := config().ClientLimits.QueueTimeout; d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case c.transfers <- struct{}{}:
+			return release, true
+		case <-r.Context().Done():
+			return nil, false
+		case <-t.C:
+		}
+	}
+	w.Header().Set("Retry-After", "1")
+	closeWithError(w, r, http.StatusTooManyRequests)
+	return nil, false
+}
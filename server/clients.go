@@ -0,0 +1,58 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+type ConfigClientOverride struct {
+	UserAgent        string   `yaml:"UserAgent"`
+	DisableEncodings []string `yaml:"DisableEncodings"`
+}
+
+type clientOverride struct {
+	userAgent      *regexp.Regexp
+	disableGzip    bool
+	disableDeflate bool
+}
+
+func validateClientOverrides(cfg *Config) error {
+	for _, o := range cfg.ClientOverrides {
+		if _, err := regexp.Compile(o.UserAgent); err != nil {
+			return err
+		}
+		for _, e := range o.DisableEncodings {
+			if e != "gzip" && e != "deflate" {
+				return fmt.Errorf(`Bad encoding "%s" for client "%s"`, e, o.UserAgent)
+			}
+		}
+	}
+	return nil
+}
+
+func compileClientOverrides(c *liveConfig) {
+	for _, cfg := range c.ClientOverrides {
+		o := clientOverride{userAgent: regexp.MustCompile(cfg.UserAgent)}
+		for _, e := range cfg.DisableEncodings {
+			switch e {
+			case "gzip":
+				o.disableGzip = true
+			case "deflate":
+				o.disableDeflate = true
+			}
+		}
+		c.clientOverrides = append(c.clientOverrides, o)
+	}
+}
+
+// applies the first override matching User-Agent to accepted encodings
+func overrideEncodings(r *http.Request, hasGzip, hasDeflate bool) (bool, bool) {
+	ua := r.UserAgent()
+	for _, o := range config().clientOverrides {
+		if o.userAgent.MatchString(ua) {
+			return hasGzip && !o.disableGzip, hasDeflate && !o.disableDeflate
+		}
+	}
+	return hasGzip, hasDeflate
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+type ConfigCompress struct {
+	Enabled        bool     `yaml:"Enabled"`
+	MinSize        int64    `yaml:"MinSize"`
+	Level          int      `yaml:"Level"`
+	SkipExtensions []string `yaml:"SkipExtensions"`
+}
+
+func validateCompress(cfg *Config) error {
+	if cfg.Compress.Level < gzip.BestSpeed || cfg.Compress.Level > gzip.BestCompression {
+		return fmt.Errorf("Bad Compress level %d", cfg.Compress.Level)
+	}
+	return nil
+}
+
+// reports whether stored entry can be compressed on the fly for gzip clients
+func compressible(name string, entry *pakFileEntry) bool {
+	if !config().Compress.Enabled || entry.method != 0 || int64(entry.size) < config().Compress.MinSize {
+		return false
+	}
+	ext := path.Ext(name)
+	for _, v := range config().Compress.SkipExtensions {
+		if strings.EqualFold(v, ext) {
+			return false
+		}
+	}
+	return true
+}
+
+// compresses stored entry on the fly. Length isn't known in advance, so
+// response uses chunked transfer encoding and doesn't support ranges.
+func (entry *pakFileEntry) handleCompress(w http.ResponseWriter, req *http.Request, r io.Reader) {
+	w.Header().Set("Content-Encoding", "gzip")
+	w.WriteHeader(http.StatusOK)
+	if req.Method == "HEAD" {
+		return
+	}
+
+	z, err := gzip.NewWriterLevel(w, config().Compress.Level)
+	if err != nil {
+		return
+	}
+	if _, err := io.Copy(z, r); err != nil {
+		return
+	}
+	z.Close()
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// default DirTimeout
+const defaultDirTimeout = 10 * time.Second
+
+var errDirBusy = errors.New("search directory not responding")
+
+// A dirPool runs blocking filesystem operations on a search directory with
+// a bounded number of goroutines, so that hung directory (e.g. on NFS) ties
+// up only its own workers instead of unlimited handler goroutines.
+type dirPool struct {
+	jobs chan func()
+}
+
+type openResult struct {
+	f   *os.File
+	err error
+}
+
+var (
+	dirPools      = make(map[string]*dirPool)
+	dirPoolsMutex sync.Mutex
+	dirOpen       = os.Open // replaced by tests
+)
+
+func newDirPool(workers int) *dirPool {
+	p := &dirPool{jobs: make(chan func(), workers)}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range p.jobs {
+				job()
+			}
+		}()
+	}
+	return p
+}
+
+func getDirPool(dir string) *dirPool {
+	dirPoolsMutex.Lock()
+	defer dirPoolsMutex.Unlock()
+
+	p, ok := dirPools[dir]
+	if !ok {
+		p = newDirPool(config().DirWorkers)
+		dirPools[dir] = p
+	}
+	return p
+}
+
+// opens file in search directory, through worker pool of that directory if
+// DirWorkers is set. Returns errDirBusy if pool is saturated or open doesn't
+// complete within DirTimeout.
+func openDirFile(dir, path string) (*os.File, error) {
+	name := filepath.Join(dir, path)
+	if config().DirWorkers <= 0 {
+		return dirOpen(name)
+	}
+
+	res := make(chan openResult, 1)
+	job := func() {
+		f, err := dirOpen(name)
+		res <- openResult{f, err}
+	}
+	select {
+	case getDirPool(dir).jobs <- job:
+	default:
+		return nil, errDirBusy
+	}
+
+	timeout := config().DirTimeout
+	if timeout <= 0 {
+		timeout = defaultDirTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-res:
+		return r.f, r.err
+	case <-timer.C:
+		log.Printf(`ERROR: open "%s" timed out`, name)
+		// close file if open eventually completes
+		go func() {
+			if r := <-res; r.f != nil {
+				r.f.Close()
+			}
+		}()
+		return nil, errDirBusy
+	}
+}
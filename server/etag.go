@@ -0,0 +1,64 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// returns strong ETag of packfile entry served with given content encoding.
+// ZIP entries have CRC, PAK entries are identified by their location. Either
+// way archive modification time changes when packfile is replaced.
+func (entry *pakFileEntry) etag(s *searchPath, encoding string) string {
+	mtime := s.state.info.ModTime().Unix()
+	var tag string
+	if s.offsets != nil {
+		tag = fmt.Sprintf("%08x-%x", entry.filecrc, mtime)
+	} else {
+		tag = fmt.Sprintf("%x-%x-%x", entry.offset, entry.size, mtime)
+	}
+	if len(encoding) > 0 {
+		tag += "-" + encoding
+	}
+	return `"` + tag + `"`
+}
+
+// reports whether any of comma separated entity tags matches etag,
+// using weak comparison as required for If-None-Match
+func etagMatch(list, etag string) bool {
+	for _, v := range strings.Split(list, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// sets validators of packfile entry and responds with 304 if client already
+// has it. If-Modified-Since is ignored if If-None-Match is present.
+func (entry *pakFileEntry) notModified(w http.ResponseWriter, r *http.Request, s *searchPath, encoding string) bool {
+	etag := entry.etag(s, encoding)
+	modtime := s.state.info.ModTime()
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); len(inm) > 0 {
+		if !etagMatch(inm, etag) {
+			return false
+		}
+	} else if t, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err != nil || modtime.Truncate(time.Second).After(t) {
+		return false
+	}
+
+	h := w.Header()
+	delete(h, "Content-Type")
+	delete(h, "Content-Length")
+	delete(h, "Content-Encoding")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
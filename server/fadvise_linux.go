@@ -0,0 +1,32 @@
+//go:build fadvise && (amd64 || arm64)
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	fadvSequential = 2 // POSIX_FADV_SEQUENTIAL
+	fadvWillNeed   = 3 // POSIX_FADV_WILLNEED
+)
+
+// entries smaller than this are not worth readahead hints
+const readaheadMinSize = 256 << 10
+
+// hints kernel that packfile region is about to be read sequentially, so
+// that readahead starts before the first read
+func readahead(f *os.File, offset, length int64) {
+	if length < readaheadMinSize {
+		return
+	}
+	c, err := f.SyscallConn()
+	if err != nil {
+		return
+	}
+	c.Control(func(fd uintptr) {
+		syscall.Syscall6(syscall.SYS_FADVISE64, fd, uintptr(offset), uintptr(length), fadvSequential, 0, 0)
+		syscall.Syscall6(syscall.SYS_FADVISE64, fd, uintptr(offset), uintptr(length), fadvWillNeed, 0, 0)
+	})
+}
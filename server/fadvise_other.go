@@ -0,0 +1,7 @@
+//go:build !fadvise || !linux || !(amd64 || arm64)
+
+package server
+
+import "os"
+
+func readahead(f *os.File, offset, length int64) {}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"container/list"
+	"os"
+	"sync"
+)
+
+type fdCacheEntry struct {
+	file   *os.File
+	info   os.FileInfo // of open file, not of path
+	path   string
+	refs   int
+	closed bool          // removed from cache, close once released
+	elem   *list.Element // position in LRU list, nil if removed
+}
+
+// fdCache keeps up to MaxOpenFiles packfiles open between requests, so that
+// they are not reopened for every request. Files in use are never closed,
+// thus more than MaxOpenFiles files may be open under load.
+type fdCache struct {
+	mutex sync.Mutex
+	files map[string]*fdCacheEntry
+	lru   list.List // most recently used at front
+}
+
+// file handle that must be closed after use like regular file
+type cachedFile struct {
+	*os.File
+	info  os.FileInfo
+	entry *fdCacheEntry
+}
+
+var openFiles = fdCache{files: make(map[string]*fdCacheEntry)}
+
+func openFile(path string) (*os.File, os.FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, fi, nil
+}
+
+// returns open packfile, either cached or freshly opened, along with its
+// info. Cached file is only returned if path still refers to it, and then
+// info is that of path, so that changes on disk can still be detected.
+func (c *fdCache) open(path string) (*cachedFile, error) {
+	if config().MaxOpenFiles <= 0 {
+		f, fi, err := openFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return &cachedFile{File: f, info: fi}, nil
+	}
+
+	if f := c.get(path); f != nil {
+		fi, err := os.Stat(path)
+		if err == nil && os.SameFile(f.entry.info, fi) {
+			f.info = fi
+			return f, nil
+		}
+		f.Close()
+		c.invalidate(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f, fi, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.files[path] != nil {
+		// opened concurrently, leave it cached and use this one once
+		return &cachedFile{File: f, info: fi}, nil
+	}
+	e := &fdCacheEntry{file: f, info: fi, path: path, refs: 1}
+	e.elem = c.lru.PushFront(e)
+	c.files[path] = e
+	c.evict()
+	return &cachedFile{File: f, info: fi, entry: e}, nil
+}
+
+func (c *fdCache) get(path string) *cachedFile {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e := c.files[path]
+	if e == nil {
+		return nil
+	}
+	e.refs++
+	c.lru.MoveToFront(e.elem)
+	return &cachedFile{File: e.file, entry: e}
+}
+
+// removes least recently used files not in use until there are no more than
+// MaxOpenFiles left. Must be called with mutex held.
+func (c *fdCache) evict() {
+	for el := c.lru.Back(); el != nil && c.lru.Len() > config().MaxOpenFiles; {
+		e := el.Value.(*fdCacheEntry)
+		el = el.Prev()
+		if e.refs == 0 {
+			c.remove(e)
+		}
+	}
+}
+
+// must be called with mutex held
+func (c *fdCache) remove(e *fdCacheEntry) {
+	c.lru.Remove(e.elem)
+	e.elem = nil
+	delete(c.files, e.path)
+	e.closed = true
+	if e.refs == 0 {
+		e.file.Close()
+	}
+}
+
+// closes cached packfile at path once it is no longer in use
+func (c *fdCache) invalidate(path string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if e := c.files[path]; e != nil {
+		c.remove(e)
+	}
+}
+
+// closes all cached packfiles once they are no longer in use
+func (c *fdCache) reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, e := range c.files {
+		c.remove(e)
+	}
+}
+
+// returns number of cached packfiles
+func (c *fdCache) len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return len(c.files)
+}
+
+func (f *cachedFile) Close() error {
+	if f.entry == nil {
+		return f.File.Close()
+	}
+
+	openFiles.mutex.Lock()
+	defer openFiles.mutex.Unlock()
+
+	e := f.entry
+	f.entry = nil
+	if e.refs--; e.refs == 0 {
+		if e.closed {
+			return e.file.Close()
+		}
+		openFiles.evict()
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build go1.24
+
+package server
+
+import "net/http"
+
+const h2cSupported = true
+
+// allows HTTP/2 with prior knowledge on plain text listener
+func enableH2C(srv *http.Server) {
+	var p http.Protocols
+	p.SetHTTP1(true)
+	p.SetUnencryptedHTTP2(true)
+	srv.Protocols = &p
+}
@@ -0,0 +1,10 @@
+//go:build !go1.24
+
+package server
+
+import "net/http"
+
+// cleartext HTTP/2 server requires Go 1.24
+const h2cSupported = false
+
+func enableH2C(srv *http.Server) {}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ConfigHashList struct {
+	Name      string   `yaml:"Name"`
+	Algorithm string   `yaml:"Algorithm"`
+	Include   []string `yaml:"Include"`
+}
+
+type compiledHashList struct {
+	name    string
+	include []*regexp.Regexp
+	newHash func() hash.Hash
+}
+
+// hash lists generated for a search path, keyed by name. Each build gets
+// next generation number, so that build of older scan that finishes late
+// doesn't replace lists of newer one.
+type hashListData struct {
+	mutex sync.RWMutex
+	lists map[string][]byte
+	built uint64 // generation of lists
+	next  atomic.Uint64
+}
+
+var hashLists []compiledHashList
+
+var hashAlgorithms = map[string]func() hash.Hash{
+	"crc32":  func() hash.Hash { return crc32.NewIEEE() },
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+func validateHashLists(cfg *Config) error {
+	for _, v := range cfg.HashLists {
+		if len(v.Name) == 0 {
+			return errors.New("HashLists entry must have Name")
+		}
+		if _, ok := hashAlgorithms[v.Algorithm]; !ok && len(v.Algorithm) > 0 {
+			return fmt.Errorf(`Bad hash list algorithm "%s"`, v.Algorithm)
+		}
+		for _, r := range v.Include {
+			if _, err := regexp.Compile(r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func compileHashLists() {
+	hashLists = nil
+	for _, cfg := range config().HashLists {
+		if len(cfg.Algorithm) == 0 {
+			cfg.Algorithm = "sha256"
+		}
+		// request paths are matched in lower case
+		list := compiledHashList{name: strings.ToLower(cfg.Name), newHash: hashAlgorithms[cfg.Algorithm]}
+		for _, r := range cfg.Include {
+			list.include = append(list.include, regexp.MustCompile(r))
+		}
+		hashLists = append(hashLists, list)
+	}
+}
+
+// opens file as it would be served, decompressing if needed
+func openSearchFile(s *searchPath, path string) (io.ReadCloser, error) {
+	if s.files == nil {
+		return os.Open(filepath.Join(s.path, path))
+	}
+	entry, _ := s.files.get(path)
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := s.dataOffset(f, &entry)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var r io.Reader = io.NewSectionReader(f, offset, int64(entry.size))
+	if entry.method != 0 {
+		r = flate.NewReader(r)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, f}, nil
+}
+
+// finds files visible through search path matching include list,
+// respecting PakBlackList and DirWhiteList like handler does. Directories
+// are walked only if dirs is true.
+func (c *compiledSearchPath) visibleFiles(search []searchPath, include []*regexp.Regexp, dirs bool) map[string]*searchPath {
+	visible := make(map[string]*searchPath)
+	tombstones := config().tombstones
+	for i := range search {
+		s := &search[i]
+		if s.files != nil {
+			for i := 0; i < s.files.len(); i++ {
+				name := s.files.name(i)
+				if _, ok := visible[name]; ok {
+					continue
+				}
+				if matchRegexpList(include, name) && c.allowPak(name) && !matchRegexpList(tombstones, name) {
+					visible[name] = s
+				}
+			}
+			continue
+		}
+		if !dirs {
+			continue
+		}
+		filepath.WalkDir(s.path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(s.path, p)
+			if err != nil {
+				return nil
+			}
+			name := filepath.ToSlash(rel)
+			if _, ok := visible[name]; ok {
+				return nil
+			}
+			if matchRegexpList(include, name) && c.allowDir(name) && !matchRegexpList(tombstones, name) {
+				visible[name] = s
+			}
+			return nil
+		})
+	}
+	return visible
+}
+
+func buildHashList(list *compiledHashList, c *compiledSearchPath, search []searchPath) []byte {
+	visible := c.visibleFiles(search, list.include, true)
+	names := make([]string, 0, len(visible))
+	for name := range visible {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		f, err := openSearchFile(visible[name], name)
+		if err != nil {
+			log.Printf(`ERROR: hash "%s": %s`, name, err)
+			continue
+		}
+		h := list.newHash()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			log.Printf(`ERROR: hash "%s": %s`, name, err)
+			continue
+		}
+		fmt.Fprintf(&buf, "%s %s\n", hex.EncodeToString(h.Sum(nil)), name)
+	}
+	return buf.Bytes()
+}
+
+// starts building hash lists of scanned search path in background
+func (h *hashListData) start(c *compiledSearchPath, search []searchPath, hashLists []compiledHashList) {
+	go h.build(h.next.Add(1), c, search, hashLists)
+}
+
+func (h *hashListData) build(gen uint64, c *compiledSearchPath, search []searchPath, hashLists []compiledHashList) {
+	lists := make(map[string][]byte, len(hashLists))
+	for i := range hashLists {
+		if h.next.Load() != gen {
+			return // superseded by newer scan
+		}
+		lists[hashLists[i].name] = buildHashList(&hashLists[i], c, search)
+	}
+
+	h.mutex.Lock()
+	if gen > h.built {
+		h.lists, h.built = lists, gen
+	}
+	h.mutex.Unlock()
+}
+
+// returns true if path names a hash list, serving it if ready
+func (h *hashListData) serve(w http.ResponseWriter, r *http.Request, path string) bool {
+	found := false
+	for i := range hashLists {
+		if hashLists[i].name == path {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+
+	h.mutex.RLock()
+	b, ok := h.lists[path]
+	h.mutex.RUnlock()
+
+	if !ok {
+		w.Header().Set("Retry-After", "10")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return true
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+	return true
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/binary"
+	"hash/maphash"
+)
+
+// fileIndex maps normalized quake paths to packfile entries. Names are kept
+// in a single buffer and entries in a slice, found through open addressing
+// hash table of entry numbers. Unlike map[string]pakFileEntry, this doesn't
+// allocate each name separately and wastes little space on bucket overhead,
+// which matters when hundreds of thousands of entries are indexed.
+type fileIndex struct {
+	names   []byte
+	ends    []uint32 // end of each entry name in names
+	entries []pakFileEntry
+	slots   []uint32 // entry number + 1, 0 if slot is free
+	mapped  []byte   // index file in IndexDir, other fields are nil if set
+}
+
+var indexSeed = maphash.MakeSeed()
+
+// maximum number of entries to preallocate, as count comes from untrusted
+// packfile header
+const maxIndexHint = 1 << 16
+
+func newFileIndex(n int) *fileIndex {
+	if n > maxIndexHint {
+		n = maxIndexHint
+	}
+	slots := 8
+	for slots < n*2 {
+		slots <<= 1
+	}
+	return &fileIndex{
+		ends:    make([]uint32, 0, n),
+		entries: make([]pakFileEntry, 0, n),
+		slots:   make([]uint32, slots),
+	}
+}
+
+func (x *fileIndex) len() int {
+	if x.mapped != nil {
+		return int(binary.LittleEndian.Uint32(x.mapped[4:]))
+	}
+	return len(x.entries)
+}
+
+func (x *fileIndex) nameBytes(i int) []byte {
+	if x.mapped != nil {
+		return x.mappedName(i)
+	}
+	start := uint32(0)
+	if i > 0 {
+		start = x.ends[i-1]
+	}
+	return x.names[start:x.ends[i]]
+}
+
+// returns name of i-th entry
+func (x *fileIndex) name(i int) string {
+	return string(x.nameBytes(i))
+}
+
+// returns i-th entry
+func (x *fileIndex) entry(i int) *pakFileEntry {
+	if x.mapped != nil {
+		e := x.mappedEntry(i)
+		return &e
+	}
+	return &x.entries[i]
+}
+
+// returns slot where name is or should be, and entry number, -1 if not found
+func (x *fileIndex) find(name string) (int, int) {
+	if x.mapped != nil {
+		return x.findMapped(name)
+	}
+	mask := len(x.slots) - 1
+	for s := int(maphash.String(indexSeed, name)) & mask; ; s = (s + 1) & mask {
+		e := x.slots[s]
+		if e == 0 {
+			return s, -1
+		}
+		if string(x.nameBytes(int(e-1))) == name {
+			return s, int(e - 1)
+		}
+	}
+}
+
+func (x *fileIndex) get(name string) (pakFileEntry, bool) {
+	if _, i := x.find(name); i >= 0 {
+		return *x.entry(i), true
+	}
+	return pakFileEntry{}, false
+}
+
+// adds entry or replaces existing one with the same name
+func (x *fileIndex) put(name string, entry pakFileEntry) {
+	s, i := x.find(name)
+	if i >= 0 {
+		x.entries[i] = entry
+		return
+	}
+	x.names = append(x.names, name...)
+	x.ends = append(x.ends, uint32(len(x.names)))
+	x.entries = append(x.entries, entry)
+	x.slots[s] = uint32(len(x.entries))
+	if len(x.entries)*2 > len(x.slots) {
+		x.rehash(len(x.slots) * 2)
+	}
+}
+
+func (x *fileIndex) rehash(n int) {
+	x.slots = make([]uint32, n)
+	mask := n - 1
+	for i := range x.entries {
+		s := int(maphash.Bytes(indexSeed, x.nameBytes(i))) & mask
+		for x.slots[s] != 0 {
+			s = (s + 1) & mask
+		}
+		x.slots[s] = uint32(i + 1)
+	}
+}
+
+// releases spare capacity once all entries are added
+func (x *fileIndex) compact() {
+	x.names = append([]byte(nil), x.names...)
+	x.ends = append([]uint32(nil), x.ends...)
+	x.entries = append([]pakFileEntry(nil), x.entries...)
+}
+
+// returns index of entries with given names, or nil if name ends are
+// inconsistent
+func restoreFileIndex(names []byte, ends []uint32, entries []pakFileEntry) *fileIndex {
+	if len(ends) != len(entries) {
+		return nil
+	}
+	prev := uint32(0)
+	for _, end := range ends {
+		if end < prev || end > uint32(len(names)) {
+			return nil
+		}
+		prev = end
+	}
+	if len(ends) > 0 && int(ends[len(ends)-1]) != len(names) {
+		return nil
+	}
+	slots := 8
+	for slots < len(entries)*2+1 {
+		slots <<= 1
+	}
+	x := &fileIndex{names: names, ends: ends, entries: entries}
+	x.rehash(slots)
+	return x
+}
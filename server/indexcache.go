@@ -0,0 +1,199 @@
+package server
+
+import (
+	"encoding/gob"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/skullernet/pakserve/pak"
+)
+
+// bumped whenever index cache format changes
+const indexCacheVersion = 1
+
+// IndexCacheFile is saved to IndexCache after scans and loaded on start, so
+// that unchanged packfiles don't need to be read again.
+type IndexCacheFile struct {
+	Version  int
+	Settings string // scan settings packfiles were scanned with
+	Archives []IndexCacheArchive
+}
+
+type IndexCacheArchive struct {
+	Path    string
+	Size    int64
+	ModTime int64 // unix nanoseconds
+	Zip     bool
+	Issues  []string
+	Meta    *pak.Metadata
+	Names   []byte
+	Ends    []uint32
+	Entries []IndexCacheEntry
+}
+
+type IndexCacheEntry struct {
+	Offset  int64
+	Size    uint64
+	CRC     uint32
+	Len     uint64
+	ModTime uint32
+	Method  uint16
+}
+
+var (
+	// packfiles loaded from IndexCache that were not scanned yet
+	diskIndex         map[string]*IndexCacheArchive
+	diskIndexSettings string
+	diskIndexMutex    sync.Mutex
+)
+
+func indexCacheEnabled() bool {
+	return len(config().IndexCache) > 0
+}
+
+func loadIndexCache() {
+	if !indexCacheEnabled() {
+		return
+	}
+	f, err := os.Open(config().IndexCache)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.Printf(`ERROR: load index cache "%s": %s`, config().IndexCache, err)
+		return
+	}
+	defer f.Close()
+
+	var cache IndexCacheFile
+	if err := gob.NewDecoder(f).Decode(&cache); err != nil {
+		log.Printf(`ERROR: load index cache "%s": %s`, config().IndexCache, err)
+		return
+	}
+	if cache.Version != indexCacheVersion {
+		log.Printf(`WARNING: index cache "%s" has unsupported version %d, ignored`, config().IndexCache, cache.Version)
+		return
+	}
+
+	diskIndexMutex.Lock()
+	defer diskIndexMutex.Unlock()
+
+	diskIndex = make(map[string]*IndexCacheArchive, len(cache.Archives))
+	diskIndexSettings = cache.Settings
+	for i := range cache.Archives {
+		a := &cache.Archives[i]
+		diskIndex[a.Path] = a
+	}
+	if config().LogLevel >= LogLevelInfo {
+		log.Printf(`Loaded %d packfiles from index cache "%s"`, len(diskIndex), config().IndexCache)
+	}
+}
+
+// returns packfile loaded from index cache if it didn't change on disk since
+// it was scanned. Each packfile is only taken from cache once, later rescans
+// reuse it from memory.
+func cachedArchive(dir, v string) *searchPath {
+	name := filepath.Join(dir, v)
+	diskIndexMutex.Lock()
+	a := diskIndex[name]
+	delete(diskIndex, name)
+	settings := diskIndexSettings
+	diskIndexMutex.Unlock()
+
+	if a == nil || settings != scanSettingsKey() {
+		return nil
+	}
+	fi, err := os.Stat(name)
+	if err != nil || fi.Size() != a.Size || fi.ModTime().UnixNano() != a.ModTime {
+		return nil
+	}
+	entries := make([]pakFileEntry, len(a.Entries))
+	for i, e := range a.Entries {
+		entries[i] = pakFileEntry{offset: e.Offset, size: e.Size, filecrc: e.CRC, filelen: e.Len, mtime: e.ModTime, method: e.Method}
+	}
+	files := restoreFileIndex(a.Names, a.Ends, entries)
+	if files == nil {
+		return nil
+	}
+	s := &searchPath{
+		path:   name,
+		files:  files,
+		issues: a.Issues,
+		state:  &archiveState{dir: dir, info: fi},
+		meta:   a.Meta,
+	}
+	if a.Zip {
+		s.offsets = newOffsetCache()
+	}
+	mapIndex(s)
+	return s
+}
+
+func newIndexCacheArchive(s *searchPath) IndexCacheArchive {
+	names, ends, entries := s.files.export()
+	a := IndexCacheArchive{
+		Path:    s.path,
+		Size:    s.state.info.Size(),
+		ModTime: s.state.info.ModTime().UnixNano(),
+		Zip:     s.offsets != nil,
+		Issues:  s.issues,
+		Meta:    s.meta,
+		Names:   names,
+		Ends:    ends,
+		Entries: make([]IndexCacheEntry, len(entries)),
+	}
+	for i, e := range entries {
+		a.Entries[i] = IndexCacheEntry{Offset: e.offset, Size: e.size, CRC: e.filecrc, Len: e.filelen, ModTime: e.mtime, Method: e.method}
+	}
+	return a
+}
+
+// writes scanned packfiles to IndexCache. With LazyScan, packfiles loaded
+// from cache that weren't needed yet are kept as long as they exist.
+// Must be called with searchPathsMutex held.
+func saveIndexCache() {
+	if !indexCacheEnabled() {
+		return
+	}
+
+	cache := IndexCacheFile{Version: indexCacheVersion, Settings: scanSettingsKey()}
+	dirCacheMutex.Lock()
+	for _, s := range cachedArchives() {
+		if !s.state.quarantined.Load() {
+			cache.Archives = append(cache.Archives, newIndexCacheArchive(&s))
+		}
+	}
+	dirCacheMutex.Unlock()
+
+	if config().LazyScan {
+		diskIndexMutex.Lock()
+		for name, a := range diskIndex {
+			if fi, err := os.Stat(name); err == nil && fi.Size() == a.Size && fi.ModTime().UnixNano() == a.ModTime &&
+				diskIndexSettings == cache.Settings {
+				cache.Archives = append(cache.Archives, *a)
+			}
+		}
+		diskIndexMutex.Unlock()
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(config().IndexCache), ".pakserve-index-*")
+	if err != nil {
+		log.Printf(`ERROR: save index cache "%s": %s`, config().IndexCache, err)
+		return
+	}
+	err = gob.NewEncoder(f).Encode(&cache)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), config().IndexCache)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		log.Printf(`ERROR: save index cache "%s": %s`, config().IndexCache, err)
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigListen is a list of addresses to listen on. Single address can be
+// given as a string, and empty string means none.
+type ConfigListen []ConfigListenAddr
+
+type ConfigListenAddr struct {
+	Address string `yaml:"Address"`
+	Profile string `yaml:"Profile"` // overrides ListenProfile or ListenTLSProfile
+}
+
+func (l *ConfigListen) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		var addr string
+		if err := value.Decode(&addr); err != nil {
+			return err
+		}
+		*l = nil
+		if len(addr) > 0 {
+			*l = ConfigListen{{Address: addr}}
+		}
+		return nil
+	}
+	var list []ConfigListenAddr
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// list entry can be either address string or mapping with Address and Profile
+func (a *ConfigListenAddr) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*a = ConfigListenAddr{}
+		return value.Decode(&a.Address)
+	}
+	type plain ConfigListenAddr
+	return value.Decode((*plain)(a))
+}
+
+func validateListen(cfg *Config) error {
+	seen := make(map[string]bool)
+	for _, list := range []ConfigListen{cfg.Listen, cfg.ListenTLS} {
+		for _, l := range list {
+			if len(l.Address) == 0 {
+				return errors.New("Listen and ListenTLS entries must have Address")
+			}
+			if seen[l.Address] {
+				return fmt.Errorf(`Duplicate listen address "%s"`, l.Address)
+			}
+			seen[l.Address] = true
+		}
+	}
+	return nil
+}
+
+// returns profile of listener, falling back to default profile name
+func listenProfile(l ConfigListenAddr, def string) *Profile {
+	if len(l.Profile) > 0 {
+		return profiles[l.Profile]
+	}
+	return profiles[def]
+}
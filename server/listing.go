@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+type ListingFile struct {
+	Name   string `json:"name"`
+	Size   uint64 `json:"size"`
+	CRC    string `json:"crc,omitempty"`    // ZIP entries only
+	Source string `json:"source,omitempty"` // packfile name, empty for directories
+}
+
+type Listing struct {
+	Files []ListingFile `json:"files"`
+}
+
+var listingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html><head><title>{{.Dir}}</title></head><body>
+<table>
+<tr><th>Name</th><th>Size</th><th>CRC</th><th>Source</th></tr>
+{{range .Files}}<tr><td><a href="{{.Href}}">{{.Name}}</a></td><td>{{.Size}}</td><td>{{.CRC}}</td><td>{{.Source}}</td></tr>
+{{end}}</table>
+</body></html>
+`))
+
+func listingRequested(r *http.Request) bool {
+	return config().FileListing && r.URL.Query().Has("list")
+}
+
+// lists files visible through search path whose names start with prefix,
+// as JSON or, if list=html is requested, as HTML page
+func handleListing(w http.ResponseWriter, r *http.Request, match *compiledSearchPath, search []searchPath, prefix string) {
+	include := []*regexp.Regexp{regexp.MustCompile("^" + regexp.QuoteMeta(prefix))}
+	listing := Listing{Files: make([]ListingFile, 0)}
+	for name, s := range match.visibleFiles(search, include, true) {
+		f := ListingFile{Name: name}
+		if s.files == nil {
+			fi, err := os.Stat(filepath.Join(s.path, filepath.FromSlash(name)))
+			if err != nil {
+				continue
+			}
+			f.Size = uint64(fi.Size())
+		} else {
+			entry, _ := s.files.get(name)
+			f.Source = filepath.Base(s.path)
+			if entry.method != 0 {
+				f.Size = entry.filelen
+			} else {
+				f.Size = entry.size
+			}
+			if s.offsets != nil {
+				f.CRC = fmt.Sprintf("%08x", entry.filecrc)
+			}
+		}
+		listing.Files = append(listing.Files, f)
+	}
+	sort.Slice(listing.Files, func(i, j int) bool {
+		return listing.Files[i].Name < listing.Files[j].Name
+	})
+
+	var buf bytes.Buffer
+	if r.URL.Query().Get("list") == "html" {
+		// links are relative to directory of request path
+		dir := prefix[:strings.LastIndex(prefix, "/")+1]
+		type htmlFile struct {
+			ListingFile
+			Href string
+		}
+		files := make([]htmlFile, len(listing.Files))
+		for i, f := range listing.Files {
+			files[i] = htmlFile{f, f.Name[len(dir):]}
+		}
+		if err := listingTemplate.Execute(&buf, struct {
+			Dir   string
+			Files []htmlFile
+		}{"/" + dir, files}); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	} else {
+		if err := json.NewEncoder(&buf).Encode(&listing); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf.Bytes()))
+}
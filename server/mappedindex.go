@@ -0,0 +1,210 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/maphash"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Index file written to IndexDir for each scanned packfile and memory mapped
+// instead of keeping fileIndex on heap. All numbers are little endian:
+//
+//	header   magic, number of entries, number of slots
+//	slots    entry number + 1 per hash table slot, 0 if slot is free
+//	entries  mappedEntrySize bytes each, see mappedEntry
+//	names    entry names back to back
+//
+// Slots are hashed with indexSeed, which is chosen on every start, so files
+// are rewritten when packfiles are scanned and never reused by next process.
+const (
+	mappedIndexMagic  = "PSIX"
+	mappedHeaderSize  = 12
+	mappedEntrySize   = 40
+	mappedIndexSuffix = ".idx"
+)
+
+var errMappedIndex = errors.New("bad index file")
+
+func (x *fileIndex) slotCount() int {
+	return int(binary.LittleEndian.Uint32(x.mapped[8:]))
+}
+
+func (x *fileIndex) mappedSlot(s int) uint32 {
+	return binary.LittleEndian.Uint32(x.mapped[mappedHeaderSize+s*4:])
+}
+
+func (x *fileIndex) mappedRecord(i int) []byte {
+	off := mappedHeaderSize + x.slotCount()*4 + i*mappedEntrySize
+	return x.mapped[off : off+mappedEntrySize]
+}
+
+func (x *fileIndex) mappedEntry(i int) pakFileEntry {
+	b := x.mappedRecord(i)
+	le := binary.LittleEndian
+	return pakFileEntry{
+		offset:  int64(le.Uint64(b[0:])),
+		size:    le.Uint64(b[8:]),
+		filelen: le.Uint64(b[16:]),
+		filecrc: le.Uint32(b[24:]),
+		mtime:   le.Uint32(b[28:]),
+		method:  le.Uint16(b[32:]),
+	}
+}
+
+func (x *fileIndex) mappedName(i int) []byte {
+	names := mappedHeaderSize + x.slotCount()*4 + x.len()*mappedEntrySize
+	start := uint32(0)
+	if i > 0 {
+		start = binary.LittleEndian.Uint32(x.mappedRecord(i - 1)[36:])
+	}
+	end := binary.LittleEndian.Uint32(x.mappedRecord(i)[36:])
+	return x.mapped[names+int(start) : names+int(end)]
+}
+
+func (x *fileIndex) findMapped(name string) (int, int) {
+	mask := x.slotCount() - 1
+	for s := int(maphash.String(indexSeed, name)) & mask; ; s = (s + 1) & mask {
+		e := x.mappedSlot(s)
+		if e == 0 {
+			return s, -1
+		}
+		if string(x.mappedName(int(e-1))) == name {
+			return s, int(e - 1)
+		}
+	}
+}
+
+// returns names, name ends and entries of index, copied out of index file if
+// it is mapped
+func (x *fileIndex) export() ([]byte, []uint32, []pakFileEntry) {
+	if x.mapped == nil {
+		return x.names, x.ends, x.entries
+	}
+	var names []byte
+	ends := make([]uint32, x.len())
+	entries := make([]pakFileEntry, x.len())
+	for i := range entries {
+		names = append(names, x.mappedName(i)...)
+		ends[i] = uint32(len(names))
+		entries[i] = x.mappedEntry(i)
+	}
+	return names, ends, entries
+}
+
+func (x *fileIndex) encode() []byte {
+	le := binary.LittleEndian
+	size := mappedHeaderSize + len(x.slots)*4 + len(x.entries)*mappedEntrySize + len(x.names)
+	b := make([]byte, 0, size)
+	b = append(b, mappedIndexMagic...)
+	b = le.AppendUint32(b, uint32(len(x.entries)))
+	b = le.AppendUint32(b, uint32(len(x.slots)))
+	for _, v := range x.slots {
+		b = le.AppendUint32(b, v)
+	}
+	for i, e := range x.entries {
+		b = le.AppendUint64(b, uint64(e.offset))
+		b = le.AppendUint64(b, e.size)
+		b = le.AppendUint64(b, e.filelen)
+		b = le.AppendUint32(b, e.filecrc)
+		b = le.AppendUint32(b, e.mtime)
+		b = le.AppendUint16(b, e.method)
+		b = append(b, 0, 0)
+		b = le.AppendUint32(b, x.ends[i])
+	}
+	return append(b, x.names...)
+}
+
+// returns name of index file of packfile in IndexDir
+func mappedIndexPath(dir, archive string) string {
+	sum := sha256.Sum256([]byte(archive))
+	return filepath.Join(dir, hex.EncodeToString(sum[:12])+mappedIndexSuffix)
+}
+
+// writes index to IndexDir and returns index mapped from written file. File
+// is replaced by rename, so that index of packfile scanned before stays valid.
+func (x *fileIndex) writeMapped(dir, archive string) (*fileIndex, error) {
+	data := x.encode()
+	f, err := os.CreateTemp(dir, ".pakserve-idx-*")
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(data)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	name := mappedIndexPath(dir, archive)
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	f, err = os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := mapFile(f, len(data))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(b[:mappedHeaderSize], data[:mappedHeaderSize]) {
+		unmapFile(b)
+		return nil, errMappedIndex
+	}
+	m := &fileIndex{mapped: b}
+	runtime.SetFinalizer(m, func(m *fileIndex) { unmapFile(m.mapped) })
+	return m, nil
+}
+
+// moves index of scanned packfile to IndexDir if it is set. Index is kept in
+// memory if it can't be written.
+func mapIndex(s *searchPath) {
+	dir := config().IndexDir
+	if len(dir) == 0 {
+		return
+	}
+	x, err := s.files.writeMapped(dir, s.path)
+	if err != nil {
+		log.Printf(`ERROR: write index of "%s": %s`, s.path, err)
+		return
+	}
+	s.files = x
+}
+
+// removes index files of packfiles that are not searched anymore.
+// Must be called with searchPathsMutex held.
+func pruneMappedIndexes() {
+	dir := config().IndexDir
+	if len(dir) == 0 {
+		return
+	}
+	keep := make(map[string]bool)
+	dirCacheMutex.Lock()
+	for path := range cachedArchives() {
+		keep[mappedIndexPath(dir, path)] = true
+	}
+	dirCacheMutex.Unlock()
+
+	d, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf(`ERROR: prune index files: %s`, err)
+		return
+	}
+	for _, v := range d {
+		name := filepath.Join(dir, v.Name())
+		if strings.HasSuffix(v.Name(), mappedIndexSuffix) && !keep[name] {
+			os.Remove(name)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"container/list"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// identifies packfile entry by packfile path and entry offset
+type cacheKey struct {
+	path   string
+	offset int64
+}
+
+// small frequently requested entry, both raw and inflated. For entries
+// stored uncompressed both refer to the same data.
+type hotEntry struct {
+	key      cacheKey
+	raw      []byte
+	inflated []byte
+	stored   bool
+}
+
+func (e *hotEntry) size() int64 {
+	if e.stored {
+		return int64(len(e.raw))
+	}
+	return int64(len(e.raw) + len(e.inflated))
+}
+
+// memCache keeps raw (possibly compressed) packfile entry data in memory,
+// along with inflated copies of compressed entries served to identity clients
+// and least recently used small entries
+type memCache struct {
+	mutex        sync.RWMutex
+	pinned       map[cacheKey][]byte
+	size         int64
+	inflated     map[cacheKey][]byte
+	inflatedSize int64
+	hot          map[cacheKey]*list.Element
+	hotList      list.List // most recently used at front
+	hotSize      int64
+}
+
+var contentCache = memCache{
+	pinned:   make(map[cacheKey][]byte),
+	inflated: make(map[cacheKey][]byte),
+	hot:      make(map[cacheKey]*list.Element),
+}
+
+func (c *memCache) get(path string, offset int64) []byte {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.pinned[cacheKey{path, offset}]
+}
+
+func (c *memCache) getInflated(path string, offset int64) []byte {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.inflated[cacheKey{path, offset}]
+}
+
+// reports whether inflated entry of given length fits into InflateCacheSize
+func (c *memCache) wantInflated(length int64) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.inflatedSize+length <= config().InflateCacheSize
+}
+
+// stores inflated entry data if it is complete and fits into cache
+func (c *memCache) putInflated(path string, entry *pakFileEntry, data []byte) {
+	if len(data) != int(entry.filelen) || crc32.ChecksumIEEE(data) != entry.filecrc {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := cacheKey{path, entry.offset}
+	if c.inflated[key] != nil || c.inflatedSize+int64(len(data)) > config().InflateCacheSize {
+		return
+	}
+	c.inflated[key] = data
+	c.inflatedSize += int64(len(data))
+}
+
+func (c *memCache) reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.pinned = make(map[cacheKey][]byte)
+	c.size = 0
+	c.inflated = make(map[cacheKey][]byte)
+	c.inflatedSize = 0
+	c.hot = make(map[cacheKey]*list.Element)
+	c.hotList.Init()
+	c.hotSize = 0
+}
+
+type cacheStats struct {
+	PinnedEntries   int   `json:"pinned_entries"`
+	PinnedBytes     int64 `json:"pinned_bytes"`
+	InflatedEntries int   `json:"inflated_entries"`
+	InflatedBytes   int64 `json:"inflated_bytes"`
+	HotEntries      int   `json:"hot_entries"`
+	HotBytes        int64 `json:"hot_bytes"`
+}
+
+func (c *memCache) stats() cacheStats {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return cacheStats{
+		PinnedEntries:   len(c.pinned),
+		PinnedBytes:     c.size,
+		InflatedEntries: len(c.inflated),
+		InflatedBytes:   c.inflatedSize,
+		HotEntries:      len(c.hot),
+		HotBytes:        c.hotSize,
+	}
+}
+
+// drops cached entries of packfile at path
+func (c *memCache) unpin(path string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for k, v := range c.pinned {
+		if k.path == path {
+			delete(c.pinned, k)
+			c.size -= int64(len(v))
+		}
+	}
+	for k, v := range c.inflated {
+		if k.path == path {
+			delete(c.inflated, k)
+			c.inflatedSize -= int64(len(v))
+		}
+	}
+	for k, el := range c.hot {
+		if k.path == path {
+			c.removeHot(el)
+		}
+	}
+}
+
+func (c *memCache) getHot(path string, offset int64) *hotEntry {
+	if config().HotCacheSize <= 0 {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	el := c.hot[cacheKey{path, offset}]
+	if el == nil {
+		return nil
+	}
+	c.hotList.MoveToFront(el)
+	return el.Value.(*hotEntry)
+}
+
+// reports whether entry is small enough to be kept in hot cache
+func wantHot(entry *pakFileEntry) bool {
+	return config().HotCacheSize > 0 && int64(entry.filelen) <= config().HotCacheMaxEntry &&
+		int64(entry.size) <= config().HotCacheMaxEntry
+}
+
+// reads entry data at offset of packfile f into hot cache, evicting least
+// recently used entries to make room. Returns raw entry data, or nil if it
+// couldn't be read or verified.
+func (c *memCache) loadHot(s *searchPath, entry *pakFileEntry, f io.ReaderAt, offset int64) []byte {
+	raw := make([]byte, entry.size)
+	if _, err := f.ReadAt(raw, offset); err != nil {
+		return nil
+	}
+	data := raw
+	if entry.method != 0 {
+		r := flate.NewReader(bytes.NewReader(raw))
+		b, err := io.ReadAll(io.LimitReader(r, int64(entry.filelen)+1))
+		r.Close()
+		if err != nil || len(b) != int(entry.filelen) {
+			return nil
+		}
+		data = b
+	}
+	// PAK files have no CRC
+	if s.offsets != nil && crc32.ChecksumIEEE(data) != entry.filecrc {
+		return nil
+	}
+
+	e := &hotEntry{key: cacheKey{s.path, entry.offset}, raw: raw, inflated: data, stored: entry.method == 0}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.hot[e.key] != nil || e.size() > config().HotCacheSize {
+		return raw
+	}
+	for c.hotSize+e.size() > config().HotCacheSize && c.hotList.Len() > 0 {
+		c.removeHot(c.hotList.Back())
+	}
+	if c.hotSize+e.size() <= config().HotCacheSize {
+		c.hot[e.key] = c.hotList.PushFront(e)
+		c.hotSize += e.size()
+	}
+	return raw
+}
+
+// must be called with mutex held
+func (c *memCache) removeHot(el *list.Element) {
+	e := el.Value.(*hotEntry)
+	c.hotList.Remove(el)
+	delete(c.hot, e.key)
+	c.hotSize -= e.size()
+}
+
+func readEntry(s *searchPath, entry *pakFileEntry) ([]byte, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	offset, err := s.dataOffset(f, entry)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, entry.size)
+	if _, err := f.ReadAt(data, offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// loads packfile entries visible through search path that match
+// PinnedPaths into memory, where they stay until next rescan
+func (c *memCache) pin(sp *compiledSearchPath, search []searchPath) {
+	pinnedPaths := config().pinnedPaths
+	if len(pinnedPaths) == 0 {
+		return
+	}
+	for name, s := range sp.visibleFiles(search, pinnedPaths, false) {
+		entry, _ := s.files.get(name)
+		key := cacheKey{s.path, entry.offset}
+		if c.get(key.path, key.offset) != nil {
+			continue
+		}
+		data, err := readEntry(s, &entry)
+		if err != nil {
+			log.Printf(`ERROR: pin "%s" from "%s": %s`, name, s.path, err)
+			continue
+		}
+
+		c.mutex.Lock()
+		c.pinned[key] = data
+		c.size += int64(len(data))
+		c.mutex.Unlock()
+	}
+	if config().LogLevel >= LogLevelInfo {
+		c.mutex.RLock()
+		log.Printf("%d files (%d bytes) pinned in memory", len(c.pinned), c.size)
+		c.mutex.RUnlock()
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type metricsData struct {
+	mutex       sync.Mutex
+	requests    map[int]uint64    // by status code
+	bytes       uint64            // bytes of response bodies
+	cacheHits   map[string]uint64 // by search path name
+	archiveHits map[string]uint64 // by packfile path
+}
+
+var metrics = newMetrics()
+
+func newMetrics() *metricsData {
+	return &metricsData{
+		requests:    make(map[int]uint64),
+		cacheHits:   make(map[string]uint64),
+		archiveHits: make(map[string]uint64),
+	}
+}
+
+func metricsEnabled() bool {
+	return len(config().MetricsListen) > 0
+}
+
+func (m *metricsData) request(status int, written int64) {
+	if status < 0 {
+		status = http.StatusOK
+	}
+	m.mutex.Lock()
+	m.requests[status]++
+	m.bytes += uint64(written)
+	m.mutex.Unlock()
+}
+
+// counts entry served from packfile, either from disk or from memory
+func (m *metricsData) archiveHit(searchPath, archive string, cached bool) {
+	if !metricsEnabled() {
+		return
+	}
+	m.mutex.Lock()
+	m.archiveHits[archive]++
+	if cached {
+		m.cacheHits[searchPath]++
+	}
+	m.mutex.Unlock()
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func writeCounterMap(w io.Writer, name, help, label string, m map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, escapeLabel(k), m[k])
+	}
+}
+
+// counts open file descriptors where this is cheap to do
+func openFDs() (int, bool) {
+	d, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, false
+	}
+	return len(d), true
+}
+
+// serves metrics in Prometheus text exposition format
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	m := metrics
+	m.mutex.Lock()
+	requests := make(map[string]uint64, len(m.requests))
+	for k, v := range m.requests {
+		requests[strconv.Itoa(k)] = v
+	}
+	writeCounterMap(w, "pakserve_requests_total", "Requests by status code.", "code", requests)
+	fmt.Fprintf(w, "# HELP pakserve_sent_bytes_total Bytes of response bodies sent.\n")
+	fmt.Fprintf(w, "# TYPE pakserve_sent_bytes_total counter\n")
+	fmt.Fprintf(w, "pakserve_sent_bytes_total %d\n", m.bytes)
+	writeCounterMap(w, "pakserve_cache_hits_total", "Packfile entries served from memory by search path.", "searchpath", m.cacheHits)
+	writeCounterMap(w, "pakserve_archive_hits_total", "Entries served by packfile.", "archive", m.archiveHits)
+	m.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP pakserve_content_revision Current content revision.\n")
+	fmt.Fprintf(w, "# TYPE pakserve_content_revision gauge\n")
+	fmt.Fprintf(w, "pakserve_content_revision %d\n", contentRevision.Load())
+	if n, ok := openFDs(); ok {
+		fmt.Fprintf(w, "# HELP pakserve_open_fds Open file descriptors.\n")
+		fmt.Fprintf(w, "# TYPE pakserve_open_fds gauge\n")
+		fmt.Fprintf(w, "pakserve_open_fds %d\n", n)
+	}
+}
+
+func metricsHandler() http.Handler {
+	path := config().MetricsPath
+	if len(path) == 0 {
+		path = "/metrics"
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, handleMetrics)
+	return mux
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type ConfigMirror struct {
+	URL        string  `yaml:"URL"`
+	Sample     float64 `yaml:"Sample"`
+	MaxPending int     `yaml:"MaxPending"`
+}
+
+type mirrorResult struct {
+	status   int
+	encoding string
+	length   int64
+}
+
+var (
+	mirrorURL    *url.URL
+	mirrorSample float64
+	mirrorSlots  chan struct{}
+	mirrorClient = &http.Client{
+		Timeout: 5 * time.Minute,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Transport: &http.Transport{DisableCompression: true},
+	}
+)
+
+func validateMirror(cfg *Config) error {
+	if len(cfg.Mirror.URL) == 0 {
+		return nil
+	}
+	u, err := url.Parse(cfg.Mirror.URL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || len(u.Host) == 0 {
+		return fmt.Errorf(`Mirror URL "%s" must be absolute http or https URL`, cfg.Mirror.URL)
+	}
+	return nil
+}
+
+func loadMirror() {
+	mirrorURL = nil
+	if len(config().Mirror.URL) == 0 {
+		return
+	}
+	u, _ := url.Parse(config().Mirror.URL)
+	mirrorSample = config().Mirror.Sample
+	if mirrorSample <= 0 {
+		mirrorSample = 1
+	}
+	maxPending := config().Mirror.MaxPending
+	if maxPending <= 0 {
+		maxPending = 16
+	}
+	mirrorURL = u
+	mirrorSlots = make(chan struct{}, maxPending)
+}
+
+func mirrorEnabled() bool {
+	return mirrorURL != nil
+}
+
+// returns response properties compared between servers
+func localResult(w *loggingResponseWriter, r *http.Request) mirrorResult {
+	res := mirrorResult{status: w.status, encoding: w.Header().Get("Content-Encoding"), length: w.written}
+	if r.Method == "HEAD" {
+		res.length, _ = strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64)
+	}
+	return res
+}
+
+// asynchronously replays a sample of requests against mirror server and
+// logs differences in responses. Client response is not affected.
+func mirrorRequest(r *http.Request, local mirrorResult) {
+	if rand.Float64() >= mirrorSample {
+		return
+	}
+	select {
+	case mirrorSlots <- struct{}{}:
+	default:
+		return // too many pending requests, drop
+	}
+
+	u := *mirrorURL
+	u.Path = r.URL.Path
+	u.RawPath = r.URL.RawPath
+	u.RawQuery = r.URL.RawQuery
+
+	req, err := http.NewRequest(r.Method, u.String(), nil)
+	if err != nil {
+		<-mirrorSlots
+		return
+	}
+	for _, h := range []string{"Accept-Encoding", "Referer", "User-Agent", "Range"} {
+		if v := r.Header.Get(h); len(v) > 0 {
+			req.Header.Set(h, v)
+		}
+	}
+	req.Host = r.Host
+
+	go func() {
+		defer func() { <-mirrorSlots }()
+
+		resp, err := mirrorClient.Do(req)
+		if err != nil {
+			log.Printf(`MIRROR: "%s": %s`, r.URL.Path, err)
+			return
+		}
+		n, err := io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			log.Printf(`MIRROR: "%s": %s`, r.URL.Path, err)
+			return
+		}
+
+		remote := mirrorResult{status: resp.StatusCode, encoding: resp.Header.Get("Content-Encoding"), length: n}
+		if r.Method == "HEAD" {
+			remote.length = resp.ContentLength
+		}
+		if remote != local {
+			log.Printf(`MIRROR: "%s": mismatch: local %d "%s" %d, mirror %d "%s" %d`, r.URL.Path,
+				local.status, local.encoding, local.length, remote.status, remote.encoding, remote.length)
+		} else if config().LogLevel >= LogLevelDebug {
+			log.Printf(`MIRROR: "%s": match`, r.URL.Path)
+		}
+	}()
+}
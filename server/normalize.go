@@ -0,0 +1,85 @@
+package server
+
+import (
+	"net/http"
+	pathpkg "path"
+	"strings"
+	"unicode/utf8"
+)
+
+type ConfigNormalize struct {
+	Lowercase         bool `yaml:"Lowercase"`
+	CollapseSlashes   bool `yaml:"CollapseSlashes"`
+	DecodeBackslashes bool `yaml:"DecodeBackslashes"`
+	RejectSuspicious  bool `yaml:"RejectSuspicious"`
+}
+
+func decodeBackslashes() bool {
+	return config().LegacyPaths || config().Normalize.DecodeBackslashes
+}
+
+// normalizes request path according to Normalize settings. Returns empty
+// string if path can't match any file.
+func normalizePath(path string) string {
+	if decodeBackslashes() {
+		// some clients send %5C encoded backslashes
+		path = strings.ReplaceAll(path, `\`, "/")
+	}
+	if !config().Normalize.CollapseSlashes && strings.Contains(path, "//") {
+		return ""
+	}
+	return pathpkg.Clean(path)
+}
+
+// reports whether request path contains control characters, dot segments,
+// encoded slashes or percent signs, or backslashes that aren't decoded
+func suspiciousPath(r *http.Request) bool {
+	escaped := strings.ToLower(r.URL.EscapedPath())
+	if strings.Contains(escaped, "%2f") || strings.Contains(escaped, "%25") {
+		return true
+	}
+	path := r.URL.Path
+	for i := 0; i < len(path); i++ {
+		if c := path[i]; c < 0x20 || c == 0x7f || c == '\\' && !decodeBackslashes() {
+			return true
+		}
+	}
+	for _, s := range strings.Split(path, "/") {
+		if s == "." || s == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// what to do with packfile entries whose names need normalization
+const (
+	SuspiciousReport = "report"
+	SuspiciousSkip   = "skip"
+	SuspiciousError  = "error"
+)
+
+// returns why packfile entry name needs normalization beyond lowercasing,
+// or empty string if it doesn't
+func suspiciousName(name string) string {
+	if !utf8.ValidString(name) {
+		return "invalid UTF-8"
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c < 0x20 || c == 0x7f {
+			return "control characters"
+		}
+	}
+	if strings.ContainsRune(name, '\\') {
+		return "backslashes"
+	}
+	if strings.HasPrefix(name, "/") || len(name) > 1 && name[1] == ':' {
+		return "absolute path"
+	}
+	for _, s := range strings.Split(name, "/") {
+		if s == "." || s == ".." {
+			return "dot segments"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,1847 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/skullernet/pakserve/pak"
+	"gopkg.in/yaml.v3"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/netip"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type pakFileEntry struct {
+	offset  int64  // local file header offset for ZIP files
+	size    uint64 // raw (compressed) size
+	filecrc uint32
+	filelen uint64 // uncompressed size
+	mtime   uint32
+	method  uint16
+}
+
+type searchPath struct {
+	path    string
+	files   *fileIndex
+	issues  []string      // problems found while scanning packfile
+	offsets *offsetCache  // non-nil for ZIP files
+	state   *archiveState // non-nil for packfiles
+	meta    *pak.Metadata // stamped by pakutil, if any
+}
+
+// shared state of a scanned packfile
+type archiveState struct {
+	dir         string      // search directory packfile was found in
+	info        os.FileInfo // packfile as it was when scanned
+	quarantined atomic.Bool
+}
+
+// reports whether packfile was replaced or modified since it was scanned
+func (st *archiveState) changed(fi os.FileInfo) bool {
+	return !os.SameFile(st.info, fi) || st.info.Size() != fi.Size() || !st.info.ModTime().Equal(fi.ModTime())
+}
+
+type compiledSearchPath struct {
+	match    *regexp.Regexp
+	cfg      ConfigSearchPath
+	search   []searchPath
+	scanned  time.Time       // when search was scanned, zero if lazy
+	lazy     *lazySearchPath // non-nil if LazyScan is enabled
+	hashes   *hashListData
+	pinned   *atomic.Bool  // false if pinned archives don't match
+	throttle *byteThrottle // non-nil if MaxBandwidth is set
+
+	// overrides of global lists, nil if not set
+	pakBlackList []*regexp.Regexp
+	dirWhiteList []*regexp.Regexp
+}
+
+// search path that is scanned on first match
+type lazySearchPath struct {
+	once    sync.Once
+	search  []searchPath
+	scanned atomic.Int64 // unix nanoseconds, set once search is ready
+}
+
+const (
+	LogLevelError = iota
+	LogLevelInfo
+	LogLevelDebug
+)
+
+const (
+	DuplicateLast  = "last"
+	DuplicateFirst = "first"
+	DuplicateError = "error"
+)
+
+type ConfigSearchPath struct {
+	Name          string            `yaml:"Name"`
+	Match         string            `yaml:"Match"`
+	Search        []string          `yaml:"Search"`
+	Pins          map[string]string `yaml:"Pins"`
+	MaxBandwidth  int64             `yaml:"MaxBandwidth"`
+	ContentType   *string           `yaml:"ContentType"`
+	PakBlackList  *[]string         `yaml:"PakBlackList"`
+	DirWhiteList  *[]string         `yaml:"DirWhiteList"`
+	CaseSensitive *bool             `yaml:"CaseSensitive"`
+}
+
+type Config struct {
+	Listen                ConfigListen            `yaml:"Listen"`
+	ListenTLS             ConfigListen            `yaml:"ListenTLS"`
+	ListenProfile         string                  `yaml:"ListenProfile"`
+	ListenTLSProfile      string                  `yaml:"ListenTLSProfile"`
+	Profiles              []ConfigProfile         `yaml:"Profiles"`
+	CertFile              string                  `yaml:"CertFile"`
+	KeyFile               string                  `yaml:"KeyFile"`
+	AutoTLS               ConfigAutoTLS           `yaml:"AutoTLS"`
+	DisableSessionTickets bool                    `yaml:"DisableSessionTickets"`
+	TLSTicketRotation     time.Duration           `yaml:"TLSTicketRotation"`
+	ContentType           string                  `yaml:"ContentType"`
+	RefererCheck          string                  `yaml:"RefererCheck"`
+	AllowedHosts          []string                `yaml:"AllowedHosts"`
+	TrustedProxies        []string                `yaml:"TrustedProxies"`
+	AllowFrom             []string                `yaml:"AllowFrom"`
+	DenyFrom              []string                `yaml:"DenyFrom"`
+	SigningKey            string                  `yaml:"SigningKey"`
+	ProxyProtocol         bool                    `yaml:"ProxyProtocol"`
+	PakBlackList          []string                `yaml:"PakBlackList"`
+	DirWhiteList          []string                `yaml:"DirWhiteList"`
+	PakDownloadWhiteList  []string                `yaml:"PakDownloadWhiteList"`
+	SearchPaths           []ConfigSearchPath      `yaml:"SearchPaths"`
+	PakOrder              map[string][]string     `yaml:"PakOrder"`
+	PakExtensions         map[string]string       `yaml:"PakExtensions"`
+	LogLevel              int                     `yaml:"LogLevel"`
+	LogTimeStamps         bool                    `yaml:"LogTimeStamps"`
+	LogChecksums          bool                    `yaml:"LogChecksums"`
+	LogFormat             string                  `yaml:"LogFormat"`
+	StateFile             string                  `yaml:"StateFile"`
+	RangeStatsMinSize     int64                   `yaml:"RangeStatsMinSize"`
+	StatusFile            string                  `yaml:"StatusFile"`
+	DrainTimeout          time.Duration           `yaml:"DrainTimeout"`
+	ReadTimeout           time.Duration           `yaml:"ReadTimeout"`
+	WriteTimeout          time.Duration           `yaml:"WriteTimeout"`
+	IdleTimeout           time.Duration           `yaml:"IdleTimeout"`
+	MaxHeaderBytes        int                     `yaml:"MaxHeaderBytes"`
+	H2C                   bool                    `yaml:"H2C"`
+	MinCompressSize       int64                   `yaml:"MinCompressSize"`
+	ArchiveManifest       string                  `yaml:"ArchiveManifest"`
+	FileListing           bool                    `yaml:"FileListing"`
+	RevisionPath          string                  `yaml:"RevisionPath"`
+	HashArchives          bool                    `yaml:"HashArchives"`
+	LazyScan              bool                    `yaml:"LazyScan"`
+	LegacyPaths           bool                    `yaml:"LegacyPaths"`
+	Normalize             ConfigNormalize         `yaml:"Normalize"`
+	CaseSensitive         bool                    `yaml:"CaseSensitive"`
+	WatchDirs             bool                    `yaml:"WatchDirs"`
+	Compress              ConfigCompress          `yaml:"Compress"`
+	HashLists             []ConfigHashList        `yaml:"HashLists"`
+	Tenants               []ConfigTenant          `yaml:"Tenants"`
+	Mirror                ConfigMirror            `yaml:"Mirror"`
+	PinnedPaths           []string                `yaml:"PinnedPaths"`
+	Tombstones            []string                `yaml:"Tombstones"`
+	Redirects             []ConfigRedirect        `yaml:"Redirects"`
+	InflateCacheSize      int64                   `yaml:"InflateCacheSize"`
+	MaxOpenFiles          int                     `yaml:"MaxOpenFiles"`
+	HotCacheSize          int64                   `yaml:"HotCacheSize"`
+	HotCacheMaxEntry      int64                   `yaml:"HotCacheMaxEntry"`
+	HeadIdentity          bool                    `yaml:"HeadIdentity"`
+	EncodingOverride      bool                    `yaml:"EncodingOverride"`
+	ChecksumQuery         bool                    `yaml:"ChecksumQuery"`
+	ClientOverrides       []ConfigClientOverride  `yaml:"ClientOverrides"`
+	MaxBandwidth          int64                   `yaml:"MaxBandwidth"`
+	BandwidthSchedule     []ConfigBandwidthWindow `yaml:"BandwidthSchedule"`
+	ClientLimits          ConfigClientLimits      `yaml:"ClientLimits"`
+	ChecksumTrailer       string                  `yaml:"ChecksumTrailer"`
+	AdminListen           string                  `yaml:"AdminListen"`
+	AdminToken            string                  `yaml:"AdminToken"`
+	MetricsListen         string                  `yaml:"MetricsListen"`
+	MetricsPath           string                  `yaml:"MetricsPath"`
+	DirWorkers            int                     `yaml:"DirWorkers"`
+	ScanWorkers           int                     `yaml:"ScanWorkers"`
+	IndexCache            string                  `yaml:"IndexCache"`
+	IndexDir              string                  `yaml:"IndexDir"`
+	DirTimeout            time.Duration           `yaml:"DirTimeout"`
+	Bans                  ConfigBans              `yaml:"Bans"`
+	MaxArchiveFiles       int                     `yaml:"MaxArchiveFiles"`
+	MaxFileSize           int64                   `yaml:"MaxFileSize"`
+	ExtendedPaks          bool                    `yaml:"ExtendedPaks"`
+	LargeZipEntries       bool                    `yaml:"LargeZipEntries"`
+	DuplicatePolicy       string                  `yaml:"DuplicatePolicy"`
+	SuspiciousNamePolicy  string                  `yaml:"SuspiciousNamePolicy"`
+}
+
+var defaultConfig = Config{
+	Listen:               ConfigListen{{Address: ":8080"}},
+	ContentType:          "application/octet-stream",
+	DuplicatePolicy:      DuplicateLast,
+	SuspiciousNamePolicy: SuspiciousReport,
+	HotCacheMaxEntry:     65536,
+	ClientLimits:         ConfigClientLimits{LargeTransferSize: 1 << 20},
+	RangeStatsMinSize:    1 << 20,
+	Normalize:            ConfigNormalize{Lowercase: true, CollapseSlashes: true},
+	Compress: ConfigCompress{
+		MinSize:        1024,
+		Level:          1,
+		SkipExtensions: []string{".jpg", ".png", ".ogg", ".mp3", ".zip", ".pkz", ".gz"},
+	},
+}
+
+// config with settings compiled from it. Reload publishes new one as a
+// whole, so that requests in flight see either old or new settings.
+type liveConfig struct {
+	Config
+	refererCheck      *regexp.Regexp
+	allowedHosts      map[string]bool
+	pakBlackList      []*regexp.Regexp
+	tombstones        []*regexp.Regexp
+	dirWhiteList      []*regexp.Regexp
+	pakDownloads      []*regexp.Regexp
+	pinnedPaths       []*regexp.Regexp
+	pakExtensions     map[string]string
+	redirects         []compiledRedirect
+	clientOverrides   []clientOverride
+	bandwidthSchedule []bandwidthWindow
+	trustedProxies    []netip.Prefix
+	allowFrom         []netip.Prefix
+	denyFrom          []netip.Prefix
+}
+
+var currentConfig atomic.Pointer[liveConfig]
+
+func init() {
+	currentConfig.Store(&liveConfig{Config: defaultConfig, pakExtensions: defaultPakExtensions()})
+}
+
+// returns current config. Callers that need consistent settings should
+// call it once.
+func config() *liveConfig {
+	return currentConfig.Load()
+}
+
+var (
+	searchPaths      []compiledSearchPath
+	dirCache         map[string][]searchPath
+	prevArchives     map[string]searchPath   // packfiles scanned before rescan
+	prevDirs         map[string][]searchPath // listings before rescan, kept if directory can't be read
+	rescans          sync.WaitGroup          // background rescans, so that tests can wait for them
+	dirCacheMutex    sync.Mutex
+	searchPathsMutex sync.RWMutex
+)
+
+func (entry *pakFileEntry) handleGzip(w http.ResponseWriter, r *io.SectionReader) {
+	var b [10]byte
+
+	w.Header().Set("Content-Length", strconv.FormatInt(int64(entry.size)+18, 10))
+	w.Header().Set("Content-Encoding", "gzip")
+	w.WriteHeader(http.StatusOK)
+
+	if r == nil {
+		return
+	}
+
+	// gzip header
+	b[0] = 0x1f
+	b[1] = 0x8b
+	b[2] = 8 // Z_DEFLATED
+	b[3] = 0 // options
+	binary.LittleEndian.PutUint32(b[4:8], entry.mtime)
+	b[8] = 0x00 // extra flags
+	b[9] = 0x03 // UNIX
+	w.Write(b[0:10])
+
+	// raw deflate stream
+	io.Copy(w, r)
+
+	// gzip trailer
+	binary.LittleEndian.PutUint32(b[0:4], entry.filecrc)
+	binary.LittleEndian.PutUint32(b[4:8], uint32(entry.filelen)) // modulo 2^32
+	w.Write(b[0:8])
+}
+
+// uncompressed entries support ranges so that clients can resume downloads
+func (entry *pakFileEntry) handleRaw(w http.ResponseWriter, req *http.Request, r *io.SectionReader, modtime time.Time) {
+	if entry.method == 0 {
+		http.ServeContent(w, req, "", modtime, r)
+		return
+	}
+
+	// Send raw deflate stream (e.g. no zlib header/trailer).
+	// This violates RFC 2616 but works with libcurl.
+	w.Header().Set("Content-Length", strconv.FormatInt(int64(entry.size), 10))
+	w.Header().Set("Content-Encoding", "deflate")
+	w.WriteHeader(http.StatusOK)
+	if r != nil {
+		io.Copy(w, r)
+	}
+}
+
+func (entry *pakFileEntry) handleInflate(w http.ResponseWriter, req *http.Request, r *io.SectionReader, path string) {
+	trailer := entry.identityHeaders(w, req)
+	w.WriteHeader(http.StatusOK)
+	if r == nil {
+		return
+	}
+
+	f := flate.NewReader(r)
+	defer f.Close()
+
+	// tee decompressed data into cache for subsequent identity clients
+	var src io.Reader = f
+	var buf *bytes.Buffer
+	if contentCache.wantInflated(int64(entry.filelen)) {
+		buf = bytes.NewBuffer(make([]byte, 0, entry.filelen))
+		src = io.TeeReader(src, buf)
+	}
+	src, sum := checksumReader(src)
+
+	if _, err := io.Copy(w, src); err != nil {
+		return
+	}
+	if buf != nil {
+		contentCache.putInflated(path, entry, buf.Bytes())
+	}
+	if trailer {
+		entry.setChecksumTrailer(w, sum)
+	}
+}
+
+// serves entry data inflated earlier from memory
+func (entry *pakFileEntry) handleInflated(w http.ResponseWriter, r *http.Request, data []byte) {
+	trailer := entry.identityHeaders(w, r)
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "HEAD" {
+		return
+	}
+
+	src, sum := checksumReader(bytes.NewReader(data))
+	if _, err := io.Copy(w, src); err == nil && trailer {
+		entry.setChecksumTrailer(w, sum)
+	}
+}
+
+// returns the longest match so that "^/" pattern works as expected
+func findSearchPath(r *http.Request) (match *compiledSearchPath, search []searchPath, path string) {
+	path = normalizePath(r.URL.Path)
+	if path != "/" && strings.HasSuffix(r.URL.Path, "/") && listingRequested(r) {
+		// directory listing needs trailing slash lost when path is cleaned
+		path += "/"
+	}
+	lower := strings.ToLower(path)
+	longest := 0
+
+	searchPathsMutex.RLock()
+	defer searchPathsMutex.RUnlock()
+
+	list := searchPaths
+	if t := tenantFor(r); t != nil {
+		list = t.searchPaths
+	}
+	p := profileFor(r)
+	for i := range list {
+		s := &list[i]
+		if !p.allows(s.cfg.Name) {
+			continue
+		}
+		loc := s.match.FindStringIndex(lower)
+		if loc != nil && loc[0] == 0 && loc[1] > longest {
+			match = s
+			longest = loc[1]
+		}
+	}
+	if match != nil {
+		search = match.load()
+	}
+	// case can only be preserved if lowercasing didn't change offsets
+	if match == nil || !match.caseSensitive() || len(lower) != len(path) {
+		path = lower
+	}
+	if config().LegacyPaths {
+		return match, search, stripGameDir(lower[:longest], path[longest:])
+	}
+
+	return match, search, path[longest:]
+}
+
+// removes game directory duplicated by some legacy clients, so that
+// "/baseq2/baseq2/maps/q2dm1.bsp" becomes "maps/q2dm1.bsp"
+func stripGameDir(prefix, path string) string {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if i := strings.LastIndexByte(prefix, '/'); i >= 0 {
+		prefix = prefix[i+1:]
+	}
+	if len(prefix) > 0 && strings.HasPrefix(path, prefix+"/") {
+		return path[len(prefix)+1:]
+	}
+	return path
+}
+
+func parseAcceptEncoding(r *http.Request) (hasGzip, hasDeflate bool) {
+	for _, value := range r.Header["Accept-Encoding"] {
+		for _, encoding := range strings.Split(value, ",") {
+			switch strings.ToLower(strings.TrimSpace(encoding)) {
+			case "gzip":
+				hasGzip = true
+			case "deflate":
+				hasDeflate = true
+			}
+		}
+	}
+	return
+}
+
+func matchRegexpList(list []*regexp.Regexp, s string) bool {
+	for _, r := range list {
+		if r.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func closeWithError(w http.ResponseWriter, r *http.Request, code int) {
+	if r.ProtoAtLeast(1, 1) {
+		w.Header().Set("Connection", "close")
+	}
+	w.WriteHeader(code)
+}
+
+// hosts of tenants are always allowed
+func hostAllowed(r *http.Request) bool {
+	hosts := config().allowedHosts
+	return len(hosts) == 0 || hosts[requestHost(r)] || tenantFor(r) != nil
+}
+
+func handler(w http.ResponseWriter, r *http.Request) {
+	if bans.blocked(r) || !aclAllowed(r) {
+		closeWithError(w, r, http.StatusForbidden)
+		return
+	}
+
+	if !hostAllowed(r) {
+		closeWithError(w, r, http.StatusMisdirectedRequest)
+		return
+	}
+
+	if !profileFor(r).admit(w, r) {
+		return
+	}
+
+	if !clientLimits.admit(w, r) {
+		return
+	}
+
+	w.Header().Set("X-Content-Revision", revisionString())
+	if len(config().RevisionPath) > 0 && r.URL.Path == config().RevisionPath {
+		handleRevision(w, r)
+		return
+	}
+
+	if !decodeBackslashes() && filepath.Separator != '/' && strings.ContainsRune(r.URL.Path, filepath.Separator) {
+		closeWithError(w, r, http.StatusForbidden)
+		return
+	}
+
+	if config().Normalize.RejectSuspicious && suspiciousPath(r) {
+		closeWithError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	if !refererAllowed(r) {
+		closeWithError(w, r, http.StatusForbidden)
+		return
+	}
+
+	if t := tenantFor(r); t != nil && !t.admit(w, r) {
+		return
+	}
+
+	if redirect(w, r) {
+		return
+	}
+
+	// packfile lookups are always case insensitive
+	match, search, dirPath := findSearchPath(r)
+	path := strings.ToLower(dirPath)
+	if search == nil || len(path) == 0 && !listingRequested(r) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !match.pinned.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if wl, ok := w.(*loggingResponseWriter); ok {
+		wl.searchPath = match.cfg.Name
+	}
+	throttleSearchPath(w, match)
+
+	if matchRegexpList(config().tombstones, path) {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+
+	if match.hashes.serve(w, r, path) {
+		return
+	}
+
+	if len(config().ArchiveManifest) > 0 && path == config().ArchiveManifest {
+		handleManifest(w, r, match, search)
+		return
+	}
+
+	if listingRequested(r) {
+		handleListing(w, r, match, search, path)
+		return
+	}
+
+	allowPak := match.allowPak(path)
+	allowDir := match.allowDir(path)
+	contentType := match.contentType()
+	if !allowPak && !allowDir {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	algorithm, checksum := checksumRequested(r)
+	if checksum && checksumAlgorithms[algorithm] == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	hasGzip, hasDeflate := parseAcceptEncoding(r)
+	hasGzip, hasDeflate = overrideEncodings(r, hasGzip, hasDeflate)
+	if r.Method == "HEAD" && config().HeadIdentity {
+		hasGzip, hasDeflate = false, false
+	}
+	if config().EncodingOverride && r.URL.Query().Has("encoding") {
+		switch r.URL.Query().Get("encoding") {
+		case "identity":
+			hasGzip, hasDeflate = false, false
+		case "gzip":
+			hasGzip, hasDeflate = true, false
+		case "deflate":
+			hasGzip, hasDeflate = false, true
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	// releases large transfer slot of client
+	var release func()
+
+	for _, s := range search {
+		if s.files == nil {
+			// look in the directory tree
+			if !allowDir {
+				continue
+			}
+			f, err := openDirFile(s.path, dirPath)
+			if err == errDirBusy {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if err == nil {
+				defer f.Close()
+				fi, err := f.Stat()
+				if checksum {
+					if err != nil || !fi.Mode().IsRegular() {
+						continue
+					}
+					sum, err := fileChecksum(f, fi, algorithm)
+					if err != nil {
+						log.Printf(`ERROR: checksum "%s": %s`, f.Name(), err)
+						w.WriteHeader(http.StatusInternalServerError)
+						return
+					}
+					writeChecksum(w, r, algorithm, sum)
+					return
+				}
+				if err == nil && fi.Mode().IsRegular() {
+					if release == nil {
+						var ok bool
+						if release, ok = clientLimits.acquire(w, r, fi.Size()); !ok {
+							return
+						}
+						defer release()
+					}
+					if isArchiveName(path) {
+						// strong ETag allows clients to safely resume
+						if sum := archiveHash(f.Name(), fi); len(sum) > 0 {
+							w.Header().Set("ETag", `"`+sum+`"`)
+						}
+					}
+				}
+				w.Header().Set("Content-Type", contentType)
+				signFile(w, f)
+				http.ServeContent(w, r, "", time.Time{}, f)
+				return
+			}
+			continue
+		}
+
+		if !allowPak {
+			continue
+		}
+
+		// look in packfile
+		entry, ok := s.files.get(path)
+		if !ok || s.state.quarantined.Load() {
+			continue
+		}
+
+		if checksum {
+			sum, err := s.entryChecksum(&entry, algorithm)
+			if err != nil {
+				log.Printf(`ERROR: checksum "%s" in "%s": %s`, path, s.path, err)
+				continue
+			}
+			writeChecksum(w, r, algorithm, sum)
+			return
+		}
+
+		// packfile may turn out unreadable below, keep slot for next one
+		if release == nil {
+			size := int64(entry.size)
+			if n := int64(entry.filelen); n > size {
+				size = n
+			}
+			if release, ok = clientLimits.acquire(w, r, size); !ok {
+				return
+			}
+			defer release()
+		}
+
+		// decompress small files and for clients that don't support compression
+		inflate := entry.method != 0 && (int64(entry.filelen) < config().MinCompressSize || !hasGzip && !hasDeflate)
+
+		// content encoding of response, which is part of ETag
+		compress := compressible(path, &entry)
+		var encoding string
+		switch {
+		case compress && hasGzip:
+			encoding = "gzip"
+		case inflate || entry.method == 0:
+		case hasGzip:
+			encoding = "gzip"
+		default:
+			encoding = "deflate"
+		}
+
+		hot := contentCache.getHot(s.path, entry.offset)
+		if inflate {
+			data := contentCache.getInflated(s.path, entry.offset)
+			if hot != nil {
+				data = hot.inflated
+			}
+			if data != nil {
+				metrics.archiveHit(match.cfg.Name, s.path, true)
+				logArchive(w, s.path)
+				w.Header().Set("Content-Type", contentType)
+				w.Header().Set("Vary", "Accept-Encoding")
+				s.signEntry(w, &entry)
+				if !entry.notModified(w, r, &s, encoding) {
+					entry.handleInflated(w, r, data)
+				}
+				return
+			}
+		}
+
+		// uncompressed entries need reader for HEAD too, to handle ranges
+		wantReader := r.Method != "HEAD" || entry.method == 0
+
+		var reader *io.SectionReader
+		if data := contentCache.get(s.path, entry.offset); data != nil {
+			metrics.archiveHit(match.cfg.Name, s.path, true)
+			logArchive(w, s.path)
+			if wantReader {
+				reader = io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data)))
+			}
+		} else if hot != nil {
+			metrics.archiveHit(match.cfg.Name, s.path, true)
+			logArchive(w, s.path)
+			if wantReader {
+				reader = io.NewSectionReader(bytes.NewReader(hot.raw), 0, int64(len(hot.raw)))
+			}
+		} else {
+			f, err := openFiles.open(s.path)
+			if err != nil {
+				s.quarantine(err)
+				continue
+			}
+			defer f.Close()
+
+			if s.state.changed(f.info) {
+				s.replaced()
+				continue
+			}
+
+			// resolve offset for HEAD too, so that it fails the same way GET would
+			offset, err := s.dataOffset(f, &entry)
+			if err != nil {
+				log.Printf(`ERROR: "%s": %s`, s.path, err)
+				continue
+			}
+			if r.Method != "HEAD" {
+				readahead(f.File, offset, int64(entry.size))
+			}
+			if wantReader {
+				// stop reading packfile once client goes away
+				reader = io.NewSectionReader(pak.NewContextReaderAt(r.Context(), f), offset, int64(entry.size))
+				if wantHot(&entry) {
+					if raw := contentCache.loadHot(&s, &entry, f, offset); raw != nil {
+						reader = io.NewSectionReader(bytes.NewReader(raw), 0, int64(len(raw)))
+					}
+				}
+			}
+			metrics.archiveHit(match.cfg.Name, s.path, false)
+			logArchive(w, s.path)
+		}
+
+		// prefer gzip wrapping because it has CRC
+		w.Header().Set("Content-Type", contentType)
+		if entry.method != 0 || compress {
+			w.Header().Set("Vary", "Accept-Encoding")
+		}
+		s.signEntry(w, &entry)
+		switch {
+		case entry.notModified(w, r, &s, encoding):
+		case inflate:
+			entry.handleInflate(w, r, reader, s.path)
+		case compress && encoding == "gzip":
+			entry.handleCompress(w, r, reader)
+		case encoding == "gzip":
+			entry.handleGzip(w, reader)
+		default:
+			entry.handleRaw(w, r, reader, s.state.info.ModTime())
+		}
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+}
+
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status     int
+	written    int64
+	searchPath string      // name of matched search path
+	archive    string      // packfile the response is served from
+	crc        hash.Hash32 // CRC of bytes written, if LogChecksums is enabled
+}
+
+func (w *loggingResponseWriter) WriteHeader(code int) {
+	w.ResponseWriter.WriteHeader(code)
+	w.status = code
+}
+
+func (w *loggingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	if w.crc != nil {
+		w.crc.Write(p[:n])
+	}
+	return n, err
+}
+
+func logHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	wl := &loggingResponseWriter{ResponseWriter: w, status: -1}
+	if config().LogChecksums {
+		wl.crc = crc32.NewIEEE()
+	}
+	handler(wl, r)
+
+	if statsEnabled() && (wl.status == http.StatusOK || wl.status == http.StatusPartialContent) {
+		path := strings.ToLower(pathpkg.Clean(r.URL.Path))
+		recordStats(path, wl.searchPath, wl.written)
+		if r.Method == "GET" {
+			recordRange(path, wl.status, wl.Header(), wl.written)
+		}
+	}
+
+	if metricsEnabled() {
+		metrics.request(wl.status, wl.written)
+	}
+
+	if mirrorEnabled() {
+		mirrorRequest(r, localResult(wl, r))
+	}
+
+	logger := log.Default()
+	if t := tenantFor(r); t != nil {
+		t.record(wl.written)
+		if t.logger != nil {
+			logger = t.logger
+		} else if config().LogLevel < LogLevelDebug {
+			return
+		}
+	} else if config().LogLevel < LogLevelDebug {
+		return
+	}
+
+	if config().LogFormat == LogFormatJSON {
+		logJSON(logger, wl, r, start)
+		return
+	}
+
+	encoding := wl.Header().Get("Content-Encoding")
+	if len(encoding) == 0 {
+		encoding = "-"
+	}
+
+	length := wl.Header().Get("Content-Length")
+	if len(length) == 0 {
+		length = "0"
+	}
+
+	if wl.crc != nil {
+		// bytes actually sent and their CRC allow to tell truncated or
+		// corrupted transfers from broken clients
+		logger.Printf(`%s %s "%s %s %s" %d %s "%s" "%s" "%s" %d %08x`,
+			r.RemoteAddr, r.Host, r.Method, r.RequestURI, r.Proto,
+			wl.status, length, encoding, r.Referer(), r.UserAgent(),
+			wl.written, wl.crc.Sum32())
+		return
+	}
+
+	logger.Printf(`%s %s "%s %s %s" %d %s "%s" "%s" "%s"`,
+		r.RemoteAddr, r.Host, r.Method, r.RequestURI, r.Proto,
+		wl.status, length, encoding, r.Referer(), r.UserAgent())
+}
+
+func (s *searchPath) reportf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	s.issues = append(s.issues, msg)
+	log.Printf(`WARNING: "%s": %s`, s.path, msg)
+}
+
+// adds entry to packfile index resolving suspicious and duplicate names
+// according to policy
+func (s *searchPath) addFile(name string, entry pakFileEntry) error {
+	if reason := suspiciousName(name); len(reason) > 0 {
+		switch config().SuspiciousNamePolicy {
+		case SuspiciousSkip:
+			s.reportf(`skipping %q with %s in name`, name, reason)
+			return nil
+		case SuspiciousError:
+			return fmt.Errorf(`file %q has %s in name`, name, reason)
+		default:
+			s.reportf(`file %q has %s in name`, name, reason)
+		}
+	}
+	key := normalizeName(name)
+	if _, ok := s.files.get(key); ok {
+		switch config().DuplicatePolicy {
+		case DuplicateFirst:
+			s.reportf(`ignoring duplicate "%s"`, name)
+			return nil
+		case DuplicateError:
+			return fmt.Errorf(`duplicate file "%s"`, name)
+		default:
+			s.reportf(`duplicate "%s" overrides previous entry`, name)
+		}
+	}
+	s.files.put(key, entry)
+	return nil
+}
+
+// returns offset of file data, reading ZIP local file header if needed
+func (s *searchPath) dataOffset(f io.ReaderAt, entry *pakFileEntry) (int64, error) {
+	if s.offsets == nil {
+		return entry.offset, nil
+	}
+	return s.offsets.resolve(f, entry.offset)
+}
+
+// returns reader of decompressed entry data
+func (s *searchPath) entryReader(f io.ReaderAt, entry *pakFileEntry) (io.ReadCloser, error) {
+	offset, err := s.dataOffset(f, entry)
+	if err != nil {
+		return nil, err
+	}
+	r := io.NewSectionReader(f, offset, int64(entry.size))
+	if entry.method != 0 {
+		return flate.NewReader(r), nil
+	}
+	return io.NopCloser(r), nil
+}
+
+func normalizeName(n string) string {
+	n = strings.ReplaceAll(n, `\`, `/`)
+	n = pathpkg.Clean("/" + n)
+	return strings.ToLower(n[1:])
+}
+
+var errTooManyFiles = errors.New("too many files")
+
+func scanpak(name string) (*searchPath, error) {
+	r, err := pak.OpenReaderOptions(name, pak.Options{
+		MaxFiles:   config().MaxArchiveFiles,
+		MaxFileLen: config().MaxFileSize,
+		Extended:   config().ExtendedPaks,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	search := &searchPath{path: name, files: newFileIndex(len(r.File))}
+	if search.meta, err = r.Metadata(); err != nil {
+		search.reportf("bad metadata: %s", err)
+	}
+
+	// overlapping entries are not fatal, but most likely indicate a
+	// broken or malicious packing tool
+	skip := make(map[*pak.File]bool)
+	for _, f := range r.Validate() {
+		switch f.Kind {
+		case pak.PastEOF:
+			search.reportf(`skipping "%s" extending past end of file`, f.File.Name)
+			skip[f.File] = true
+		case pak.EmptyName:
+			search.reportf("skipping %s", f)
+			skip[f.File] = true
+		default:
+			search.reportf("%s", f)
+		}
+	}
+
+	for _, f := range r.File {
+		if skip[f] || f.Name == pak.MetadataName {
+			continue
+		}
+		err := search.addFile(f.Name, pakFileEntry{
+			offset: int64(f.Filepos),
+			size:   uint64(f.Filelen),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	search.files.compact()
+	return search, nil
+}
+
+func scanzip(name string) (*searchPath, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := findZipEnd(f, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	if config().MaxArchiveFiles > 0 && dir.count > uint64(config().MaxArchiveFiles) {
+		return nil, errTooManyFiles
+	}
+
+	search := &searchPath{
+		path:    name,
+		files:   newFileIndex(int(dir.count)),
+		offsets: newOffsetCache(),
+	}
+	if search.meta, err = pak.MetadataFromComment(dir.comment); err != nil {
+		search.reportf("bad metadata: %s", err)
+	}
+	err = dir.scan(f, func(e *zipEntry) error {
+		if strings.HasSuffix(e.name, "/") {
+			return nil
+		}
+		if !config().LargeZipEntries && (e.compressedSize >= math.MaxUint32 || e.uncompressedSize >= math.MaxUint32) {
+			search.reportf(`skipping "%s" of 4 GiB or larger`, e.name)
+			return nil
+		}
+		if config().MaxFileSize > 0 && int64(e.uncompressedSize) > config().MaxFileSize {
+			search.reportf(`skipping "%s" exceeding MaxFileSize`, e.name)
+			return nil
+		}
+		if e.method != zip.Store && e.method != zip.Deflate {
+			search.reportf(`skipping "%s" compressed with unsupported method %d`, e.name, e.method)
+			return nil
+		}
+		if e.compressedSize > uint64(dir.offset) || e.headerOffset > dir.offset-zipLocalHeaderLen-int64(e.compressedSize) {
+			search.reportf(`skipping "%s" extending past central directory`, e.name)
+			return nil
+		}
+		return search.addFile(e.name, pakFileEntry{
+			offset:  e.headerOffset,
+			size:    e.compressedSize,
+			filecrc: e.crc32,
+			filelen: e.uncompressedSize,
+			mtime:   e.mtime,
+			method:  e.method,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	search.files.compact()
+	return search, nil
+}
+
+// moves packfiles listed in order to the front of the search path. Order is
+// specified in load order, i.e. the last listed packfile has the highest
+// priority. Packfiles not listed keep their heuristic order after these.
+func pinPakOrder(dir string, paks, order []string) []string {
+	pinned := make([]string, 0, len(paks))
+	for i := len(order) - 1; i >= 0; i-- {
+		found := false
+		for j, v := range paks {
+			if len(v) > 0 && strings.EqualFold(v, order[i]) {
+				pinned = append(pinned, v)
+				paks[j] = ""
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.Printf(`WARNING: packfile "%s" listed in PakOrder not found in "%s"`, order[i], dir)
+		}
+	}
+	for _, v := range paks {
+		if len(v) > 0 {
+			pinned = append(pinned, v)
+		}
+	}
+	return pinned
+}
+
+// scans packfile v found in search directory dir
+func scanArchive(dir, v string) (*searchPath, error) {
+	name := filepath.Join(dir, v)
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := archiveScanner(v)(name)
+	if err != nil {
+		return nil, err
+	}
+	s.state = &archiveState{dir: dir, info: fi}
+	mapIndex(s)
+	return s, nil
+}
+
+// calls f for each index below n from up to ScanWorkers goroutines
+func scanParallel(n int, f func(i int)) {
+	workers := config().ScanWorkers
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			f(i)
+		}
+		return
+	}
+
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := int(next.Add(1) - 1); i < n; i = int(next.Add(1) - 1) {
+				f(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// returns packfiles in directory followed by directory itself. If directory
+// can't be read, listing from before rescan is kept.
+func scandir(name string) ([]searchPath, error) {
+	dirCacheMutex.Lock()
+	defer dirCacheMutex.Unlock()
+
+	sp, ok := dirCache[name]
+	if ok {
+		return sp, nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return keepListing(name), err
+	}
+	defer f.Close()
+
+	n, err := f.Readdirnames(0)
+	if err != nil {
+		return keepListing(name), err
+	}
+	paks := make([]string, 0, len(n))
+	for _, v := range n {
+		if isArchiveName(v) {
+			paks = append(paks, v)
+		}
+	}
+
+	pak.SortSearchOrder(paks)
+
+	if order, ok := config().PakOrder[name]; ok {
+		paks = pinPakOrder(name, paks, order)
+	}
+
+	// scan in parallel, keeping search order
+	scanned := make([]*searchPath, len(paks))
+	scanParallel(len(paks), func(i int) {
+		if s := reusableArchive(name, paks[i]); s != nil {
+			scanned[i] = s
+			return
+		}
+		if s := cachedArchive(name, paks[i]); s != nil {
+			scanned[i] = s
+			return
+		}
+		s, err := scanArchive(name, paks[i])
+		if err != nil {
+			log.Printf(`ERROR: scan "%s": %s`, paks[i], err)
+			return
+		}
+		scanned[i] = s
+	})
+
+	sp = make([]searchPath, 0, len(paks)+1)
+	for _, s := range scanned {
+		if s != nil {
+			sp = append(sp, *s)
+		}
+	}
+
+	if dirsServed() {
+		sp = append(sp, searchPath{path: name})
+	} else if len(sp) == 0 {
+		log.Printf(`WARNING: directory "%s" ignored due to empty DirWhiteList`, name)
+	}
+	dirCache[name] = sp
+	return sp, nil
+}
+
+// keeps listing of directory scanned before rescan, if there was one.
+// Must be called with dirCacheMutex held.
+func keepListing(name string) []searchPath {
+	sp, ok := prevDirs[name]
+	if ok {
+		dirCache[name] = sp
+	}
+	return sp
+}
+
+func usage() {
+	log.Printf("Usage: %s <config>", os.Args[0])
+	log.Printf("       %s -selftest", os.Args[0])
+	log.Printf("       %s -bench <config> [-c clients] [-n requests] [-e encoding] [-r referer] [access.log]", os.Args[0])
+	os.Exit(1)
+}
+
+// reads config file on top of defaults and validates it
+func readConfig(name string) (Config, error) {
+	cfg := defaultConfig
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return cfg, err
+	}
+	if err = yaml.Unmarshal(b, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, validateConfig(&cfg)
+}
+
+func validateConfig(cfg *Config) error {
+	var patterns []string
+	patterns = append(patterns, cfg.PakBlackList...)
+	patterns = append(patterns, cfg.DirWhiteList...)
+	patterns = append(patterns, cfg.PakDownloadWhiteList...)
+	patterns = append(patterns, cfg.PinnedPaths...)
+	patterns = append(patterns, cfg.Tombstones...)
+	patterns = append(patterns, cfg.RefererCheck)
+	for _, sp := range cfg.SearchPaths {
+		patterns = append(patterns, sp.Match)
+	}
+	for _, sp := range allSearchPathConfigs(cfg) {
+		for _, dir := range sp.Search {
+			fi, err := os.Stat(dir)
+			if err != nil {
+				return err
+			}
+			if !fi.IsDir() {
+				return fmt.Errorf(`Search path "%s" is not a directory`, dir)
+			}
+		}
+		if sp.PakBlackList != nil {
+			patterns = append(patterns, *sp.PakBlackList...)
+		}
+		if sp.DirWhiteList != nil {
+			patterns = append(patterns, *sp.DirWhiteList...)
+		}
+	}
+	for _, rd := range cfg.Redirects {
+		patterns = append(patterns, rd.Match)
+	}
+	for _, r := range patterns {
+		if _, err := regexp.Compile(r); err != nil {
+			return err
+		}
+	}
+	if err := validatePakExtensions(cfg); err != nil {
+		return err
+	}
+	if err := validateRedirects(cfg); err != nil {
+		return err
+	}
+	if err := validateProfiles(cfg); err != nil {
+		return err
+	}
+	if err := validateClientOverrides(cfg); err != nil {
+		return err
+	}
+	if err := validateBandwidthSchedule(cfg); err != nil {
+		return err
+	}
+	if err := validateCompress(cfg); err != nil {
+		return err
+	}
+	if err := validateClientLimits(cfg); err != nil {
+		return err
+	}
+	if err := validateTrustedProxies(cfg); err != nil {
+		return err
+	}
+	if err := validateACL(cfg); err != nil {
+		return err
+	}
+	if err := validateSigningKey(cfg); err != nil {
+		return err
+	}
+	if err := validateHashLists(cfg); err != nil {
+		return err
+	}
+	if err := validateTenants(cfg); err != nil {
+		return err
+	}
+	if err := validateMirror(cfg); err != nil {
+		return err
+	}
+	if cfg.ReadTimeout < 0 || cfg.WriteTimeout < 0 || cfg.IdleTimeout < 0 || cfg.MaxHeaderBytes < 0 {
+		return errors.New("Timeouts and MaxHeaderBytes can't be negative")
+	}
+	if len(cfg.IndexDir) > 0 {
+		fi, err := os.Stat(cfg.IndexDir)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf(`IndexDir "%s" is not a directory`, cfg.IndexDir)
+		}
+	}
+	if cfg.ScanWorkers < 0 {
+		return errors.New("ScanWorkers can't be negative")
+	}
+	if cfg.H2C && !h2cSupported {
+		return errors.New("H2C requires pakserve built with Go 1.24 or newer")
+	}
+	if len(cfg.SearchPaths)+len(cfg.Tenants) == 0 {
+		return errors.New("No search paths configured")
+	}
+	switch cfg.DuplicatePolicy {
+	case DuplicateLast, DuplicateFirst, DuplicateError:
+	default:
+		return fmt.Errorf(`Bad DuplicatePolicy "%s"`, cfg.DuplicatePolicy)
+	}
+	switch cfg.SuspiciousNamePolicy {
+	case SuspiciousReport, SuspiciousSkip, SuspiciousError:
+	default:
+		return fmt.Errorf(`Bad SuspiciousNamePolicy "%s"`, cfg.SuspiciousNamePolicy)
+	}
+	if len(cfg.AdminListen) > 0 && len(cfg.AdminToken) == 0 {
+		return errors.New("AdminToken must be set if AdminListen is set")
+	}
+	if cfg.Bans.AutoBanAfter > 0 && (cfg.Bans.AutoBanWindow <= 0 || cfg.Bans.AutoBanDuration <= 0) {
+		return errors.New("AutoBanWindow and AutoBanDuration must be set if AutoBanAfter is set")
+	}
+	switch cfg.LogFormat {
+	case "", LogFormatText, LogFormatJSON:
+	default:
+		return fmt.Errorf(`Bad LogFormat "%s"`, cfg.LogFormat)
+	}
+	switch cfg.ChecksumTrailer {
+	case "", ChecksumCRC32, ChecksumSHA256:
+	default:
+		return fmt.Errorf(`Bad ChecksumTrailer "%s"`, cfg.ChecksumTrailer)
+	}
+	if len(cfg.Listen)+len(cfg.ListenTLS) == 0 {
+		return errors.New("At least one of Listen or ListenTLS must be set")
+	}
+	if err := validateListen(cfg); err != nil {
+		return err
+	}
+	if len(cfg.ListenTLS) > 0 && !autoTLSEnabled(cfg) && (len(cfg.CertFile) == 0 || len(cfg.KeyFile) == 0) {
+		return errors.New("CertFile and KeyFile must be set if ListenTLS is set")
+	}
+	if err := validateAutoTLS(cfg); err != nil {
+		return err
+	}
+	return nil
+}
+
+// compiles settings that can be changed by reloading config and makes them
+// current at once
+func applyConfig(cfg Config) {
+	c := &liveConfig{Config: cfg}
+	c.pakBlackList = compileRegexpList(cfg.PakBlackList)
+	c.dirWhiteList = compileRegexpList(cfg.DirWhiteList)
+	c.pakDownloads = compileRegexpList(cfg.PakDownloadWhiteList)
+	c.pinnedPaths = compileRegexpList(cfg.PinnedPaths)
+	c.tombstones = compileRegexpList(cfg.Tombstones)
+	c.refererCheck = regexp.MustCompile(cfg.RefererCheck)
+	for _, h := range cfg.AllowedHosts {
+		if c.allowedHosts == nil {
+			c.allowedHosts = make(map[string]bool)
+		}
+		c.allowedHosts[strings.ToLower(h)] = true
+	}
+	compilePakExtensions(c)
+	compileRedirects(c)
+	compileClientOverrides(c)
+	compileBandwidthSchedule(c)
+	compileTrustedProxies(c)
+	compileACL(c)
+	currentConfig.Store(c)
+	compileSigningKey()
+	compileClientLimits()
+	if cfg.LogTimeStamps {
+		log.SetFlags(log.LstdFlags)
+	} else {
+		log.SetFlags(0)
+	}
+}
+
+func loadConfig(name string) {
+	cfg, err := readConfig(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := useConfig(cfg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// makes validated config current and loads data it refers to
+func useConfig(cfg Config) error {
+	applyConfig(cfg)
+	compileHashLists()
+	loadProfiles()
+	loadMirror()
+	if err := loadTenants(); err != nil {
+		return err
+	}
+	return loadBans()
+}
+
+func printSearchPath(cfg ConfigSearchPath, sp []searchPath) {
+	if cfg.Name != cfg.Match {
+		log.Printf(`Search path "%s" for "%s":`, cfg.Name, cfg.Match)
+	} else {
+		log.Printf(`Search path for "%s":`, cfg.Match)
+	}
+	for _, s := range sp {
+		if s.files == nil {
+			log.Println(s.path)
+		} else {
+			log.Printf("%s (%d files, %d issues)", s.path, s.files.len(), len(s.issues))
+		}
+	}
+	log.Println("--------------------")
+}
+
+// returns packfiles in directory cache by path.
+// Must be called with dirCacheMutex held.
+func cachedArchives() map[string]searchPath {
+	archives := make(map[string]searchPath)
+	for _, sp := range dirCache {
+		for _, s := range sp {
+			if s.files != nil {
+				archives[s.path] = s
+			}
+		}
+	}
+	return archives
+}
+
+// reports whether packfile is still usable and didn't change on disk since
+// it was scanned
+func (s *searchPath) unchanged() bool {
+	if s.state.quarantined.Load() {
+		return false
+	}
+	fi, err := os.Stat(s.path)
+	return err == nil && !s.state.changed(fi)
+}
+
+// returns packfile scanned before rescan if it didn't change on disk since.
+// Must be called with dirCacheMutex held.
+func reusableArchive(dir, v string) *searchPath {
+	s, ok := prevArchives[filepath.Join(dir, v)]
+	if !ok || !s.unchanged() {
+		return nil
+	}
+	return &s
+}
+
+// logs packfiles added, changed and removed by rescan
+func logArchiveDiff(old, cur map[string]searchPath) {
+	var added, changed, removed []string
+	reused := 0
+	for path, s := range cur {
+		if o, ok := old[path]; !ok {
+			added = append(added, path)
+		} else if o.state != s.state {
+			changed = append(changed, path)
+		} else {
+			reused++
+		}
+	}
+	for path := range old {
+		if _, ok := cur[path]; !ok {
+			removed = append(removed, path)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(changed)
+	sort.Strings(removed)
+	for _, path := range added {
+		log.Printf(`Added "%s"`, path)
+	}
+	for _, path := range changed {
+		log.Printf(`Rescanned "%s"`, path)
+	}
+	for _, path := range removed {
+		log.Printf(`Removed "%s"`, path)
+	}
+	log.Printf("Rescan: %d added, %d changed, %d removed, %d unchanged packfiles",
+		len(added), len(changed), len(removed), reused)
+}
+
+func scanSearchPaths() {
+	searchPathsMutex.Lock()
+	defer searchPathsMutex.Unlock()
+
+	prev := getPhase()
+	setPhase(PhaseScanning)
+	start := time.Now()
+
+	// packfiles that didn't change on disk are reused, unless scanned
+	// lazily or with different settings
+	dirCacheMutex.Lock()
+	rescan := dirCache != nil && !config().LazyScan
+	old := cachedArchives()
+	if rescan && !scanSettingsChanged() {
+		prevArchives = old
+	}
+	prevDirs = dirCache
+	dirCache = make(map[string][]searchPath)
+	dirCacheMutex.Unlock()
+	contentCache.reset()
+	openFiles.reset()
+
+	searchPaths = compileSearchPaths(config().SearchPaths)
+	for _, t := range tenants {
+		t.searchPaths = compileSearchPaths(t.config)
+	}
+
+	dirCacheMutex.Lock()
+	prevArchives, prevDirs = nil, nil
+	cur := cachedArchives()
+	dirCacheMutex.Unlock()
+	if rescan && config().LogLevel >= LogLevelInfo {
+		logArchiveDiff(old, cur)
+	}
+	cfg := config().Config
+	scannedConfig = &cfg
+	updateWatches()
+
+	// packfiles left in index cache are not searched anymore, unless
+	// search paths are scanned lazily
+	if !config().LazyScan {
+		diskIndexMutex.Lock()
+		diskIndex = nil
+		diskIndexMutex.Unlock()
+	}
+	saveIndexCache()
+
+	pruneArchiveHashes()
+	pruneMappedIndexes()
+	bumpRevision()
+	recordScan(start)
+	setPhase(prev)
+}
+
+// rescans search paths that include directory, after packfile in it was
+// found missing or packfiles were added or removed. Packfiles that didn't
+// change are reused.
+func rescanDir(dir string) {
+	searchPathsMutex.Lock()
+	defer searchPathsMutex.Unlock()
+
+	dirCacheMutex.Lock()
+	prevArchives = make(map[string]searchPath)
+	for _, s := range dirCache[dir] {
+		if s.files == nil {
+			continue
+		}
+		if s.unchanged() {
+			prevArchives[s.path] = s
+		} else {
+			contentCache.unpin(s.path)
+			openFiles.invalidate(s.path)
+		}
+	}
+	prevDirs = map[string][]searchPath{dir: dirCache[dir]}
+	delete(dirCache, dir)
+	dirCacheMutex.Unlock()
+
+	rebuildSearchPaths(dir)
+
+	dirCacheMutex.Lock()
+	prevArchives, prevDirs = nil, nil
+	dirCacheMutex.Unlock()
+}
+
+// rescans single packfile that was replaced on disk, keeping the rest
+// of its search directory cached
+func rescanArchive(path string, state *archiveState) {
+	searchPathsMutex.Lock()
+	defer searchPathsMutex.Unlock()
+
+	dir := state.dir
+	dirCacheMutex.Lock()
+	cached, ok := dirCache[dir]
+	if ok {
+		sp := make([]searchPath, 0, len(cached))
+		for _, v := range cached {
+			if v.state != state {
+				sp = append(sp, v)
+				continue
+			}
+			s, err := scanArchive(dir, filepath.Base(v.path))
+			if err != nil {
+				log.Printf(`ERROR: scan "%s": %s`, v.path, err)
+				continue
+			}
+			sp = append(sp, *s)
+		}
+		dirCache[dir] = sp
+	}
+	dirCacheMutex.Unlock()
+
+	contentCache.unpin(path)
+	openFiles.invalidate(path)
+	rebuildSearchPaths(dir)
+}
+
+// recompiles search paths that include search directory dir.
+// Must be called with searchPathsMutex held.
+func rebuildSearchPaths(dir string) {
+	lists := [][]compiledSearchPath{searchPaths}
+	for _, t := range tenants {
+		lists = append(lists, t.searchPaths)
+	}
+	for _, list := range lists {
+		for i := range list {
+			s := &list[i]
+			for _, d := range s.cfg.Search {
+				if d != dir {
+					continue
+				}
+				if s.lazy != nil {
+					s.lazy = new(lazySearchPath)
+				} else {
+					s.search, s.scanned = s.scan(), time.Now()
+				}
+				break
+			}
+		}
+	}
+	bumpRevision()
+	saveIndexCache()
+	pruneArchiveHashes()
+	pruneMappedIndexes()
+}
+
+func (s *searchPath) quarantine(err error) {
+	if s.state.quarantined.CompareAndSwap(false, true) {
+		log.Printf(`ERROR: quarantined "%s": %s`, s.path, err)
+		dir := s.state.dir
+		rescans.Add(1)
+		go func() {
+			defer rescans.Done()
+			rescanDir(dir)
+		}()
+	}
+}
+
+// takes packfile that changed on disk since it was scanned out of service
+// until it is rescanned
+func (s *searchPath) replaced() {
+	if s.state.quarantined.CompareAndSwap(false, true) {
+		log.Printf(`WARNING: "%s" changed on disk, rescanning`, s.path)
+		path, state := s.path, s.state
+		rescans.Add(1)
+		go func() {
+			defer rescans.Done()
+			rescanArchive(path, state)
+		}()
+	}
+}
+
+func compileSearchPaths(cfgs []ConfigSearchPath) []compiledSearchPath {
+	compiled := make([]compiledSearchPath, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		if len(cfg.Name) == 0 {
+			cfg.Name = cfg.Match
+		}
+		s := compiledSearchPath{match: regexp.MustCompile(cfg.Match), cfg: cfg, hashes: new(hashListData), pinned: new(atomic.Bool)}
+		if cfg.MaxBandwidth > 0 {
+			s.throttle = new(byteThrottle)
+		}
+		if cfg.PakBlackList != nil {
+			s.pakBlackList = compileRegexpList(*cfg.PakBlackList)
+		}
+		if cfg.DirWhiteList != nil {
+			s.dirWhiteList = compileRegexpList(*cfg.DirWhiteList)
+		}
+		if config().LazyScan {
+			s.lazy = new(lazySearchPath)
+		} else {
+			s.search, s.scanned = s.scan(), time.Now()
+		}
+		compiled = append(compiled, s)
+	}
+	return compiled
+}
+
+// scans search path and prepares data derived from it
+func (s *compiledSearchPath) scan() []searchPath {
+	search := scanSearchPath(s.cfg)
+	s.pinned.Store(verifyPins(s.cfg, search))
+	contentCache.pin(s, search)
+	if config().HashArchives {
+		hashArchives(search)
+	}
+	if len(hashLists) > 0 {
+		s.hashes.start(s, search, hashLists)
+	}
+	return search
+}
+
+func scanSearchPath(cfg ConfigSearchPath) []searchPath {
+	sp := make([]searchPath, 0)
+	for _, dir := range cfg.Search {
+		list, err := scandir(dir)
+		if err != nil {
+			log.Printf(`ERROR: scan "%s": %s`, dir, err)
+		}
+		sp = append(sp, list...)
+	}
+	if config().LogLevel >= LogLevelInfo {
+		printSearchPath(cfg, sp)
+	}
+	return sp
+}
+
+// returns non-nil, possibly empty list of compiled regular expressions
+func compileRegexpList(list []string) []*regexp.Regexp {
+	compiled := make([]*regexp.Regexp, 0, len(list))
+	for _, r := range list {
+		compiled = append(compiled, regexp.MustCompile(r))
+	}
+	return compiled
+}
+
+// reports whether quake path can be served from packfiles
+func (s *compiledSearchPath) allowPak(path string) bool {
+	list := config().pakBlackList
+	if s.pakBlackList != nil {
+		list = s.pakBlackList
+	}
+	return !matchRegexpList(list, path)
+}
+
+// reports whether quake path can be served from directories
+func (s *compiledSearchPath) allowDir(path string) bool {
+	list := config().dirWhiteList
+	if s.dirWhiteList != nil {
+		list = s.dirWhiteList
+	}
+	return matchRegexpList(list, path) || pakDownloadAllowed(path)
+}
+
+// reports whether directory lookups preserve request path case
+func (s *compiledSearchPath) caseSensitive() bool {
+	if s.cfg.CaseSensitive != nil {
+		return *s.cfg.CaseSensitive
+	}
+	return config().CaseSensitive || !config().Normalize.Lowercase
+}
+
+func (s *compiledSearchPath) contentType() string {
+	if s.cfg.ContentType != nil {
+		return *s.cfg.ContentType
+	}
+	return config().ContentType
+}
+
+// reports whether files can be served from search directories themselves,
+// not only from packfiles in them
+func dirsServed() bool {
+	c := config()
+	if len(c.dirWhiteList) > 0 || len(c.pakDownloads) > 0 {
+		return true
+	}
+	for _, sp := range allSearchPathConfigs(&config().Config) {
+		if sp.DirWhiteList != nil && len(*sp.DirWhiteList) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// returns search path, scanning it first if needed
+func (s *compiledSearchPath) load() []searchPath {
+	if s.lazy == nil {
+		return s.search
+	}
+	lazy := s.lazy
+	lazy.once.Do(func() {
+		lazy.search = s.scan()
+		lazy.scanned.Store(time.Now().UnixNano())
+	})
+	return lazy.search
+}
+
+// returns search list and time it was scanned without scanning lazy search
+// path, in which case time is zero
+func (s *compiledSearchPath) peek() ([]searchPath, time.Time) {
+	if s.lazy == nil {
+		return s.search, s.scanned
+	}
+	if t := s.lazy.scanned.Load(); t != 0 {
+		return s.lazy.search, time.Unix(0, t)
+	}
+	return nil, time.Time{}
+}
+
+// returns handler serving game clients, shared by all listeners
+func newHandler() http.Handler {
+	var h http.Handler = http.HandlerFunc(handler)
+	if config().LogLevel >= LogLevelDebug || statsEnabled() || len(tenants) > 0 || mirrorEnabled() || metricsEnabled() {
+		h = http.HandlerFunc(logHandler)
+	}
+	return trackTransfers(proxyHandler(throttleHandler(h)))
+}
+
+// Main runs pakserve command with arguments of the process.
+func Main() {
+	log.SetFlags(0)
+
+	if len(os.Args) > 1 && os.Args[1] == "-bench" {
+		bench(os.Args[2:])
+		return
+	}
+	if len(os.Args) == 2 && os.Args[1] == "-selftest" {
+		if !selfTest() {
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) != 2 {
+		usage()
+	}
+
+	configFile = os.Args[1]
+	loadConfig(configFile)
+	loadState()
+	loadIndexCache()
+	contentRevision.Store(time.Now().Unix())
+	scanSearchPaths()
+	if config().WatchDirs {
+		startWatcher()
+	}
+
+	mux := newHandler()
+
+	for _, t := range tenants {
+		if len(t.listen) > 0 {
+			serve(&http.Server{Addr: t.listen, Handler: tenantHandler(t, mux)}, false)
+		}
+	}
+
+	if len(config().ListenTLS) > 0 {
+		tlsCfg := tlsConfig()
+		for _, l := range config().ListenTLS {
+			serve(&http.Server{
+				Addr:      l.Address,
+				Handler:   profileHandler(listenProfile(l, config().ListenTLSProfile), mux),
+				TLSConfig: tlsCfg,
+			}, true)
+		}
+	}
+
+	for _, l := range config().Listen {
+		serve(&http.Server{Addr: l.Address, Handler: autoTLSHandler(profileHandler(listenProfile(l, config().ListenProfile), mux))}, false)
+	}
+
+	if len(config().AdminListen) > 0 {
+		go func() { log.Fatal(http.ListenAndServe(config().AdminListen, adminHandler())) }()
+	}
+
+	if metricsEnabled() {
+		go func() { log.Fatal(http.ListenAndServe(config().MetricsListen, metricsHandler())) }()
+	}
+
+	closeUnusedListeners()
+	setPhase(PhaseReady)
+	if statusEnabled() {
+		go statusLoop()
+	}
+
+	waitForSignal(func() { sdNotify("READY=1") })
+	sdNotify("STOPPING=1")
+	drain()
+	saveState()
+	setPhase(PhaseStopped)
+}
@@ -0,0 +1,3564 @@
+package server
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skullernet/pakserve/pak"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	testStored   = []byte("stored in pak")
+	testDeflated = bytes.Repeat([]byte("deflated in pkz "), 100)
+	testLoose    = []byte("loose file")
+
+	// testDeflated compressed once, so that golden transcripts don't depend
+	// on compress/flate output of the toolchain
+	testDeflatedRaw = []byte{
+		0x4a, 0x49, 0x4d, 0xcb, 0x49, 0x2c, 0x49, 0x4d, 0x51, 0xc8, 0xcc, 0x53, 0x28, 0xc8, 0xae, 0x52,
+		0x18, 0xe5, 0x8f, 0xf2, 0x47, 0xf9, 0xa3, 0xfc, 0x51, 0xfe, 0x28, 0x9f, 0x18, 0x3e, 0x60, 0x00,
+	}
+)
+
+// so that test packfiles have the same layout every time
+func sortedKeys(files map[string][]byte) []string {
+	keys := make([]string, 0, len(files))
+	for k := range files {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeTestPak(tb testing.TB, name string, files map[string][]byte) {
+	w, err := pak.OpenWriter(name)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for _, k := range sortedKeys(files) {
+		if err := w.Create(k); err != nil {
+			tb.Fatal(err)
+		}
+		if _, err := w.Write(files[k]); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func writeTestPkz(tb testing.TB, name string, files map[string][]byte) {
+	f, err := os.Create(name)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	z := zip.NewWriter(f)
+	for _, k := range sortedKeys(files) {
+		data := files[k]
+		var w io.Writer
+		if bytes.Equal(data, testDeflated) {
+			w, err = z.CreateRaw(&zip.FileHeader{
+				Name:               k,
+				Method:             zip.Deflate,
+				CRC32:              crc32.ChecksumIEEE(data),
+				CompressedSize64:   uint64(len(testDeflatedRaw)),
+				UncompressedSize64: uint64(len(data)),
+			})
+			data = testDeflatedRaw
+		} else {
+			w, err = z.Create(k)
+		}
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := z.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func resetConfig() {
+	rescans.Wait()
+	applyConfig(defaultConfig)
+	hashLists = nil
+	tenants = nil
+	profiles = nil
+	metrics = newMetrics()
+	openFiles.reset()
+	dirPools = make(map[string]*dirPool)
+	dirCache = nil
+	scannedConfig = nil
+	serverCreated.Store(false)
+}
+
+// creates test game directory and loads config with extra lines appended,
+// where $BASE is replaced with game directory path
+func setupTestServer(tb testing.TB, extra string) string {
+	dir := tb.TempDir()
+	base := filepath.Join(dir, "baseq2")
+	if err := os.MkdirAll(filepath.Join(base, "maps"), 0755); err != nil {
+		tb.Fatal(err)
+	}
+	writeTestPak(tb, filepath.Join(base, "pak0.pak"), map[string][]byte{
+		"maps/stored.bsp":  testStored,
+		"secret/stuff.cfg": testStored,
+	})
+	writeTestPkz(tb, filepath.Join(base, "pak1.pkz"), map[string][]byte{
+		"maps/deflated.bsp": testDeflated,
+	})
+	if err := os.WriteFile(filepath.Join(base, "maps", "loose.txt"), testLoose, 0644); err != nil {
+		tb.Fatal(err)
+	}
+
+	cfg := `
+RefererCheck: ^quake2://
+PakBlackList:
+  - ^secret/
+DirWhiteList:
+  - ^maps/
+SearchPaths:
+  - Match: ^/(baseq2/)?
+    Search:
+      - ` + base + "\n" + strings.ReplaceAll(extra, "$BASE", base)
+	name := filepath.Join(dir, "pakserve.yml")
+	if err := os.WriteFile(name, []byte(cfg), 0644); err != nil {
+		tb.Fatal(err)
+	}
+
+	resetConfig()
+	loadConfig(name)
+	scanSearchPaths()
+	return dir
+}
+
+func testRequest(method, path, encoding string) *http.Request {
+	r := httptest.NewRequest(method, path, nil)
+	r.Header.Set("Referer", "quake2://127.0.0.1")
+	if len(encoding) > 0 {
+		r.Header.Set("Accept-Encoding", encoding)
+	}
+	return r
+}
+
+func TestServer(t *testing.T) {
+	dir := setupTestServer(t, "")
+	resetConfig()
+
+	cfg := DefaultConfig()
+	if _, err := NewServer(cfg); err == nil {
+		t.Fatal("config without search paths accepted")
+	}
+	cfg.DirWhiteList = []string{"^maps/"}
+	cfg.SearchPaths = []ConfigSearchPath{{Match: "^/", Search: []string{filepath.Join(dir, "baseq2")}}}
+
+	// bad configs are reported instead of exiting
+	for _, bad := range []func(*Config){
+		func(c *Config) {
+			c.SearchPaths = []ConfigSearchPath{{Match: "^/", Search: []string{filepath.Join(dir, "missing")}}}
+		},
+		func(c *Config) { c.HashLists = []ConfigHashList{{Algorithm: "sha256"}} },
+		func(c *Config) { c.HashLists = []ConfigHashList{{Name: "list", Algorithm: "bogus"}} },
+		func(c *Config) { c.Tenants = []ConfigTenant{{Name: "t", Hosts: []string{"t.example.com"}}} },
+		func(c *Config) { c.Mirror.URL = "http://[::1" },
+		func(c *Config) { c.Mirror.URL = "ftp://example.com" },
+		func(c *Config) { c.Mirror.URL = "example.com:8080" },
+		func(c *Config) { c.Mirror.URL = "/new-server" },
+		func(c *Config) { c.Mirror.URL = "http://" },
+	} {
+		c := cfg
+		bad(&c)
+		if _, err := NewServer(c); err == nil {
+			t.Errorf("bad config %+v accepted", c)
+		}
+	}
+
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	get := func(path string) int {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get("/maps/stored.bsp"); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+
+	writeTestPak(t, filepath.Join(dir, "baseq2", "pak2.pak"), map[string][]byte{"maps/added.bsp": testStored})
+	if code := get("/maps/added.bsp"); code != http.StatusNotFound {
+		t.Fatalf("unexpected status %d before rescan", code)
+	}
+	srv.Rescan()
+	if code := get("/maps/added.bsp"); code != http.StatusOK {
+		t.Fatalf("unexpected status %d after rescan", code)
+	}
+
+	// running server is not silently reconfigured
+	cfg.HashLists = []ConfigHashList{{Name: "list"}}
+	if _, err := NewServer(cfg); err != errServerExists {
+		t.Fatalf("second server created: %v", err)
+	}
+	if len(hashLists) != 0 {
+		t.Fatal("config of second server applied")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	setupTestServer(t, "")
+
+	tests := []struct {
+		path     string
+		encoding string
+		status   int
+		content  []byte
+		ce       string
+	}{
+		{"/baseq2/maps/stored.bsp", "gzip", http.StatusOK, testStored, ""},
+		{"/MAPS/Stored.bsp", "", http.StatusOK, testStored, ""},
+		{"/maps/deflated.bsp", "gzip", http.StatusOK, testDeflated, "gzip"},
+		{"/maps/deflated.bsp", "deflate", http.StatusOK, testDeflated, "deflate"},
+		{"/maps/deflated.bsp", "", http.StatusOK, testDeflated, ""},
+		{"/maps/loose.txt", "gzip", http.StatusOK, testLoose, ""},
+		{"/secret/stuff.cfg", "", http.StatusNotFound, nil, ""},
+		{"/maps/missing.bsp", "", http.StatusNotFound, nil, ""},
+		{"/baseq2/", "", http.StatusNotFound, nil, ""},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		handler(w, testRequest("GET", test.path, test.encoding))
+		resp := w.Result()
+
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: unexpected status %d", test.path, resp.StatusCode)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		ce := resp.Header.Get("Content-Encoding")
+		if ce != test.ce {
+			t.Errorf("%s: unexpected encoding %q", test.path, ce)
+			continue
+		}
+
+		var body io.Reader = resp.Body
+		switch ce {
+		case "gzip":
+			body, _ = gzip.NewReader(body)
+		case "deflate":
+			body = flate.NewReader(body)
+		}
+		b, err := io.ReadAll(body)
+		if err != nil {
+			t.Errorf("%s: %v", test.path, err)
+			continue
+		}
+		if !bytes.Equal(b, test.content) {
+			t.Errorf("%s: unexpected content", test.path)
+		}
+	}
+}
+
+func TestMinCompressSize(t *testing.T) {
+	dir := setupTestServer(t, "MinCompressSize: 1000\n")
+	small := []byte("small deflated entry")
+	writeTestPkz(t, filepath.Join(dir, "baseq2", "pak2.pkz"), map[string][]byte{"maps/small.bsp": small})
+	config().Compress.Enabled = true
+	scanSearchPaths()
+
+	tests := []struct {
+		path    string
+		content []byte
+		ce      string
+	}{
+		{"/maps/small.bsp", small, ""},
+		{"/maps/deflated.bsp", testDeflated, "gzip"},
+	}
+	for _, encoding := range []string{"gzip", "deflate", "gzip, deflate"} {
+		for _, test := range tests {
+			w := httptest.NewRecorder()
+			handler(w, testRequest("GET", test.path, encoding))
+			resp := w.Result()
+			ce := resp.Header.Get("Content-Encoding")
+			want := test.ce
+			if want != "" && encoding == "deflate" {
+				want = "deflate"
+			}
+			if resp.StatusCode != http.StatusOK || ce != want {
+				t.Errorf("%s %q: unexpected status %d, encoding %q", test.path, encoding, resp.StatusCode, ce)
+				continue
+			}
+			if want == "" && !bytes.Equal(w.Body.Bytes(), test.content) {
+				t.Errorf("%s %q: entry below MinCompressSize not inflated", test.path, encoding)
+			}
+		}
+	}
+}
+
+func TestMirror(t *testing.T) {
+	mirrored := make(chan *http.Request, 10)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- r
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer mirror.Close()
+	setupTestServer(t, "Mirror:\n  URL: "+mirror.URL+"\n")
+
+	h := newHandler()
+	for _, path := range []string{"/maps/stored.bsp", "/maps/missing.bsp"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, testRequest("GET", path+"?x=1", ""))
+		want := http.StatusNotFound
+		if path == "/maps/stored.bsp" {
+			if !bytes.Equal(w.Body.Bytes(), testStored) {
+				t.Errorf("%s: client response affected by mirror", path)
+			}
+			want = http.StatusOK
+		}
+		if w.Code != want {
+			t.Errorf("%s: unexpected status %d", path, w.Code)
+		}
+
+		select {
+		case r := <-mirrored:
+			if r.URL.Path != path || r.URL.RawQuery != "x=1" || r.Header.Get("Referer") != "quake2://127.0.0.1" {
+				t.Errorf("%s: unexpected mirrored request %s %v", path, r.URL, r.Header)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: request not mirrored", path)
+		}
+	}
+}
+
+func TestRefererCheck(t *testing.T) {
+	setupTestServer(t, "")
+
+	r := testRequest("GET", "/maps/stored.bsp", "")
+	r.Header.Set("Referer", "http://example.com/")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+}
+
+func benchmarkHandler(b *testing.B, path, encoding string) {
+	setupTestServer(b, "")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		handler(w, testRequest("GET", path, encoding))
+		if w.Code != http.StatusOK && w.Code != http.StatusNotFound {
+			b.Fatalf("unexpected status %d", w.Code)
+		}
+	}
+}
+
+func BenchmarkPakEntry(b *testing.B) {
+	benchmarkHandler(b, "/baseq2/maps/stored.bsp", "gzip")
+}
+
+func BenchmarkGzipEntry(b *testing.B) {
+	benchmarkHandler(b, "/baseq2/maps/deflated.bsp", "gzip")
+}
+
+func BenchmarkInflateEntry(b *testing.B) {
+	benchmarkHandler(b, "/baseq2/maps/deflated.bsp", "")
+}
+
+func BenchmarkDirFile(b *testing.B) {
+	benchmarkHandler(b, "/baseq2/maps/loose.txt", "")
+}
+
+func BenchmarkNotFound(b *testing.B) {
+	benchmarkHandler(b, "/baseq2/maps/missing.bsp", "")
+}
+
+func BenchmarkFindSearchPath(b *testing.B) {
+	setupTestServer(b, "")
+	r := testRequest("GET", "/baseq2/maps/stored.bsp", "")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		findSearchPath(r)
+	}
+}
+
+func fuzzScan(f *testing.F, seed string, scan func(string) (*searchPath, error)) {
+	dir := setupTestServer(f, "")
+	b, err := os.ReadFile(filepath.Join(dir, "baseq2", seed))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(b)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		name := filepath.Join(t.TempDir(), seed)
+		if err := os.WriteFile(name, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		scan(name)
+	})
+}
+
+func FuzzScanpak(f *testing.F) {
+	fuzzScan(f, "pak0.pak", scanpak)
+}
+
+func FuzzScanzip(f *testing.F) {
+	fuzzScan(f, "pak1.pkz", scanzip)
+}
+
+type testPakEntry struct {
+	name     string
+	pos, len uint32
+}
+
+// builds PAK file with arbitrary directory that pak.Writer would refuse to
+// create, directory is placed right after the header
+func writeRawPak(tb testing.TB, name string, entries []testPakEntry, size int) {
+	b := make([]byte, size)
+	copy(b, "PACK")
+	binary.LittleEndian.PutUint32(b[4:], 12)
+	binary.LittleEndian.PutUint32(b[8:], uint32(len(entries)*64))
+	for i, e := range entries {
+		d := b[12+i*64:]
+		copy(d, e.name)
+		binary.LittleEndian.PutUint32(d[56:], e.pos)
+		binary.LittleEndian.PutUint32(d[60:], e.len)
+	}
+	if err := os.WriteFile(name, b, 0644); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestScanpakBounds(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "bad.pak")
+	writeRawPak(t, name, []testPakEntry{
+		{"good", 200, 10},
+		{"overlap", 205, 10},
+		{"truncated", 250, 100},
+		{"empty", 300, 0},
+	}, 300)
+
+	s, err := scanpak(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.files.len() != 3 {
+		t.Fatalf("unexpected number of files: %d", s.files.len())
+	}
+	if _, ok := s.files.get("truncated"); ok {
+		t.Fatal("truncated entry not skipped")
+	}
+	if len(s.issues) != 2 {
+		t.Fatalf("unexpected issues: %q", s.issues)
+	}
+}
+
+func TestDuplicatePolicy(t *testing.T) {
+	setupTestServer(t, "")
+	name := filepath.Join(t.TempDir(), "dup.pkz")
+
+	// same name twice in known archive order, with different bodies
+	entries := []struct {
+		name string
+		data []byte
+	}{
+		{"maps/dup.bsp", testStored},
+		{`MAPS\Dup.bsp`, testLoose},
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z := zip.NewWriter(f)
+	for _, e := range entries {
+		w, err := z.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []struct {
+		policy string
+		want   []byte
+	}{
+		{DuplicateFirst, testStored},
+		{DuplicateLast, testLoose},
+		{DuplicateError, nil},
+	} {
+		config().DuplicatePolicy = v.policy
+		s, err := scanzip(name)
+		if v.want == nil {
+			if err == nil {
+				t.Fatal("duplicate not rejected")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		// backslash is reported too
+		if s.files.len() != 1 || len(s.issues) != 2 {
+			t.Fatalf("%s: unexpected scan result", v.policy)
+		}
+		r, err := openSearchFile(s, "maps/dup.bsp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, v.want) {
+			t.Fatalf("%s: served %q, want %q", v.policy, got, v.want)
+		}
+	}
+}
+
+func TestSuspiciousNamePolicy(t *testing.T) {
+	setupTestServer(t, "")
+	name := filepath.Join(t.TempDir(), "bad.pkz")
+	writeTestPkz(t, name, map[string][]byte{
+		"maps/good.bsp":     testStored,
+		`maps\back.bsp`:     testStored,
+		"/maps/abs.bsp":     testStored,
+		"maps/../dots.bsp":  testStored,
+		"maps/ctrl\x01.bsp": testStored,
+		"maps/bad\xff.bsp":  testStored,
+		"c:/maps/drive.bsp": testStored,
+	})
+
+	for _, policy := range []string{SuspiciousReport, SuspiciousSkip, SuspiciousError} {
+		config().SuspiciousNamePolicy = policy
+		s, err := scanzip(name)
+		if policy == SuspiciousError {
+			if err == nil {
+				t.Fatal("suspicious names not rejected")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 7
+		if policy == SuspiciousSkip {
+			want = 1
+		}
+		if s.files.len() != want || len(s.issues) != 6 {
+			t.Fatalf("%s: unexpected scan result %d files, issues %q", policy, s.files.len(), s.issues)
+		}
+	}
+}
+
+func TestZipMaxFileSize(t *testing.T) {
+	setupTestServer(t, "MaxFileSize: 100\n")
+	name := filepath.Join(t.TempDir(), "big.pkz")
+	writeTestPkz(t, name, map[string][]byte{
+		"maps/stored.bsp":   testStored,
+		"maps/deflated.bsp": testDeflated,
+	})
+
+	s, err := scanzip(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.files.len() != 1 || len(s.issues) != 1 || !strings.Contains(s.issues[0], "maps/deflated.bsp") {
+		t.Fatalf("unexpected scan result %d files, issues %q", s.files.len(), s.issues)
+	}
+}
+
+// compares scanzip against archive/zip, using enough files to require zip64
+// end of central directory record
+func TestScanzip(t *testing.T) {
+	setupTestServer(t, "")
+	name := filepath.Join(t.TempDir(), "big.pkz")
+	files := make(map[string][]byte)
+	for i := 0; i < 70000; i++ {
+		files[fmt.Sprintf("dir/file%d", i)] = []byte(fmt.Sprint(i))
+	}
+	files["maps/deflated.bsp"] = testDeflated
+	writeTestPkz(t, name, files)
+
+	s, err := scanzip(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.OpenReader(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer z.Close()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if s.files.len() != len(z.File) {
+		t.Fatalf("unexpected number of files: %d", s.files.len())
+	}
+	for _, zf := range z.File {
+		entry, ok := s.files.get(zf.Name)
+		if !ok {
+			t.Fatalf("%s: missing", zf.Name)
+		}
+		want, err := zf.DataOffset()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.dataOffset(f, &entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want || entry.size != zf.CompressedSize64 || entry.filelen != zf.UncompressedSize64 ||
+			entry.filecrc != zf.CRC32 || entry.method != zf.Method || entry.mtime != uint32(zf.Modified.Unix()) {
+			t.Fatalf("%s: entry mismatch", zf.Name)
+		}
+	}
+}
+
+func TestFileIndex(t *testing.T) {
+	x := newFileIndex(0)
+	for i := 0; i < 1000; i++ {
+		x.put(fmt.Sprintf("maps/%d.bsp", i), pakFileEntry{offset: int64(i)})
+	}
+	x.put("maps/10.bsp", pakFileEntry{offset: 12345})
+	x.compact()
+	if x.len() != 1000 {
+		t.Fatalf("unexpected number of entries: %d", x.len())
+	}
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("maps/%d.bsp", i)
+		want := int64(i)
+		if i == 10 {
+			want = 12345
+		}
+		if e, ok := x.get(name); !ok || e.offset != want {
+			t.Fatalf("%s: unexpected entry %v %v", name, e, ok)
+		}
+		if x.name(i) != name {
+			t.Fatalf("%d: unexpected name %s", i, x.name(i))
+		}
+	}
+	if _, ok := x.get("maps/1000.bsp"); ok {
+		t.Fatal("found missing entry")
+	}
+	if _, ok := x.get(""); ok {
+		t.Fatal("found empty entry")
+	}
+}
+
+func heapAlloc() uint64 {
+	var m runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+func TestFileIndexMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+	const n = 200000
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("textures/e%du%d/wall%05d.wal", i%4, i%3, i)
+	}
+
+	before := heapAlloc()
+	m := make(map[string]pakFileEntry)
+	for _, name := range names {
+		m[string([]byte(name))] = pakFileEntry{}
+	}
+	mapSize := heapAlloc() - before
+	runtime.KeepAlive(m)
+	m = nil
+
+	before = heapAlloc()
+	x := newFileIndex(0)
+	for _, name := range names {
+		x.put(name, pakFileEntry{})
+	}
+	x.compact()
+	indexSize := heapAlloc() - before
+	runtime.KeepAlive(x)
+
+	t.Logf("%d entries: map %d bytes, index %d bytes", n, mapSize, indexSize)
+	if indexSize*2 > mapSize {
+		t.Fatalf("index not at least twice smaller than map: %d vs %d", indexSize, mapSize)
+	}
+}
+
+func TestArchiveMetadata(t *testing.T) {
+	resetConfig()
+	dir := t.TempDir()
+	meta := &pak.Metadata{Creator: "tester", Created: time.Unix(1700000000, 0).UTC(), Version: "1.0"}
+
+	w, err := pak.OpenWriter(filepath.Join(dir, "pak0.pak"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Create("maps/stored.bsp"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(testStored); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteMetadata(meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestPkz(t, filepath.Join(dir, "pak1.pkz"), map[string][]byte{"maps/deflated.bsp": testDeflated})
+	comment, err := meta.Comment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	z.SetComment(comment)
+	if _, err := z.Create("maps/deflated.bsp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "pak2.pkz"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var search []searchPath
+	for _, name := range []string{"pak0.pak", "pak1.pkz", "pak2.pkz"} {
+		s, err := scanArchive(dir, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := s.files.get(pak.MetadataName); ok {
+			t.Fatalf("%s: metadata entry indexed", name)
+		}
+		search = append(search, *s)
+	}
+
+	config().dirWhiteList = []*regexp.Regexp{regexp.MustCompile(`^pak\d[.](pak|pkz)$`)}
+	rec := httptest.NewRecorder()
+	handleManifest(rec, testRequest("GET", "/archives.json", ""), new(compiledSearchPath), search)
+	var manifest Manifest
+	if err := json.Unmarshal(rec.Body.Bytes(), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Archives) != 3 {
+		t.Fatalf("unexpected manifest %s", rec.Body)
+	}
+	for i, want := range []*pak.Metadata{meta, nil, meta} {
+		got := manifest.Archives[i].Metadata
+		if (got == nil) != (want == nil) || got != nil && *got != *want {
+			t.Fatalf("%s: unexpected metadata %v", manifest.Archives[i].Name, got)
+		}
+	}
+}
+
+func TestPakDownloadWhiteList(t *testing.T) {
+	dir := setupTestServer(t, `
+PakDownloadWhiteList:
+  - ^pak\d+[.]pak$
+ArchiveManifest: archives.json
+`)
+	want, err := os.ReadFile(filepath.Join(dir, "baseq2", "pak0.pak"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, testRequest("GET", "/baseq2/PAK0.pak", ""))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), want) {
+		t.Fatalf("unexpected status %d, %d bytes", w.Code, w.Body.Len())
+	}
+
+	r := testRequest("GET", "/pak0.pak", "")
+	r.Header.Set("Range", "bytes=0-3")
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusPartialContent || w.Body.String() != "PACK" {
+		t.Fatalf("unexpected range response %d %q", w.Code, w.Body)
+	}
+
+	for _, path := range []string{"/pak1.pkz", "/maps/pak0.pak", "/pak2.pak"} {
+		w := httptest.NewRecorder()
+		handler(w, testRequest("GET", path, ""))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: unexpected status %d", path, w.Code)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, testRequest("GET", "/archives.json", ""))
+	var manifest Manifest
+	if err := json.Unmarshal(w.Body.Bytes(), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Archives) != 1 || manifest.Archives[0].Name != "pak0.pak" {
+		t.Fatalf("unexpected manifest %s", w.Body)
+	}
+
+	// names are listed as on disk
+	base := filepath.Join(dir, "baseq2")
+	writeTestPak(t, filepath.Join(base, "Pak3.pak"), map[string][]byte{"maps/new.bsp": testStored})
+	scanSearchPaths()
+	w = httptest.NewRecorder()
+	handler(w, testRequest("GET", "/archives.json", ""))
+	manifest = Manifest{}
+	if err := json.Unmarshal(w.Body.Bytes(), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Archives) != 2 || manifest.Archives[0].Name != "Pak3.pak" {
+		t.Fatalf("unexpected manifest %s", w.Body)
+	}
+
+	// hashes of replaced and removed archives are dropped on rescan
+	hashed := func(name string) archiveKey {
+		t.Helper()
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := archiveHashNow(name, fi); err != nil {
+			t.Fatal(err)
+		}
+		return archiveKey{name, fi.Size(), fi.ModTime().UnixNano()}
+	}
+	kept := func(key archiveKey) bool {
+		archiveHashMutex.Lock()
+		defer archiveHashMutex.Unlock()
+		_, ok := archiveHashes[key]
+		return ok
+	}
+	name := filepath.Join(base, "pak0.pak")
+	pak3 := filepath.Join(base, "Pak3.pak")
+	old, current := hashed(name), hashed(pak3)
+	writeTestPak(t, name, map[string][]byte{"maps/stored.bsp": testStored, "maps/more.bsp": testStored})
+	scanSearchPaths()
+	if kept(old) || !kept(current) {
+		t.Fatal("hash of replaced archive kept")
+	}
+	old = hashed(name)
+	os.Remove(name)
+	scanSearchPaths()
+	if kept(old) {
+		t.Fatal("hash of removed archive kept")
+	}
+}
+
+func TestSearchPathOverrides(t *testing.T) {
+	setupTestServer(t, `  - Match: ^/custom/
+    Search:
+      - $BASE
+    ContentType: application/x-quake2
+    PakBlackList: []
+    DirWhiteList:
+      - ^maps/.*[.]bsp$
+`)
+
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+	}{
+		{"/maps/stored.bsp", http.StatusOK, "application/octet-stream"},
+		{"/maps/loose.txt", http.StatusOK, "application/octet-stream"},
+		{"/secret/stuff.cfg", http.StatusNotFound, ""},
+		{"/custom/maps/stored.bsp", http.StatusOK, "application/x-quake2"},
+		{"/custom/maps/loose.txt", http.StatusNotFound, ""},
+		{"/custom/secret/stuff.cfg", http.StatusOK, "application/x-quake2"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler(w, testRequest("GET", tt.path, ""))
+		if w.Code != tt.status {
+			t.Errorf("%s: unexpected status %d", tt.path, w.Code)
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); tt.status == http.StatusOK && ct != tt.contentType {
+			t.Errorf("%s: unexpected content type %q", tt.path, ct)
+		}
+	}
+}
+
+func TestLazyScan(t *testing.T) {
+	setupTestServer(t, "LazyScan: true\n")
+
+	if searchPaths[0].lazy.search != nil {
+		t.Fatal("search path scanned too early")
+	}
+	w := httptest.NewRecorder()
+	handler(w, testRequest("GET", "/maps/stored.bsp", ""))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), testStored) {
+		t.Fatalf("unexpected response %d", w.Code)
+	}
+	if len(searchPaths[0].lazy.search) != 3 {
+		t.Fatalf("unexpected search path length %d", len(searchPaths[0].lazy.search))
+	}
+}
+
+func TestLegacyPaths(t *testing.T) {
+	setupTestServer(t, "LegacyPaths: true\n")
+
+	for _, path := range []string{
+		"/baseq2/baseq2/maps/stored.bsp",
+		"/BaseQ2/MAPS/Stored.BSP",
+		"/baseq2/maps%5Cstored.bsp",
+		"/baseq2/..%5Cbaseq2/maps/stored.bsp",
+	} {
+		w := httptest.NewRecorder()
+		handler(w, testRequest("GET", path, ""))
+		if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), testStored) {
+			t.Errorf("%s: unexpected response %d", path, w.Code)
+		}
+	}
+}
+
+func TestHashList(t *testing.T) {
+	setupTestServer(t, `
+HashLists:
+  - Name: Hashes.TXT
+    Algorithm: md5
+    Include:
+      - ^maps/
+      - ^secret/
+`)
+
+	var w *httptest.ResponseRecorder
+	for i := 0; i < 100; i++ {
+		w = httptest.NewRecorder()
+		handler(w, testRequest("GET", "/baseq2/hashes.txt", ""))
+		if w.Code != http.StatusServiceUnavailable {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+
+	want := fmt.Sprintf("%x maps/deflated.bsp\n%x maps/loose.txt\n%x maps/stored.bsp\n",
+		md5.Sum(testDeflated), md5.Sum(testLoose), md5.Sum(testStored))
+	if w.Body.String() != want {
+		t.Fatalf("unexpected hash list:\n%s", w.Body.String())
+	}
+
+	// build of older scan finishing late doesn't replace newer lists
+	sp := &searchPaths[0]
+	older, newer := sp.hashes.next.Add(1), sp.hashes.next.Add(1)
+	sp.hashes.build(newer, sp, nil, hashLists)
+	sp.hashes.build(older, sp, sp.search, hashLists)
+	w = httptest.NewRecorder()
+	handler(w, testRequest("GET", "/baseq2/hashes.txt", ""))
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("stale hash list served: %d %q", w.Code, w.Body)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	setupTestServer(t, `
+Tenants:
+  - Name: test
+    Hosts:
+      - dl.example.com
+    SearchPaths:
+      - Match: ^/tenant/
+        Search:
+          - $BASE
+    DailyQuota: 20
+`)
+
+	tests := []struct {
+		host   string
+		path   string
+		status int
+	}{
+		{"example.com", "/tenant/maps/stored.bsp", http.StatusNotFound},
+		{"dl.example.com:8080", "/baseq2/maps/stored.bsp", http.StatusNotFound},
+		{"DL.example.com", "/tenant/maps/stored.bsp", http.StatusOK},
+		{"dl.example.com", "/tenant/maps/stored.bsp", http.StatusOK},
+		{"dl.example.com", "/tenant/maps/stored.bsp", http.StatusServiceUnavailable},
+		{"example.com", "/baseq2/maps/stored.bsp", http.StatusOK},
+	}
+	for _, test := range tests {
+		r := testRequest("GET", test.path, "")
+		r.Host = test.host
+		w := httptest.NewRecorder()
+		logHandler(w, r)
+		if w.Code != test.status {
+			t.Fatalf("%s%s: unexpected status %d", test.host, test.path, w.Code)
+		}
+	}
+}
+
+func TestPinnedPaths(t *testing.T) {
+	dir := setupTestServer(t, `
+PinnedPaths:
+  - ^maps/
+`)
+
+	stored, _ := searchPaths[0].search[1].files.get("maps/stored.bsp")
+	if contentCache.get(filepath.Join(dir, "baseq2", "pak0.pak"), stored.offset) == nil {
+		t.Fatal("entry not pinned")
+	}
+
+	// pinned content must be served even if packfile is gone
+	os.Remove(filepath.Join(dir, "baseq2", "pak0.pak"))
+	os.Remove(filepath.Join(dir, "baseq2", "pak1.pkz"))
+	for path, content := range map[string][]byte{
+		"/maps/stored.bsp":   testStored,
+		"/maps/deflated.bsp": testDeflated,
+	} {
+		w := httptest.NewRecorder()
+		handler(w, testRequest("GET", path, ""))
+		if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+			t.Fatalf("%s: unexpected response %d", path, w.Code)
+		}
+	}
+}
+
+func TestPakOrder(t *testing.T) {
+	tests := []struct {
+		paks  []string
+		order []string
+		want  []string
+	}{
+		// pinned ahead of unlisted, last listed first
+		{[]string{"pak2.pak", "pak1.pak", "pak0.pak"}, []string{"pak1.pak", "PAK0.PAK"}, []string{"pak0.pak", "pak1.pak", "pak2.pak"}},
+		// unlisted keep default order
+		{[]string{"z.pkz", "b.pak", "a.pak", "c.pak"}, []string{"c.pak"}, []string{"c.pak", "z.pkz", "b.pak", "a.pak"}},
+		// missing packfile is skipped
+		{[]string{"pak1.pak", "pak0.pak"}, []string{"pak0.pak", "missing.pak"}, []string{"pak0.pak", "pak1.pak"}},
+		{[]string{"pak0.pak"}, nil, []string{"pak0.pak"}},
+	}
+	for _, test := range tests {
+		paks := append([]string(nil), test.paks...)
+		if got := pinPakOrder("dir", paks, test.order); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q with order %q: got %q, want %q", test.paks, test.order, got, test.want)
+		}
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	resetConfig()
+	if !selfTest() {
+		t.Fatal("self test failed")
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	dir := setupTestServer(t, "")
+	os.Remove(filepath.Join(dir, "baseq2", "pak0.pak"))
+
+	w := httptest.NewRecorder()
+	handler(w, testRequest("GET", "/maps/stored.bsp", ""))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+
+	rescans.Wait()
+	if len(searchPaths[0].search) != 2 {
+		t.Fatal("search path not rescanned")
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, testRequest("GET", "/maps/deflated.bsp", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+
+	// directory that can't be read keeps previous listing
+	if err := os.RemoveAll(filepath.Join(dir, "baseq2")); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	handler(w, testRequest("GET", "/maps/deflated.bsp", ""))
+	rescans.Wait()
+	if len(searchPaths[0].search) != 2 {
+		t.Fatal("previous listing not kept")
+	}
+}
+
+func TestArchiveReplaced(t *testing.T) {
+	dir := setupTestServer(t, "")
+	name := filepath.Join(dir, "baseq2", "pak0.pak")
+	replaced := []byte("replaced content")
+	writeTestPak(t, name+".tmp", map[string][]byte{"maps/stored.bsp": replaced})
+	if err := os.Rename(name+".tmp", name); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, testRequest("GET", "/maps/stored.bsp", ""))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+
+	for i := 0; ; i++ {
+		w = httptest.NewRecorder()
+		handler(w, testRequest("GET", "/maps/stored.bsp", ""))
+		if w.Code == http.StatusOK {
+			break
+		}
+		if i == 100 {
+			t.Fatal("packfile not rescanned")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !bytes.Equal(w.Body.Bytes(), replaced) {
+		t.Fatalf("unexpected content %q", w.Body.Bytes())
+	}
+}
+
+func TestOpenFiles(t *testing.T) {
+	dir := setupTestServer(t, "MaxOpenFiles: 1\n")
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, testRequest("GET", path, ""))
+		return w
+	}
+
+	for _, path := range []string{"/maps/deflated.bsp", "/maps/stored.bsp", "/maps/stored.bsp"} {
+		if w := get(path); w.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d", path, w.Code)
+		}
+		if n := openFiles.len(); n != 1 {
+			t.Fatalf("%s: %d files open", path, n)
+		}
+	}
+
+	// cached descriptor must not be used after packfile is replaced
+	name := filepath.Join(dir, "baseq2", "pak0.pak")
+	replaced := []byte("replaced content")
+	writeTestPak(t, name+".tmp", map[string][]byte{"maps/stored.bsp": replaced})
+	if err := os.Rename(name+".tmp", name); err != nil {
+		t.Fatal(err)
+	}
+	if w := get("/maps/stored.bsp"); w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	for i := 0; ; i++ {
+		w := get("/maps/stored.bsp")
+		if w.Code == http.StatusOK {
+			if !bytes.Equal(w.Body.Bytes(), replaced) {
+				t.Fatalf("unexpected content %q", w.Body.Bytes())
+			}
+			break
+		}
+		if i == 100 {
+			t.Fatal("packfile not rescanned")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	dir := setupTestServer(t, "AdminToken: secret\n")
+	base := filepath.Join(dir, "baseq2")
+	staging := filepath.Join(dir, "staging")
+
+	publish := func(staging string) (published bool, problems []string) {
+		t.Helper()
+		q := url.Values{"dir": {staging}, "slot": {base}}
+		r := httptest.NewRequest("POST", "/admin/publish?"+q.Encode(), nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		adminHandler().ServeHTTP(w, r)
+		var result struct {
+			Published bool
+			Problems  []string
+		}
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &result) != nil {
+			t.Fatalf("unexpected response %d %s", w.Code, w.Body)
+		}
+		return result.Published, result.Problems
+	}
+	get := func(want []byte) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler(w, testRequest("GET", "/maps/stored.bsp", ""))
+		if !bytes.Equal(w.Body.Bytes(), want) {
+			t.Fatalf("unexpected content %q", w.Body)
+		}
+	}
+
+	// corrupt staging is rejected
+	if err := os.Mkdir(staging, 0755); err != nil {
+		t.Fatal(err)
+	}
+	bad := filepath.Join(staging, "pak1.pkz")
+	writeTestPkz(t, bad, map[string][]byte{"maps/deflated.bsp": testDeflated})
+	b, _ := os.ReadFile(bad)
+	b[60] ^= 0xff
+	os.WriteFile(bad, b, 0644)
+	if ok, problems := publish(staging); ok || len(problems) != 1 {
+		t.Fatalf("corrupt staging published %v", problems)
+	}
+	os.Remove(bad)
+
+	// good staging is swapped in, previous content is left in staging
+	updated := []byte("updated in pak")
+	writeTestPak(t, filepath.Join(staging, "pak0.pak"), map[string][]byte{"maps/stored.bsp": updated})
+	if ok, problems := publish(staging); !ok {
+		t.Fatalf("staging not published %v", problems)
+	}
+	get(updated)
+	if _, err := os.Stat(filepath.Join(staging, "pak1.pkz")); err != nil {
+		t.Fatal(err)
+	}
+
+	// swap is rolled back on pinned archive mismatch
+	b, _ = os.ReadFile(filepath.Join(base, "pak0.pak"))
+	searchPaths[0].cfg.Pins = map[string]string{filepath.Join(base, "pak0.pak"): fmt.Sprintf("%x", sha256.Sum256(b))}
+	if ok, _ := publish(staging); ok {
+		t.Fatal("pinned archive replaced")
+	}
+	get(updated)
+	if _, err := os.Stat(filepath.Join(staging, "pak1.pkz")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSwapDirs(t *testing.T) {
+	for _, swap := range []func(a, b string) error{swapDirs, renameDirs} {
+		dir := t.TempDir()
+		a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+		for _, d := range []string{a, b} {
+			if err := os.Mkdir(d, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(d, "name"), []byte(d), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := swap(a, b); err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range [][2]string{{a, b}, {b, a}} {
+			if data, err := os.ReadFile(filepath.Join(d[0], "name")); err != nil || string(data) != d[1] {
+				t.Fatalf("%s not swapped: %q %v", d[0], data, err)
+			}
+		}
+		if list, _ := os.ReadDir(dir); len(list) != 2 {
+			t.Fatalf("unexpected %d entries left", len(list))
+		}
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	setupTestServer(t, "TrustedProxies: [192.0.2.0/24]\n")
+
+	tests := []struct {
+		remote string
+		xff    string
+		realIP string
+		want   string
+	}{
+		{"192.0.2.1:1234", "198.51.100.7, 192.0.2.5", "", "198.51.100.7"},
+		{"192.0.2.1:1234", "10.0.0.1, 198.51.100.7", "", "198.51.100.7"},
+		{"192.0.2.1:1234", "", "198.51.100.8", "198.51.100.8"},
+		{"192.0.2.1:1234", "bogus", "", "192.0.2.1:1234"},
+		{"203.0.113.1:1234", "198.51.100.7", "", "203.0.113.1:1234"},
+	}
+	for _, v := range tests {
+		r := testRequest("GET", "/maps/stored.bsp", "")
+		r.RemoteAddr = v.remote
+		if len(v.xff) > 0 {
+			r.Header.Set("X-Forwarded-For", v.xff)
+		}
+		if len(v.realIP) > 0 {
+			r.Header.Set("X-Real-IP", v.realIP)
+		}
+		var got string
+		proxyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = r.RemoteAddr
+		})).ServeHTTP(httptest.NewRecorder(), r)
+		if got != v.want {
+			t.Errorf("%s %q: got %s", v.remote, v.xff, got)
+		}
+	}
+
+	v2 := append([]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c"), 198, 51, 100, 9, 192, 0, 2, 1, 0x30, 0x39, 0, 80)
+	headers := []struct {
+		header string
+		want   string
+	}{
+		{"PROXY TCP4 198.51.100.7 192.0.2.1 4321 80\r\n", "198.51.100.7:4321"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 4321 80\r\n", "[2001:db8::1]:4321"},
+		{"PROXY UNKNOWN\r\n", ""},
+		{string(v2), "198.51.100.9:12345"},
+		{"PROXY TCP4 198.51.100.7\r\n", "error"},
+		{"GET / HTTP/1.1\r\n", "error"},
+	}
+	for _, v := range headers {
+		r := bufio.NewReader(strings.NewReader(v.header + "GET"))
+		addr, err := readProxyHeader(r)
+		got := ""
+		if err != nil {
+			got = "error"
+		} else if addr != nil {
+			got = addr.String()
+		}
+		if got != v.want {
+			t.Errorf("%q: got %s", v.header, got)
+			continue
+		}
+		if rest, _ := io.ReadAll(r); err == nil && string(rest) != "GET" {
+			t.Errorf("%q: header not consumed", v.header)
+		}
+	}
+}
+
+func TestACL(t *testing.T) {
+	setupTestServer(t, `AllowFrom: [192.0.2.0/24, "2001:db8::/32"]
+DenyFrom: [192.0.2.128/25]
+`)
+
+	tests := []struct {
+		addr   string
+		status int
+	}{
+		{"192.0.2.1:1234", http.StatusOK},
+		{"[::ffff:192.0.2.2]:1234", http.StatusOK},
+		{"192.0.2.200:1234", http.StatusForbidden},
+		{"198.51.100.1:1234", http.StatusForbidden},
+		{"[2001:db8::1]:1234", http.StatusOK},
+		{"[2001:db9::1]:1234", http.StatusForbidden},
+	}
+	for _, v := range tests {
+		r := testRequest("GET", "/maps/stored.bsp", "")
+		r.RemoteAddr = v.addr
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != v.status {
+			t.Errorf("%s: unexpected status %d", v.addr, w.Code)
+		}
+	}
+
+	// only DenyFrom
+	config().AllowFrom = nil
+	compileACL(config())
+	r := testRequest("GET", "/maps/stored.bsp", "")
+	r.RemoteAddr = "198.51.100.1:1234"
+	if !aclAllowed(r) {
+		t.Fatal("address not in DenyFrom rejected")
+	}
+}
+
+func TestSigningKey(t *testing.T) {
+	seed := bytes.Repeat([]byte{7}, ed25519.SeedSize)
+	setupTestServer(t, "SigningKey: "+base64.StdEncoding.EncodeToString(seed)+"\n")
+	pub := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+
+	tests := []struct {
+		path     string
+		encoding string
+		content  []byte
+	}{
+		{"/maps/stored.bsp", "", testStored},
+		{"/maps/deflated.bsp", "", testDeflated},
+		{"/maps/deflated.bsp", "gzip", testDeflated},
+		{"/maps/deflated.bsp", "gzip", testDeflated},
+		{"/maps/loose.txt", "", testLoose},
+	}
+	for _, v := range tests {
+		w := httptest.NewRecorder()
+		handler(w, testRequest("GET", v.path, v.encoding))
+		sum := sha256.Sum256(v.content)
+		if w.Header().Get("X-Content-SHA256") != hex.EncodeToString(sum[:]) {
+			t.Fatalf("%s: unexpected digest %q", v.path, w.Header().Get("X-Content-SHA256"))
+		}
+		sig, _ := base64.StdEncoding.DecodeString(w.Header().Get("X-Content-Signature"))
+		if !ed25519.Verify(pub, sum[:], sig) {
+			t.Fatalf("%s: bad signature", v.path)
+		}
+	}
+
+	cfg := defaultConfig
+	cfg.SigningKey = "c2hvcnQ="
+	if validateSigningKey(&cfg) == nil {
+		t.Fatal("short key accepted")
+	}
+}
+
+func TestServerSettings(t *testing.T) {
+	setupTestServer(t, "ReadTimeout: 5s\nIdleTimeout: 1m\nMaxHeaderBytes: 4096\n")
+
+	srv := &http.Server{Addr: "127.0.0.1:0", Handler: http.HandlerFunc(handler)}
+	serve(srv, false)
+	defer func() {
+		srv.Close()
+		servers = servers[:len(servers)-1]
+	}()
+	if srv.ReadTimeout != 5*time.Second || srv.WriteTimeout != 0 || srv.IdleTimeout != time.Minute || srv.MaxHeaderBytes != 4096 {
+		t.Fatalf("unexpected server settings %v %v %v %d", srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout, srv.MaxHeaderBytes)
+	}
+
+	cfg := config().Config
+	cfg.WriteTimeout = -1
+	if validateConfig(&cfg) == nil {
+		t.Fatal("negative timeout accepted")
+	}
+	cfg.WriteTimeout = 0
+	cfg.H2C = true
+	if err := validateConfig(&cfg); (err == nil) != h2cSupported {
+		t.Fatalf("unexpected H2C validation result %v", err)
+	}
+}
+
+func TestLargeTransfers(t *testing.T) {
+	setupTestServer(t, "ClientLimits:\n  MaxLargeTransfers: 1\n  LargeTransferSize: 1000\n")
+
+	get := func(path, addr string) int {
+		r := testRequest("GET", path, "")
+		r.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	// hold the only slot of client
+	r := testRequest("GET", "/", "")
+	r.RemoteAddr = "192.0.2.1:1234"
+	release, ok := clientLimits.acquire(httptest.NewRecorder(), r, 1000)
+	if !ok {
+		t.Fatal("slot not acquired")
+	}
+	if code := get("/maps/deflated.bsp", "192.0.2.1:1235"); code != http.StatusTooManyRequests {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if code := get("/maps/stored.bsp", "192.0.2.1:1235"); code != http.StatusOK {
+		t.Fatalf("small file: unexpected status %d", code)
+	}
+	if code := get("/maps/deflated.bsp", "192.0.2.2:1234"); code != http.StatusOK {
+		t.Fatalf("other client: unexpected status %d", code)
+	}
+
+	// queued request gets slot once it is released
+	config().ClientLimits.QueueTimeout = time.Second
+	time.AfterFunc(50*time.Millisecond, release)
+	if code := get("/maps/deflated.bsp", "192.0.2.1:1235"); code != http.StatusOK {
+		t.Fatalf("queued: unexpected status %d", code)
+	}
+
+	// slot is released after transfer
+	if release, ok = clientLimits.acquire(httptest.NewRecorder(), r, 1000); !ok {
+		t.Fatal("slot not released")
+	}
+	release()
+}
+
+func TestAutoTLS(t *testing.T) {
+	setupTestServer(t, "")
+
+	cfg := config().Config
+	cfg.ListenTLS = ConfigListen{{Address: ":8443"}}
+	cfg.AutoTLS = ConfigAutoTLS{Domains: []string{"dl.example.com"}, CacheDir: t.TempDir()}
+	if err := validateConfig(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	bad := cfg
+	bad.CertFile = "cert.pem"
+	if validateConfig(&bad) == nil {
+		t.Fatal("CertFile accepted with AutoTLS")
+	}
+	bad = cfg
+	bad.AutoTLS.CacheDir = ""
+	if validateConfig(&bad) == nil {
+		t.Fatal("missing CacheDir accepted")
+	}
+
+	applyConfig(cfg)
+	defer func() { autoCert = nil }()
+	tc := tlsConfig()
+	if tc.GetCertificate == nil || len(tc.NextProtos) != 3 {
+		t.Fatal("certificate manager not set up")
+	}
+
+	// requests other than ACME challenges are passed through
+	h := autoTLSHandler(http.HandlerFunc(handler))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, testRequest("GET", "/maps/stored.bsp", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://other.example.com/.well-known/acme-challenge/token", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("challenge: unexpected status %d", w.Code)
+	}
+}
+
+func TestStatusFile(t *testing.T) {
+	dir := setupTestServer(t, "StatusFile: $BASE/../status.json\n")
+	defer setPhase(PhaseStarting)
+
+	read := func() ServerStatus {
+		var st ServerStatus
+		b, err := os.ReadFile(filepath.Join(dir, "status.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(b, &st); err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+
+	st := read()
+	if st.Phase != PhaseStarting || st.PID != os.Getpid() || st.Revision != revisionString() {
+		t.Fatalf("unexpected status %+v", st)
+	}
+	if st.LastScan == nil || st.LastScan.Archives != 2 || st.LastScan.Files != 3 {
+		t.Fatalf("unexpected scan result %+v", st.LastScan)
+	}
+
+	started := make(chan struct{})
+	done := make(chan struct{})
+	h := trackTransfers(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-done
+	}))
+	go h.ServeHTTP(httptest.NewRecorder(), testRequest("GET", "/", ""))
+	<-started
+	setPhase(PhaseReady)
+	close(done)
+
+	st = read()
+	if st.Phase != PhaseReady || st.ActiveTransfers != 1 {
+		t.Fatalf("unexpected status %+v", st)
+	}
+}
+
+func TestHotCache(t *testing.T) {
+	dir := setupTestServer(t, "HotCacheSize: 1048576\nHotCacheMaxEntry: 100\n")
+
+	get := func(path, encoding string, content []byte) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler(w, testRequest("GET", path, encoding))
+		var body io.Reader = w.Body
+		switch w.Header().Get("Content-Encoding") {
+		case "gzip":
+			body, _ = gzip.NewReader(body)
+		case "deflate":
+			body = flate.NewReader(body)
+		}
+		b, _ := io.ReadAll(body)
+		if w.Code != http.StatusOK || !bytes.Equal(b, content) {
+			t.Fatalf("%s %q: unexpected response %d", path, encoding, w.Code)
+		}
+	}
+
+	get("/maps/stored.bsp", "", testStored)
+	get("/maps/deflated.bsp", "gzip", testDeflated)
+	if n := contentCache.hotList.Len(); n != 1 {
+		t.Fatalf("%d entries cached", n)
+	}
+
+	config().HotCacheMaxEntry = 1 << 20
+	get("/maps/deflated.bsp", "gzip", testDeflated)
+	if n := contentCache.hotList.Len(); n != 2 {
+		t.Fatalf("%d entries cached", n)
+	}
+
+	// cached entries are served without touching packfiles
+	for _, name := range []string{"pak0.pak", "pak1.pkz"} {
+		if err := os.Remove(filepath.Join(dir, "baseq2", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, encoding := range []string{"", "gzip", "deflate"} {
+		get("/maps/stored.bsp", encoding, testStored)
+		get("/maps/deflated.bsp", encoding, testDeflated)
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	setupTestServer(t, "Tombstones:\n  - ^maps/(stored|loose)[.]\n")
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/maps/stored.bsp", http.StatusGone},
+		{"/baseq2/MAPS/Stored.bsp", http.StatusGone},
+		{"/maps/loose.txt", http.StatusGone},
+		{"/maps/deflated.bsp", http.StatusOK},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		handler(w, testRequest("GET", test.path, ""))
+		if w.Code != test.status {
+			t.Errorf("%s: unexpected status %d", test.path, w.Code)
+		}
+	}
+}
+
+func TestFileListing(t *testing.T) {
+	setupTestServer(t, "FileListing: true\n")
+
+	w := httptest.NewRecorder()
+	handler(w, testRequest("GET", "/baseq2/?list=1", ""))
+	var listing Listing
+	if err := json.Unmarshal(w.Body.Bytes(), &listing); err != nil {
+		t.Fatal(err)
+	}
+	want := []ListingFile{
+		{Name: "maps/deflated.bsp", Size: uint64(len(testDeflated)), CRC: fmt.Sprintf("%08x", crc32.ChecksumIEEE(testDeflated)), Source: "pak1.pkz"},
+		{Name: "maps/loose.txt", Size: uint64(len(testLoose))},
+		{Name: "maps/stored.bsp", Size: uint64(len(testStored)), Source: "pak0.pak"},
+	}
+	if len(listing.Files) != len(want) {
+		t.Fatalf("unexpected listing %+v", listing.Files)
+	}
+	for i := range want {
+		if listing.Files[i] != want[i] {
+			t.Errorf("unexpected file %+v", listing.Files[i])
+		}
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, testRequest("GET", "/baseq2/maps/?list=html", ""))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `<a href="loose.txt">maps/loose.txt</a>`) {
+		t.Fatalf("unexpected listing %d %q", w.Code, w.Body.String())
+	}
+
+	config().FileListing = false
+	w = httptest.NewRecorder()
+	handler(w, testRequest("GET", "/baseq2/?list=1", ""))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+}
+
+func TestBandwidthSchedule(t *testing.T) {
+	setupTestServer(t, `BandwidthSchedule:
+  - From: "00:00"
+    To: "00:00"
+    Limit: 10000
+`)
+
+	saved := config().bandwidthSchedule
+	config().bandwidthSchedule = []bandwidthWindow{{from: 18 * 60, to: 2 * 60, limit: 100}, {from: 0, to: 0, limit: 200}}
+	times := []struct {
+		clock string
+		limit int64
+	}{
+		{"17:59", 200},
+		{"18:00", 100},
+		{"01:59", 100},
+		{"02:00", 200},
+	}
+	for _, v := range times {
+		tm, _ := time.Parse("15:04", v.clock)
+		if limit := scheduledBandwidth(tm); limit != v.limit {
+			t.Errorf("%s: unexpected limit %d", v.clock, limit)
+		}
+	}
+	config().bandwidthSchedule = saved
+
+	// 3 responses of 1600 bytes at 10000 bytes/s take at least 320 ms
+	h := throttleHandler(http.HandlerFunc(handler))
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, testRequest("GET", "/maps/deflated.bsp", ""))
+		if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), testDeflated) {
+			t.Fatalf("unexpected response %d", w.Code)
+		}
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Fatalf("responses not throttled, took %v", d)
+	}
+}
+
+func TestMaxBandwidth(t *testing.T) {
+	setupTestServer(t, `  - Name: mod
+    Match: ^/mod/
+    MaxBandwidth: 10000
+    Search:
+      - $BASE
+`)
+
+	config().MaxBandwidth = 300
+	config().bandwidthSchedule = []bandwidthWindow{{from: 0, to: 0, limit: 200}}
+	if limit := globalBandwidth(time.Now()); limit != 200 {
+		t.Errorf("unexpected limit %d", limit)
+	}
+	config().bandwidthSchedule = nil
+	if limit := globalBandwidth(time.Now()); limit != 300 {
+		t.Errorf("unexpected limit %d", limit)
+	}
+	config().MaxBandwidth = 0
+
+	get := func(path string) time.Duration {
+		t.Helper()
+		h := throttleHandler(http.HandlerFunc(handler))
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, testRequest("GET", path, ""))
+			if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), testDeflated) {
+				t.Fatalf("unexpected response %d", w.Code)
+			}
+		}
+		return time.Since(start)
+	}
+
+	// only search path with MaxBandwidth is throttled
+	if d := get("/maps/deflated.bsp"); d > 200*time.Millisecond {
+		t.Fatalf("responses throttled, took %v", d)
+	}
+	if d := get("/mod/maps/deflated.bsp"); d < 300*time.Millisecond {
+		t.Fatalf("responses not throttled, took %v", d)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	setupTestServer(t, "Compress:\n  Enabled: true\n  MinSize: 1\n  Level: 9\n")
+
+	get := func(encoding, ce string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler(w, testRequest("GET", "/maps/stored.bsp", encoding))
+		if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != ce || w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Fatalf("%q: unexpected response %d %q", encoding, w.Code, w.Header().Get("Content-Encoding"))
+		}
+		var body io.Reader = w.Body
+		if ce == "gzip" {
+			body, _ = gzip.NewReader(body)
+		}
+		if b, _ := io.ReadAll(body); !bytes.Equal(b, testStored) {
+			t.Fatalf("%q: unexpected content %q", encoding, b)
+		}
+	}
+
+	get("gzip", "gzip")
+	get("deflate", "")
+	get("", "")
+
+	config().Compress.SkipExtensions = []string{".BSP"}
+	w := httptest.NewRecorder()
+	handler(w, testRequest("GET", "/maps/stored.bsp", "gzip"))
+	if ce := w.Header().Get("Content-Encoding"); ce != "" || !bytes.Equal(w.Body.Bytes(), testStored) {
+		t.Fatalf("unexpected encoding %q", ce)
+	}
+}
+
+func TestClientLimits(t *testing.T) {
+	setupTestServer(t, `ClientLimits:
+  RequestRate: 0.001
+  RequestBurst: 2
+  TrustedProxies: [192.0.2.0/24]
+`)
+
+	get := func(addr string) int {
+		r := testRequest("GET", "/maps/stored.bsp", "")
+		r.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := get("198.51.100.1:1234"); code != http.StatusOK {
+			t.Fatalf("unexpected status %d", code)
+		}
+	}
+	if code := get("198.51.100.1:1234"); code != http.StatusTooManyRequests {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if code := get("198.51.100.2:1234"); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	for i := 0; i < 3; i++ {
+		if code := get("192.0.2.1:1234"); code != http.StatusOK {
+			t.Fatalf("trusted proxy: unexpected status %d", code)
+		}
+	}
+
+	// 4800 bytes with burst of 4000 at 4000 bytes/s take at least 200 ms
+	config().ClientLimits = ConfigClientLimits{Bandwidth: 4000, BandwidthBurst: 4000}
+	compileClientLimits()
+	h := throttleHandler(http.HandlerFunc(handler))
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, testRequest("GET", "/maps/deflated.bsp", ""))
+		if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), testDeflated) {
+			t.Fatalf("unexpected response %d", w.Code)
+		}
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Fatalf("responses not throttled, took %v", d)
+	}
+}
+
+func TestInflateCache(t *testing.T) {
+	dir := setupTestServer(t, "InflateCacheSize: 1048576\n")
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler(w, testRequest("GET", "/maps/deflated.bsp", ""))
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d", w.Code)
+		}
+		if !bytes.Equal(w.Body.Bytes(), testDeflated) {
+			t.Fatal("unexpected content")
+		}
+		if i > 0 {
+			break
+		}
+
+		// second request must be served from cache
+		name := filepath.Join(dir, "baseq2", "pak1.pkz")
+		if err := os.Truncate(name, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHead(t *testing.T) {
+	setupTestServer(t, "")
+
+	headers := []string{"Content-Type", "Content-Length", "Content-Encoding", "Vary", "ETag", "Last-Modified"}
+	for _, path := range []string{"/maps/stored.bsp", "/maps/deflated.bsp", "/maps/loose.txt", "/maps/missing.bsp"} {
+		for _, encoding := range []string{"", "gzip", "deflate"} {
+			get := httptest.NewRecorder()
+			handler(get, testRequest("GET", path, encoding))
+			head := httptest.NewRecorder()
+			handler(head, testRequest("HEAD", path, encoding))
+
+			if head.Code != get.Code {
+				t.Errorf("%s %q: HEAD status %d, GET status %d", path, encoding, head.Code, get.Code)
+			}
+			if head.Body.Len() > 0 {
+				t.Errorf("%s %q: HEAD response has body", path, encoding)
+			}
+			for _, h := range headers {
+				if head.Header().Get(h) != get.Header().Get(h) {
+					t.Errorf("%s %q: HEAD %s %q, GET %s %q", path, encoding,
+						h, head.Header().Get(h), h, get.Header().Get(h))
+				}
+			}
+			if get.Code == http.StatusOK && get.Header().Get("Content-Length") != strconv.Itoa(get.Body.Len()) {
+				t.Errorf("%s %q: Content-Length doesn't match body", path, encoding)
+			}
+		}
+	}
+
+	config().HeadIdentity = true
+	w := httptest.NewRecorder()
+	handler(w, testRequest("HEAD", "/maps/deflated.bsp", "gzip"))
+	if w.Header().Get("Content-Encoding") != "" || w.Header().Get("Content-Length") != strconv.Itoa(len(testDeflated)) {
+		t.Fatalf("unexpected HEAD headers %v", w.Header())
+	}
+}
+
+func TestAllowedHosts(t *testing.T) {
+	setupTestServer(t, "AllowedHosts: [Example.com]\n")
+
+	tests := []struct {
+		host   string
+		status int
+	}{
+		{"example.com", http.StatusOK},
+		{"EXAMPLE.COM:8080", http.StatusOK},
+		{"192.0.2.1", http.StatusMisdirectedRequest},
+		{"evil.example.net", http.StatusMisdirectedRequest},
+	}
+	for _, test := range tests {
+		r := testRequest("GET", "/maps/stored.bsp", "")
+		r.Host = test.host
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: unexpected status %d", test.host, w.Code)
+		}
+	}
+}
+
+func TestTicketKeys(t *testing.T) {
+	setupTestServer(t, "TLSTicketRotation: 12h\n")
+	if config().TLSTicketRotation != 12*time.Hour {
+		t.Fatalf("unexpected rotation %v", config().TLSTicketRotation)
+	}
+
+	k := new(ticketKeys)
+	var first [32]byte
+	for i := 0; i < ticketKeyCount+2; i++ {
+		keys, err := k.rotate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			first = keys[0]
+		} else if keys[0] == keys[1] {
+			t.Fatal("key not rotated")
+		}
+		if len(keys) > ticketKeyCount {
+			t.Fatalf("%d keys kept", len(keys))
+		}
+		if (keys[len(keys)-1] == first) != (i < ticketKeyCount) {
+			t.Fatalf("unexpected oldest key after %d rotations", i+1)
+		}
+	}
+}
+
+func TestSearchPathName(t *testing.T) {
+	setupTestServer(t, `  - Name: mod
+    Match: ^/mod/
+    Search:
+      - $BASE
+StateFile: `+filepath.Join(t.TempDir(), "state.json")+"\n")
+	fileStats = make(map[string]*FileStats)
+	searchPathStats = make(map[string]*FileStats)
+
+	for _, path := range []string{"/mod/maps/stored.bsp", "/mod/maps/loose.txt", "/maps/stored.bsp", "/mod/missing"} {
+		logHandler(httptest.NewRecorder(), testRequest("GET", path, ""))
+	}
+
+	if s := searchPathStats["mod"]; s == nil || s.Hits != 2 || s.Bytes != uint64(len(testStored)+len(testLoose)) {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	if s := searchPathStats["^/(baseq2/)?"]; s == nil || s.Hits != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func TestRangeStats(t *testing.T) {
+	setupTestServer(t, "StateFile: "+filepath.Join(t.TempDir(), "state.json")+"\nRangeStatsMinSize: 1\n")
+	fileStats = make(map[string]*FileStats)
+	searchPathStats = make(map[string]*FileStats)
+
+	size := int64(len(testStored))
+	for _, rng := range []string{"", "bytes=3-8", fmt.Sprintf("bytes=%d-", size/2), "bytes=0-1,4-5"} {
+		r := testRequest("GET", "/maps/stored.bsp", "")
+		if len(rng) > 0 {
+			r.Header.Set("Range", rng)
+		}
+		logHandler(httptest.NewRecorder(), r)
+	}
+	logHandler(httptest.NewRecorder(), testRequest("HEAD", "/maps/stored.bsp", ""))
+
+	rs := statsSnapshot().Files["/maps/stored.bsp"].Ranges
+	if rs == nil || rs.Size != size || rs.Full != 1 || rs.Partial != 2 || rs.Truncated != 0 {
+		t.Fatalf("unexpected range stats %+v", rs)
+	}
+	var starts, completion [rangeBuckets]uint64
+	starts[rangeBucket(3, size)]++
+	starts[rangeBucket(size/2, size)]++
+	completion[rangeBucket(6, size)]++
+	completion[rangeBucket(size-size/2, size)]++
+	completion[rangeBuckets-1]++
+	if rs.Starts != starts || rs.Completion != completion {
+		t.Fatalf("unexpected histograms %v %v", rs.Starts, rs.Completion)
+	}
+
+	if _, _, ok := parseContentRange("bytes 5-4/10"); ok {
+		t.Fatal("bad range accepted")
+	}
+}
+
+func TestEncodingOverride(t *testing.T) {
+	setupTestServer(t, "EncodingOverride: true\n")
+
+	tests := []struct {
+		query    string
+		encoding string
+		status   int
+		ce       string
+	}{
+		{"", "gzip", http.StatusOK, "gzip"},
+		{"?encoding=identity", "gzip, deflate", http.StatusOK, ""},
+		{"?encoding=gzip", "", http.StatusOK, "gzip"},
+		{"?encoding=deflate", "gzip", http.StatusOK, "deflate"},
+		{"?encoding=br", "", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		handler(w, testRequest("GET", "/maps/deflated.bsp"+test.query, test.encoding))
+		if w.Code != test.status {
+			t.Errorf("%q: unexpected status %d", test.query, w.Code)
+			continue
+		}
+		if ce := w.Header().Get("Content-Encoding"); ce != test.ce {
+			t.Errorf("%q: unexpected encoding %q", test.query, ce)
+		}
+	}
+
+	config().EncodingOverride = false
+	w := httptest.NewRecorder()
+	handler(w, testRequest("GET", "/maps/deflated.bsp?encoding=identity", "gzip"))
+	if ce := w.Header().Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("override applied when disabled: %q", ce)
+	}
+}
+
+func TestChecksumTrailer(t *testing.T) {
+	sum := sha256.Sum256(testDeflated)
+	tests := []struct {
+		checksum string
+		header   string
+		value    string
+	}{
+		{"crc32", "X-Content-CRC32", fmt.Sprintf("%08x", crc32.ChecksumIEEE(testDeflated))},
+		{"sha256", "Digest", "sha-256=" + base64.StdEncoding.EncodeToString(sum[:])},
+	}
+	for _, test := range tests {
+		setupTestServer(t, "ChecksumTrailer: "+test.checksum+"\nInflateCacheSize: 1048576\n")
+		srv := httptest.NewServer(http.HandlerFunc(handler))
+
+		// second request is served from inflated cache
+		for i := 0; i < 2; i++ {
+			r := testRequest("GET", srv.URL+"/maps/deflated.bsp", "identity")
+			r.RequestURI = ""
+			resp, err := http.DefaultTransport.RoundTrip(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, testDeflated) {
+				t.Fatalf("%s: unexpected content", test.checksum)
+			}
+			if v := resp.Trailer.Get(test.header); v != test.value {
+				t.Fatalf("%s: unexpected trailer %q", test.checksum, v)
+			}
+		}
+		srv.Close()
+	}
+}
+
+func TestSnapshotDiff(t *testing.T) {
+	dir := setupTestServer(t, "AdminToken: secret\n")
+	admin := adminHandler()
+	adminRequest := func(method, path, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := adminRequest("POST", "/admin/snapshot?name=before", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	if w := adminRequest("POST", "/admin/snapshot?name=before", "secret"); w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+
+	base := filepath.Join(dir, "baseq2")
+	writeTestPak(t, filepath.Join(base, "pak0.pak"), map[string][]byte{
+		"maps/stored.bsp": []byte("changed"),
+		"maps/added.bsp":  testStored,
+	})
+	os.Remove(filepath.Join(base, "pak1.pkz"))
+	rescanDir(base)
+
+	w := adminRequest("GET", "/admin/diff?name=before", "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	var diffs map[string]indexDiff
+	if err := json.Unmarshal(w.Body.Bytes(), &diffs); err != nil {
+		t.Fatal(err)
+	}
+	d := diffs["^/(baseq2/)?"]
+	if fmt.Sprint(d.Added, d.Removed, d.Changed) != "[maps/added.bsp] [maps/deflated.bsp] [maps/stored.bsp]" {
+		t.Fatalf("unexpected diff %+v", d)
+	}
+
+	if w := adminRequest("GET", "/admin/diff?name=missing", "secret"); w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	const caseSensitivePath = "  - Match: ^/cs/\n    Search:\n      - $BASE\n    CaseSensitive: true"
+	tests := []struct {
+		extra  string
+		path   string
+		status int
+	}{
+		{"", "/maps/Mixed.TXT", http.StatusNotFound},
+		{"", "/maps//loose.txt", http.StatusOK},
+		{"", `/maps\loose.txt`, http.StatusNotFound},
+		{"", "/maps/a%2fb", http.StatusNotFound},
+		{"Normalize: {Lowercase: false}", "/maps/Mixed.TXT", http.StatusOK},
+		{"Normalize: {Lowercase: false}", "/MAPS/Stored.bsp", http.StatusOK},
+		{"Normalize: {Lowercase: false}", "/SECRET/stuff.cfg", http.StatusNotFound},
+		{"CaseSensitive: true", "/maps/Mixed.TXT", http.StatusOK},
+		{"CaseSensitive: true", "/MAPS/Stored.bsp", http.StatusOK},
+		{caseSensitivePath, "/cs/maps/Mixed.TXT", http.StatusOK},
+		{caseSensitivePath, "/cs/MAPS/Stored.bsp", http.StatusOK},
+		{caseSensitivePath, "/maps/Mixed.TXT", http.StatusNotFound},
+		{"Normalize: {CollapseSlashes: false}", "/maps//loose.txt", http.StatusNotFound},
+		{"Normalize: {DecodeBackslashes: true}", `/maps\loose.txt`, http.StatusOK},
+		{"Normalize: {RejectSuspicious: true}", "/maps/loose.txt", http.StatusOK},
+		{"Normalize: {RejectSuspicious: true}", "/maps/a%2fb", http.StatusBadRequest},
+		{"Normalize: {RejectSuspicious: true}", "/maps/a%01b", http.StatusBadRequest},
+		{"Normalize: {RejectSuspicious: true}", "/maps/../maps/loose.txt", http.StatusBadRequest},
+		{"Normalize: {RejectSuspicious: true}", `/maps\loose.txt`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		dir := setupTestServer(t, test.extra+"\n")
+		if err := os.WriteFile(filepath.Join(dir, "baseq2", "maps", "Mixed.TXT"), testLoose, 0644); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handler(w, testRequest("GET", test.path, ""))
+		if w.Code != test.status {
+			t.Errorf("%q %s: unexpected status %d", test.extra, test.path, w.Code)
+		}
+	}
+}
+
+func TestArchivePins(t *testing.T) {
+	for _, good := range []bool{true, false} {
+		dir := t.TempDir()
+		name := filepath.Join(dir, "pak0.pak")
+		writeTestPak(t, name, map[string][]byte{"maps/stored.bsp": testStored})
+		sum, err := hashFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !good {
+			sum = strings.Repeat("0", len(sum))
+		}
+		setupTestServer(t, `  - Match: ^/pinned/
+    Search:
+      - `+dir+`
+    Pins:
+      `+name+`: `+sum+"\n")
+
+		w := httptest.NewRecorder()
+		handler(w, testRequest("GET", "/pinned/maps/stored.bsp", ""))
+		if good && w.Code != http.StatusOK || !good && w.Code != http.StatusServiceUnavailable {
+			t.Errorf("pin match %v: unexpected status %d", good, w.Code)
+		}
+
+		// other search paths are not affected
+		w = httptest.NewRecorder()
+		handler(w, testRequest("GET", "/maps/stored.bsp", ""))
+		if w.Code != http.StatusOK {
+			t.Errorf("pin match %v: unexpected status %d", good, w.Code)
+		}
+	}
+}
+
+func TestBans(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "bans.txt")
+	err := os.WriteFile(name, []byte(`# comment
+192.0.2.1
+198.51.100.0/24 2000-01-01T00:00:00Z
+2001:db8::/32   # documentation
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupTestServer(t, `
+AdminToken: secret
+Bans:
+  File: `+name+`
+  AutoBanAfter: 2
+  AutoBanWindow: 1m
+  AutoBanDuration: 1h
+Tenants:
+  - Name: test
+    Hosts:
+      - dl.example.com
+    SearchPaths:
+      - Match: ^/
+        Search:
+          - $BASE
+    RateLimit: 0.001
+`)
+
+	get := func(addr, host string) int {
+		r := testRequest("GET", "/maps/stored.bsp", "")
+		r.RemoteAddr = addr
+		r.Host = host
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+	admin := func(method, query string) int {
+		r := httptest.NewRequest(method, "/admin/bans"+query, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		adminHandler().ServeHTTP(w, r)
+		return w.Code
+	}
+
+	tests := []struct {
+		addr   string
+		status int
+	}{
+		{"192.0.2.1:1234", http.StatusForbidden},
+		{"192.0.2.2:1234", http.StatusOK},
+		{"198.51.100.5:1234", http.StatusOK},
+		{"[2001:db8::1]:1234", http.StatusForbidden},
+		{"[::ffff:192.0.2.1]:1234", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		if status := get(test.addr, "example.com"); status != test.status {
+			t.Errorf("%s: unexpected status %d", test.addr, status)
+		}
+	}
+
+	if status := admin("POST", "?addr=203.0.113.0/24&duration=1h"); status != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", status)
+	}
+	if status := get("203.0.113.7:1234", "example.com"); status != http.StatusForbidden {
+		t.Fatalf("unexpected status %d", status)
+	}
+	b, _ := os.ReadFile(name)
+	if !strings.Contains(string(b), "203.0.113.0/24 ") || strings.Contains(string(b), "198.51.100.0/24") {
+		t.Fatalf("unexpected ban file:\n%s", b)
+	}
+	if status := admin("DELETE", "?addr=203.0.113.0/24"); status != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", status)
+	}
+	if status := get("203.0.113.7:1234", "example.com"); status != http.StatusOK {
+		t.Fatalf("unexpected status %d", status)
+	}
+
+	// rate limiter escalates to temporary ban
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusForbidden} {
+		if status := get("203.0.113.8:1234", "dl.example.com"); status != want {
+			t.Fatalf("request %d: unexpected status %d", i, status)
+		}
+	}
+	if status := get("203.0.113.9:1234", "example.com"); status != http.StatusOK {
+		t.Fatalf("unexpected status %d", status)
+	}
+
+	// stale strikes and forgotten offenses are pruned, escalation is capped
+	stale, forgiven, repeat := netip.MustParseAddr("203.0.113.10"), netip.MustParseAddr("203.0.113.11"), netip.MustParseAddr("203.0.113.12")
+	now := time.Now()
+	bans.mutex.Lock()
+	bans.strikes[stale] = &strike{count: 1, start: now.Add(-2 * time.Minute)}
+	bans.offenses[forgiven] = offense{count: 3, expires: now.Add(-time.Second)}
+	bans.offenses[repeat] = offense{count: 10, expires: now.Add(time.Hour)}
+	bans.pruned = now.Add(-2 * time.Minute)
+	bans.mutex.Unlock()
+	bans.strike(repeat)
+	bans.strike(repeat)
+
+	bans.mutex.Lock()
+	_, staleKept := bans.strikes[stale]
+	_, forgivenKept := bans.offenses[forgiven]
+	o := bans.offenses[repeat]
+	bans.mutex.Unlock()
+	if staleKept || forgivenKept {
+		t.Fatal("stale strike or forgotten offense kept")
+	}
+	if o.count != 10 {
+		t.Fatalf("offense count escalated to %d", o.count)
+	}
+	for _, b := range bans.list() {
+		if b.prefix.Addr() == repeat && b.expires.Sub(now) > maxAutoBan+time.Minute {
+			t.Fatalf("ban longer than %s: %s", maxAutoBan, b)
+		}
+	}
+}
+
+func TestLogChecksums(t *testing.T) {
+	setupTestServer(t, "LogLevel: 2\nLogChecksums: true\n")
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	w := httptest.NewRecorder()
+	logHandler(w, testRequest("GET", "/maps/deflated.bsp", "gzip"))
+	want := fmt.Sprintf(" %d %08x\n", w.Body.Len(), crc32.ChecksumIEEE(w.Body.Bytes()))
+	if !strings.HasSuffix(buf.String(), want) {
+		t.Fatalf("log line %q doesn't end with %q", buf.String(), want)
+	}
+}
+
+func TestLogFormatJSON(t *testing.T) {
+	setupTestServer(t, "LogLevel: 2\nLogFormat: json\n")
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	w := httptest.NewRecorder()
+	logHandler(w, testRequest("GET", "/maps/deflated.bsp", "gzip"))
+
+	var rec accessLogRecord
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("bad log line %q: %v", buf.String(), err)
+	}
+	if rec.Path != "/maps/deflated.bsp" || rec.Status != http.StatusOK ||
+		rec.Bytes != int64(w.Body.Len()) || rec.Encoding != "gzip" ||
+		!strings.HasSuffix(rec.Archive, "pak1.pkz") || len(rec.SearchPath) == 0 {
+		t.Fatalf("unexpected log record %+v", rec)
+	}
+}
+
+func TestDirWorkers(t *testing.T) {
+	setupTestServer(t, "DirWorkers: 1\nDirTimeout: 50ms\n")
+
+	hang := make(chan struct{})
+	dirOpen = func(name string) (*os.File, error) {
+		if strings.HasSuffix(name, "hang.txt") {
+			<-hang
+		}
+		return os.Open(name)
+	}
+	defer func() { dirOpen = os.Open }()
+
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		handler(w, testRequest("GET", path, ""))
+		return w.Code
+	}
+
+	if status := get("/maps/loose.txt"); status != http.StatusOK {
+		t.Fatalf("unexpected status %d", status)
+	}
+	// hung open ties up the only worker, and queue holds one more job
+	for i := 0; i < 2; i++ {
+		if status := get("/maps/hang.txt"); status != http.StatusServiceUnavailable {
+			t.Fatalf("unexpected status %d", status)
+		}
+	}
+	// pool is saturated now, so this fails without waiting
+	start := time.Now()
+	if status := get("/maps/loose.txt"); status != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status %d", status)
+	}
+	if time.Since(start) > 40*time.Millisecond {
+		t.Fatal("saturated pool didn't fail fast")
+	}
+	// packfiles are not affected
+	if status := get("/maps/stored.bsp"); status != http.StatusOK {
+		t.Fatalf("unexpected status %d", status)
+	}
+
+	close(hang)
+	for i := 0; ; i++ {
+		if get("/maps/loose.txt") == http.StatusOK {
+			break
+		}
+		if i == 100 {
+			t.Fatal("pool didn't recover")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRange(t *testing.T) {
+	dir := setupTestServer(t, "")
+
+	// stored zip entry
+	f, err := os.Create(filepath.Join(dir, "baseq2", "pak2.pkz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	z := zip.NewWriter(f)
+	zw, err := z.CreateHeader(&zip.FileHeader{Name: "maps/zipstored.bsp", Method: zip.Store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(testLoose)
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	scanSearchPaths()
+
+	tests := []struct {
+		path   string
+		ranges string
+		status int
+		body   string
+	}{
+		{"/maps/stored.bsp", "bytes=3-8", http.StatusPartialContent, string(testStored[3:9])},
+		{"/maps/stored.bsp", "bytes=-4", http.StatusPartialContent, string(testStored[len(testStored)-4:])},
+		{"/maps/stored.bsp", "bytes=100-", http.StatusRequestedRangeNotSatisfiable, ""},
+		{"/maps/zipstored.bsp", "bytes=5-", http.StatusPartialContent, string(testLoose[5:])},
+		{"/maps/deflated.bsp", "bytes=0-9", http.StatusOK, string(testDeflated)},
+	}
+	for _, test := range tests {
+		r := testRequest("GET", test.path, "")
+		r.Header.Set("Range", test.ranges)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s %s: unexpected status %d", test.path, test.ranges, w.Code)
+			continue
+		}
+		if test.status != http.StatusRequestedRangeNotSatisfiable && w.Body.String() != test.body {
+			t.Errorf("%s %s: unexpected body %q", test.path, test.ranges, w.Body.String())
+		}
+	}
+
+	// multipart ranges
+	r := testRequest("GET", "/maps/stored.bsp", "")
+	r.Header.Set("Range", "bytes=0-1,5-6")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusPartialContent || !strings.HasPrefix(w.Header().Get("Content-Type"), "multipart/byteranges") {
+		t.Fatalf("unexpected multipart response %d %v", w.Code, w.Header())
+	}
+	if !strings.Contains(w.Body.String(), string(testStored[0:2])) || !strings.Contains(w.Body.String(), string(testStored[5:7])) {
+		t.Fatalf("unexpected multipart body %q", w.Body.String())
+	}
+
+	// HEAD reports ranges the same way
+	r = testRequest("HEAD", "/maps/stored.bsp", "")
+	r.Header.Set("Range", "bytes=3-8")
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusPartialContent || w.Header().Get("Content-Length") != "6" || w.Body.Len() > 0 {
+		t.Fatalf("unexpected HEAD response %d %v", w.Code, w.Header())
+	}
+}
+
+func TestConditional(t *testing.T) {
+	dir := setupTestServer(t, "")
+
+	etags := make(map[string]bool)
+	for _, test := range []struct{ path, encoding string }{
+		{"/maps/stored.bsp", ""},
+		{"/maps/deflated.bsp", ""},
+		{"/maps/deflated.bsp", "gzip"},
+		{"/maps/deflated.bsp", "deflate"},
+	} {
+		w := httptest.NewRecorder()
+		handler(w, testRequest("GET", test.path, test.encoding))
+		etag := w.Header().Get("ETag")
+		modified := w.Header().Get("Last-Modified")
+		if w.Code != http.StatusOK || len(etag) == 0 || len(modified) == 0 {
+			t.Fatalf("%s %q: unexpected response %d %v", test.path, test.encoding, w.Code, w.Header())
+		}
+		if etags[etag] {
+			t.Fatalf("%s %q: duplicate ETag %s", test.path, test.encoding, etag)
+		}
+		etags[etag] = true
+
+		r := testRequest("GET", test.path, test.encoding)
+		r.Header.Set("If-None-Match", `"foo", W/`+etag)
+		w = httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusNotModified || w.Body.Len() > 0 || w.Header().Get("ETag") != etag {
+			t.Fatalf("%s %q: unexpected If-None-Match response %d", test.path, test.encoding, w.Code)
+		}
+
+		r = testRequest("GET", test.path, test.encoding)
+		r.Header.Set("If-Modified-Since", modified)
+		w = httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusNotModified {
+			t.Fatalf("%s %q: unexpected If-Modified-Since response %d", test.path, test.encoding, w.Code)
+		}
+
+		r = testRequest("GET", test.path, test.encoding)
+		r.Header.Set("If-None-Match", `"foo"`)
+		r.Header.Set("If-Modified-Since", modified)
+		w = httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %q: unexpected response %d to mismatched ETag", test.path, test.encoding, w.Code)
+		}
+	}
+
+	// replacing packfile changes ETag
+	w := httptest.NewRecorder()
+	handler(w, testRequest("GET", "/maps/stored.bsp", ""))
+	etag := w.Header().Get("ETag")
+	name := filepath.Join(dir, "baseq2", "pak0.pak")
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(name, future, future); err != nil {
+		t.Fatal(err)
+	}
+	scanSearchPaths()
+	r := testRequest("GET", "/maps/stored.bsp", "")
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Fatalf("unexpected response %d after packfile changed", w.Code)
+	}
+}
+
+func TestPakExtensions(t *testing.T) {
+	for _, test := range []struct {
+		extra  string
+		status int
+	}{
+		{"", http.StatusNotFound},
+		{"PakExtensions: {pk3: zip, .ZIP: zip}\n", http.StatusOK},
+	} {
+		dir := setupTestServer(t, test.extra)
+		writeTestPkz(t, filepath.Join(dir, "baseq2", "zzz.pk3"), map[string][]byte{"maps/pk3.bsp": testLoose})
+		writeTestPkz(t, filepath.Join(dir, "baseq2", "mod.Zip"), map[string][]byte{"maps/zip.bsp": testLoose})
+		scanSearchPaths()
+
+		for _, path := range []string{"/maps/pk3.bsp", "/maps/zip.bsp"} {
+			w := httptest.NewRecorder()
+			handler(w, testRequest("GET", path, ""))
+			if w.Code != test.status {
+				t.Errorf("%q %s: unexpected status %d", test.extra, path, w.Code)
+			}
+		}
+	}
+}
+
+func TestContentRevision(t *testing.T) {
+	dir := setupTestServer(t, "RevisionPath: /revision\n")
+
+	revision := func() int64 {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/revision", nil))
+		var v struct{ Revision int64 }
+		if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("unexpected response %d %q", w.Code, w.Body.String())
+		}
+		if w.Header().Get("X-Content-Revision") != strconv.FormatInt(v.Revision, 10) {
+			t.Fatalf("header doesn't match endpoint")
+		}
+		return v.Revision
+	}
+
+	rev := revision()
+	w := httptest.NewRecorder()
+	handler(w, testRequest("GET", "/maps/stored.bsp", ""))
+	if w.Header().Get("X-Content-Revision") != strconv.FormatInt(rev, 10) {
+		t.Fatalf("unexpected X-Content-Revision %q", w.Header().Get("X-Content-Revision"))
+	}
+
+	scanSearchPaths()
+	if r := revision(); r <= rev {
+		t.Fatalf("revision not bumped by rescan: %d", r)
+	}
+	rev = revision()
+
+	rescanDir(filepath.Join(dir, "baseq2"))
+	if r := revision(); r <= rev {
+		t.Fatalf("revision not bumped by directory rescan: %d", r)
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	setupTestServer(t, `Redirects:
+  - Match: ^/(baseq2/)?(huge[.]pkz)$
+    Target: https://cdn.example.com/q2/$2
+  - Match: ^/old/
+    Target: /baseq2/
+    Status: 301
+`)
+
+	tests := []struct {
+		path     string
+		status   int
+		location string
+	}{
+		{"/baseq2/HUGE.pkz", http.StatusFound, "https://cdn.example.com/q2/huge.pkz"},
+		{"/huge.pkz", http.StatusFound, "https://cdn.example.com/q2/huge.pkz"},
+		{"/old/maps/stored.bsp", http.StatusMovedPermanently, "/baseq2/"},
+		{"/maps/stored.bsp", http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		handler(w, testRequest("GET", test.path, ""))
+		if w.Code != test.status || w.Header().Get("Location") != test.location {
+			t.Errorf("%s: unexpected response %d %q", test.path, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir := setupTestServer(t, "")
+	name := filepath.Join(dir, "pakserve.yml")
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		handler(w, testRequest("GET", path, ""))
+		return w.Code
+	}
+	if get("/maps/stored.bsp") != http.StatusOK {
+		t.Fatal("unexpected status before reload")
+	}
+
+	cfg := strings.Replace(string(b), "  - ^secret/", "  - ^secret/\n  - ^maps/stored", 1) + "Listen: :1234\n"
+	if err := os.WriteFile(name, []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadConfig(name); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	scanSearchPaths()
+	if get("/maps/stored.bsp") != http.StatusNotFound || get("/maps/deflated.bsp") != http.StatusOK {
+		t.Fatal("blacklist not reloaded")
+	}
+	if !reflect.DeepEqual(config().Listen, defaultConfig.Listen) {
+		t.Fatalf("startup setting changed: %v", config().Listen)
+	}
+
+	// broken config is rejected, old one is kept
+	for _, bad := range []string{"PakBlackList: [\n", "PakBlackList: ['(']\n", cfg + "DuplicatePolicy: bogus\n"} {
+		if err := os.WriteFile(name, []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if reloadConfig(name) == nil {
+			t.Fatalf("%q: reload succeeded", bad)
+		}
+		if get("/maps/stored.bsp") != http.StatusNotFound || len(config().pakBlackList) != 2 {
+			t.Fatalf("%q: old config not kept", bad)
+		}
+	}
+}
+
+// run with -race to check that requests see config published by reload
+// atomically
+func TestReloadConcurrent(t *testing.T) {
+	dir := setupTestServer(t, "AllowFrom: [0.0.0.0/0]\nAllowedHosts: [example.com]\n")
+	name := filepath.Join(dir, "pakserve.yml")
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			w := httptest.NewRecorder()
+			handler(w, testRequest("GET", "/maps/deflated.bsp", ""))
+			if w.Code != http.StatusOK {
+				t.Errorf("unexpected status %d", w.Code)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if err := reloadConfig(name); err != nil {
+			t.Error(err)
+			break
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestAdminReload(t *testing.T) {
+	dir := setupTestServer(t, "AdminToken: secret\n")
+	configFile = filepath.Join(dir, "pakserve.yml")
+	h := adminHandler()
+
+	reload := func(method, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/admin/reload", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	if w := reload("POST", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected status %d without token", w.Code)
+	}
+	if w := reload("GET", "secret"); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status %d for GET", w.Code)
+	}
+
+	// new packfile is picked up
+	writeTestPak(t, filepath.Join(dir, "baseq2", "pak2.pak"), map[string][]byte{"maps/new.bsp": testStored})
+	w := reload("POST", "secret")
+	var result struct {
+		Reloaded bool
+		Revision int64
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || !result.Reloaded {
+		t.Fatalf("unexpected response %d %q", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	handler(w, testRequest("GET", "/maps/new.bsp", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d after reload", w.Code)
+	}
+
+	// broken config is reported
+	if err := os.WriteFile(configFile, []byte("SearchPaths: [\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w = reload("POST", "secret")
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || result.Reloaded {
+		t.Fatalf("unexpected response %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestIncrementalRescan(t *testing.T) {
+	dir := setupTestServer(t, "LogLevel: 1\n")
+	base := filepath.Join(dir, "baseq2")
+	archives := func() map[string]searchPath {
+		dirCacheMutex.Lock()
+		defer dirCacheMutex.Unlock()
+		return cachedArchives()
+	}
+	before := archives()
+
+	writeTestPak(t, filepath.Join(base, "pak0.pak"), map[string][]byte{"maps/changed.bsp": testDeflated})
+	writeTestPak(t, filepath.Join(base, "pak2.pak"), map[string][]byte{"maps/added.bsp": testStored})
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	scanSearchPaths()
+	log.SetOutput(os.Stderr)
+	after := archives()
+
+	pak0, pak1, pak2 := filepath.Join(base, "pak0.pak"), filepath.Join(base, "pak1.pkz"), filepath.Join(base, "pak2.pak")
+	if after[pak1].files != before[pak1].files || after[pak1].state != before[pak1].state {
+		t.Error("unchanged packfile was rescanned")
+	}
+	if after[pak0].files == before[pak0].files {
+		t.Error("changed packfile was reused")
+	}
+	if _, ok := after[pak2]; !ok {
+		t.Error("added packfile was not scanned")
+	}
+	if !strings.Contains(buf.String(), "1 added, 1 changed, 0 removed, 1 unchanged") {
+		t.Errorf("unexpected log %q", buf.String())
+	}
+	w := httptest.NewRecorder()
+	handler(w, testRequest("GET", "/maps/changed.bsp", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+
+	// changed scan settings force full rescan
+	config().MaxFileSize = 1 << 20
+	scanSearchPaths()
+	if archives()[pak1].files == after[pak1].files {
+		t.Error("packfile was reused with changed settings")
+	}
+}
+
+func TestScanWorkers(t *testing.T) {
+	dir := setupTestServer(t, "ScanWorkers: 4\n")
+	base := filepath.Join(dir, "baseq2")
+	for i := 2; i < 20; i++ {
+		name := fmt.Sprintf("pak%d.pak", i)
+		writeTestPak(t, filepath.Join(base, name), map[string][]byte{"maps/" + name + ".bsp": testStored})
+	}
+	scan := func(workers int) []string {
+		config().ScanWorkers = workers
+		dirCacheMutex.Lock()
+		delete(dirCache, base)
+		dirCacheMutex.Unlock()
+		sp, err := scandir(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, s := range sp {
+			paths = append(paths, s.path)
+		}
+		return paths
+	}
+
+	serial := scan(1)
+	if len(serial) != 21 {
+		t.Fatalf("unexpected search path %q", serial)
+	}
+	for _, workers := range []int{0, 4, 32} {
+		if parallel := scan(workers); !reflect.DeepEqual(parallel, serial) {
+			t.Errorf("%d workers: unexpected search path %q", workers, parallel)
+		}
+	}
+}
+
+func TestIndexCache(t *testing.T) {
+	dir := setupTestServer(t, "IndexCache: $BASE/../index.cache\n")
+	base := filepath.Join(dir, "baseq2")
+	pak0 := filepath.Join(base, "pak0.pak")
+	if _, err := os.Stat(filepath.Join(dir, "index.cache")); err != nil {
+		t.Fatal(err)
+	}
+
+	// garbage that can't be scanned, but looks unchanged
+	fi, err := os.Stat(pak0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pak0, make([]byte, fi.Size()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	restart := func() map[string]searchPath {
+		if err := os.Chtimes(pak0, fi.ModTime(), fi.ModTime()); err != nil {
+			t.Fatal(err)
+		}
+		dirCache, scannedConfig = nil, nil
+		loadIndexCache()
+		scanSearchPaths()
+		dirCacheMutex.Lock()
+		defer dirCacheMutex.Unlock()
+		return cachedArchives()
+	}
+
+	archives := restart()
+	s, ok := archives[pak0]
+	if !ok || s.files.len() != 2 || s.offsets != nil {
+		t.Fatal("packfile not loaded from index cache")
+	}
+	if _, ok := s.files.get("secret/stuff.cfg"); !ok {
+		t.Fatal("entry missing from cached index")
+	}
+	w := httptest.NewRecorder()
+	handler(w, testRequest("GET", "/maps/deflated.bsp", "identity"))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), testDeflated) {
+		t.Fatalf("unexpected response %d from cached pkz", w.Code)
+	}
+
+	// changed scan settings invalidate cache
+	config().MaxFileSize = 1 << 20
+	if _, ok := restart()[pak0]; ok {
+		t.Fatal("packfile loaded from index cache scanned with different settings")
+	}
+}
+
+func TestIndexDir(t *testing.T) {
+	dir := setupTestServer(t, "IndexDir: $BASE/..\n")
+	indexFiles := func() int {
+		m, err := filepath.Glob(filepath.Join(dir, "*"+mappedIndexSuffix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(m)
+	}
+
+	dirCacheMutex.Lock()
+	for path, s := range cachedArchives() {
+		if s.files.mapped == nil {
+			t.Errorf("%s: index not mapped", path)
+		}
+	}
+	dirCacheMutex.Unlock()
+	if n := indexFiles(); n != 2 {
+		t.Fatalf("unexpected %d index files", n)
+	}
+	for _, test := range []struct {
+		path string
+		body []byte
+	}{
+		{"/maps/stored.bsp", testStored},
+		{"/maps/deflated.bsp", testDeflated},
+	} {
+		w := httptest.NewRecorder()
+		handler(w, testRequest("GET", test.path, "identity"))
+		if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), test.body) {
+			t.Fatalf("%s: unexpected response %d", test.path, w.Code)
+		}
+	}
+
+	// index file of removed packfile is pruned
+	if err := os.Remove(filepath.Join(dir, "baseq2", "pak0.pak")); err != nil {
+		t.Fatal(err)
+	}
+	scanSearchPaths()
+	if n := indexFiles(); n != 1 {
+		t.Fatalf("unexpected %d index files after rescan", n)
+	}
+}
+
+func TestWatchDirs(t *testing.T) {
+	dir := setupTestServer(t, "WatchDirs: true\n")
+	delay := watchDelay
+	watchDelay = 50 * time.Millisecond
+	startWatcher()
+	t.Cleanup(func() {
+		watchDelay = delay
+		watchMutex.Lock()
+		dirWatcher.Close()
+		dirWatcher, watchedDirs = nil, nil
+		watchMutex.Unlock()
+	})
+
+	waitStatus := func(path string, status int) {
+		t.Helper()
+		code := 0
+		for i := 0; i < 100; i++ {
+			w := httptest.NewRecorder()
+			handler(w, testRequest("GET", path, ""))
+			if code = w.Code; code == status {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatalf("%s: unexpected status %d", path, code)
+	}
+
+	name := filepath.Join(dir, "baseq2", "pak2.pak")
+	writeTestPak(t, name, map[string][]byte{"maps/added.bsp": testStored})
+	waitStatus("/maps/added.bsp", http.StatusOK)
+
+	if err := os.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus("/maps/added.bsp", http.StatusNotFound)
+	waitStatus("/maps/stored.bsp", http.StatusOK)
+}
+
+func TestAdminStatus(t *testing.T) {
+	for _, lazy := range []bool{false, true} {
+		setupTestServer(t, fmt.Sprintf("AdminToken: secret\nLazyScan: %v\n", lazy))
+		status := func() adminStatus {
+			r := httptest.NewRequest("GET", "/admin/status", nil)
+			r.Header.Set("Authorization", "Bearer secret")
+			w := httptest.NewRecorder()
+			adminHandler().ServeHTTP(w, r)
+			var st adminStatus
+			if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil || w.Code != http.StatusOK {
+				t.Fatalf("unexpected response %d %q", w.Code, w.Body)
+			}
+			return st
+		}
+
+		st := status()
+		if len(st.SearchPaths) != 1 || st.SearchPaths[0].Lazy != lazy {
+			t.Fatalf("unexpected search paths %+v", st.SearchPaths)
+		}
+		if lazy {
+			if sp := st.SearchPaths[0]; sp.Scanned != nil || len(sp.Archives) != 0 {
+				t.Fatalf("lazy search path reported as scanned: %+v", sp)
+			}
+			w := httptest.NewRecorder()
+			handler(w, testRequest("GET", "/maps/stored.bsp", ""))
+			st = status()
+		}
+
+		sp := st.SearchPaths[0]
+		if sp.Scanned == nil || sp.Files != 3 {
+			t.Fatalf("unexpected search path %+v", sp)
+		}
+		var types []string
+		for _, a := range sp.Archives {
+			types = append(types, a.Type)
+		}
+		if strings.Join(types, " ") != "pkz pak dir" {
+			t.Fatalf("unexpected archive types %q", types)
+		}
+		if a := sp.Archives[1]; a.Files != 2 || a.Size == 0 || a.Modified == nil || a.Quarantined {
+			t.Fatalf("unexpected archive %+v", a)
+		}
+
+		// hashes show up once computed in background
+		want, err := hashFile(sp.Archives[1].Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; ; i++ {
+			if sum := status().SearchPaths[0].Archives[1].SHA256; sum == want {
+				break
+			} else if len(sum) > 0 || i == 100 {
+				t.Fatalf("unexpected SHA-256 %q", sum)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if a := status().SearchPaths[0].Archives[2]; len(a.SHA256) > 0 {
+			t.Fatalf("directory hashed: %+v", a)
+		}
+	}
+}
+
+// writes sparse ZIP file with single stored entry of given zip64 size
+func writeLargeZip(tb testing.TB, name, entry string, size uint64) {
+	f, err := os.Create(name)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+
+	le := binary.LittleEndian
+	extra := make([]byte, 20)
+	le.PutUint16(extra[0:], 0x0001)
+	le.PutUint16(extra[2:], 16)
+	le.PutUint64(extra[4:], size)
+	le.PutUint64(extra[12:], size)
+
+	local := make([]byte, 30)
+	le.PutUint32(local[0:], 0x04034b50)
+	le.PutUint16(local[4:], 45)
+	le.PutUint32(local[18:], 0xffffffff)
+	le.PutUint32(local[22:], 0xffffffff)
+	le.PutUint16(local[26:], uint16(len(entry)))
+	le.PutUint16(local[28:], uint16(len(extra)))
+	local = append(append(local, entry...), extra...)
+
+	dirOffset := uint64(len(local)) + size
+	central := make([]byte, 46)
+	le.PutUint32(central[0:], 0x02014b50)
+	le.PutUint16(central[4:], 45)
+	le.PutUint16(central[6:], 45)
+	le.PutUint32(central[20:], 0xffffffff)
+	le.PutUint32(central[24:], 0xffffffff)
+	le.PutUint16(central[28:], uint16(len(entry)))
+	le.PutUint16(central[30:], uint16(len(extra)))
+	central = append(append(central, entry...), extra...)
+
+	end64 := make([]byte, 56)
+	le.PutUint32(end64[0:], 0x06064b50)
+	le.PutUint64(end64[4:], 44)
+	le.PutUint64(end64[24:], 1)
+	le.PutUint64(end64[32:], 1)
+	le.PutUint64(end64[40:], uint64(len(central)))
+	le.PutUint64(end64[48:], dirOffset)
+
+	locator := make([]byte, 20)
+	le.PutUint32(locator[0:], 0x07064b50)
+	le.PutUint64(locator[8:], dirOffset+uint64(len(central)))
+	le.PutUint32(locator[16:], 1)
+
+	end := make([]byte, 22)
+	le.PutUint32(end[0:], 0x06054b50)
+	le.PutUint16(end[8:], 0xffff)
+	le.PutUint16(end[10:], 0xffff)
+	le.PutUint32(end[12:], 0xffffffff)
+	le.PutUint32(end[16:], 0xffffffff)
+
+	if _, err := f.Write(local); err != nil {
+		tb.Fatal(err)
+	}
+	tail := append(append(append(central, end64...), locator...), end...)
+	if _, err := f.WriteAt(tail, int64(dirOffset)); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestLargeZipEntries(t *testing.T) {
+	const size = 1<<32 + 1
+	for _, large := range []bool{false, true} {
+		dir := setupTestServer(t, fmt.Sprintf("AdminToken: secret\nLargeZipEntries: %v\n", large))
+		name := filepath.Join(dir, "baseq2", "large.pkz")
+		writeLargeZip(t, name, "maps/large.bsp", size)
+		scanSearchPaths()
+
+		w := httptest.NewRecorder()
+		handler(w, testRequest("HEAD", "/maps/large.bsp", ""))
+		if large {
+			if w.Code != http.StatusOK || w.Header().Get("Content-Length") != strconv.Itoa(size) {
+				t.Fatalf("unexpected response %d %v", w.Code, w.Header())
+			}
+			continue
+		}
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("unexpected status %d", w.Code)
+		}
+
+		r := httptest.NewRequest("GET", "/admin/issues", nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w = httptest.NewRecorder()
+		adminHandler().ServeHTTP(w, r)
+		var issues map[string][]string
+		if err := json.Unmarshal(w.Body.Bytes(), &issues); err != nil {
+			t.Fatal(err)
+		}
+		if len(issues[name]) != 1 || !strings.Contains(issues[name][0], "maps/large.bsp") {
+			t.Fatalf("unexpected issues %v", issues)
+		}
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	setupTestServer(t, `  - Name: mod
+    Match: ^/mod/
+    Search:
+      - $BASE
+Profiles:
+  - Name: lan
+    RefererCheck: ""
+  - Name: public
+    SearchPaths: [mod]
+    AuthToken: secret
+    RateLimit: 1
+    RateBurst: 3
+ListenProfile: lan
+ListenTLSProfile: public
+`)
+	lan := profileHandler(profiles[config().ListenProfile], http.HandlerFunc(handler))
+	public := profileHandler(profiles[config().ListenTLSProfile], http.HandlerFunc(handler))
+
+	tests := []struct {
+		h       http.Handler
+		path    string
+		referer string
+		token   string
+		status  int
+	}{
+		{lan, "/maps/stored.bsp", "", "", http.StatusOK},
+		{http.HandlerFunc(handler), "/maps/stored.bsp", "", "", http.StatusForbidden},
+		{public, "/mod/maps/stored.bsp", "quake2://", "", http.StatusUnauthorized},
+		{public, "/mod/maps/stored.bsp", "", "secret", http.StatusForbidden},
+		{public, "/mod/maps/stored.bsp", "quake2://", "secret", http.StatusOK},
+		{public, "/maps/stored.bsp", "quake2://", "secret", http.StatusNotFound},
+		{public, "/mod/maps/stored.bsp", "quake2://", "secret", http.StatusTooManyRequests},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest("GET", test.path, nil)
+		r.Header.Set("Referer", test.referer)
+		if len(test.token) > 0 {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		test.h.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%d %s: unexpected status %d", i, test.path, w.Code)
+		}
+	}
+}
+
+func TestListen(t *testing.T) {
+	setupTestServer(t, `
+Listen:
+  - 127.0.0.1:8080
+  - Address: "[::1]:8080"
+    Profile: lan
+ListenTLS: ""
+ListenProfile: public
+Profiles:
+  - Name: lan
+    RefererCheck: ""
+    AllowFrom: [192.168.0.0/16]
+  - Name: public
+    DenyFrom: [192.168.1.0/24]
+`)
+	want := ConfigListen{{Address: "127.0.0.1:8080"}, {Address: "[::1]:8080", Profile: "lan"}}
+	if !reflect.DeepEqual(config().Listen, want) || len(config().ListenTLS) != 0 {
+		t.Fatalf("unexpected listeners %v %v", config().Listen, config().ListenTLS)
+	}
+
+	tests := []struct {
+		listener int
+		addr     string
+		referer  string
+		status   int
+	}{
+		{0, "10.0.0.1:1234", "quake2://", http.StatusOK},
+		{0, "192.168.1.1:1234", "quake2://", http.StatusForbidden},
+		{0, "192.168.2.1:1234", "", http.StatusForbidden},
+		{1, "192.168.1.1:1234", "", http.StatusOK},
+		{1, "10.0.0.1:1234", "", http.StatusForbidden},
+	}
+	for i, test := range tests {
+		l := config().Listen[test.listener]
+		h := profileHandler(listenProfile(l, config().ListenProfile), http.HandlerFunc(handler))
+		r := httptest.NewRequest("GET", "/maps/stored.bsp", nil)
+		r.RemoteAddr = test.addr
+		r.Header.Set("Referer", test.referer)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%d %s: unexpected status %d", i, test.addr, w.Code)
+		}
+	}
+
+	for _, bad := range []string{
+		"Listen: [':80', ':80']",
+		"Listen: [{Profile: lan}]",
+		"Listen: [{Address: ':80', Profile: missing}]",
+		"Listen: ''\nListenTLS: []",
+	} {
+		var cfg Config = defaultConfig
+		if err := yaml.Unmarshal([]byte(bad), &cfg); err != nil {
+			t.Fatalf("%s: %v", bad, err)
+		}
+		if validateConfig(&cfg) == nil {
+			t.Errorf("%s: config accepted", bad)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	setupTestServer(t, "MetricsListen: 127.0.0.1:0\nPinnedPaths: [^maps/deflated]\n")
+	scanSearchPaths()
+
+	for _, path := range []string{"/maps/stored.bsp", "/maps/stored.bsp", "/maps/deflated.bsp", "/maps/missing.bsp"} {
+		logHandler(httptest.NewRecorder(), testRequest("GET", path, "gzip"))
+	}
+
+	w := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		`pakserve_requests_total{code="200"} 3`,
+		`pakserve_requests_total{code="404"} 1`,
+		`pakserve_cache_hits_total{searchpath="^/(baseq2/)?"} 1`,
+		`pak0.pak"} 2`,
+		`pak1.pkz"} 1`,
+		"pakserve_sent_bytes_total ",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in metrics:\n%s", want, body)
+		}
+	}
+}
+
+func TestChecksumQuery(t *testing.T) {
+	setupTestServer(t, "ChecksumQuery: true\n")
+
+	digests := func(data []byte) map[string]string {
+		m, s := md5.Sum(data), sha1.Sum(data)
+		return map[string]string{
+			"crc32": fmt.Sprintf("%08x", crc32.ChecksumIEEE(data)),
+			"md5":   hex.EncodeToString(m[:]),
+			"sha1":  hex.EncodeToString(s[:]),
+		}
+	}
+	for path, data := range map[string][]byte{
+		"/maps/stored.bsp":   testStored,
+		"/maps/deflated.bsp": testDeflated,
+		"/maps/loose.txt":    testLoose,
+	} {
+		for alg, want := range digests(data) {
+			for _, method := range []string{"GET", "HEAD", "GET"} {
+				w := httptest.NewRecorder()
+				handler(w, testRequest(method, path+"?checksum="+alg, "gzip"))
+				if w.Code != http.StatusOK {
+					t.Fatalf("%s %s %s: unexpected status %d", method, path, alg, w.Code)
+				}
+				if got := w.Header().Get("X-Content-" + alg); got != want {
+					t.Fatalf("%s %s %s: unexpected checksum %s", method, path, alg, got)
+				}
+				if body := w.Body.String(); method == "GET" && body != want+"\n" || method == "HEAD" && body != "" {
+					t.Fatalf("%s %s %s: unexpected body %q", method, path, alg, body)
+				}
+			}
+		}
+	}
+
+	for path, status := range map[string]int{
+		"/maps/stored.bsp?checksum=sha256": http.StatusBadRequest,
+		"/maps/missing.bsp?checksum=md5":   http.StatusNotFound,
+		"/secret/stuff.cfg?checksum=md5":   http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		handler(w, testRequest("GET", path, ""))
+		if w.Code != status {
+			t.Errorf("%s: unexpected status %d", path, w.Code)
+		}
+	}
+
+	config().ChecksumQuery = false
+	w := httptest.NewRecorder()
+	handler(w, testRequest("GET", "/maps/stored.bsp?checksum=md5", ""))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), testStored) {
+		t.Fatal("checksum served while disabled")
+	}
+}
+
+func TestClientOverrides(t *testing.T) {
+	setupTestServer(t, `ClientOverrides:
+  - UserAgent: ^oldq2/1[.]0
+    DisableEncodings: [deflate]
+  - UserAgent: ^brokenq2
+    DisableEncodings: [gzip, deflate]
+`)
+
+	tests := []struct {
+		ua       string
+		encoding string
+		ce       string
+	}{
+		{"q2pro", "deflate", "deflate"},
+		{"oldq2/1.0", "deflate", ""},
+		{"oldq2/1.0", "gzip, deflate", "gzip"},
+		{"oldq2/1.1", "deflate", "deflate"},
+		{"brokenq2", "gzip, deflate", ""},
+	}
+	for _, test := range tests {
+		r := testRequest("GET", "/maps/deflated.bsp", test.encoding)
+		r.Header.Set("User-Agent", test.ua)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != test.ce {
+			t.Errorf("%s %q: unexpected response %d %q", test.ua, test.encoding, w.Code, w.Header().Get("Content-Encoding"))
+		}
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite golden transcripts in testdata")
+
+type goldenRequest struct {
+	method string
+	path   string
+	header []string // "Name: value" lines
+}
+
+// writes request and complete response as text. Date header is omitted and
+// binary or long bodies are summarized by their length and SHA-256.
+func writeTranscript(b *strings.Builder, req goldenRequest, resp *http.Response) error {
+	fmt.Fprintf(b, "> %s %s\n", req.method, req.path)
+	for _, v := range req.header {
+		fmt.Fprintf(b, "> %s\n", v)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(b, "< %s %s\n", resp.Proto, resp.Status)
+	h := resp.Header.Clone()
+	h.Del("Date")
+	if len(resp.TransferEncoding) > 0 {
+		h.Set("Transfer-Encoding", strings.Join(resp.TransferEncoding, ", "))
+	}
+	writeHeaders := func(prefix string, h http.Header) {
+		keys := make([]string, 0, len(h))
+		for k := range h {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			for _, v := range h[k] {
+				fmt.Fprintf(b, "%s%s: %s\n", prefix, k, v)
+			}
+		}
+	}
+	writeHeaders("< ", h)
+
+	printable := len(body) <= 80
+	for _, c := range body {
+		if c < ' ' && c != '\n' || c > '~' {
+			printable = false
+			break
+		}
+	}
+	if printable {
+		fmt.Fprintf(b, "< %q\n", body)
+	} else {
+		sum := sha256.Sum256(body)
+		fmt.Fprintf(b, "< <%d bytes, sha256 %x>\n", len(body), sum[:8])
+	}
+	writeHeaders("< trailer ", resp.Trailer)
+	b.WriteString("\n")
+	return nil
+}
+
+// runs requests against full handler chain over real connection and
+// compares transcript with golden file in testdata
+func checkGolden(t *testing.T, name string, requests []goldenRequest) {
+	srv := httptest.NewServer(newHandler())
+	defer srv.Close()
+	client := &http.Client{
+		Transport:     &http.Transport{DisableCompression: true},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	defer client.CloseIdleConnections()
+
+	var b strings.Builder
+	for _, req := range requests {
+		r, err := http.NewRequest(req.method, srv.URL+req.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range req.header {
+			k, v, _ := strings.Cut(v, ": ")
+			r.Header.Set(k, v)
+		}
+		resp, err := client.Do(r)
+		if err != nil {
+			t.Fatalf("%s %s: %v", req.method, req.path, err)
+		}
+		if err := writeTranscript(&b, req, resp); err != nil {
+			t.Fatalf("%s %s: %v", req.method, req.path, err)
+		}
+	}
+
+	golden := filepath.Join("testdata", name+".golden")
+	if *updateGolden {
+		if err := os.WriteFile(golden, []byte(b.String()), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create)", err)
+	}
+	got, wantLines := strings.Split(b.String(), "\n"), strings.Split(string(want), "\n")
+	for i := 0; i < len(got) || i < len(wantLines); i++ {
+		var g, w string
+		if i < len(got) {
+			g = got[i]
+		}
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if g != w {
+			t.Fatalf("%s:%d: transcript differs\ngot:  %s\nwant: %s", golden, i+1, g, w)
+		}
+	}
+}
+
+// sets up test server with fixed modification times and content revision,
+// so that validators in transcripts don't change between runs
+func setupGoldenServer(t *testing.T, extra string) {
+	dir := setupTestServer(t, extra)
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	err := filepath.WalkDir(filepath.Join(dir, "baseq2"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(path, mtime, mtime)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanSearchPaths()
+	contentRevision.Store(1)
+}
+
+var goldenRequests = []goldenRequest{
+	{"GET", "/baseq2/maps/stored.bsp", []string{"Referer: quake2://127.0.0.1"}},
+	{"GET", "/maps/stored.bsp", []string{"Referer: quake2://127.0.0.1", "Accept-Encoding: gzip"}},
+	{"HEAD", "/maps/stored.bsp", []string{"Referer: quake2://127.0.0.1"}},
+	{"GET", "/maps/stored.bsp", []string{"Referer: quake2://127.0.0.1", "Range: bytes=2-5"}},
+	{"GET", "/maps/stored.bsp", []string{"Referer: quake2://127.0.0.1", `If-None-Match: "c-d-5e0be100"`}},
+	{"GET", "/maps/deflated.bsp", []string{"Referer: quake2://127.0.0.1"}},
+	{"GET", "/maps/deflated.bsp", []string{"Referer: quake2://127.0.0.1", "Accept-Encoding: gzip"}},
+	{"GET", "/maps/deflated.bsp", []string{"Referer: quake2://127.0.0.1", "Accept-Encoding: deflate"}},
+	{"HEAD", "/maps/deflated.bsp", []string{"Referer: quake2://127.0.0.1", "Accept-Encoding: gzip"}},
+	{"GET", "/maps/loose.txt", []string{"Referer: quake2://127.0.0.1", "Accept-Encoding: gzip"}},
+	{"HEAD", "/maps/loose.txt", []string{"Referer: quake2://127.0.0.1"}},
+	{"GET", "/secret/stuff.cfg", []string{"Referer: quake2://127.0.0.1"}},
+	{"GET", "/maps/missing.bsp", []string{"Referer: quake2://127.0.0.1"}},
+	{"GET", "/maps/stored.bsp", nil},
+	{"POST", "/maps/stored.bsp", []string{"Referer: quake2://127.0.0.1"}},
+	{"GET", "/baseq2/", []string{"Referer: quake2://127.0.0.1"}},
+}
+
+func TestGolden(t *testing.T) {
+	setupGoldenServer(t, "")
+	checkGolden(t, "default", goldenRequests)
+}
+
+func TestGoldenChecksumTrailer(t *testing.T) {
+	setupGoldenServer(t, "ChecksumTrailer: crc32\n")
+	checkGolden(t, "trailer", goldenRequests)
+}
+
+func TestSystemd(t *testing.T) {
+	configFile = filepath.Join(setupTestServer(t, ""), "pakserve.yml")
+
+	name := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", name)
+
+	if err := reload(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 256)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, want := range []string{"RELOADING=1", "READY=1"} {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); !strings.HasPrefix(got, want) {
+			t.Fatalf("unexpected notification %q, want %q", got, want)
+		}
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	activatedListenersOnce.Do(func() {})
+	activatedListeners = []net.Listener{ln}
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	if activatedListener("127.0.0.2:"+port) != nil || activatedListener("127.0.0.1:1") != nil {
+		t.Fatal("socket matched wrong address")
+	}
+	if activatedListener(":"+port) != ln {
+		t.Fatal("socket not matched")
+	}
+	if activatedListener(":"+port) != nil {
+		t.Fatal("socket matched twice")
+	}
+}
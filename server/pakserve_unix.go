@@ -0,0 +1,33 @@
+//go:build unix
+
+package server
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// calls ready once signals are handled and returns when server should shut
+// down
+func waitForSignal(ready func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	ready()
+
+	for {
+		if <-c != syscall.SIGHUP {
+			return
+		}
+		reload()
+	}
+}
+
+// maps file of given size into memory read only
+func mapFile(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func unmapFile(b []byte) {
+	syscall.Munmap(b)
+}
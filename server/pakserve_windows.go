@@ -0,0 +1,30 @@
+//go:build windows
+
+package server
+
+import (
+	"io"
+	"os"
+	"os/signal"
+)
+
+// calls ready once signals are handled and returns when server should shut
+// down
+func waitForSignal(ready func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	ready()
+	<-c
+}
+
+// reads file into memory, as it isn't worth mapping with Windows API calls
+func mapFile(f *os.File, size int) ([]byte, error) {
+	b := make([]byte, size)
+	if _, err := io.ReadFull(f, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func unmapFile(b []byte) {
+}
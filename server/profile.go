@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+type ConfigProfile struct {
+	Name         string   `yaml:"Name"`
+	RefererCheck *string  `yaml:"RefererCheck"`
+	SearchPaths  []string `yaml:"SearchPaths"`
+	RateLimit    float64  `yaml:"RateLimit"`
+	RateBurst    int      `yaml:"RateBurst"`
+	AuthToken    string   `yaml:"AuthToken"`
+	AllowFrom    []string `yaml:"AllowFrom"`
+	DenyFrom     []string `yaml:"DenyFrom"`
+}
+
+// A Profile is an access policy assigned to a listener.
+type Profile struct {
+	name         string
+	refererCheck *regexp.Regexp  // nil to use global RefererCheck
+	searchPaths  map[string]bool // names of allowed search paths, nil if all
+	limiter      *tokenBucket
+	authToken    string
+	allowFrom    []netip.Prefix
+	denyFrom     []netip.Prefix
+}
+
+type profileKey struct{}
+
+var profiles map[string]*Profile
+
+func validateProfiles(cfg *Config) error {
+	names := make(map[string]bool)
+	for _, p := range cfg.Profiles {
+		if len(p.Name) == 0 {
+			return errors.New("Profiles entry must have Name")
+		}
+		if names[p.Name] {
+			return fmt.Errorf(`Duplicate profile "%s"`, p.Name)
+		}
+		names[p.Name] = true
+		if p.RefererCheck != nil {
+			if _, err := regexp.Compile(*p.RefererCheck); err != nil {
+				return err
+			}
+		}
+		for _, list := range [][]string{p.AllowFrom, p.DenyFrom} {
+			for _, v := range list {
+				if _, err := parsePrefix(v); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	listeners := []string{cfg.ListenProfile, cfg.ListenTLSProfile}
+	for _, list := range []ConfigListen{cfg.Listen, cfg.ListenTLS} {
+		for _, l := range list {
+			listeners = append(listeners, l.Profile)
+		}
+	}
+	for _, name := range listeners {
+		if len(name) > 0 && !names[name] {
+			return fmt.Errorf(`Profile "%s" not found`, name)
+		}
+	}
+	return nil
+}
+
+func loadProfiles() {
+	profiles = make(map[string]*Profile)
+	for _, cfg := range config().Profiles {
+		p := &Profile{
+			name:      cfg.Name,
+			authToken: cfg.AuthToken,
+			allowFrom: compilePrefixes(cfg.AllowFrom),
+			denyFrom:  compilePrefixes(cfg.DenyFrom),
+		}
+		if cfg.RefererCheck != nil {
+			p.refererCheck = regexp.MustCompile(*cfg.RefererCheck)
+		}
+		if len(cfg.SearchPaths) > 0 {
+			p.searchPaths = make(map[string]bool)
+			for _, name := range cfg.SearchPaths {
+				p.searchPaths[name] = true
+			}
+		}
+		if cfg.RateLimit > 0 {
+			p.limiter = newTokenBucket(cfg.RateLimit, cfg.RateBurst)
+		}
+		profiles[cfg.Name] = p
+	}
+}
+
+// returns profile of the listener request came from, or nil
+func profileFor(r *http.Request) *Profile {
+	p, _ := r.Context().Value(profileKey{}).(*Profile)
+	return p
+}
+
+// wraps handler so that profile applies to all requests
+func profileHandler(p *Profile, h http.Handler) http.Handler {
+	if p == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), profileKey{}, p)))
+	})
+}
+
+// returns false if request was rejected due to profile auth or limits
+func (p *Profile) admit(w http.ResponseWriter, r *http.Request) bool {
+	if p == nil {
+		return true
+	}
+	if len(p.authToken) > 0 {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(p.authToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			closeWithError(w, r, http.StatusUnauthorized)
+			return false
+		}
+	}
+	if p.limiter != nil && !p.limiter.allow() {
+		bans.strike(clientAddr(r))
+		w.Header().Set("Retry-After", "1")
+		closeWithError(w, r, http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// checks Referer against profile or global RefererCheck
+func refererAllowed(r *http.Request) bool {
+	if p := profileFor(r); p != nil && p.refererCheck != nil {
+		return p.refererCheck.MatchString(r.Referer())
+	}
+	return config().refererCheck.MatchString(r.Referer())
+}
+
+// reports whether search path is reachable through profile
+func (p *Profile) allows(name string) bool {
+	return p == nil || p.searchPaths == nil || p.searchPaths[name]
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long trusted proxy may take to send PROXY protocol header
+const proxyHeaderTimeout = 5 * time.Second
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errProxyHeader = errors.New("bad PROXY protocol header")
+
+func validateTrustedProxies(cfg *Config) error {
+	for _, v := range cfg.TrustedProxies {
+		if _, err := parsePrefix(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compiles addresses of reverse proxies whose forwarding headers are honored
+func compileTrustedProxies(c *liveConfig) {
+	c.trustedProxies = compilePrefixes(c.TrustedProxies)
+}
+
+func isTrustedProxy(addr netip.Addr) bool {
+	return containsAddr(config().trustedProxies, addr)
+}
+
+// returns client address from X-Forwarded-For or X-Real-IP header set by
+// trusted proxy, or empty string if there is none. X-Forwarded-For is walked
+// from the right, skipping trusted proxies.
+func forwardedAddr(r *http.Request) string {
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	var client netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = addr.Unmap()
+		if !isTrustedProxy(client) {
+			break
+		}
+	}
+	if !client.IsValid() {
+		addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP")))
+		if err != nil {
+			return ""
+		}
+		client = addr.Unmap()
+	}
+	return client.String()
+}
+
+// replaces remote address of requests coming from TrustedProxies with client
+// address they forward, so that logs, limits and bans see real client
+func proxyHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(config().trustedProxies) > 0 && isTrustedProxy(clientAddr(r)) {
+			if addr := forwardedAddr(r); len(addr) > 0 {
+				r.RemoteAddr = addr
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// proxyListener accepts PROXY protocol (version 1 or 2) header on
+// connections from TrustedProxies
+type proxyListener struct {
+	net.Listener
+}
+
+type proxyConn struct {
+	net.Conn
+	once   sync.Once
+	r      *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c, remote: c.RemoteAddr()}, nil
+}
+
+// reads PROXY protocol header once, if peer is trusted proxy
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.r = bufio.NewReader(c.Conn)
+		addr, ok := c.Conn.RemoteAddr().(*net.TCPAddr)
+		if !ok || !isTrustedProxy(addr.AddrPort().Addr().Unmap()) {
+			return
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		remote, err := readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			log.Printf("WARNING: PROXY header from %s: %s", addr, err)
+			c.err = err
+			return
+		}
+		if remote != nil {
+			c.remote = remote
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+// parses PROXY protocol header, returning source address or nil if proxy
+// doesn't tell it (e.g. for health checks)
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+
+	// PROXY TCP4|TCP6|UNKNOWN src dst sport dport\r\n, at most 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	s := string(line)
+	if !strings.HasSuffix(s, "\r\n") {
+		return nil, errProxyHeader
+	}
+	f := strings.Split(strings.TrimSuffix(s, "\r\n"), " ")
+	if len(f) < 2 || f[0] != "PROXY" {
+		return nil, errProxyHeader
+	}
+	if f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || f[1] != "TCP4" && f[1] != "TCP6" {
+		return nil, errProxyHeader
+	}
+	addr, err := netip.ParseAddrPort(net.JoinHostPort(f[2], f[4]))
+	if err != nil {
+		return nil, errProxyHeader
+	}
+	return net.TCPAddrFromAddrPort(addr), nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	data := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	// LOCAL command carries no address
+	if hdr[12]&0xf == 0 {
+		return nil, nil
+	}
+	var ip []byte
+	var port uint16
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET
+		if len(data) < 12 {
+			return nil, errProxyHeader
+		}
+		ip, port = data[:4], binary.BigEndian.Uint16(data[8:])
+	case 2: // AF_INET6
+		if len(data) < 36 {
+			return nil, errProxyHeader
+		}
+		ip, port = data[:16], binary.BigEndian.Uint16(data[32:])
+	default:
+		return nil, nil
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, port)), nil
+}
+
+// returns listener for server, accepting PROXY protocol if enabled. Socket
+// passed by systemd is used if it matches address.
+func listen(addr string) (net.Listener, error) {
+	ln := activatedListener(addr)
+	if ln == nil {
+		var err error
+		if ln, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	if config().ProxyProtocol {
+		return proxyListener{ln}, nil
+	}
+	return ln, nil
+}
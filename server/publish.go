@@ -0,0 +1,202 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+var (
+	errPublishPins         = errors.New("pinned archive mismatch after publish, rolled back")
+	errExchangeUnsupported = errors.New("atomic exchange not supported")
+)
+
+// scans every packfile in staging directory, returning problems found
+func verifyStaging(dir string) []string {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var problems []string
+	for _, v := range files {
+		if !v.Type().IsRegular() || !isArchiveName(v.Name()) {
+			continue
+		}
+		s, err := scanArchive(dir, v.Name())
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", v.Name(), err))
+			continue
+		}
+		for _, issue := range s.issues {
+			problems = append(problems, fmt.Sprintf("%s: %s", v.Name(), issue))
+		}
+		problems = append(problems, verifyEntries(s)...)
+	}
+	return problems
+}
+
+// reads every entry of ZIP packfile, checking its length and CRC.
+// PAK files have no CRC.
+func verifyEntries(s *searchPath) []string {
+	if s.offsets == nil {
+		return nil
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	defer f.Close()
+
+	var problems []string
+	base := filepath.Base(s.path)
+	for i := 0; i < s.files.len(); i++ {
+		name, entry := s.files.name(i), s.files.entry(i)
+		r, err := s.entryReader(f, entry)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf(`%s: "%s": %s`, base, name, err))
+			continue
+		}
+		h := crc32.NewIEEE()
+		n, err := io.Copy(h, io.LimitReader(r, int64(entry.filelen)+1))
+		r.Close()
+		if err != nil || n != int64(entry.filelen) || h.Sum32() != entry.filecrc {
+			problems = append(problems, fmt.Sprintf(`%s: "%s" fails CRC check`, base, name))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// returns search directory as spelled in config if dir is one.
+// Must be called with searchPathsMutex held.
+func findSearchDir(dir string) (string, bool) {
+	for _, s := range allSearchPaths() {
+		for _, d := range s.cfg.Search {
+			if filepath.Clean(d) == dir {
+				return d, true
+			}
+		}
+	}
+	return "", false
+}
+
+// exchanges contents of directories a and b. This is atomic where kernel and
+// file system support it, see exchangeDirs.
+func swapDirs(a, b string) error {
+	if err := exchangeDirs(a, b); err != errExchangeUnsupported {
+		return err
+	}
+	return renameDirs(a, b)
+}
+
+// exchanges contents of directories a and b by three renames. Not atomic:
+// b is briefly missing, and interrupted swap leaves it renamed aside.
+func renameDirs(a, b string) error {
+	tmp := b + ".publish"
+	if err := os.Rename(b, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(a, b); err != nil {
+		if err2 := os.Rename(tmp, b); err2 != nil {
+			log.Printf(`ERROR: restore "%s": %s`, b, err2)
+		}
+		return err
+	}
+	return os.Rename(tmp, a)
+}
+
+// drops cached scan results of search directory and rescans search paths
+// that include it. Returns false if any of them has pinned archive mismatch.
+// Must be called with searchPathsMutex held.
+func rescanPublished(dir string) bool {
+	dirCacheMutex.Lock()
+	for _, s := range dirCache[dir] {
+		contentCache.unpin(s.path)
+		openFiles.invalidate(s.path)
+	}
+	delete(dirCache, dir)
+	dirCacheMutex.Unlock()
+
+	rebuildSearchPaths(dir)
+	rewatchDir(dir)
+
+	ok := true
+	for _, s := range allSearchPaths() {
+		for _, d := range s.cfg.Search {
+			if d == dir {
+				s.load()
+				ok = ok && s.pinned.Load()
+				break
+			}
+		}
+	}
+	return ok
+}
+
+// swaps staging directory into search directory slot, leaving previous
+// content in staging directory. Swap is rolled back if pinned archives don't
+// match afterwards.
+func publish(staging, slot string) error {
+	searchPathsMutex.Lock()
+	defer searchPathsMutex.Unlock()
+
+	dir, ok := findSearchDir(slot)
+	if !ok {
+		return fmt.Errorf(`"%s" is not a search directory`, slot)
+	}
+	if err := swapDirs(staging, dir); err != nil {
+		return err
+	}
+	if rescanPublished(dir) {
+		log.Printf(`Published "%s" to "%s"`, staging, dir)
+		return nil
+	}
+	if err := swapDirs(staging, dir); err != nil {
+		log.Printf(`ERROR: roll back "%s": %s`, dir, err)
+	}
+	rescanPublished(dir)
+	return errPublishPins
+}
+
+// POST /admin/publish?dir=<staging>&slot=<search dir>
+func handlePublish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	staging := r.URL.Query().Get("dir")
+	slot := r.URL.Query().Get("slot")
+	if len(staging) == 0 || len(slot) == 0 {
+		http.Error(w, "missing dir or slot", http.StatusBadRequest)
+		return
+	}
+	staging = filepath.Clean(staging)
+	slot = filepath.Clean(slot)
+	if fi, err := os.Stat(staging); err != nil || !fi.IsDir() || staging == slot {
+		http.Error(w, "bad staging directory", http.StatusBadRequest)
+		return
+	}
+
+	result := struct {
+		Published bool     `json:"published"`
+		Problems  []string `json:"problems,omitempty"`
+		Error     string   `json:"error,omitempty"`
+		Revision  int64    `json:"revision"`
+	}{}
+	result.Problems = verifyStaging(staging)
+	if len(result.Problems) == 0 {
+		if err := publish(staging, slot); err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Published = true
+		}
+	}
+	result.Revision = contentRevision.Load()
+	writeJSON(w, result)
+}
@@ -0,0 +1,17 @@
+package server
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// exchanges directories a and b atomically with renameat2, so that search
+// directory is never missing during publish
+func exchangeDirs(a, b string) error {
+	err := unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, b, unix.RENAME_EXCHANGE)
+	if errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EINVAL) {
+		return errExchangeUnsupported
+	}
+	return err
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package server
+
+func exchangeDirs(a, b string) error {
+	return errExchangeUnsupported
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// A tokenBucket allows average rate of events per second with bursts of up
+// to burst events.
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// returns true if event is allowed
+func (b *tokenBucket) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// takes n tokens, possibly going into debt, and returns how long to wait
+// until the debt is paid off
+func (b *tokenBucket) reserve(n float64) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.refill(time.Now())
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// reports whether bucket is full, i.e. it wasn't used recently
+func (b *tokenBucket) full() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.refill(time.Now())
+	return b.tokens >= b.burst
+}
+
+// dailyQuota limits number of bytes served per calendar day
+type dailyQuota struct {
+	mutex sync.Mutex
+	limit int64
+	used  int64
+	day   time.Time
+}
+
+func today() time.Time {
+	y, m, d := time.Now().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+}
+
+func (q *dailyQuota) reset() {
+	if t := today(); !t.Equal(q.day) {
+		q.day = t
+		q.used = 0
+	}
+}
+
+func (q *dailyQuota) exceeded() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.reset()
+	return q.used >= q.limit
+}
+
+func (q *dailyQuota) add(n int64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.reset()
+	q.used += n
+}
+
+// returns time until quota is reset
+func (q *dailyQuota) retryAfter() time.Duration {
+	return time.Until(today().AddDate(0, 0, 1))
+}
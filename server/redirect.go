@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+type ConfigRedirect struct {
+	Match  string `yaml:"Match"`
+	Target string `yaml:"Target"`
+	Status int    `yaml:"Status"`
+}
+
+type compiledRedirect struct {
+	match  *regexp.Regexp
+	target string
+	status int
+}
+
+func validateRedirects(cfg *Config) error {
+	for _, rd := range cfg.Redirects {
+		if len(rd.Target) == 0 {
+			return fmt.Errorf(`Redirect for "%s" must have Target`, rd.Match)
+		}
+		switch rd.Status {
+		case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return fmt.Errorf(`Bad redirect Status %d for "%s"`, rd.Status, rd.Match)
+		}
+	}
+	return nil
+}
+
+func compileRedirects(c *liveConfig) {
+	for _, cfg := range c.Redirects {
+		if cfg.Status == 0 {
+			cfg.Status = http.StatusFound
+		}
+		c.redirects = append(c.redirects, compiledRedirect{
+			match:  regexp.MustCompile(cfg.Match),
+			target: cfg.Target,
+			status: cfg.Status,
+		})
+	}
+}
+
+// redirects request if its path matches any of Redirects. Target can refer
+// to submatches of the first matching regexp as $1, $2, etc.
+func redirect(w http.ResponseWriter, r *http.Request) bool {
+	redirects := config().redirects
+	if len(redirects) == 0 {
+		return false
+	}
+	path := strings.ToLower(normalizePath(r.URL.Path))
+	for _, rd := range redirects {
+		m := rd.match.FindStringSubmatchIndex(path)
+		if m == nil {
+			continue
+		}
+		target := rd.match.ExpandString(nil, rd.target, path, m)
+		http.Redirect(w, r, string(target), rd.status)
+		return true
+	}
+	return false
+}
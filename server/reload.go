@@ -0,0 +1,95 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+)
+
+// name of config file, for reloading
+var configFile string
+
+// settings that are only used at startup. Changing them requires restart.
+var startupSettings = []string{
+	"Listen", "ListenTLS", "ListenProfile", "ListenTLSProfile", "Profiles",
+	"CertFile", "KeyFile", "AutoTLS", "DisableSessionTickets", "TLSTicketRotation",
+	"AdminListen", "AdminToken", "MetricsListen", "MetricsPath", "LogLevel",
+	"StateFile", "StatusFile", "HashLists", "Tenants", "Mirror", "Bans", "DirWorkers",
+	"ProxyProtocol", "ReadTimeout", "WriteTimeout", "IdleTimeout", "MaxHeaderBytes", "H2C",
+	"WatchDirs",
+}
+
+// settings that affect how packfiles are scanned. Packfiles scanned before are
+// only reused on rescan if these didn't change.
+var scanSettings = []string{
+	"PakExtensions", "MaxArchiveFiles", "MaxFileSize", "ExtendedPaks", "LargeZipEntries",
+	"DuplicatePolicy", "SuspiciousNamePolicy", "IndexDir",
+}
+
+// config search paths were last scanned with
+var scannedConfig *Config
+
+// reports whether packfiles scanned before can't be reused with current config
+func scanSettingsChanged() bool {
+	if scannedConfig == nil {
+		return true
+	}
+	o := reflect.ValueOf(scannedConfig).Elem()
+	n := reflect.ValueOf(&config().Config).Elem()
+	for _, name := range scanSettings {
+		if !reflect.DeepEqual(o.FieldByName(name).Interface(), n.FieldByName(name).Interface()) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns scan settings of current config as string, for comparing with
+// settings packfiles in IndexCache were scanned with
+func scanSettingsKey() string {
+	n := reflect.ValueOf(&config().Config).Elem()
+	var b strings.Builder
+	for _, name := range scanSettings {
+		fmt.Fprintf(&b, "%s=%v\n", name, n.FieldByName(name).Interface())
+	}
+	return b.String()
+}
+
+// keeps startup settings of old config in new one, warning about changes
+func keepStartupSettings(old, cfg *Config) {
+	o := reflect.ValueOf(old).Elem()
+	n := reflect.ValueOf(cfg).Elem()
+	for _, name := range startupSettings {
+		if !reflect.DeepEqual(o.FieldByName(name).Interface(), n.FieldByName(name).Interface()) {
+			log.Printf("WARNING: %s changed, restart to apply", name)
+		}
+		n.FieldByName(name).Set(o.FieldByName(name))
+	}
+}
+
+// rereads config file and applies it, unless it fails to parse or validate,
+// in which case old config is kept. Search paths must be rescanned afterwards.
+func reloadConfig(name string) error {
+	cfg, err := readConfig(name)
+	if err != nil {
+		log.Printf(`ERROR: reload config "%s": %s`, name, err)
+		return err
+	}
+	keepStartupSettings(&config().Config, &cfg)
+
+	searchPathsMutex.Lock()
+	defer searchPathsMutex.Unlock()
+	applyConfig(cfg)
+	return nil
+}
+
+// reloads config file and rescans search paths, as done on SIGHUP. Search
+// paths are rescanned even if config fails to reload.
+func reload() error {
+	sdNotifyReloading()
+	err := reloadConfig(configFile)
+	scanSearchPaths()
+	sdNotify("READY=1")
+	return err
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// content revision, bumped after every scan of search paths. Seeded with
+// startup time, so that it keeps increasing across restarts.
+var contentRevision atomic.Int64
+
+func bumpRevision() {
+	contentRevision.Add(1)
+}
+
+func revisionString() string {
+	return strconv.FormatInt(contentRevision.Load(), 10)
+}
+
+// serves current content revision at RevisionPath
+func handleRevision(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache")
+	writeJSON(w, struct {
+		Revision int64 `json:"revision"`
+	}{contentRevision.Load()})
+}
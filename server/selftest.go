@@ -0,0 +1,207 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/skullernet/pakserve/pak"
+)
+
+var (
+	selfTestStored   = []byte("stored in pak")
+	selfTestDeflated = bytes.Repeat([]byte("deflated in pkz "), 100)
+	selfTestLoose    = []byte("loose file")
+)
+
+const selfTestReferer = "quake2://127.0.0.1"
+
+type selfTestCase struct {
+	name     string
+	method   string
+	path     string
+	encoding string
+	referer  string
+	status   int
+	ce       string
+	content  []byte
+}
+
+var selfTestCases = []selfTestCase{
+	{"pak entry", "GET", "/baseq2/maps/stored.bsp", "gzip", selfTestReferer, 200, "", selfTestStored},
+	{"pkz entry gzip", "GET", "/baseq2/maps/deflated.bsp", "gzip", selfTestReferer, 200, "gzip", selfTestDeflated},
+	{"pkz entry deflate", "GET", "/baseq2/maps/deflated.bsp", "deflate", selfTestReferer, 200, "deflate", selfTestDeflated},
+	{"pkz entry identity", "GET", "/baseq2/maps/deflated.bsp", "", selfTestReferer, 200, "", selfTestDeflated},
+	{"pkz entry HEAD", "HEAD", "/baseq2/maps/deflated.bsp", "gzip", selfTestReferer, 200, "gzip", nil},
+	{"directory file", "GET", "/baseq2/maps/loose.txt", "gzip", selfTestReferer, 200, "", selfTestLoose},
+	{"case insensitive path", "GET", "/BASEQ2/Maps/Stored.BSP", "", selfTestReferer, 200, "", selfTestStored},
+	{"blacklist hit", "GET", "/baseq2/secret/server.cfg", "", selfTestReferer, 404, "", nil},
+	{"whitelist miss", "GET", "/baseq2/secret.txt", "", selfTestReferer, 404, "", nil},
+	{"missing file", "GET", "/baseq2/maps/missing.bsp", "", selfTestReferer, 404, "", nil},
+	{"referer rejection", "GET", "/baseq2/maps/stored.bsp", "", "http://example.com/", 403, "", nil},
+}
+
+func writeSelfTestData(dir string) error {
+	base := filepath.Join(dir, "baseq2")
+	if err := os.MkdirAll(filepath.Join(base, "maps"), 0755); err != nil {
+		return err
+	}
+
+	w, err := pak.OpenWriter(filepath.Join(base, "pak0.pak"))
+	if err != nil {
+		return err
+	}
+	for name, data := range map[string][]byte{
+		"maps/stored.bsp":   selfTestStored,
+		"secret/server.cfg": selfTestStored,
+	} {
+		if err := w.Create(name); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(base, "pak1.pkz"))
+	if err != nil {
+		return err
+	}
+	z := zip.NewWriter(f)
+	zw, err := z.Create("maps/deflated.bsp")
+	if err == nil {
+		_, err = zw.Write(selfTestDeflated)
+	}
+	if err == nil {
+		err = z.Close()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(filepath.Join(base, "maps", "loose.txt"), selfTestLoose, 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(base, "secret.txt"), selfTestLoose, 0644); err != nil {
+		return err
+	}
+
+	cfg := fmt.Sprintf(`
+RefererCheck: ^quake2://
+PakBlackList:
+  - ^secret/
+DirWhiteList:
+  - ^maps/
+SearchPaths:
+  - Match: ^/baseq2/
+    Search:
+      - %s
+`, base)
+	return os.WriteFile(filepath.Join(dir, "pakserve.yml"), []byte(cfg), 0644)
+}
+
+func (c *selfTestCase) run(client *http.Client, url string) error {
+	req, err := http.NewRequest(c.method, url+c.path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Referer", c.referer)
+	if len(c.encoding) > 0 {
+		req.Header.Set("Accept-Encoding", c.encoding)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != c.status {
+		return fmt.Errorf("status %d, expected %d", resp.StatusCode, c.status)
+	}
+	if c.status != http.StatusOK {
+		return nil
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != c.ce {
+		return fmt.Errorf(`encoding "%s", expected "%s"`, ce, c.ce)
+	}
+	if c.method == "HEAD" {
+		if resp.ContentLength <= 0 {
+			return fmt.Errorf("bad content length %d", resp.ContentLength)
+		}
+		return nil
+	}
+
+	var body io.Reader = resp.Body
+	switch c.ce {
+	case "gzip":
+		// gzip reader verifies CRC and length from trailer
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return err
+		}
+		body = gz
+	case "deflate":
+		body = flate.NewReader(body)
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(b, c.content) {
+		return fmt.Errorf("content mismatch")
+	}
+	return nil
+}
+
+// runs the server with built-in test data on ephemeral port and checks its
+// responses, returns false if any check failed
+func selfTest() bool {
+	dir, err := os.MkdirTemp("", "pakserve-selftest-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := writeSelfTestData(dir); err != nil {
+		log.Fatal(err)
+	}
+	loadConfig(filepath.Join(dir, "pakserve.yml"))
+	scanSearchPaths()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(logHandler)}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	url := "http://" + l.Addr().String()
+
+	passed := true
+	for i := range selfTestCases {
+		c := &selfTestCases[i]
+		if err := c.run(client, url); err != nil {
+			fmt.Printf("FAIL  %s: %s\n", c.name, err)
+			passed = false
+		} else {
+			fmt.Printf("PASS  %s\n", c.name)
+		}
+	}
+	return passed
+}
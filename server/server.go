@@ -0,0 +1,66 @@
+// Package server implements pakserve, HTTP server that serves downloads to
+// Quake 2 clients from game server data, so that other programs can embed it
+// into their own HTTP servers.
+package server
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Server serves game clients from search paths of its config. Server state
+// is global, so only one Server can be used per process.
+type Server struct {
+	handler http.Handler
+}
+
+var errServerExists = errors.New("server: NewServer already called in this process")
+
+// set once NewServer succeeds
+var serverCreated atomic.Bool
+
+// DefaultConfig returns config with default values of all parameters, to be
+// filled in before passing it to NewServer.
+func DefaultConfig() Config {
+	cfg := defaultConfig
+	cfg.Compress.SkipExtensions = append([]string(nil), cfg.Compress.SkipExtensions...)
+	return cfg
+}
+
+// ReadConfig reads YAML config file on top of defaults and validates it.
+func ReadConfig(name string) (Config, error) {
+	return readConfig(name)
+}
+
+// NewServer applies config and scans its search paths. Listener, TLS, admin
+// and metrics parameters are ignored, since returned Server is meant to be
+// used as handler of caller's own HTTP server. Only the first successful
+// call creates a Server, later calls return an error.
+func NewServer(cfg Config) (*Server, error) {
+	if !serverCreated.CompareAndSwap(false, true) {
+		return nil, errServerExists
+	}
+	if err := validateConfig(&cfg); err != nil {
+		serverCreated.Store(false)
+		return nil, err
+	}
+	if err := useConfig(cfg); err != nil {
+		serverCreated.Store(false)
+		return nil, err
+	}
+	contentRevision.Store(time.Now().Unix())
+	scanSearchPaths()
+	return &Server{handler: newHandler()}, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// Rescan rescans search paths, picking up packfiles added, replaced or
+// removed since, like SIGHUP does for pakserve command.
+func (s *Server) Rescan() {
+	scanSearchPaths()
+}
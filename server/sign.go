@@ -0,0 +1,152 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// maximum number of cached signatures, cache is cleared when exceeded
+const maxSignatures = 65536
+
+// identifies content of packfile entry or directory file
+type signatureKey struct {
+	path   string
+	offset int64         // entry offset, or size of directory file
+	state  *archiveState // nil for directory files
+	mtime  int64         // modification time of directory file
+}
+
+type contentSignature struct {
+	digest    string
+	signature string
+}
+
+var (
+	signingKey      ed25519.PrivateKey
+	signatures      = make(map[signatureKey]contentSignature)
+	signaturesMutex sync.Mutex
+)
+
+func decodeSigningKey(s string) (ed25519.PrivateKey, error) {
+	seed, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("SigningKey must be base64 encoded 32 byte Ed25519 seed")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func validateSigningKey(cfg *Config) error {
+	if len(cfg.SigningKey) == 0 {
+		return nil
+	}
+	_, err := decodeSigningKey(cfg.SigningKey)
+	return err
+}
+
+func compileSigningKey() {
+	signaturesMutex.Lock()
+	defer signaturesMutex.Unlock()
+
+	signingKey = nil
+	signatures = make(map[signatureKey]contentSignature)
+	c := config()
+	if len(c.SigningKey) == 0 {
+		return
+	}
+	signingKey, _ = decodeSigningKey(c.SigningKey)
+	if c.LogLevel >= LogLevelInfo {
+		pub := signingKey.Public().(ed25519.PublicKey)
+		log.Printf("Signing with public key %s", base64.StdEncoding.EncodeToString(pub))
+	}
+}
+
+func signingEnabled() bool {
+	signaturesMutex.Lock()
+	defer signaturesMutex.Unlock()
+	return signingKey != nil
+}
+
+func hashContent(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// sets SHA-256 of content and its signature headers, calling digest to
+// compute them if not cached
+func setSignature(w http.ResponseWriter, key signatureKey, digest func() ([]byte, error)) {
+	signaturesMutex.Lock()
+	priv := signingKey
+	cs, ok := signatures[key]
+	signaturesMutex.Unlock()
+	if priv == nil {
+		return
+	}
+
+	if !ok {
+		sum, err := digest()
+		if err != nil {
+			log.Printf(`ERROR: sign "%s": %s`, key.path, err)
+			return
+		}
+		cs = contentSignature{
+			digest:    hex.EncodeToString(sum),
+			signature: base64.StdEncoding.EncodeToString(ed25519.Sign(priv, sum)),
+		}
+
+		signaturesMutex.Lock()
+		if len(signatures) >= maxSignatures {
+			signatures = make(map[signatureKey]contentSignature)
+		}
+		signatures[key] = cs
+		signaturesMutex.Unlock()
+	}
+
+	w.Header().Set("X-Content-SHA256", cs.digest)
+	w.Header().Set("X-Content-Signature", cs.signature)
+}
+
+// signs decompressed data of packfile entry
+func (s *searchPath) signEntry(w http.ResponseWriter, entry *pakFileEntry) {
+	if !signingEnabled() {
+		return
+	}
+	setSignature(w, signatureKey{path: s.path, offset: entry.offset, state: s.state}, func() ([]byte, error) {
+		f, err := openFiles.open(s.path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		r, err := s.entryReader(f, entry)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return hashContent(r)
+	})
+}
+
+// signs content of directory file
+func signFile(w http.ResponseWriter, f *os.File) {
+	if !signingEnabled() {
+		return
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return
+	}
+	setSignature(w, signatureKey{path: f.Name(), offset: fi.Size(), mtime: fi.ModTime().UnixNano()}, func() ([]byte, error) {
+		return hashContent(io.NewSectionReader(f, 0, fi.Size()))
+	})
+}
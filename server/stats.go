@@ -0,0 +1,221 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+type FileStats struct {
+	Hits   uint64      `json:"hits"`
+	Bytes  uint64      `json:"bytes"`
+	Ranges *RangeStats `json:"ranges,omitempty"`
+}
+
+// number of histogram buckets, each covering a tenth of file size
+const rangeBuckets = 10
+
+// RangeStats tells how much of a large file clients actually download.
+type RangeStats struct {
+	Size      int64  `json:"size"`      // file size seen last
+	Full      uint64 `json:"full"`      // complete downloads
+	Truncated uint64 `json:"truncated"` // whole file requested, not all sent
+	Partial   uint64 `json:"partial"`   // range requests
+
+	// responses by fraction of file size sent
+	Completion [rangeBuckets]uint64 `json:"completion"`
+
+	// range requests by start offset as fraction of file size
+	Starts [rangeBuckets]uint64 `json:"starts"`
+}
+
+// ServerState is persisted to StateFile on shutdown and loaded back on start.
+type ServerState struct {
+	Files       map[string]*FileStats `json:"files"`
+	SearchPaths map[string]*FileStats `json:"searchpaths,omitempty"`
+}
+
+var (
+	fileStats       = make(map[string]*FileStats)
+	searchPathStats = make(map[string]*FileStats)
+	statsMutex      sync.Mutex
+)
+
+func statsEnabled() bool {
+	return len(config().StateFile) > 0
+}
+
+func addStats(m map[string]*FileStats, key string, written int64) {
+	s, ok := m[key]
+	if !ok {
+		s = new(FileStats)
+		m[key] = s
+	}
+	s.Hits++
+	s.Bytes += uint64(written)
+}
+
+// counts request both per path and per name of matched search path
+func recordStats(path, searchPath string, written int64) {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+
+	addStats(fileStats, path, written)
+	if len(searchPath) > 0 {
+		addStats(searchPathStats, searchPath, written)
+	}
+}
+
+func rangeBucket(n, size int64) int {
+	if i := int(n * rangeBuckets / size); i < rangeBuckets {
+		return i
+	}
+	return rangeBuckets - 1
+}
+
+// returns start offset and total size from single range Content-Range header
+func parseContentRange(s string) (start, size int64, ok bool) {
+	var end int64
+	if _, err := fmt.Sscanf(s, "bytes %d-%d/%d", &start, &end, &size); err != nil {
+		return 0, 0, false
+	}
+	return start, size, start <= end && end < size
+}
+
+// records how much of the file response delivered, for files of at least
+// RangeStatsMinSize bytes. Multipart range responses are not recorded.
+func recordRange(path string, status int, h http.Header, written int64) {
+	var start, size int64
+	var ok bool
+	switch status {
+	case http.StatusOK:
+		var err error
+		size, err = strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+		ok = err == nil
+	case http.StatusPartialContent:
+		start, size, ok = parseContentRange(h.Get("Content-Range"))
+	}
+	if !ok || size <= 0 || size < config().RangeStatsMinSize {
+		return
+	}
+
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+
+	f := fileStats[path]
+	if f == nil {
+		return
+	}
+	if f.Ranges == nil {
+		f.Ranges = new(RangeStats)
+	}
+	rs := f.Ranges
+	rs.Size = size
+	switch {
+	case status == http.StatusPartialContent:
+		rs.Partial++
+		rs.Starts[rangeBucket(start, size)]++
+	case written < size:
+		rs.Truncated++
+	default:
+		rs.Full++
+	}
+	rs.Completion[rangeBucket(written, size)]++
+}
+
+// returns copy of collected statistics
+func statsSnapshot() ServerState {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+
+	state := ServerState{
+		Files:       make(map[string]*FileStats, len(fileStats)),
+		SearchPaths: make(map[string]*FileStats, len(searchPathStats)),
+	}
+	for k, v := range fileStats {
+		f := *v
+		if v.Ranges != nil {
+			rs := *v.Ranges
+			f.Ranges = &rs
+		}
+		state.Files[k] = &f
+	}
+	for k, v := range searchPathStats {
+		f := *v
+		state.SearchPaths[k] = &f
+	}
+	return state
+}
+
+func loadState() {
+	if !statsEnabled() {
+		return
+	}
+	b, err := os.ReadFile(config().StateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.Printf(`ERROR: load state "%s": %s`, config().StateFile, err)
+		return
+	}
+	var state ServerState
+	if err := json.Unmarshal(b, &state); err != nil {
+		log.Printf(`ERROR: load state "%s": %s`, config().StateFile, err)
+		return
+	}
+
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+
+	for k, v := range state.Files {
+		if v != nil {
+			fileStats[k] = v
+		}
+	}
+	for k, v := range state.SearchPaths {
+		if v != nil {
+			searchPathStats[k] = v
+		}
+	}
+}
+
+// writes state to a temporary file first, so that interrupted
+// write doesn't destroy previously saved state
+func saveState() {
+	if !statsEnabled() {
+		return
+	}
+
+	statsMutex.Lock()
+	b, err := json.Marshal(&ServerState{Files: fileStats, SearchPaths: searchPathStats})
+	statsMutex.Unlock()
+	if err != nil {
+		log.Printf(`ERROR: save state "%s": %s`, config().StateFile, err)
+		return
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(config().StateFile), ".pakserve-state-*")
+	if err != nil {
+		log.Printf(`ERROR: save state "%s": %s`, config().StateFile, err)
+		return
+	}
+	_, err = f.Write(b)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), config().StateFile)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		log.Printf(`ERROR: save state "%s": %s`, config().StateFile, err)
+	}
+}
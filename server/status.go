@@ -0,0 +1,208 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// server phases reported in StatusFile
+const (
+	PhaseStarting = "starting"
+	PhaseScanning = "scanning"
+	PhaseReady    = "ready"
+	PhaseDraining = "draining"
+	PhaseStopped  = "stopped"
+)
+
+// how often StatusFile is rewritten to update transfer count
+const statusInterval = 5 * time.Second
+
+type ScanResult struct {
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration"` // seconds
+	Archives int       `json:"archives"`
+	Files    int       `json:"files"`
+	Issues   int       `json:"issues"`
+}
+
+// ServerStatus is written to StatusFile on phase changes and periodically.
+type ServerStatus struct {
+	Phase           string      `json:"phase"`
+	PID             int         `json:"pid"`
+	Started         time.Time   `json:"started"`
+	Updated         time.Time   `json:"updated"`
+	Revision        string      `json:"revision"`
+	ActiveTransfers int64       `json:"active_transfers"`
+	LastScan        *ScanResult `json:"last_scan,omitempty"`
+}
+
+var (
+	statusMutex     sync.Mutex
+	phase           = PhaseStarting
+	lastScan        *ScanResult
+	startTime       = time.Now()
+	activeTransfers atomic.Int64
+	servers         []*http.Server // content servers to drain on shutdown
+)
+
+func statusEnabled() bool {
+	return len(config().StatusFile) > 0
+}
+
+func setPhase(p string) {
+	statusMutex.Lock()
+	phase = p
+	statusMutex.Unlock()
+	writeStatus()
+}
+
+func getPhase() string {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+	return phase
+}
+
+// records result of full scan. Must be called with searchPathsMutex held.
+func recordScan(start time.Time) {
+	res := &ScanResult{Time: start, Duration: time.Since(start).Seconds()}
+	seen := make(map[string]bool)
+	lists := [][]compiledSearchPath{searchPaths}
+	for _, t := range tenants {
+		lists = append(lists, t.searchPaths)
+	}
+	for _, list := range lists {
+		for _, c := range list {
+			for _, s := range c.search {
+				if s.files == nil || seen[s.path] {
+					continue
+				}
+				seen[s.path] = true
+				res.Archives++
+				res.Files += s.files.len()
+				res.Issues += len(s.issues)
+			}
+		}
+	}
+
+	statusMutex.Lock()
+	lastScan = res
+	statusMutex.Unlock()
+}
+
+func writeStatus() {
+	if !statusEnabled() {
+		return
+	}
+
+	statusMutex.Lock()
+	b, err := json.Marshal(&ServerStatus{
+		Phase:           phase,
+		PID:             os.Getpid(),
+		Started:         startTime,
+		Updated:         time.Now(),
+		Revision:        revisionString(),
+		ActiveTransfers: activeTransfers.Load(),
+		LastScan:        lastScan,
+	})
+	statusMutex.Unlock()
+	if err != nil {
+		log.Printf(`ERROR: write status "%s": %s`, config().StatusFile, err)
+		return
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(config().StatusFile), ".pakserve-status-*")
+	if err != nil {
+		log.Printf(`ERROR: write status "%s": %s`, config().StatusFile, err)
+		return
+	}
+	_, err = f.Write(append(b, '\n'))
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), config().StatusFile)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		log.Printf(`ERROR: write status "%s": %s`, config().StatusFile, err)
+	}
+}
+
+func statusLoop() {
+	for range time.Tick(statusInterval) {
+		writeStatus()
+	}
+}
+
+// counts requests being served
+func trackTransfers(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		activeTransfers.Add(1)
+		defer activeTransfers.Add(-1)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// stops accepting new connections and waits up to DrainTimeout for active
+// transfers to finish
+func drain() {
+	if config().DrainTimeout <= 0 || len(servers) == 0 {
+		return
+	}
+	setPhase(PhaseDraining)
+	if config().LogLevel >= LogLevelInfo {
+		log.Printf("Draining %d active transfers", activeTransfers.Load())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config().DrainTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("WARNING: drain %s: %s", srv.Addr, err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+}
+
+// starts content server that is drained on shutdown
+func serve(srv *http.Server, tls bool) {
+	srv.ReadTimeout = config().ReadTimeout
+	srv.WriteTimeout = config().WriteTimeout
+	srv.IdleTimeout = config().IdleTimeout
+	srv.MaxHeaderBytes = config().MaxHeaderBytes
+	if !tls && config().H2C {
+		enableH2C(srv)
+	}
+	servers = append(servers, srv)
+	ln, err := listen(srv.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		var err error
+		if tls {
+			err = srv.ServeTLS(ln, config().CertFile, config().KeyFile)
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// first file descriptor passed by systemd socket activation
+const listenFdsStart = 3
+
+var (
+	// sockets passed by systemd not yet claimed by any listener
+	activatedListeners     []net.Listener
+	activatedListenersOnce sync.Once
+)
+
+// picks up sockets passed by systemd, if server was started by socket
+// activation. Environment is cleared so that child processes don't see it.
+func initActivation() {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(listenFdsStart+i), "LISTEN_FD_"+strconv.Itoa(listenFdsStart+i))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Printf("WARNING: socket activation fd %d: %s", listenFdsStart+i, err)
+			continue
+		}
+		activatedListeners = append(activatedListeners, ln)
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+}
+
+// reports whether socket bound to b can serve configured address a. Ports
+// must be equal, addresses only if both are specific.
+func matchListenAddr(a, b *net.TCPAddr) bool {
+	if a.Port != b.Port {
+		return false
+	}
+	if a.IP == nil || a.IP.IsUnspecified() || b.IP.IsUnspecified() {
+		return true
+	}
+	return a.IP.Equal(b.IP)
+}
+
+// returns socket passed by systemd matching address, or nil if there is none
+func activatedListener(addr string) net.Listener {
+	activatedListenersOnce.Do(initActivation)
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil
+	}
+	for i, ln := range activatedListeners {
+		if b, ok := ln.Addr().(*net.TCPAddr); ok && matchListenAddr(a, b) {
+			activatedListeners = append(activatedListeners[:i], activatedListeners[i+1:]...)
+			return ln
+		}
+	}
+	return nil
+}
+
+// closes sockets passed by systemd that don't match any listen address
+func closeUnusedListeners() {
+	activatedListenersOnce.Do(initActivation)
+	for _, ln := range activatedListeners {
+		log.Printf("WARNING: socket %s passed by systemd matches no listen address", ln.Addr())
+		ln.Close()
+	}
+	activatedListeners = nil
+}
+
+// sends state notification to systemd if it is listening
+func sdNotify(state string) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if len(name) == 0 {
+		return
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		log.Printf("WARNING: notify systemd: %s", err)
+		return
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte(state)); err != nil {
+		log.Printf("WARNING: notify systemd: %s", err)
+	}
+}
+
+// tells systemd that server is reloading, as required by Type=notify-reload
+func sdNotifyReloading() {
+	state := "RELOADING=1"
+	if usec := monotonicUsec(); usec > 0 {
+		state += "\nMONOTONIC_USEC=" + strconv.FormatInt(usec, 10)
+	}
+	sdNotify(state)
+}
@@ -0,0 +1,19 @@
+package server
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const clockMonotonic = 1 // CLOCK_MONOTONIC
+
+// returns CLOCK_MONOTONIC in microseconds, which systemd expects in reload
+// notifications
+func monotonicUsec() int64 {
+	var ts syscall.Timespec
+	_, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockMonotonic, uintptr(unsafe.Pointer(&ts)), 0)
+	if errno != 0 {
+		return 0
+	}
+	return ts.Nano() / 1000
+}
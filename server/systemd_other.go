@@ -0,0 +1,8 @@
+//go:build !linux
+
+package server
+
+// systemd is Linux only
+func monotonicUsec() int64 {
+	return 0
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type ConfigTenant struct {
+	Name        string             `yaml:"Name"`
+	Hosts       []string           `yaml:"Hosts"`
+	Listen      string             `yaml:"Listen"`
+	SearchPaths []ConfigSearchPath `yaml:"SearchPaths"`
+	RateLimit   float64            `yaml:"RateLimit"`
+	RateBurst   int                `yaml:"RateBurst"`
+	DailyQuota  int64              `yaml:"DailyQuota"`
+	LogFile     string             `yaml:"LogFile"`
+}
+
+// A Tenant is a group of search paths with its own limits and access log,
+// selected by listener or by Host header.
+type Tenant struct {
+	name        string
+	hosts       []string
+	listen      string
+	config      []ConfigSearchPath
+	searchPaths []compiledSearchPath // protected by searchPathsMutex
+	limiter     *tokenBucket
+	quota       *dailyQuota
+	logger      *log.Logger
+}
+
+type tenantKey struct{}
+
+var tenants []*Tenant
+
+func validateTenants(cfg *Config) error {
+	for _, v := range cfg.Tenants {
+		if len(v.Name) == 0 {
+			return errors.New("Tenants entry must have Name")
+		}
+		if len(v.SearchPaths) == 0 {
+			return fmt.Errorf(`No search paths configured for tenant "%s"`, v.Name)
+		}
+		if len(v.Hosts)+len(v.Listen) == 0 {
+			return fmt.Errorf(`At least one of Hosts or Listen must be set for tenant "%s"`, v.Name)
+		}
+	}
+	return nil
+}
+
+func loadTenants() error {
+	tenants = nil
+	for _, cfg := range config().Tenants {
+		t := &Tenant{name: cfg.Name, listen: cfg.Listen, config: cfg.SearchPaths}
+		for _, h := range cfg.Hosts {
+			t.hosts = append(t.hosts, strings.ToLower(h))
+		}
+		if cfg.RateLimit > 0 {
+			t.limiter = newTokenBucket(cfg.RateLimit, cfg.RateBurst)
+		}
+		if cfg.DailyQuota > 0 {
+			t.quota = &dailyQuota{limit: cfg.DailyQuota}
+		}
+		if len(cfg.LogFile) > 0 {
+			f, err := os.OpenFile(cfg.LogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				return err
+			}
+			t.logger = log.New(f, "", log.Flags())
+		}
+		tenants = append(tenants, t)
+	}
+	return nil
+}
+
+// returns configs of global and tenant search paths
+func allSearchPathConfigs(cfg *Config) []ConfigSearchPath {
+	list := append([]ConfigSearchPath(nil), cfg.SearchPaths...)
+	for _, t := range cfg.Tenants {
+		list = append(list, t.SearchPaths...)
+	}
+	return list
+}
+
+// returns lowercased Host header without port
+func requestHost(r *http.Request) string {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host
+}
+
+// returns tenant owning the listener request came from, or matching
+// request Host header, or nil for default tenant
+func tenantFor(r *http.Request) *Tenant {
+	if t, ok := r.Context().Value(tenantKey{}).(*Tenant); ok {
+		return t
+	}
+	if len(tenants) == 0 {
+		return nil
+	}
+	host := requestHost(r)
+	for _, t := range tenants {
+		for _, h := range t.hosts {
+			if h == host {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+// wraps handler so that all requests are attributed to tenant
+func tenantHandler(t *Tenant, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, t)))
+	})
+}
+
+// returns false if request was rejected due to tenant limits
+func (t *Tenant) admit(w http.ResponseWriter, r *http.Request) bool {
+	if t.limiter != nil && !t.limiter.allow() {
+		bans.strike(clientAddr(r))
+		w.Header().Set("Retry-After", "1")
+		closeWithError(w, r, http.StatusTooManyRequests)
+		return false
+	}
+	if t.quota != nil && t.quota.exceeded() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(t.quota.retryAfter().Seconds())+1))
+		closeWithError(w, r, http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+func (t *Tenant) record(written int64) {
+	if t.quota != nil {
+		t.quota.add(written)
+	}
+}
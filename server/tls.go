@@ -0,0 +1,59 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"log"
+	"time"
+)
+
+// number of session ticket keys accepted for resumption, including the one
+// used to issue new tickets. Tickets stay valid for this many rotation periods.
+const ticketKeyCount = 3
+
+// maintains session ticket keys rotated every TLSTicketRotation
+type ticketKeys struct {
+	keys [][32]byte
+}
+
+// generates new key for issuing tickets and drops the oldest one
+func (t *ticketKeys) rotate() ([][32]byte, error) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, err
+	}
+	t.keys = append([][32]byte{key}, t.keys...)
+	if len(t.keys) > ticketKeyCount {
+		t.keys = t.keys[:ticketKeyCount]
+	}
+	return t.keys, nil
+}
+
+func rotateTicketKeys(cfg *tls.Config, t *ticketKeys) {
+	for range time.Tick(config().TLSTicketRotation) {
+		keys, err := t.rotate()
+		if err != nil {
+			log.Printf("ERROR: rotate session ticket keys: %s", err)
+			continue
+		}
+		cfg.SetSessionTicketKeys(keys)
+	}
+}
+
+func tlsConfig() *tls.Config {
+	cfg := &tls.Config{SessionTicketsDisabled: config().DisableSessionTickets}
+	if autoTLSEnabled(&config().Config) {
+		setupAutoTLS(cfg)
+	}
+	if config().DisableSessionTickets || config().TLSTicketRotation <= 0 {
+		return cfg
+	}
+	t := new(ticketKeys)
+	keys, err := t.rotate()
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.SetSessionTicketKeys(keys)
+	go rotateTicketKeys(cfg, t)
+	return cfg
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// checksums that can be sent in trailer of identity responses
+const (
+	ChecksumCRC32  = "crc32"
+	ChecksumSHA256 = "sha256"
+)
+
+func checksumHeader() string {
+	if config().ChecksumTrailer == ChecksumSHA256 {
+		return "Digest"
+	}
+	return "X-Content-CRC32"
+}
+
+// sets Content-Length for identity response, or announces checksum trailer
+// if enabled. Trailers require chunked encoding, which HTTP/1.0 lacks.
+func (entry *pakFileEntry) identityHeaders(w http.ResponseWriter, r *http.Request) (trailer bool) {
+	if len(config().ChecksumTrailer) > 0 && r.ProtoAtLeast(1, 1) {
+		w.Header().Set("Trailer", checksumHeader())
+		return true
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(int64(entry.filelen), 10))
+	return false
+}
+
+// wraps body reader so that checksum trailer can be computed
+func checksumReader(r io.Reader) (io.Reader, hash.Hash) {
+	if config().ChecksumTrailer != ChecksumSHA256 {
+		return r, nil
+	}
+	h := sha256.New()
+	return io.TeeReader(r, h), h
+}
+
+// CRC32 is known in advance, so it also protects against corrupted packfile
+func (entry *pakFileEntry) setChecksumTrailer(w http.ResponseWriter, h hash.Hash) {
+	if h != nil {
+		w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	} else {
+		w.Header().Set("X-Content-CRC32", fmt.Sprintf("%08x", entry.filecrc))
+	}
+}
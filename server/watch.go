@@ -0,0 +1,137 @@
+package server
+
+import (
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var (
+	// how long search directory must stay quiet after change before it is
+	// rescanned, so that packfiles being copied are scanned once complete
+	watchDelay = 2 * time.Second
+
+	dirWatcher  *fsnotify.Watcher
+	watchedDirs map[string][]string // cleaned path to search directories as configured
+	watchMutex  sync.Mutex
+)
+
+// starts watching search directories for packfiles being added, replaced or
+// removed. Watched directories are updated on every rescan.
+func startWatcher() {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Fatal(err)
+	}
+	watchMutex.Lock()
+	dirWatcher = w
+	watchMutex.Unlock()
+
+	searchPathsMutex.RLock()
+	updateWatches()
+	searchPathsMutex.RUnlock()
+
+	go watchLoop(w)
+}
+
+// starts watching search directories of current config and stops watching
+// directories no longer searched. Must be called with searchPathsMutex held.
+func updateWatches() {
+	watchMutex.Lock()
+	defer watchMutex.Unlock()
+
+	if dirWatcher == nil {
+		return
+	}
+	dirs := make(map[string][]string)
+	for _, cfg := range allSearchPathConfigs(&config().Config) {
+		for _, dir := range cfg.Search {
+			clean := filepath.Clean(dir)
+			if !containsString(dirs[clean], dir) {
+				dirs[clean] = append(dirs[clean], dir)
+			}
+		}
+	}
+	for clean := range watchedDirs {
+		if _, ok := dirs[clean]; !ok {
+			dirWatcher.Remove(clean)
+		}
+	}
+	for clean := range dirs {
+		if _, ok := watchedDirs[clean]; ok {
+			continue
+		}
+		if err := dirWatcher.Add(clean); err != nil {
+			log.Printf(`ERROR: watch "%s": %s`, clean, err)
+		}
+	}
+	watchedDirs = dirs
+}
+
+// watches directory again after it was replaced by rename
+func rewatchDir(dir string) {
+	watchMutex.Lock()
+	defer watchMutex.Unlock()
+
+	if dirWatcher == nil {
+		return
+	}
+	clean := filepath.Clean(dir)
+	dirWatcher.Remove(clean)
+	if err := dirWatcher.Add(clean); err != nil {
+		log.Printf(`ERROR: watch "%s": %s`, clean, err)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// returns search directories as configured that contain changed file
+func changedDirs(name string) []string {
+	watchMutex.Lock()
+	defer watchMutex.Unlock()
+	return watchedDirs[filepath.Dir(name)]
+}
+
+func watchLoop(w *fsnotify.Watcher) {
+	pending := make(map[string]bool)
+	var timer <-chan time.Time
+	for {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if ev.Op == fsnotify.Chmod || !isArchiveName(filepath.Base(ev.Name)) {
+				continue
+			}
+			for _, dir := range changedDirs(ev.Name) {
+				pending[dir] = true
+			}
+			timer = time.After(watchDelay)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("ERROR: watch: %s", err)
+		case <-timer:
+			for dir := range pending {
+				if config().LogLevel >= LogLevelInfo {
+					log.Printf(`Packfiles changed in "%s", rescanning`, dir)
+				}
+				rescanDir(dir)
+			}
+			pending = make(map[string]bool)
+			timer = nil
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	zipLocalHeaderSig  = 0x04034b50
+	zipCentralDirSig   = 0x02014b50
+	zipEndSig          = 0x06054b50
+	zip64EndSig        = 0x06064b50
+	zip64LocatorSig    = 0x07064b50
+	zipLocalHeaderLen  = 30
+	zipCentralDirLen   = 46
+	zipEndLen          = 22
+	zip64EndLen        = 56
+	zip64LocatorLen    = 20
+	zipMaxCommentLen   = 65535
+	zip64ExtraID       = 0x0001
+	zipNTFSExtraID     = 0x000a
+	zipExtTimeExtraID  = 0x5455
+	ntfsEpochOffset    = 11644473600
+	ntfsTicksPerSecond = 10000000
+)
+
+var (
+	errZipFormat = errors.New("not a valid zip file")
+	errZipDisk   = errors.New("multi-disk zip files not supported")
+)
+
+// A zipEntry is parsed central directory record. Offset of file data is not
+// known until local file header is read.
+type zipEntry struct {
+	name             string
+	headerOffset     int64
+	compressedSize   uint64
+	uncompressedSize uint64
+	crc32            uint32
+	mtime            uint32
+	method           uint16
+}
+
+type zipDirectory struct {
+	count   uint64
+	size    int64
+	offset  int64
+	comment string
+}
+
+func findZipEnd(r io.ReaderAt, size int64) (*zipDirectory, error) {
+	n := int64(zipEndLen + zipMaxCommentLen + zip64LocatorLen)
+	if n > size {
+		n = size
+	}
+	buf := make([]byte, n)
+	if _, err := r.ReadAt(buf, size-n); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	p := -1
+	for i := len(buf) - zipEndLen; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(buf[i:]) == zipEndSig {
+			p = i
+			break
+		}
+	}
+	if p < 0 {
+		return nil, errZipFormat
+	}
+
+	b := buf[p:]
+	if binary.LittleEndian.Uint16(b[4:]) != 0 || binary.LittleEndian.Uint16(b[6:]) != 0 {
+		return nil, errZipDisk
+	}
+	dir := &zipDirectory{
+		count:  uint64(binary.LittleEndian.Uint16(b[10:])),
+		size:   int64(binary.LittleEndian.Uint32(b[12:])),
+		offset: int64(binary.LittleEndian.Uint32(b[16:])),
+	}
+	if n := int(binary.LittleEndian.Uint16(b[20:])); n <= len(b)-zipEndLen {
+		dir.comment = string(b[zipEndLen : zipEndLen+n])
+	}
+
+	// zip64 end of central directory locator immediately precedes
+	if p >= zip64LocatorLen {
+		loc := buf[p-zip64LocatorLen : p]
+		if binary.LittleEndian.Uint32(loc) == zip64LocatorSig {
+			if err := readZip64End(r, size, int64(binary.LittleEndian.Uint64(loc[8:])), dir); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if dir.offset < 0 || dir.size < 0 || dir.offset > size-dir.size {
+		return nil, errZipFormat
+	}
+	if dir.count > uint64(dir.size/zipCentralDirLen) {
+		return nil, errZipFormat
+	}
+	return dir, nil
+}
+
+func readZip64End(r io.ReaderAt, size, offset int64, dir *zipDirectory) error {
+	if offset < 0 || offset > size-zip64EndLen {
+		return errZipFormat
+	}
+	var b [zip64EndLen]byte
+	if _, err := r.ReadAt(b[:], offset); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(b[:]) != zip64EndSig {
+		return errZipFormat
+	}
+	if binary.LittleEndian.Uint32(b[16:]) != 0 || binary.LittleEndian.Uint32(b[20:]) != 0 {
+		return errZipDisk
+	}
+	dir.count = binary.LittleEndian.Uint64(b[32:])
+	dir.size = int64(binary.LittleEndian.Uint64(b[40:]))
+	dir.offset = int64(binary.LittleEndian.Uint64(b[48:]))
+	return nil
+}
+
+func msDosTime(date, t uint16) uint32 {
+	return uint32(time.Date(
+		int(date>>9)+1980,
+		time.Month(date>>5&0xf),
+		int(date&0x1f),
+		int(t>>11),
+		int(t>>5&0x3f),
+		int(t&0x1f)*2,
+		0, time.UTC).Unix())
+}
+
+func parseZipExtra(e *zipEntry, extra []byte) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		n := int(binary.LittleEndian.Uint16(extra[2:]))
+		extra = extra[4:]
+		if n > len(extra) {
+			return
+		}
+		b := extra[:n]
+		extra = extra[n:]
+
+		switch id {
+		case zip64ExtraID:
+			// only present for fields that overflowed, in this order
+			if e.uncompressedSize == math.MaxUint32 && len(b) >= 8 {
+				e.uncompressedSize = binary.LittleEndian.Uint64(b)
+				b = b[8:]
+			}
+			if e.compressedSize == math.MaxUint32 && len(b) >= 8 {
+				e.compressedSize = binary.LittleEndian.Uint64(b)
+				b = b[8:]
+			}
+			if e.headerOffset == math.MaxUint32 && len(b) >= 8 {
+				e.headerOffset = int64(binary.LittleEndian.Uint64(b))
+			}
+		case zipNTFSExtraID:
+			if len(b) >= 4+4+24 && binary.LittleEndian.Uint16(b[4:]) == 1 {
+				ticks := binary.LittleEndian.Uint64(b[8:])
+				e.mtime = uint32(int64(ticks/ntfsTicksPerSecond) - ntfsEpochOffset)
+			}
+		case zipExtTimeExtraID:
+			if len(b) >= 5 && b[0]&1 != 0 {
+				e.mtime = binary.LittleEndian.Uint32(b[1:])
+			}
+		}
+	}
+}
+
+// reads zip central directory sequentially calling fn for each entry,
+// without seeking to local file headers
+func (dir *zipDirectory) scan(r io.ReaderAt, fn func(*zipEntry) error) error {
+	br := bufio.NewReaderSize(io.NewSectionReader(r, dir.offset, dir.size), 64*1024)
+	var b [zipCentralDirLen]byte
+	var names []byte
+	for i := uint64(0); i < dir.count; i++ {
+		if _, err := io.ReadFull(br, b[:]); err != nil {
+			return errZipFormat
+		}
+		if binary.LittleEndian.Uint32(b[:]) != zipCentralDirSig {
+			return errZipFormat
+		}
+		nameLen := int(binary.LittleEndian.Uint16(b[28:]))
+		extraLen := int(binary.LittleEndian.Uint16(b[30:]))
+		commentLen := int(binary.LittleEndian.Uint16(b[32:]))
+
+		if cap(names) < nameLen+extraLen {
+			names = make([]byte, nameLen+extraLen)
+		}
+		buf := names[:nameLen+extraLen]
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return errZipFormat
+		}
+		if _, err := br.Discard(commentLen); err != nil {
+			return errZipFormat
+		}
+
+		e := &zipEntry{
+			name:             string(buf[:nameLen]),
+			method:           binary.LittleEndian.Uint16(b[10:]),
+			mtime:            msDosTime(binary.LittleEndian.Uint16(b[14:]), binary.LittleEndian.Uint16(b[12:])),
+			crc32:            binary.LittleEndian.Uint32(b[16:]),
+			compressedSize:   uint64(binary.LittleEndian.Uint32(b[20:])),
+			uncompressedSize: uint64(binary.LittleEndian.Uint32(b[24:])),
+			headerOffset:     int64(binary.LittleEndian.Uint32(b[42:])),
+		}
+		parseZipExtra(e, buf[nameLen:])
+
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Caches data offsets resolved from local file headers. Shared between
+// copies of searchPath.
+type offsetCache struct {
+	mutex   sync.Mutex
+	offsets map[int64]int64
+}
+
+func newOffsetCache() *offsetCache {
+	return &offsetCache{offsets: make(map[int64]int64)}
+}
+
+// returns offset of file data following local file header at given offset
+func (c *offsetCache) resolve(r io.ReaderAt, header int64) (int64, error) {
+	c.mutex.Lock()
+	ofs, ok := c.offsets[header]
+	c.mutex.Unlock()
+	if ok {
+		return ofs, nil
+	}
+
+	var b [zipLocalHeaderLen]byte
+	if _, err := r.ReadAt(b[:], header); err != nil {
+		return 0, err
+	}
+	if binary.LittleEndian.Uint32(b[:]) != zipLocalHeaderSig {
+		return 0, errZipFormat
+	}
+	ofs = header + zipLocalHeaderLen +
+		int64(binary.LittleEndian.Uint16(b[26:])) +
+		int64(binary.LittleEndian.Uint16(b[28:]))
+
+	c.mutex.Lock()
+	c.offsets[header] = ofs
+	c.mutex.Unlock()
+	return ofs, nil
+}